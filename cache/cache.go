@@ -12,3 +12,11 @@ func InitRedis(addr, password string, db int) {
 		DB:       db,
 	})
 }
+
+// CloseRedis 关闭redis连接池
+func CloseRedis() error {
+	if RedisClient == nil {
+		return nil
+	}
+	return RedisClient.Close()
+}
@@ -0,0 +1,46 @@
+// aofcheck 检查内存数据库的AOF文件是否完整 加上--fix时截掉末尾不完整的部分
+//
+// 用法：go run ./cmd/aofcheck [--fix] snapshots/节点1/memory.aof
+package main
+
+import (
+	"flag"
+	"fmt"
+	"node2/dao"
+	"os"
+)
+
+func main() {
+	fix := flag.Bool("fix", false, "截掉文件末尾不完整的记录 只保留完整的记录")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "用法：aofcheck [--fix] <AOF文件>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+
+	result, err := dao.CheckAOF(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if result.Err == nil {
+		fmt.Printf("AOF文件完整：%d条记录 %d字节\n", result.Records, result.FileSize)
+		return
+	}
+	fmt.Printf("AOF文件损坏：%v\n", result.Err)
+	fmt.Printf("完整的记录：%d条 %d字节 需要截掉：%d字节\n", result.Records, result.ValidSize, result.FileSize-result.ValidSize)
+	if !*fix {
+		fmt.Println("加上--fix截掉不完整的部分")
+		os.Exit(1)
+	}
+	if _, err = dao.RepairAOF(path); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("已修复AOF文件")
+}
@@ -1,93 +1,197 @@
 package config
 
 import (
+	"net"
+	"path/filepath"
 	"time"
 )
 
 // MySQLConfig 定义 MySQL 配置结构体
 type MySQLConfig struct {
-	DSN string
+	DSN string `yaml:"dsn"`
 }
 
 // RedisConfig 定义 Redis 配置结构体
 type RedisConfig struct {
-	Addr     string
-	Password string
-	DB       int
+	Addr             string        `yaml:"addr"`
+	Password         *string       `yaml:"password"` // 没有密码时需要明确配置为空字符串 nil表示没有配置
+	DB               int           `yaml:"db"`
+	DefaultTTL       time.Duration `yaml:"default_ttl"`        // 永不过期的学生在缓存中的过期时间 0表示缓存中也永不过期
+	EarlyRefreshBeta float64       `yaml:"early_refresh_beta"` // 概率提前刷新的系数 越大越早刷新 0表示不提前刷新
 }
 
 // MemoryDBConfig 定义内存数据库配置结构体
 type MemoryDBConfig struct {
-	Capacity   int
-	EvictRatio float64
+	Capacity       int           `yaml:"capacity"`
+	EvictRatio     float64       `yaml:"evict_ratio"`
+	Shards         int           `yaml:"shards"`          // 分段数量 每个分段有自己的锁 容量由所有分段共享
+	EvictionPolicy string        `yaml:"eviction_policy"` // 内存淘汰策略 lru、lfu、2q、volatile-ttl或者random
+	LFUHalfLife    time.Duration `yaml:"lfu_half_life"`   // LFU策略中访问次数衰减一半的时间
+	MaxMemory      int64         `yaml:"max_memory"`      // 估算的内存占用上限(字节) 大于0时按字节数限制容量 不再限制键的数量
+	HighWatermark  float64       `yaml:"high_watermark"`  // 内存占用超过max_memory的这个比例时开始淘汰
+	LowWatermark   float64       `yaml:"low_watermark"`   // 淘汰到内存占用低于max_memory的这个比例为止
+	DumpPath       string        `yaml:"dump_path"`       // 转储文件的路径 为空时使用snapshots/<NodeId>/dump.mdb
+	AOF            AOFConfig     `yaml:"aof"`
+}
+
+// AOFConfig 定义内存数据库追加写日志(AOF)配置结构体
+type AOFConfig struct {
+	Enabled           bool   `yaml:"enabled"`
+	Path              string `yaml:"path"`               // AOF文件的路径 为空时使用snapshots/<NodeId>/memory.aof
+	Fsync             string `yaml:"fsync"`              // 刷盘策略 always 每次写入都fsync everysec 每秒fsync一次 no 交给操作系统刷盘
+	RewritePercentage int    `yaml:"rewrite_percentage"` // 文件比上次重写后增长了这个百分比时自动重写 0表示不自动重写
+	RewriteMinSize    int64  `yaml:"rewrite_min_size"`   // 文件小于这个字节数时不自动重写
+	LoadTruncated     bool   `yaml:"load_truncated"`     // 启动时文件末尾不完整是否截掉不完整的部分继续加载 否则启动失败
 }
 
 // CachePreheatingConfig 定义缓存预热配置结构体
 type CachePreheatingConfig struct {
-	LoadRatio float64
+	LoadRatio float64 `yaml:"load_ratio"`
 }
 
 // ServerConfig 定义服务器配置结构体
 type ServerConfig struct {
-	ReloadInterval         time.Duration
-	PeriodicDeleteInterval time.Duration
-	ExamineSize            int
+	ReloadInterval       time.Duration `yaml:"reload_interval"`
+	ActiveExpireInterval time.Duration `yaml:"active_expire_interval"` // 每个节点主动删除过期键的间隔
+	ActiveExpireBudget   time.Duration `yaml:"active_expire_budget"`   // 每次主动删除过期键最多花费的时间
+	VerifyInterval       time.Duration `yaml:"verify_interval"`        // 每个节点在内存中的学生不完整时重新和数据库确认的间隔
+}
+
+// RaftConfig 定义Raft存储配置结构体
+type RaftConfig struct {
+	LogStore   string `yaml:"log_store"`   // Raft日志和任期投票的存储方式 memory 保存在内存中 file 保存在snapshots/<NodeId>目录下的文件中
+	SyncPolicy string `yaml:"sync_policy"` // 文件存储的刷盘策略 always 每次写入都fsync none 交给操作系统刷盘
+	// LeaseTimeout 领导者的租约 领导者超过这个时间没有联系上多数节点就退位 租约读也只在和多数节点确认领导权后的这段时间内不再确认
+	LeaseTimeout time.Duration `yaml:"lease_timeout"`
 }
 
 // Node 定义节点信息结构体
 type Node struct {
-	NodeId      string
-	Address     string
-	PortAddress string
+	NodeId      string `yaml:"node_id"`
+	Address     string `yaml:"address"`      // Raft节点之间通信的TCP地址
+	PortAddress string `yaml:"port_address"` // HTTP服务的端口
+	HttpAddress string `yaml:"http_address"` // HTTP服务的地址 为空时使用Raft地址的主机和HTTP端口拼接
 }
 
 // Peer 表示集群中其他单个节点的信息
 type Peer struct {
-	NodeId      string
-	Address     string
-	PortAddress string
+	NodeId      string `yaml:"node_id"`
+	Address     string `yaml:"address"`
+	PortAddress string `yaml:"port_address"`
+	HttpAddress string `yaml:"http_address"`
+}
+
+// HttpAddr 返回节点的HTTP地址
+func (n Node) HttpAddr() string {
+	return httpAddr(n.HttpAddress, n.Address, n.PortAddress)
+}
+
+// HttpAddr 返回节点的HTTP地址
+func (p Peer) HttpAddr() string {
+	return httpAddr(p.HttpAddress, p.Address, p.PortAddress)
+}
+
+// httpAddr 没有配置HTTP地址时 用Raft地址的主机和HTTP端口拼接出HTTP地址
+func httpAddr(httpAddress string, address string, portAddress string) string {
+	if httpAddress != "" {
+		return httpAddress
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, portAddress)
 }
 
 // Config 定义配置结构体
 type Config struct {
-	MySQL           MySQLConfig
-	Redis           RedisConfig
-	MemoryDB        MemoryDBConfig
-	CachePreheating CachePreheatingConfig
-	Server          ServerConfig
-	Node            Node
-	Peers           []*Peer
+	MySQL           MySQLConfig           `yaml:"mysql"`
+	Redis           RedisConfig           `yaml:"redis"`
+	MemoryDB        MemoryDBConfig        `yaml:"memory_db"`
+	CachePreheating CachePreheatingConfig `yaml:"cache_preheating"`
+	Server          ServerConfig          `yaml:"server"`
+	Raft            RaftConfig            `yaml:"raft"`
+	Node            Node                  `yaml:"node"`
+	Peers           []*Peer               `yaml:"peers"` // 集群中其他节点 加入集群时用来寻找领导者
+	Join            []string              `yaml:"join"`  // 已经在集群中的节点的HTTP地址 通过它们加入集群
+}
+
+// AOFPath 返回内存数据库AOF文件的路径
+func (c Config) AOFPath() string {
+	if c.MemoryDB.AOF.Path != "" {
+		return c.MemoryDB.AOF.Path
+	}
+	return filepath.Join("snapshots", c.Node.NodeId, "memory.aof")
 }
 
-// GetConfig 获取配置实例
-func GetConfig() Config {
+// DumpPath 返回内存数据库转储文件的路径
+func (c Config) DumpPath() string {
+	if c.MemoryDB.DumpPath != "" {
+		return c.MemoryDB.DumpPath
+	}
+	return filepath.Join("snapshots", c.Node.NodeId, "dump.mdb")
+}
+
+// Seeds 返回加入集群时用来寻找领导者的节点 没有任何节点时本节点会初始化一个新的集群
+func (c Config) Seeds() []*Peer {
+	seeds := make([]*Peer, 0, len(c.Peers)+len(c.Join))
+	seeds = append(seeds, c.Peers...)
+	for _, httpAddress := range c.Join {
+		seeds = append(seeds, &Peer{NodeId: httpAddress, HttpAddress: httpAddress})
+	}
+	return seeds
+}
+
+// DefaultConfig 返回默认配置 配置文件、环境变量和命令行参数在它的基础上覆盖
+func DefaultConfig() Config {
 	return Config{
-		// 配置 Mysql
+		// 配置 Mysql 连接的用户名和密码只能通过配置文件、环境变量或者命令行参数提供
 		MySQL: MySQLConfig{
-			DSN: "root:1234@tcp(127.0.0.1:3306)/mdb?charset=utf8mb4&parseTime=True&loc=Local",
+			DSN: "",
 		},
-		// 配置 redis
+		// 配置 redis 密码同样没有默认值
 		Redis: RedisConfig{
-			Addr:     "192.168.88.128:6379",
-			Password: "1234",
-			DB:       0,
+			Addr:             "127.0.0.1:6379",
+			Password:         nil,
+			DB:               0,
+			DefaultTTL:       24 * time.Hour,
+			EarlyRefreshBeta: 0,
 		},
 		// 配置内存数据库
 		MemoryDB: MemoryDBConfig{
-			Capacity:   10,
-			EvictRatio: 0.2,
+			Capacity:       10,
+			EvictRatio:     0.2,
+			Shards:         16,
+			EvictionPolicy: "lru",
+			LFUHalfLife:    10 * time.Minute,
+			MaxMemory:      0,
+			HighWatermark:  0.9,
+			LowWatermark:   0.7,
+			AOF: AOFConfig{
+				Enabled:           false,
+				Fsync:             "everysec",
+				RewritePercentage: 100,
+				RewriteMinSize:    64 << 20,
+				LoadTruncated:     true,
+			},
 		},
 		CachePreheating: CachePreheatingConfig{
 			LoadRatio: 0.5,
 		},
 		Server: ServerConfig{
-			ReloadInterval:         time.Hour,
-			PeriodicDeleteInterval: time.Hour,
-			ExamineSize:            10,
+			ReloadInterval:       time.Hour,
+			ActiveExpireInterval: 100 * time.Millisecond,
+			ActiveExpireBudget:   25 * time.Millisecond,
+			VerifyInterval:       time.Minute,
+		},
+		Raft: RaftConfig{
+			LogStore:     "file",
+			SyncPolicy:   "always",
+			LeaseTimeout: 500 * time.Millisecond,
 		},
 		Node: Node{
 			NodeId:      "节点1",
-			Address:     "127.0.0.1:8080",
+			Address:     "127.0.0.1:9080",
 			PortAddress: "8080",
 		},
 		Peers: []*Peer{},
@@ -0,0 +1,268 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix 环境变量的前缀
+const envPrefix = "MDB_"
+
+// Load 加载配置 优先级从低到高依次是默认配置、配置文件、环境变量、命令行参数
+// 配置文件通过--config或者环境变量MDB_CONFIG指定 加载完成后会检查配置是否合法
+func Load(args []string) (Config, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("node2", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "YAML配置文件的路径")
+	nodeId := fs.String("node-id", "", "节点id")
+	raftAddr := fs.String("raft-addr", "", "Raft节点之间通信的TCP地址 例如127.0.0.1:9001")
+	httpPort := fs.String("http-port", "", "HTTP服务的端口 例如8081")
+	httpAddr := fs.String("http-addr", "", "其他节点访问本节点HTTP服务的地址 为空时使用Raft地址的主机和HTTP端口拼接")
+	peers := fs.String("peers", "", "集群中其他节点 格式为id=raft地址@HTTP端口 多个节点用逗号分隔")
+	join := fs.String("join", "", "通过这些节点加入已有的集群 格式为HTTP地址 多个地址用逗号分隔")
+	mysqlDSN := fs.String("mysql-dsn", "", "MySQL的连接字符串 命令行参数可能被其他用户看到 建议用环境变量MDB_MYSQL_DSN")
+	redisPassword := fs.String("redis-password", "", "Redis的密码 没有密码时传空字符串 建议用环境变量MDB_REDIS_PASSWORD")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("config.Load 无法识别的参数：%s", strings.Join(fs.Args(), " "))
+	}
+
+	if *configFile != "" {
+		if err := loadFile(&cfg, *configFile); err != nil {
+			return cfg, err
+		}
+	}
+	if err := loadEnv(&cfg); err != nil {
+		return cfg, err
+	}
+
+	// 只覆盖命令行中出现过的参数 没有出现的参数不能用空值覆盖配置文件和环境变量
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "node-id":
+			cfg.Node.NodeId = *nodeId
+		case "raft-addr":
+			cfg.Node.Address = *raftAddr
+		case "http-port":
+			cfg.Node.PortAddress = *httpPort
+		case "http-addr":
+			cfg.Node.HttpAddress = *httpAddr
+		case "peers":
+			parsed, err := ParsePeers(*peers)
+			if err != nil {
+				flagErr = fmt.Errorf("config.Load 参数--peers不合法：%w", err)
+				return
+			}
+			cfg.Peers = parsed
+		case "join":
+			cfg.Join = splitList(*join)
+		case "mysql-dsn":
+			cfg.MySQL.DSN = *mysqlDSN
+		case "redis-password":
+			cfg.Redis.Password = redisPassword
+		}
+	})
+	if flagErr != nil {
+		return cfg, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// loadFile 用YAML配置文件中出现的配置项覆盖配置 文件中不认识的配置项会报错 防止拼写错误被忽略
+func loadFile(cfg *Config, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config.loadFile 打开配置文件：%s失败：%w", path, err)
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err = decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("config.loadFile 解析配置文件：%s失败：%w", path, err)
+	}
+	return nil
+}
+
+// loadEnv 用MDB_开头的环境变量覆盖配置
+func loadEnv(cfg *Config) error {
+	stringVars := map[string]*string{
+		"NODE_ID":          &cfg.Node.NodeId,
+		"RAFT_ADDR":        &cfg.Node.Address,
+		"HTTP_PORT":        &cfg.Node.PortAddress,
+		"HTTP_ADDR":        &cfg.Node.HttpAddress,
+		"MYSQL_DSN":        &cfg.MySQL.DSN,
+		"REDIS_ADDR":       &cfg.Redis.Addr,
+		"RAFT_LOG_STORE":   &cfg.Raft.LogStore,
+		"RAFT_SYNC_POLICY": &cfg.Raft.SyncPolicy,
+		"EVICTION_POLICY":  &cfg.MemoryDB.EvictionPolicy,
+	}
+	for name, target := range stringVars {
+		if value, ok := os.LookupEnv(envPrefix + name); ok {
+			*target = value
+		}
+	}
+	if value, ok := os.LookupEnv(envPrefix + "REDIS_PASSWORD"); ok {
+		cfg.Redis.Password = &value
+	}
+	if value, ok := os.LookupEnv(envPrefix + "REDIS_DB"); ok {
+		db, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("config.loadEnv 环境变量%sREDIS_DB不是整数：%s", envPrefix, value)
+		}
+		cfg.Redis.DB = db
+	}
+	if value, ok := os.LookupEnv(envPrefix + "MAX_MEMORY"); ok {
+		maxMemory, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("config.loadEnv 环境变量%sMAX_MEMORY不是整数：%s", envPrefix, value)
+		}
+		cfg.MemoryDB.MaxMemory = maxMemory
+	}
+	if value, ok := os.LookupEnv(envPrefix + "PEERS"); ok {
+		peers, err := ParsePeers(value)
+		if err != nil {
+			return fmt.Errorf("config.loadEnv 环境变量%sPEERS不合法：%w", envPrefix, err)
+		}
+		cfg.Peers = peers
+	}
+	if value, ok := os.LookupEnv(envPrefix + "JOIN"); ok {
+		cfg.Join = splitList(value)
+	}
+	return nil
+}
+
+// ParsePeers 解析节点列表 每个节点的格式为id=raft地址@HTTP端口 @后面也可以是完整的HTTP地址 多个节点用逗号分隔
+// 例如 节点2=127.0.0.1:9002@8082,节点3=127.0.0.1:9003@127.0.0.1:8083
+func ParsePeers(value string) ([]*Peer, error) {
+	var peers []*Peer
+	for _, item := range splitList(value) {
+		nodeId, rest, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("节点：%s缺少=", item)
+		}
+		peer := &Peer{NodeId: strings.TrimSpace(nodeId)}
+		address, http, hasHttp := strings.Cut(rest, "@")
+		peer.Address = strings.TrimSpace(address)
+		if hasHttp {
+			http = strings.TrimSpace(http)
+			if strings.Contains(http, ":") {
+				peer.HttpAddress = http
+			} else {
+				peer.PortAddress = http
+			}
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// splitList 按逗号拆分列表 忽略空白的项
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Validate 检查配置是否合法 返回所有不合法的配置项
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Node.NodeId != "", "node.node_id不能为空")
+	check(validHostPort(c.Node.Address), "node.address：%q不是合法的host:port地址", c.Node.Address)
+	check(validPort(c.Node.PortAddress), "node.port_address：%q不是合法的端口", c.Node.PortAddress)
+	check(c.Node.HttpAddress == "" || validHostPort(c.Node.HttpAddress), "node.http_address：%q不是合法的host:port地址", c.Node.HttpAddress)
+
+	seen := map[string]bool{c.Node.NodeId: true}
+	for i, peer := range c.Peers {
+		if peer == nil {
+			errs = append(errs, fmt.Errorf("peers[%d]不能为空", i))
+			continue
+		}
+		check(peer.NodeId != "", "peers[%d].node_id不能为空", i)
+		check(!seen[peer.NodeId], "peers[%d].node_id：%q和其他节点重复", i, peer.NodeId)
+		seen[peer.NodeId] = true
+		check(validHostPort(peer.Address), "peers[%d].address：%q不是合法的host:port地址", i, peer.Address)
+		check(peer.PortAddress != "" || peer.HttpAddress != "", "peers[%d]需要port_address或者http_address", i)
+		check(peer.PortAddress == "" || validPort(peer.PortAddress), "peers[%d].port_address：%q不是合法的端口", i, peer.PortAddress)
+		check(peer.HttpAddress == "" || validHostPort(peer.HttpAddress), "peers[%d].http_address：%q不是合法的host:port地址", i, peer.HttpAddress)
+	}
+	for i, address := range c.Join {
+		check(validHostPort(address), "join[%d]：%q不是合法的host:port地址", i, address)
+	}
+
+	check(c.MySQL.DSN != "", "mysql.dsn不能为空 通过配置文件、环境变量%sMYSQL_DSN或者参数--mysql-dsn提供", envPrefix)
+	check(c.Redis.Password != nil, "redis.password没有配置 通过配置文件、环境变量%sREDIS_PASSWORD或者参数--redis-password提供 没有密码时配置为空字符串", envPrefix)
+	check(validHostPort(c.Redis.Addr), "redis.addr：%q不是合法的host:port地址", c.Redis.Addr)
+	check(c.Redis.DB >= 0, "redis.db：%d不能小于0", c.Redis.DB)
+	check(c.Redis.DefaultTTL >= 0, "redis.default_ttl：%v不能小于0", c.Redis.DefaultTTL)
+	check(c.Redis.EarlyRefreshBeta >= 0, "redis.early_refresh_beta：%v不能小于0", c.Redis.EarlyRefreshBeta)
+	check(c.MemoryDB.Capacity > 0, "memory_db.capacity：%d必须大于0", c.MemoryDB.Capacity)
+	check(c.MemoryDB.EvictRatio > 0 && c.MemoryDB.EvictRatio <= 1, "memory_db.evict_ratio：%v必须在(0,1]之间", c.MemoryDB.EvictRatio)
+	check(c.MemoryDB.Shards > 0, "memory_db.shards：%d必须大于0", c.MemoryDB.Shards)
+	check(c.MemoryDB.MaxMemory >= 0, "memory_db.max_memory：%d不能小于0", c.MemoryDB.MaxMemory)
+	if c.MemoryDB.MaxMemory > 0 {
+		check(c.MemoryDB.HighWatermark > 0 && c.MemoryDB.HighWatermark <= 1, "memory_db.high_watermark：%v必须在(0,1]之间", c.MemoryDB.HighWatermark)
+		check(c.MemoryDB.LowWatermark > 0 && c.MemoryDB.LowWatermark < c.MemoryDB.HighWatermark, "memory_db.low_watermark：%v必须大于0并且小于high_watermark", c.MemoryDB.LowWatermark)
+	}
+	check(c.MemoryDB.AOF.Fsync == "always" || c.MemoryDB.AOF.Fsync == "everysec" || c.MemoryDB.AOF.Fsync == "no", "memory_db.aof.fsync：%q只能是always、everysec或者no", c.MemoryDB.AOF.Fsync)
+	check(c.MemoryDB.AOF.RewritePercentage >= 0, "memory_db.aof.rewrite_percentage：%d不能小于0", c.MemoryDB.AOF.RewritePercentage)
+	check(c.MemoryDB.AOF.RewriteMinSize >= 0, "memory_db.aof.rewrite_min_size：%d不能小于0", c.MemoryDB.AOF.RewriteMinSize)
+	switch c.MemoryDB.EvictionPolicy {
+	case "", "lru", "2q", "volatile-ttl", "random":
+	case "lfu":
+		check(c.MemoryDB.LFUHalfLife > 0, "memory_db.lfu_half_life：%v必须大于0", c.MemoryDB.LFUHalfLife)
+	default:
+		check(false, "memory_db.eviction_policy：%q只能是lru、lfu、2q、volatile-ttl或者random", c.MemoryDB.EvictionPolicy)
+	}
+	check(c.CachePreheating.LoadRatio >= 0 && c.CachePreheating.LoadRatio <= 1, "cache_preheating.load_ratio：%v必须在[0,1]之间", c.CachePreheating.LoadRatio)
+	check(c.Server.ReloadInterval > 0, "server.reload_interval：%v必须大于0", c.Server.ReloadInterval)
+	check(c.Server.ActiveExpireInterval > 0, "server.active_expire_interval：%v必须大于0", c.Server.ActiveExpireInterval)
+	check(c.Server.VerifyInterval > 0, "server.verify_interval：%v必须大于0", c.Server.VerifyInterval)
+	check(c.Server.ActiveExpireBudget > 0 && c.Server.ActiveExpireBudget <= c.Server.ActiveExpireInterval, "server.active_expire_budget：%v必须大于0并且不能超过active_expire_interval", c.Server.ActiveExpireBudget)
+	check(c.Raft.LogStore == "" || c.Raft.LogStore == "memory" || c.Raft.LogStore == "file", "raft.log_store：%q只能是memory或者file", c.Raft.LogStore)
+	// hashicorp/raft要求租约不小于5ms并且不超过心跳超时(默认1s)
+	check(c.Raft.LeaseTimeout >= 5*time.Millisecond && c.Raft.LeaseTimeout <= time.Second, "raft.lease_timeout：%v必须在[5ms,1s]之间", c.Raft.LeaseTimeout)
+	check(c.Raft.SyncPolicy == "" || c.Raft.SyncPolicy == "always" || c.Raft.SyncPolicy == "none", "raft.sync_policy：%q只能是always或者none", c.Raft.SyncPolicy)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("配置不合法：%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// validHostPort 判断地址是不是合法的host:port
+func validHostPort(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	return err == nil && host != "" && validPort(port)
+}
+
+// validPort 判断是不是合法的端口号
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
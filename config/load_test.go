@@ -0,0 +1,49 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// nodeArgs 合法的节点参数 只缺少MySQL和Redis的凭据
+var nodeArgs = []string{"--node-id", "节点1", "--raft-addr", "127.0.0.1:9001", "--http-port", "8081"}
+
+// TestLoadRequiresCredentials 没有提供MySQL的连接字符串和Redis的密码时加载失败 环境变量和命令行参数都可以提供 Redis的密码可以明确为空
+func TestLoadRequiresCredentials(t *testing.T) {
+	// t.Setenv在测试结束后恢复原来的值 之后再删除 让测试不受运行环境中的变量影响
+	for _, name := range []string{"CONFIG", "MYSQL_DSN", "REDIS_PASSWORD"} {
+		t.Setenv(envPrefix+name, "")
+		os.Unsetenv(envPrefix + name)
+	}
+	_, err := Load(nodeArgs)
+	if err == nil {
+		t.Fatalf("没有提供凭据时加载成功")
+	}
+	for _, want := range []string{"mysql.dsn", "redis.password"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("错误：%v中没有提到%s", err, want)
+		}
+	}
+
+	t.Setenv(envPrefix+"MYSQL_DSN", "user:secret@tcp(127.0.0.1:3306)/mdb")
+	cfg, err := Load(append(nodeArgs, "--redis-password", ""))
+	if err != nil {
+		t.Fatalf("通过环境变量和命令行参数提供凭据后加载失败：%v", err)
+	}
+	if cfg.MySQL.DSN != "user:secret@tcp(127.0.0.1:3306)/mdb" {
+		t.Errorf("mysql.dsn是：%q", cfg.MySQL.DSN)
+	}
+	if cfg.Redis.Password == nil || *cfg.Redis.Password != "" {
+		t.Errorf("redis.password是：%v 期望明确配置的空字符串", cfg.Redis.Password)
+	}
+
+	t.Setenv(envPrefix+"REDIS_PASSWORD", "from-env")
+	cfg, err = Load(append(nodeArgs, "--mysql-dsn", "other:secret@tcp(127.0.0.1:3306)/mdb"))
+	if err != nil {
+		t.Fatalf("通过环境变量提供Redis的密码后加载失败：%v", err)
+	}
+	if cfg.MySQL.DSN != "other:secret@tcp(127.0.0.1:3306)/mdb" || *cfg.Redis.Password != "from-env" {
+		t.Errorf("命令行参数没有覆盖环境变量：dsn=%q password=%q", cfg.MySQL.DSN, *cfg.Redis.Password)
+	}
+}
@@ -1,22 +1,45 @@
 package controller
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"io"
 	"log"
 	"net/http"
+	"node2/dao"
 	"node2/model"
+	"node2/raft/fsm"
 	"node2/response"
+	"node2/scheduler"
 	"node2/service"
+	"strconv"
+	"time"
 )
 
+// idempotencyKeyHeader 客户端通过这个请求头传入幂等键 相同幂等键的重复请求只会执行一次
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// commandErrorStatus 返回修改学生失败时的状态码 幂等键已经用于不同的请求时返回409 其他错误返回fallback
+func commandErrorStatus(err error, fallback int) int {
+	if errors.Is(err, fsm.ErrRequestConflict) {
+		return http.StatusConflict
+	}
+	return fallback
+}
+
 // StudentController 定义控制层结构体实例
 type StudentController struct {
 	studentService *service.StudentService
+	jobScheduler   *scheduler.Scheduler
 }
 
-func NewStudentController(studentService *service.StudentService) *StudentController {
+func NewStudentController(studentService *service.StudentService, jobScheduler *scheduler.Scheduler) *StudentController {
 	return &StudentController{
 		studentService: studentService,
+		jobScheduler:   jobScheduler,
 	}
 }
 
@@ -27,9 +50,9 @@ func (sc *StudentController) AddStudent(c *gin.Context) {
 		log.Printf("StudentController.AddStudent err：%v", err.Error())
 		c.JSON(http.StatusBadRequest, response.Error(err.Error()))
 		// 调用服务层方法添加学生信息
-	} else if err = sc.studentService.AddStudent(&student); err != nil {
+	} else if err = sc.studentService.AddStudent(&student, c.GetHeader(idempotencyKeyHeader)); err != nil {
 		log.Printf("StudentController.AddStudent err：%v", err.Error())
-		c.JSON(http.StatusBadRequest, response.Error(err.Error()))
+		c.JSON(commandErrorStatus(err, http.StatusBadRequest), response.Error(err.Error()))
 	} else {
 		log.Printf("添加学号为：%s的学生", student.ID)
 		c.JSON(http.StatusOK, response.SuccessWithoutData())
@@ -39,11 +62,21 @@ func (sc *StudentController) AddStudent(c *gin.Context) {
 // GetStudent 处理获取学生信息的 HTTP 请求
 func (sc *StudentController) GetStudent(c *gin.Context) {
 	studentId := c.Param("id")
+	consistency := c.DefaultQuery("consistency", service.ConsistencyStale)
+	if !service.ValidConsistency(consistency) {
+		c.JSON(http.StatusBadRequest, response.Error("consistency只能是linearizable、lease或stale"))
+		return
+	}
 	// 调用服务层方法获取学生信息
-	resp, err := sc.studentService.GetStudent(studentId)
+	resp, err := sc.studentService.ReadStudent(studentId, consistency)
 	if err != nil {
 		log.Printf("StudentController.GetStudent err：%v", err.Error())
-		c.JSON(500, response.Error(err.Error()))
+		// 不是领导者时客户端可以换成领导者重试
+		if errors.Is(err, service.ErrNotLeader) {
+			c.JSON(http.StatusServiceUnavailable, response.Error(err.Error()))
+		} else {
+			c.JSON(500, response.Error(err.Error()))
+		}
 	} else {
 		log.Printf("查询学号为：%s的学生", studentId)
 		c.JSON(http.StatusOK, response.Success(resp))
@@ -60,10 +93,10 @@ func (sc *StudentController) UpdateStudent(c *gin.Context) {
 		return
 	}
 	// 调用服务层方法，更新学生信息
-	err := sc.studentService.UpdateStudent(&student)
+	err := sc.studentService.UpdateStudent(&student, c.GetHeader(idempotencyKeyHeader))
 	if err != nil {
 		log.Printf(err.Error())
-		c.JSON(http.StatusNotFound, response.Error(err.Error()))
+		c.JSON(commandErrorStatus(err, http.StatusNotFound), response.Error(err.Error()))
 	} else {
 		log.Printf("修改学生：%s", student.ID)
 		c.JSON(http.StatusOK, response.SuccessWithoutData())
@@ -74,22 +107,117 @@ func (sc *StudentController) UpdateStudent(c *gin.Context) {
 func (sc *StudentController) DeleteStudent(c *gin.Context) {
 	studentId := c.Param("id")
 	// 调用服务层方法，删除学生信息
-	err := sc.studentService.DeleteStudent(studentId)
+	err := sc.studentService.DeleteStudent(studentId, c.GetHeader(idempotencyKeyHeader))
 	if err != nil {
 		log.Printf("StudentController.DeleteStudent err：%v", err.Error())
-		c.JSON(http.StatusNotFound, response.Error(err.Error()))
+		c.JSON(commandErrorStatus(err, http.StatusNotFound), response.Error(err.Error()))
 	} else {
 		log.Printf("删除学号为：%s的学生", studentId)
 		c.JSON(http.StatusOK, response.SuccessWithoutData())
 	}
 }
 
+// expireRequest 修改学生过期设置的请求体
+type expireRequest struct {
+	Expiration     int64  `json:"expiration"`      // 过期时间 单位秒
+	ExpirationMode string `json:"expiration_mode"` // 过期方式 absolute或者sliding 为空时是absolute
+}
+
+// ListStudents 处理获取学生列表的 HTTP 请求 有class、gender或subject条件时按条件查询 否则以MySQL为准分页获取
+func (sc *StudentController) ListStudents(c *gin.Context) {
+	class, gender, subject := c.Query("class"), c.Query("gender"), c.Query("subject")
+	if class != "" || gender != "" || subject != "" {
+		sc.queryStudents(c, class, gender, subject)
+		return
+	}
+	pageSize := service.DefaultPageSize
+	if value := c.Query("page_size"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 || size > service.MaxPageSize {
+			c.JSON(http.StatusBadRequest, response.Error(fmt.Sprintf("page_size必须是1到%d之间的整数", service.MaxPageSize)))
+			return
+		}
+		pageSize = size
+	}
+	page, err := sc.studentService.ListStudents(c.Query("page_token"), pageSize)
+	if err != nil {
+		log.Printf("StudentController.ListStudents err：%v", err.Error())
+		if errors.Is(err, service.ErrInvalidPageToken) {
+			c.JSON(http.StatusBadRequest, response.Error(err.Error()))
+		} else {
+			c.JSON(500, response.Error(err.Error()))
+		}
+		return
+	}
+	c.JSON(http.StatusOK, response.Success(page))
+}
+
+// queryStudents 按班级、性别和科目查询学生 返回结果和回答查询的来源
+func (sc *StudentController) queryStudents(c *gin.Context, class string, gender string, subject string) {
+	result, err := sc.studentService.QueryStudents(class, gender, subject)
+	if err != nil {
+		log.Printf("StudentController.ListStudents err：%v", err.Error())
+		c.JSON(500, response.Error(err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, response.Success(result))
+}
+
+// GetStudentTTL 处理查询学生剩余过期时间的 HTTP 请求
+func (sc *StudentController) GetStudentTTL(c *gin.Context) {
+	studentId := c.Param("id")
+	ttl, err := sc.studentService.GetStudentTTL(studentId)
+	if err != nil {
+		log.Printf("StudentController.GetStudentTTL err：%v", err.Error())
+		c.JSON(http.StatusNotFound, response.Error(err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, response.Success(ttl))
+}
+
+// ExpireStudent 处理修改学生过期时间和过期方式的 HTTP 请求
+func (sc *StudentController) ExpireStudent(c *gin.Context) {
+	studentId := c.Param("id")
+	var req expireRequest
+	if err := c.BindJSON(&req); err != nil {
+		log.Printf("StudentController.ExpireStudent err：%v", err.Error())
+		c.JSON(http.StatusBadRequest, response.Error(err.Error()))
+		return
+	}
+	if req.ExpirationMode == model.ExpireNever {
+		c.JSON(http.StatusBadRequest, response.Error("清除过期时间请使用persist"))
+		return
+	}
+	err := sc.studentService.ExpireStudent(studentId, req.Expiration, req.ExpirationMode, c.GetHeader(idempotencyKeyHeader))
+	if err != nil {
+		log.Printf("StudentController.ExpireStudent err：%v", err.Error())
+		c.JSON(commandErrorStatus(err, http.StatusBadRequest), response.Error(err.Error()))
+	} else {
+		log.Printf("修改学生：%s的过期时间为：%d秒 过期方式：%s", studentId, req.Expiration, req.ExpirationMode)
+		c.JSON(http.StatusOK, response.SuccessWithoutData())
+	}
+}
+
+// PersistStudent 处理清除学生过期时间的 HTTP 请求
+func (sc *StudentController) PersistStudent(c *gin.Context) {
+	studentId := c.Param("id")
+	err := sc.studentService.PersistStudent(studentId, c.GetHeader(idempotencyKeyHeader))
+	if err != nil {
+		log.Printf("StudentController.PersistStudent err：%v", err.Error())
+		c.JSON(commandErrorStatus(err, http.StatusBadRequest), response.Error(err.Error()))
+	} else {
+		log.Printf("清除学生：%s的过期时间", studentId)
+		c.JSON(http.StatusOK, response.SuccessWithoutData())
+	}
+}
+
 // JoinRaftCluster 向领导者节点发送请求 把自身加入到集群中
 func (sc *StudentController) JoinRaftCluster(c *gin.Context) {
 	nodeID := c.Query("nodeID")
 	nodeAddress := c.Query("nodeAddress")
 	nodePortAddress := c.Query("portAddress")
-	if err := sc.studentService.JoinRaftCluster(nodeID, nodeAddress, nodePortAddress); err != nil {
+	nodeHttpAddress := c.Query("httpAddress")
+	if err := sc.studentService.JoinRaftCluster(nodeID, nodeAddress, nodePortAddress, nodeHttpAddress); err != nil {
 		log.Printf("StudentController.JoinRaftCluster err:%v", err)
 		c.JSON(500, response.Error(err.Error()))
 	} else {
@@ -98,22 +226,307 @@ func (sc *StudentController) JoinRaftCluster(c *gin.Context) {
 	}
 }
 
-// LeaderHandleCommand 在找到领导者的端口后会向领导者端口发送命令 这个接口会处理这些命令
+// GetClusterMembers 返回Raft当前配置中的所有成员
+func (sc *StudentController) GetClusterMembers(c *gin.Context) {
+	members, err := sc.studentService.GetClusterMembers()
+	if err != nil {
+		log.Printf("StudentController.GetClusterMembers err:%v", err)
+		c.JSON(500, response.Error(err.Error()))
+	} else {
+		c.JSON(http.StatusOK, response.Success(members))
+	}
+}
+
+// RemoveRaftClusterMember 领导者把节点从集群中移除
+func (sc *StudentController) RemoveRaftClusterMember(c *gin.Context) {
+	nodeID := c.Query("nodeID")
+	if nodeID == "" {
+		c.JSON(http.StatusBadRequest, response.Error("缺少参数：nodeID"))
+		return
+	}
+	if err := sc.studentService.RemoveRaftClusterMember(nodeID); err != nil {
+		log.Printf("StudentController.RemoveRaftClusterMember err:%v", err)
+		c.JSON(500, response.Error(err.Error()))
+	} else {
+		log.Printf("移除节点：%s成功", nodeID)
+		c.JSON(http.StatusOK, response.SuccessWithoutData())
+	}
+}
+
+// DemoteRaftClusterMember 领导者把节点降级为不参与投票的节点
+func (sc *StudentController) DemoteRaftClusterMember(c *gin.Context) {
+	nodeID := c.Query("nodeID")
+	if nodeID == "" {
+		c.JSON(http.StatusBadRequest, response.Error("缺少参数：nodeID"))
+		return
+	}
+	if err := sc.studentService.DemoteRaftClusterMember(nodeID); err != nil {
+		log.Printf("StudentController.DemoteRaftClusterMember err:%v", err)
+		c.JSON(500, response.Error(err.Error()))
+	} else {
+		log.Printf("降级节点：%s成功", nodeID)
+		c.JSON(http.StatusOK, response.SuccessWithoutData())
+	}
+}
+
+// ReplaceRaftClusterMember 领导者用新节点替换集群中的旧节点
+func (sc *StudentController) ReplaceRaftClusterMember(c *gin.Context) {
+	oldNodeID := c.Query("oldNodeID")
+	nodeID := c.Query("nodeID")
+	nodeAddress := c.Query("nodeAddress")
+	nodePortAddress := c.Query("portAddress")
+	nodeHttpAddress := c.Query("httpAddress")
+	if oldNodeID == "" || nodeID == "" || nodeAddress == "" || nodePortAddress == "" {
+		c.JSON(http.StatusBadRequest, response.Error("缺少参数：oldNodeID、nodeID、nodeAddress、portAddress都是必填的"))
+		return
+	}
+	if err := sc.studentService.ReplaceRaftClusterMember(oldNodeID, nodeID, nodeAddress, nodePortAddress, nodeHttpAddress); err != nil {
+		log.Printf("StudentController.ReplaceRaftClusterMember err:%v", err)
+		c.JSON(500, response.Error(err.Error()))
+	} else {
+		log.Printf("用节点：%s替换节点：%s成功", nodeID, oldNodeID)
+		c.JSON(http.StatusOK, response.SuccessWithoutData())
+	}
+}
+
+// LeaveRaftCluster 本节点主动离开集群
+func (sc *StudentController) LeaveRaftCluster(c *gin.Context) {
+	if err := sc.studentService.LeaveRaftCluster(); err != nil {
+		log.Printf("StudentController.LeaveRaftCluster err:%v", err)
+		c.JSON(500, response.Error(err.Error()))
+	} else {
+		log.Printf("本节点已离开集群")
+		c.JSON(http.StatusOK, response.SuccessWithoutData())
+	}
+}
+
+// maxCommandBodySize 转发命令请求体的最大长度
+const maxCommandBodySize = 1 << 20
+
+// LeaderHandleCommand 跟随者把命令放在POST请求体中转发给领导者 这个接口会检查并处理这些命令
 func (sc *StudentController) LeaderHandleCommand(c *gin.Context) {
-	cmdData := c.Query("cmd")
-	if err := sc.studentService.LeaderHandleCommand(cmdData); err != nil {
+	var cmd fsm.StudentCommand
+	decoder := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, maxCommandBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cmd); err != nil {
 		log.Printf("StudentController.LeaderHandleCommand err:%v", err)
-		c.JSON(500, response.Error(err.Error()))
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, response.Error(err.Error()))
+		} else {
+			c.JSON(http.StatusBadRequest, response.Error(err.Error()))
+		}
+		return
+	}
+	if !fsm.IsClientOperation(cmd.Operation) {
+		log.Printf("StudentController.LeaderHandleCommand 拒绝转发内部命令：%s", cmd.Operation)
+		c.JSON(http.StatusBadRequest, response.Error(fmt.Sprintf("不能转发操作：%s", cmd.Operation)))
+		return
+	}
+	if err := cmd.Validate(); err != nil {
+		log.Printf("StudentController.LeaderHandleCommand err:%v", err)
+		c.JSON(http.StatusBadRequest, response.Error(err.Error()))
+		return
+	}
+	if err := sc.studentService.LeaderHandleCommand(&cmd); err != nil {
+		log.Printf("StudentController.LeaderHandleCommand err:%v", err)
+		// 跟随者收到503会重新寻找领导者后重试 收到409时还原成ErrRequestConflict 其他错误是状态机的处理结果 原样返回
+		if errors.Is(err, service.ErrNotLeader) {
+			c.JSON(http.StatusServiceUnavailable, response.Error(err.Error()))
+		} else {
+			c.JSON(commandErrorStatus(err, http.StatusUnprocessableEntity), response.Error(err.Error()))
+		}
 	} else {
 		log.Printf("领导者节点已处理命令")
 		c.JSON(http.StatusOK, response.SuccessWithoutData())
 	}
 }
 
-// GetLeaderPortAddress 获取领导者端口的地址 方法是向所有节点都通过此端口发送请求 领导者端口会返回自己的端口地址
-func (sc *StudentController) GetLeaderPortAddress(c *gin.Context) {
-	leaderAddr := sc.studentService.HandleGetLeaderPortAddressRequest()
-	if leaderAddr != "" {
+// LeaderReadIndex 领导者确认领导权后返回读索引 供跟随者进行线性一致读
+func (sc *StudentController) LeaderReadIndex(c *gin.Context) {
+	readIndex, err := sc.studentService.LeaderReadIndex()
+	if err != nil {
+		log.Printf("StudentController.LeaderReadIndex err:%v", err)
+		if errors.Is(err, service.ErrNotLeader) {
+			c.JSON(http.StatusServiceUnavailable, response.Error(err.Error()))
+		} else {
+			c.JSON(500, response.Error(err.Error()))
+		}
+	} else {
+		c.JSON(http.StatusOK, response.Success(readIndex))
+	}
+}
+
+// GetLeaderAddress 获取领导者的HTTP地址 任何节点都可以通过Raft知道当前的领导者
+func (sc *StudentController) GetLeaderAddress(c *gin.Context) {
+	leaderAddr, err := sc.studentService.HandleGetLeaderAddressRequest()
+	if err != nil {
+		log.Printf("StudentController.GetLeaderAddress err:%v", err)
+		c.JSON(http.StatusServiceUnavailable, response.Error(err.Error()))
+	} else {
 		c.JSON(http.StatusOK, response.Success(leaderAddr))
 	}
 }
+
+// GetJobStatus 返回后台任务在本节点上的执行状态 只有领导者上的任务在执行
+func (sc *StudentController) GetJobStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, response.Success(sc.jobScheduler.Status()))
+}
+
+// RewriteAOF 在本节点上重写内存数据库的AOF
+func (sc *StudentController) RewriteAOF(c *gin.Context) {
+	if err := sc.studentService.MdbService.RewriteAOF(); err != nil {
+		log.Printf("StudentController.RewriteAOF err：%v", err.Error())
+		c.JSON(http.StatusBadRequest, response.Error(err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, response.SuccessWithoutData())
+}
+
+// GetMemoryStats 返回本节点内存数据库的淘汰策略、命中率和淘汰次数
+func (sc *StudentController) GetMemoryStats(c *gin.Context) {
+	c.JSON(http.StatusOK, response.Success(sc.studentService.MdbService.Stats()))
+}
+
+// DumpMemoryDB 把本节点内存数据库某一时刻的全部内容转储到配置的转储文件
+func (sc *StudentController) DumpMemoryDB(c *gin.Context) {
+	info, err := sc.studentService.MdbService.Dump()
+	if err != nil {
+		log.Printf("StudentController.DumpMemoryDB err：%v", err.Error())
+		c.JSON(500, response.Error(err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, response.Success(info))
+}
+
+// maxDumpBodySize 请求体中转储内容的最大长度 更大的转储可以放在配置的转储文件中加载
+const maxDumpBodySize = 64 << 20
+
+// LoadMemoryDB 用转储文件替换内存数据库的全部内容 请求体不为空时加载请求体中的转储内容 否则加载配置的转储文件
+// 加载的内容不经过Raft复制 所以只能在只有本节点的集群中加载 之后加入的节点从快照中得到加载的内容
+func (sc *StudentController) LoadMemoryDB(c *gin.Context) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxDumpBodySize))
+	if err != nil {
+		log.Printf("StudentController.LoadMemoryDB err：%v", err.Error())
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, response.Error(err.Error()))
+		} else {
+			c.JSON(http.StatusBadRequest, response.Error(err.Error()))
+		}
+		return
+	}
+	var info *dao.DumpInfo
+	if len(body) > 0 {
+		info, err = sc.studentService.LoadMemoryDB(bytes.NewReader(body))
+	} else {
+		info, err = sc.studentService.LoadMemoryDB(nil)
+	}
+	if err != nil {
+		log.Printf("StudentController.LoadMemoryDB err：%v", err.Error())
+		switch {
+		case errors.Is(err, dao.ErrDumpCorrupted):
+			c.JSON(http.StatusBadRequest, response.Error(err.Error()))
+		case errors.Is(err, service.ErrLoadRequiresSingleNode):
+			c.JSON(http.StatusConflict, response.Error(err.Error()))
+		case errors.Is(err, service.ErrNotLeader):
+			c.JSON(http.StatusServiceUnavailable, response.Error(err.Error()))
+		default:
+			c.JSON(500, response.Error(err.Error()))
+		}
+		return
+	}
+	c.JSON(http.StatusOK, response.Success(info))
+}
+
+// scanResponse 遍历内存中学生id的一批结果
+type scanResponse struct {
+	Cursor string   `json:"cursor"`
+	Ids    []string `json:"ids"`
+}
+
+// ScanMemoryDB 用游标遍历本节点内存中的学生id 参数cursor(第一次为0) match(通配符 可选) count(每次检查的数量 可选)
+// 返回的cursor为0表示遍历完了 游标以字符串返回 避免超过JSON数字的精度
+func (sc *StudentController) ScanMemoryDB(c *gin.Context) {
+	cursor, err := strconv.ParseUint(c.DefaultQuery("cursor", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, response.Error("cursor必须是非负整数"))
+		return
+	}
+	count, err := strconv.Atoi(c.DefaultQuery("count", "0"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, response.Error("count必须是整数"))
+		return
+	}
+	ids, next, err := sc.studentService.MdbService.ScanStudents(cursor, c.Query("match"), count)
+	if err != nil {
+		log.Printf("StudentController.ScanMemoryDB err：%v", err.Error())
+		c.JSON(http.StatusBadRequest, response.Error(err.Error()))
+		return
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	c.JSON(http.StatusOK, response.Success(scanResponse{Cursor: strconv.FormatUint(next, 10), Ids: ids}))
+}
+
+// eventHeartbeatInterval 事件流没有事件时发送心跳的间隔 防止代理因为连接空闲而断开
+const eventHeartbeatInterval = 15 * time.Second
+
+// droppedEvent 订阅者读取得太慢时通知客户端到目前为止一共丢弃了多少个事件
+type droppedEvent struct {
+	Dropped uint64 `json:"dropped"`
+}
+
+// StreamEvents 以Server-Sent Events推送本节点内存中学生的变化事件 事件名是操作(set、update、delete、evict、expire、import)
+// 参数buffer(缓冲区大小 可选) overflow(缓冲区满了时的处理方式 drop-newest或drop-oldest 可选)
+// 有事件被丢弃时会推送dropped事件 客户端需要重新读取可能错过的学生
+func (sc *StudentController) StreamEvents(c *gin.Context) {
+	buffer, err := strconv.Atoi(c.DefaultQuery("buffer", "0"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, response.Error("buffer必须是整数"))
+		return
+	}
+	sub, err := sc.studentService.MdbService.Subscribe(dao.SubscribeOptions{Buffer: buffer, Overflow: c.Query("overflow")})
+	if err != nil {
+		log.Printf("StudentController.StreamEvents err：%v", err.Error())
+		c.JSON(http.StatusBadRequest, response.Error(err.Error()))
+		return
+	}
+	defer sub.Close()
+	log.Printf("客户端：%s 开始订阅内存数据库事件", c.ClientIP())
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+	var reported uint64
+	reportDropped := func() {
+		if dropped := sub.Dropped(); dropped > reported {
+			reported = dropped
+			c.SSEvent("dropped", droppedEvent{Dropped: dropped})
+		}
+	}
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case event, ok := <-sub.C:
+			// 订阅被关闭 说明节点正在停止
+			if !ok {
+				return false
+			}
+			reportDropped()
+			c.SSEvent(event.Op, event)
+		case <-heartbeat.C:
+			reportDropped()
+			fmt.Fprint(w, ": heartbeat\n\n")
+		}
+		return true
+	})
+	log.Printf("客户端：%s 结束订阅内存数据库事件", c.ClientIP())
+}
@@ -0,0 +1,588 @@
+package dao
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"node2/config"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AOF的刷盘策略
+const (
+	AOFFsyncAlways   = "always"   // 每次写入后都fsync 最多丢失正在写入的一条修改
+	AOFFsyncEverysec = "everysec" // 每秒fsync一次 最多丢失一秒的修改
+	AOFFsyncNo       = "no"       // 只写入操作系统 由操作系统决定什么时候刷盘
+)
+
+// AOF记录的操作 修改和过期都记录完整的结果 重复重放的结果相同
+const (
+	aofOpSet = "set" // Set和Update 记录键的完整值和过期设置
+	aofOpDel = "del" // 删除、过期删除和淘汰
+)
+
+// aofHeaderSize 每条记录的头部 4字节的数据长度和4字节的CRC32校验和
+const aofHeaderSize = 8
+
+// aofMaxRecordSize 单条记录的最大长度 超过时认为文件已经损坏
+const aofMaxRecordSize = 64 << 20
+
+// ErrAOFCorrupted AOF文件末尾不完整或者校验失败 可以截掉不完整的部分修复
+var ErrAOFCorrupted = errors.New("AOF文件损坏")
+
+// Codec 把内存数据库中的键和值编码成字节和解码回来 开启AOF和转储时需要提供
+type Codec[K comparable, V any] interface {
+	EncodeKey(key K) string
+	DecodeKey(key string) (K, error)
+	Encode(value V) ([]byte, error)
+	Decode(data []byte) (V, error)
+}
+
+// StringKeys 键是字符串时的键编码 Codec可以嵌入它 只需要实现值的编码
+type StringKeys struct{}
+
+func (StringKeys) EncodeKey(key string) string {
+	return key
+}
+
+func (StringKeys) DecodeKey(key string) (string, error) {
+	return key, nil
+}
+
+// aofRecord AOF中的一条修改
+type aofRecord struct {
+	Op       string        `json:"op"`
+	Key      string        `json:"key"`
+	Value    []byte        `json:"value,omitempty"`
+	ExpireAt int64         `json:"expire_at,omitempty"` // 过期时间点 unix纳秒 0表示永不过期
+	TTL      time.Duration `json:"ttl,omitempty"`
+	Sliding  bool          `json:"sliding,omitempty"`
+}
+
+// AOFStats AOF的统计数据
+type AOFStats struct {
+	Path         string     `json:"path"`
+	Fsync        string     `json:"fsync"`
+	Size         int64      `json:"size"`      // 当前文件的字节数
+	BaseSize     int64      `json:"base_size"` // 上次重写后文件的字节数
+	Rewriting    bool       `json:"rewriting"`
+	RewriteCount int64      `json:"rewrite_count"`
+	LastRewrite  *time.Time `json:"last_rewrite"`
+	LastError    string     `json:"last_error"` // 最后一次写入或重写的错误 成功后清空
+}
+
+// aofWriter 追加写日志 所有方法并发安全
+// 重写期间新的修改同时写入旧文件和重写缓冲区 重写完成后把缓冲区追加到新文件再替换旧文件
+type aofWriter[K comparable, V any] struct {
+	mu                sync.Mutex
+	file              *os.File
+	path              string
+	fsync             string
+	codec             Codec[K, V]
+	rewritePercentage int
+	rewriteMinSize    int64
+	size              int64
+	baseSize          int64
+	dirty             bool // 有还没有fsync的写入
+	closed            bool
+	rewriting         bool
+	rewriteBuf        [][]byte
+	rewriteCount      int64
+	lastRewrite       time.Time
+	lastErr           string
+	rewriteCh         chan struct{}
+	stopOnce          sync.Once
+	stop              chan struct{}
+	done              chan struct{}
+}
+
+// encodeAOFRecord 把记录编码成带长度和校验和的一帧
+func encodeAOFRecord(record aofRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, aofHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[aofHeaderSize:], payload)
+	return frame, nil
+}
+
+// readAOF 依次读取AOF中的记录 返回完整记录的数量和它们占用的字节数
+// 文件末尾不完整或者校验失败时返回ErrAOFCorrupted 前面完整的记录已经交给fn处理
+func readAOF(r io.Reader, fn func(record aofRecord) error) (records int, validSize int64, err error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, aofHeaderSize)
+	for {
+		if _, err = io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return records, validSize, nil
+			}
+			return records, validSize, fmt.Errorf("%w：偏移量%d处的记录头部不完整", ErrAOFCorrupted, validSize)
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > aofMaxRecordSize {
+			return records, validSize, fmt.Errorf("%w：偏移量%d处的记录长度%d不合法", ErrAOFCorrupted, validSize, length)
+		}
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(reader, payload); err != nil {
+			return records, validSize, fmt.Errorf("%w：偏移量%d处的记录不完整", ErrAOFCorrupted, validSize)
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return records, validSize, fmt.Errorf("%w：偏移量%d处的记录校验失败", ErrAOFCorrupted, validSize)
+		}
+		var record aofRecord
+		if err = json.Unmarshal(payload, &record); err != nil {
+			return records, validSize, fmt.Errorf("%w：偏移量%d处的记录无法解析：%v", ErrAOFCorrupted, validSize, err)
+		}
+		if err = fn(record); err != nil {
+			return records, validSize, err
+		}
+		records++
+		validSize += int64(aofHeaderSize) + int64(length)
+	}
+}
+
+// AOFCheckResult 检查AOF文件的结果
+type AOFCheckResult struct {
+	Records   int   // 完整记录的数量
+	ValidSize int64 // 完整记录占用的字节数 修复时截断到这个长度
+	FileSize  int64
+	Err       error // 文件损坏的原因 没有损坏时为nil
+}
+
+// CheckAOF 检查AOF文件是否完整
+func CheckAOF(path string) (AOFCheckResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return AOFCheckResult{}, fmt.Errorf("dao.CheckAOF 打开AOF文件：%s失败：%w", path, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return AOFCheckResult{}, fmt.Errorf("dao.CheckAOF 获取AOF文件：%s信息失败：%w", path, err)
+	}
+	records, validSize, err := readAOF(file, func(aofRecord) error { return nil })
+	result := AOFCheckResult{Records: records, ValidSize: validSize, FileSize: info.Size(), Err: err}
+	if err != nil && !errors.Is(err, ErrAOFCorrupted) {
+		return result, fmt.Errorf("dao.CheckAOF 读取AOF文件：%s失败：%w", path, err)
+	}
+	return result, nil
+}
+
+// RepairAOF 截掉AOF文件末尾不完整的部分 只保留完整的记录 返回检查的结果
+func RepairAOF(path string) (AOFCheckResult, error) {
+	result, err := CheckAOF(path)
+	if err != nil || result.Err == nil {
+		return result, err
+	}
+	if err = os.Truncate(path, result.ValidSize); err != nil {
+		return result, fmt.Errorf("dao.RepairAOF 截断AOF文件：%s失败：%w", path, err)
+	}
+	log.Printf("已修复AOF文件：%s 截掉%d字节 保留%d条记录", path, result.FileSize-result.ValidSize, result.Records)
+	return result, nil
+}
+
+// OpenAOF replay为true时重放AOF文件恢复内存数据库 否则丢弃已有的AOF文件 然后打开AOF记录之后的每次修改
+// 需要在内存数据库开始使用之前调用 滑动过期的键重放时重新开始计时
+func (store *Store[K, V]) OpenAOF(cfg config.AOFConfig, path string, codec Codec[K, V], replay bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Store.OpenAOF 创建AOF目录失败：%w", err)
+	}
+	if replay {
+		if err := store.replayAOF(path, codec, cfg.LoadTruncated); err != nil {
+			return err
+		}
+	} else if err := os.Remove(path); err == nil {
+		log.Printf("已丢弃AOF文件：%s", path)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("Store.OpenAOF 删除AOF文件：%s失败：%w", path, err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Store.OpenAOF 打开AOF文件：%s失败：%w", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Store.OpenAOF 获取AOF文件：%s信息失败：%w", path, err)
+	}
+	store.aof = &aofWriter[K, V]{
+		file:              file,
+		path:              path,
+		fsync:             cfg.Fsync,
+		codec:             codec,
+		rewritePercentage: cfg.RewritePercentage,
+		rewriteMinSize:    cfg.RewriteMinSize,
+		size:              info.Size(),
+		baseSize:          info.Size(),
+		rewriteCh:         make(chan struct{}, 1),
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+	go store.runAOF()
+	log.Printf("已开启AOF：%s 刷盘策略：%s", path, cfg.Fsync)
+	return nil
+}
+
+// replayAOF 重放AOF文件 文件不存在时什么也不做
+func (store *Store[K, V]) replayAOF(path string, codec Codec[K, V], loadTruncated bool) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Store.replayAOF 打开AOF文件：%s失败：%w", path, err)
+	}
+	defer file.Close()
+	now := time.Now()
+	records, validSize, err := readAOF(file, func(record aofRecord) error {
+		key, err := codec.DecodeKey(record.Key)
+		if err != nil {
+			return fmt.Errorf("解码键：%s失败：%w", record.Key, err)
+		}
+		switch record.Op {
+		case aofOpSet:
+			value, err := codec.Decode(record.Value)
+			if err != nil {
+				return fmt.Errorf("解码键：%s的值失败：%w", record.Key, err)
+			}
+			expiry := Expiry{TTL: record.TTL, Sliding: record.Sliding}
+			var expireAt time.Time
+			if record.ExpireAt > 0 && !record.Sliding {
+				expireAt = time.Unix(0, record.ExpireAt)
+				if now.After(expireAt) {
+					store.Delete(key)
+					return nil
+				}
+			}
+			store.set(key, value, expiry, expireAt)
+		case aofOpDel:
+			store.Delete(key)
+		default:
+			return fmt.Errorf("未知的AOF操作：%s", record.Op)
+		}
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, ErrAOFCorrupted) || !loadTruncated {
+			return fmt.Errorf("Store.replayAOF 重放AOF文件：%s失败：%w 可以用aofcheck --fix修复", path, err)
+		}
+		log.Printf("AOF文件：%s末尾不完整：%v 截掉不完整的部分继续加载", path, err)
+		if err = os.Truncate(path, validSize); err != nil {
+			return fmt.Errorf("Store.replayAOF 截断AOF文件：%s失败：%w", path, err)
+		}
+	}
+	log.Printf("已重放AOF文件：%s 共%d条记录 内存数据库中有%d个键值对", path, records, store.Count())
+	return nil
+}
+
+// runAOF 每秒刷盘一次 收到通知时在后台重写AOF 直到关闭
+func (store *Store[K, V]) runAOF() {
+	aof := store.aof
+	defer close(aof.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-aof.stop:
+			return
+		case <-ticker.C:
+			if aof.fsync == AOFFsyncEverysec {
+				aof.sync()
+			}
+		case <-aof.rewriteCh:
+			if err := store.RewriteAOF(); err != nil {
+				log.Printf("Store.runAOF 重写AOF失败：%v", err)
+			}
+		}
+	}
+}
+
+// logSet 记录键的完整值和过期设置 调用者需要持有分段的锁 保证同一个键的记录和修改顺序一致
+func (store *Store[K, V]) logSet(entry *memoryEntry[K, V]) {
+	if store.aof == nil {
+		return
+	}
+	record, err := store.aof.setRecord(entry)
+	if err != nil {
+		store.aof.fail(err)
+		return
+	}
+	store.aof.append(record)
+}
+
+// logDel 记录删除键 调用者需要持有分段的锁
+func (store *Store[K, V]) logDel(key K) {
+	if store.aof == nil {
+		return
+	}
+	store.aof.append(aofRecord{Op: aofOpDel, Key: store.aof.codec.EncodeKey(key)})
+}
+
+// setRecord 把键的完整值和过期设置编码成一条记录 调用者需要持有分段的锁
+func (aof *aofWriter[K, V]) setRecord(entry *memoryEntry[K, V]) (aofRecord, error) {
+	record := aofRecord{Op: aofOpSet, Key: aof.codec.EncodeKey(entry.key), TTL: entry.expiry.TTL, Sliding: entry.expiry.Sliding}
+	if !entry.expireAt.IsZero() {
+		record.ExpireAt = entry.expireAt.UnixNano()
+	}
+	value, err := aof.codec.Encode(entry.value)
+	if err != nil {
+		return record, fmt.Errorf("编码键：%s的值失败：%w", record.Key, err)
+	}
+	record.Value = value
+	return record, nil
+}
+
+// append 写入一条记录 写入失败只记录错误 内存中的修改已经完成
+func (aof *aofWriter[K, V]) append(record aofRecord) {
+	frame, err := encodeAOFRecord(record)
+	if err != nil {
+		aof.fail(fmt.Errorf("编码键：%s的记录失败：%w", record.Key, err))
+		return
+	}
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if aof.closed {
+		return
+	}
+	if _, err = aof.file.Write(frame); err != nil {
+		aof.lastErr = err.Error()
+		log.Printf("写入AOF失败：%v", err)
+		return
+	}
+	aof.size += int64(len(frame))
+	aof.dirty = true
+	if aof.fsync == AOFFsyncAlways {
+		aof.syncLocked()
+	}
+	if aof.rewriting {
+		aof.rewriteBuf = append(aof.rewriteBuf, frame)
+	} else if aof.shouldRewrite() {
+		select {
+		case aof.rewriteCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// shouldRewrite 文件比上次重写后增长了足够多时需要重写 调用者需要持有锁
+func (aof *aofWriter[K, V]) shouldRewrite() bool {
+	if aof.rewritePercentage <= 0 || aof.size < aof.rewriteMinSize {
+		return false
+	}
+	return aof.size >= aof.baseSize+aof.baseSize*int64(aof.rewritePercentage)/100
+}
+
+// sync 把写入的记录刷到磁盘
+func (aof *aofWriter[K, V]) sync() {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	aof.syncLocked()
+}
+
+// syncLocked 调用者需要持有锁
+func (aof *aofWriter[K, V]) syncLocked() {
+	if aof.closed || !aof.dirty {
+		return
+	}
+	if err := aof.file.Sync(); err != nil {
+		aof.lastErr = err.Error()
+		log.Printf("AOF刷盘失败：%v", err)
+		return
+	}
+	aof.dirty = false
+}
+
+// fail 记录错误
+func (aof *aofWriter[K, V]) fail(err error) {
+	log.Printf("写入AOF失败：%v", err)
+	aof.mu.Lock()
+	aof.lastErr = err.Error()
+	aof.mu.Unlock()
+}
+
+// RewriteAOF 用内存数据库当前的内容重写AOF 去掉被覆盖和删除的记录
+// 依次锁住每个分段导出 不会阻塞整个内存数据库 导出期间的修改写入重写缓冲区 最后追加到新文件
+// 每条记录都是键的完整结果 所以导出时已经包含的修改在缓冲区中重复出现也没有关系
+func (store *Store[K, V]) RewriteAOF() error {
+	aof := store.aof
+	if aof == nil {
+		return errors.New("Store.RewriteAOF 没有开启AOF")
+	}
+	aof.mu.Lock()
+	if aof.closed || aof.rewriting {
+		aof.mu.Unlock()
+		return errors.New("Store.RewriteAOF AOF已关闭或者正在重写")
+	}
+	aof.rewriting = true
+	aof.rewriteBuf = nil
+	aof.mu.Unlock()
+
+	tmpPath := aof.path + ".rewrite"
+	err := store.rewriteAOF(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		aof.mu.Lock()
+		aof.rewriting = false
+		aof.rewriteBuf = nil
+		aof.lastErr = err.Error()
+		aof.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// rewriteAOF 把当前内容写入临时文件 再用它替换AOF文件
+func (store *Store[K, V]) rewriteAOF(tmpPath string) error {
+	aof := store.aof
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("Store.RewriteAOF 创建临时文件失败：%w", err)
+	}
+	defer tmp.Close()
+	writer := bufio.NewWriter(tmp)
+	now := time.Now()
+	for _, shard := range store.shards {
+		// 在分段锁内编码 在锁外写入文件
+		var frames [][]byte
+		shard.mu.Lock()
+		for _, entry := range shard.entries {
+			if !entry.expireAt.IsZero() && now.After(entry.expireAt) {
+				continue
+			}
+			var record aofRecord
+			if record, err = aof.setRecord(entry); err == nil {
+				var frame []byte
+				if frame, err = encodeAOFRecord(record); err == nil {
+					frames = append(frames, frame)
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		shard.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("Store.RewriteAOF 编码键值对失败：%w", err)
+		}
+		for _, frame := range frames {
+			if _, err = writer.Write(frame); err != nil {
+				return fmt.Errorf("Store.RewriteAOF 写入临时文件失败：%w", err)
+			}
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		return fmt.Errorf("Store.RewriteAOF 写入临时文件失败：%w", err)
+	}
+
+	// 追加重写期间的修改并替换文件 这段时间新的修改需要等待
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if aof.closed {
+		return errors.New("Store.RewriteAOF AOF已关闭")
+	}
+	for _, frame := range aof.rewriteBuf {
+		if _, err = tmp.Write(frame); err != nil {
+			return fmt.Errorf("Store.RewriteAOF 写入重写缓冲区失败：%w", err)
+		}
+	}
+	if err = tmp.Sync(); err != nil {
+		return fmt.Errorf("Store.RewriteAOF 临时文件刷盘失败：%w", err)
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return fmt.Errorf("Store.RewriteAOF 获取临时文件信息失败：%w", err)
+	}
+	if err = os.Rename(tmpPath, aof.path); err != nil {
+		return fmt.Errorf("Store.RewriteAOF 替换AOF文件失败：%w", err)
+	}
+	file, err := os.OpenFile(aof.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		// 新文件已经替换了旧文件 旧的文件句柄写入的内容会丢失 只能关闭AOF
+		aof.closed = true
+		aof.file.Close()
+		return fmt.Errorf("Store.RewriteAOF 打开新的AOF文件失败 已关闭AOF：%w", err)
+	}
+	aof.file.Close()
+	aof.file = file
+	aof.size = info.Size()
+	aof.baseSize = info.Size()
+	aof.dirty = false
+	aof.rewriting = false
+	aof.rewriteBuf = nil
+	aof.rewriteCount++
+	aof.lastRewrite = time.Now()
+	aof.lastErr = ""
+	log.Printf("已重写AOF：%s 大小：%d字节", aof.path, aof.size)
+	return nil
+}
+
+// requestAOFRewrite 通知后台重写AOF 已经有通知在等待时什么也不做
+func (store *Store[K, V]) requestAOFRewrite() {
+	if store.aof == nil {
+		return
+	}
+	select {
+	case store.aof.rewriteCh <- struct{}{}:
+	default:
+	}
+}
+
+// AOFStats 返回AOF的统计数据 没有开启AOF时返回nil
+func (store *Store[K, V]) AOFStats() *AOFStats {
+	aof := store.aof
+	if aof == nil {
+		return nil
+	}
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	stats := &AOFStats{
+		Path:         aof.path,
+		Fsync:        aof.fsync,
+		Size:         aof.size,
+		BaseSize:     aof.baseSize,
+		Rewriting:    aof.rewriting,
+		RewriteCount: aof.rewriteCount,
+		LastError:    aof.lastErr,
+	}
+	if !aof.lastRewrite.IsZero() {
+		lastRewrite := aof.lastRewrite
+		stats.LastRewrite = &lastRewrite
+	}
+	return stats
+}
+
+// CloseAOF 停止后台任务 把写入的记录刷到磁盘并关闭文件 没有开启AOF时什么也不做
+func (store *Store[K, V]) CloseAOF() error {
+	aof := store.aof
+	if aof == nil {
+		return nil
+	}
+	aof.stopOnce.Do(func() { close(aof.stop) })
+	<-aof.done
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if aof.closed {
+		return nil
+	}
+	aof.closed = true
+	if err := aof.file.Sync(); err != nil {
+		aof.file.Close()
+		return fmt.Errorf("Store.CloseAOF 刷盘失败：%w", err)
+	}
+	if err := aof.file.Close(); err != nil {
+		return fmt.Errorf("Store.CloseAOF 关闭AOF文件失败：%w", err)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package dao
+
+import (
+	"errors"
+	"fmt"
+	"node2/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStringCodec 值也是字符串的编码
+type testStringCodec struct {
+	StringKeys
+}
+
+func (testStringCodec) Encode(value string) ([]byte, error) { return []byte(value), nil }
+
+func (testStringCodec) Decode(data []byte) (string, error) { return string(data), nil }
+
+// openTestAOF 创建一个内存数据库并打开path处的AOF
+func openTestAOF(t *testing.T, path string, replay bool) *Store[string, string] {
+	t.Helper()
+	store, err := NewStore[string, string](config.MemoryDBConfig{Capacity: 100, EvictRatio: 0.1}, nil)
+	if err != nil {
+		t.Fatalf("创建内存数据库失败：%v", err)
+	}
+	if err = store.OpenAOF(config.AOFConfig{Fsync: AOFFsyncAlways}, path, testStringCodec{}, replay); err != nil {
+		t.Fatalf("打开AOF失败：%v", err)
+	}
+	t.Cleanup(func() { store.CloseAOF() })
+	return store
+}
+
+// TestOpenAOFReplayOrDiscard 需要重放时恢复之前记录的键 不需要时丢弃已有的AOF 之后的修改重新开始记录
+func TestOpenAOFReplayOrDiscard(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memory.aof")
+	first := openTestAOF(t, path, true)
+	first.Set("a", "1", NoExpiry)
+	if err := first.CloseAOF(); err != nil {
+		t.Fatalf("关闭AOF失败：%v", err)
+	}
+
+	replayed := openTestAOF(t, path, true)
+	if value, ok := replayed.Get("a"); !ok || value != "1" {
+		t.Fatalf("重放后键a的值是：%q %v 期望1", value, ok)
+	}
+	if err := replayed.CloseAOF(); err != nil {
+		t.Fatalf("关闭AOF失败：%v", err)
+	}
+
+	discarded := openTestAOF(t, path, false)
+	if _, ok := discarded.Get("a"); ok {
+		t.Fatalf("丢弃AOF后仍然恢复了键a")
+	}
+	discarded.Set("b", "2", NoExpiry)
+	if err := discarded.CloseAOF(); err != nil {
+		t.Fatalf("关闭AOF失败：%v", err)
+	}
+
+	reopened := openTestAOF(t, path, true)
+	if _, ok := reopened.Get("a"); ok {
+		t.Errorf("丢弃之前的键a又被重放了")
+	}
+	if value, ok := reopened.Get("b"); !ok || value != "2" {
+		t.Errorf("丢弃之后记录的键b的值是：%q %v 期望2", value, ok)
+	}
+}
+
+// checkSameEntries 两个内存数据库中的键值对完全相同
+func checkSameEntries(t *testing.T, got, want *Store[string, string]) {
+	t.Helper()
+	wantEntries := make(map[string]string)
+	for _, entry := range want.Export() {
+		wantEntries[entry.Key] = entry.Value
+	}
+	gotEntries := got.Export()
+	if len(gotEntries) != len(wantEntries) {
+		t.Errorf("有%d个键值对 期望%d个", len(gotEntries), len(wantEntries))
+	}
+	for _, entry := range gotEntries {
+		if value, exists := wantEntries[entry.Key]; !exists || value != entry.Value {
+			t.Errorf("键：%s的值是：%q 期望：%q(存在：%v)", entry.Key, entry.Value, value, exists)
+		}
+	}
+}
+
+// TestCheckAndRepairTruncatedAOF 最后一条记录被截断时CheckAOF报告损坏 RepairAOF截掉它之后剩下的记录可以正常重放
+func TestCheckAndRepairTruncatedAOF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memory.aof")
+	store := openTestAOF(t, path, true)
+	for _, key := range []string{"a", "b", "c"} {
+		store.Set(key, "value-"+key, NoExpiry)
+	}
+	if err := store.CloseAOF(); err != nil {
+		t.Fatalf("关闭AOF失败：%v", err)
+	}
+	intact, err := CheckAOF(path)
+	if err != nil || intact.Err != nil || intact.Records != 3 {
+		t.Fatalf("检查完整的AOF返回：%+v 错误：%v", intact, err)
+	}
+	// 模拟写入最后一条记录时宕机
+	if err = os.Truncate(path, intact.FileSize-3); err != nil {
+		t.Fatalf("截断AOF失败：%v", err)
+	}
+
+	result, err := CheckAOF(path)
+	if err != nil {
+		t.Fatalf("检查AOF失败：%v", err)
+	}
+	if !errors.Is(result.Err, ErrAOFCorrupted) || result.Records != 2 || result.ValidSize >= result.FileSize {
+		t.Fatalf("检查截断的AOF返回：%+v 期望两条完整记录和ErrAOFCorrupted", result)
+	}
+	strict, err := NewStore[string, string](config.MemoryDBConfig{Capacity: 100, EvictRatio: 0.1}, nil)
+	if err != nil {
+		t.Fatalf("创建内存数据库失败：%v", err)
+	}
+	if err = strict.OpenAOF(config.AOFConfig{Fsync: AOFFsyncAlways}, path, testStringCodec{}, true); !errors.Is(err, ErrAOFCorrupted) {
+		strict.CloseAOF()
+		t.Fatalf("不允许加载截断的AOF时打开返回：%v 期望ErrAOFCorrupted", err)
+	}
+
+	repaired, err := RepairAOF(path)
+	if err != nil || repaired.ValidSize != result.ValidSize {
+		t.Fatalf("修复AOF返回：%+v 错误：%v", repaired, err)
+	}
+	if result, err = CheckAOF(path); err != nil || result.Err != nil || result.Records != 2 || result.FileSize != repaired.ValidSize {
+		t.Fatalf("修复后检查AOF返回：%+v 错误：%v", result, err)
+	}
+	replayed := openTestAOF(t, path, true)
+	for _, key := range []string{"a", "b"} {
+		if value, ok := replayed.Get(key); !ok || value != "value-"+key {
+			t.Errorf("修复后重放的键：%s的值是：%q %v", key, value, ok)
+		}
+	}
+	if _, ok := replayed.Get("c"); ok {
+		t.Errorf("修复后仍然重放了被截断的键c")
+	}
+}
+
+// TestRewriteAOFKeepsConcurrentWrites 重写期间的修改通过重写缓冲区写入新文件 重写后的AOF重放得到相同的内容
+func TestRewriteAOFKeepsConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memory.aof")
+	store := openTestAOF(t, path, true)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%d", i)
+		store.Set(key, "old", NoExpiry)
+		store.Set(key, "older-than-rewrite", NoExpiry)
+	}
+
+	// 锁住最后一个分段 让重写在导出其他分段之后停下 这时其他分段的修改只能通过重写缓冲区进入新文件
+	blocked := store.shards[len(store.shards)-1]
+	blocked.mu.Lock()
+	rewriteErr := make(chan error, 1)
+	go func() { rewriteErr <- store.RewriteAOF() }()
+	deadline := time.Now().Add(5 * time.Second)
+	for !store.AOFStats().Rewriting {
+		if time.Now().After(deadline) {
+			blocked.mu.Unlock()
+			t.Fatalf("重写没有开始")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// 给重写留出时间导出前面的分段
+	time.Sleep(50 * time.Millisecond)
+	var changed, deleted int
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if store.shard(key) == blocked {
+			continue
+		}
+		if i%2 == 0 {
+			store.Delete(key)
+			deleted++
+		} else {
+			store.Set(key, "during-rewrite", NoExpiry)
+			changed++
+		}
+	}
+	store.Set("added-during-rewrite", "new", NoExpiry)
+	blocked.mu.Unlock()
+	if err := <-rewriteErr; err != nil {
+		t.Fatalf("重写AOF失败：%v", err)
+	}
+	if changed == 0 || deleted == 0 {
+		t.Fatalf("重写期间修改了%d个键 删除了%d个键 测试的键都在同一个分段中", changed, deleted)
+	}
+	if stats := store.AOFStats(); stats.RewriteCount != 1 || stats.Rewriting {
+		t.Fatalf("重写后的统计：%+v", stats)
+	}
+	store.Set("added-after-rewrite", "new", NoExpiry)
+	if err := store.CloseAOF(); err != nil {
+		t.Fatalf("关闭AOF失败：%v", err)
+	}
+
+	checkSameEntries(t, openTestAOF(t, path, true), store)
+}
@@ -0,0 +1,256 @@
+package dao
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dumpMagic 转储文件开头的魔数
+const dumpMagic = "MDBDUMP"
+
+// dumpVersion 转储文件格式的版本号 格式变化时递增
+const dumpVersion = 1
+
+// dumpFlagSliding 键是滑动过期的
+const dumpFlagSliding = 1
+
+// dumpChecksumSize 文件末尾CRC64校验和的字节数
+const dumpChecksumSize = 8
+
+// dumpCRCTable 转储文件校验和使用的CRC64表
+var dumpCRCTable = crc64.MakeTable(crc64.ECMA)
+
+// ErrDumpCorrupted 转储文件格式不对或者校验失败
+var ErrDumpCorrupted = errors.New("转储文件损坏")
+
+// DumpInfo 转储或者加载的结果
+type DumpInfo struct {
+	Path     string    `json:"path,omitempty"`
+	Keys     int       `json:"keys"`
+	Size     int64     `json:"size"`
+	Checksum string    `json:"checksum"`
+	Time     time.Time `json:"time"`
+}
+
+// writeDump 把键值对按二进制格式写入w 返回写入的字节数和校验和
+// 格式：魔数 版本号 键值对数量 每个键值对(键 值 过期时间点 TTL 标志) 最后是前面所有内容的CRC64
+// 长度和时间都用变长整数编码
+func writeDump[K comparable, V any](w io.Writer, entries []StoreEntry[K, V], codec Codec[K, V]) (int64, uint64, error) {
+	hash := crc64.New(dumpCRCTable)
+	writer := bufio.NewWriter(io.MultiWriter(w, hash))
+	var written int64
+	varint := make([]byte, binary.MaxVarintLen64)
+	write := func(data []byte) error {
+		n, err := writer.Write(data)
+		written += int64(n)
+		return err
+	}
+	writeUvarint := func(v uint64) error {
+		return write(varint[:binary.PutUvarint(varint, v)])
+	}
+	writeVarint := func(v int64) error {
+		return write(varint[:binary.PutVarint(varint, v)])
+	}
+	writeBytes := func(data []byte) error {
+		if err := writeUvarint(uint64(len(data))); err != nil {
+			return err
+		}
+		return write(data)
+	}
+
+	writeEntry := func(entry StoreEntry[K, V]) error {
+		key := codec.EncodeKey(entry.Key)
+		value, err := codec.Encode(entry.Value)
+		if err != nil {
+			return fmt.Errorf("编码键：%s的值失败：%w", key, err)
+		}
+		var expireAt int64
+		if !entry.ExpireAt.IsZero() {
+			expireAt = entry.ExpireAt.UnixNano()
+		}
+		var flags byte
+		if entry.Expiry.Sliding {
+			flags |= dumpFlagSliding
+		}
+		if err = writeBytes([]byte(key)); err != nil {
+			return err
+		}
+		if err = writeBytes(value); err != nil {
+			return err
+		}
+		if err = writeVarint(expireAt); err != nil {
+			return err
+		}
+		if err = writeVarint(int64(entry.Expiry.TTL)); err != nil {
+			return err
+		}
+		return write([]byte{flags})
+	}
+
+	if err := write(append([]byte(dumpMagic), dumpVersion)); err != nil {
+		return written, 0, err
+	}
+	if err := writeUvarint(uint64(len(entries))); err != nil {
+		return written, 0, err
+	}
+	for _, entry := range entries {
+		if err := writeEntry(entry); err != nil {
+			return written, 0, err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return written, 0, err
+	}
+	checksum := hash.Sum64()
+	footer := make([]byte, dumpChecksumSize)
+	binary.BigEndian.PutUint64(footer, checksum)
+	n, err := w.Write(footer)
+	written += int64(n)
+	return written, checksum, err
+}
+
+// readDump 校验并解析转储文件的内容
+func readDump[K comparable, V any](data []byte, codec Codec[K, V]) ([]StoreEntry[K, V], uint64, error) {
+	if len(data) < len(dumpMagic)+1+dumpChecksumSize {
+		return nil, 0, fmt.Errorf("%w：文件太短", ErrDumpCorrupted)
+	}
+	body := data[:len(data)-dumpChecksumSize]
+	checksum := binary.BigEndian.Uint64(data[len(body):])
+	if crc64.Checksum(body, dumpCRCTable) != checksum {
+		return nil, 0, fmt.Errorf("%w：校验和不一致", ErrDumpCorrupted)
+	}
+	if string(body[:len(dumpMagic)]) != dumpMagic {
+		return nil, 0, fmt.Errorf("%w：不是内存数据库的转储文件", ErrDumpCorrupted)
+	}
+	if version := body[len(dumpMagic)]; version != dumpVersion {
+		return nil, 0, fmt.Errorf("%w：不支持的版本号：%d", ErrDumpCorrupted, version)
+	}
+
+	reader := bytes.NewReader(body[len(dumpMagic)+1:])
+	readBytes := func() ([]byte, error) {
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		if length > uint64(reader.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		data := make([]byte, length)
+		_, err = io.ReadFull(reader, data)
+		return data, err
+	}
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w：读取键值对数量失败：%v", ErrDumpCorrupted, err)
+	}
+	// 每个键值对至少占5个字节 防止损坏的数量导致分配过多内存
+	if count > uint64(reader.Len())/5 {
+		return nil, 0, fmt.Errorf("%w：键值对数量：%d不合法", ErrDumpCorrupted, count)
+	}
+	entries := make([]StoreEntry[K, V], 0, count)
+	for i := uint64(0); i < count; i++ {
+		key, err := readBytes()
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w：读取第%d个键失败：%v", ErrDumpCorrupted, i, err)
+		}
+		value, err := readBytes()
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w：读取键：%s的值失败：%v", ErrDumpCorrupted, key, err)
+		}
+		expireAt, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w：读取键：%s的过期时间失败：%v", ErrDumpCorrupted, key, err)
+		}
+		ttl, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w：读取键：%s的TTL失败：%v", ErrDumpCorrupted, key, err)
+		}
+		flags, err := reader.ReadByte()
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w：读取键：%s的标志失败：%v", ErrDumpCorrupted, key, err)
+		}
+		decodedKey, err := codec.DecodeKey(string(key))
+		if err != nil {
+			return nil, 0, fmt.Errorf("解码键：%s失败：%w", key, err)
+		}
+		decoded, err := codec.Decode(value)
+		if err != nil {
+			return nil, 0, fmt.Errorf("解码键：%s的值失败：%w", key, err)
+		}
+		entry := StoreEntry[K, V]{
+			Key:    decodedKey,
+			Value:  decoded,
+			Expiry: Expiry{TTL: time.Duration(ttl), Sliding: flags&dumpFlagSliding != 0},
+		}
+		if expireAt > 0 {
+			entry.ExpireAt = time.Unix(0, expireAt)
+		}
+		entries = append(entries, entry)
+	}
+	if reader.Len() > 0 {
+		return nil, 0, fmt.Errorf("%w：键值对之后还有%d字节", ErrDumpCorrupted, reader.Len())
+	}
+	return entries, checksum, nil
+}
+
+// Dump 把内存数据库某一时刻的全部内容转储到path 先写入临时文件 完成后再替换 不会留下写了一半的文件
+// 转储之间互斥 每次转储使用自己的临时文件 并发的转储不会写入同一个文件
+func (store *Store[K, V]) Dump(path string, codec Codec[K, V]) (*DumpInfo, error) {
+	store.dumpLock.Lock()
+	defer store.dumpLock.Unlock()
+	entries := store.Export()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("Store.Dump 创建目录失败：%w", err)
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("Store.Dump 创建临时文件失败：%w", err)
+	}
+	tmpPath := file.Name()
+	// CreateTemp创建的文件只有所有者可以读写 和之前的转储文件保持一样的权限
+	err = file.Chmod(0644)
+	var size int64
+	var checksum uint64
+	if err == nil {
+		size, checksum, err = writeDump(file, entries, codec)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("Store.Dump 写入转储文件：%s失败：%w", path, err)
+	}
+	info := &DumpInfo{Path: path, Keys: len(entries), Size: size, Checksum: fmt.Sprintf("%016x", checksum), Time: time.Now()}
+	log.Printf("已转储内存数据库到：%s 共%d个键值对 %d字节", path, info.Keys, info.Size)
+	return info, nil
+}
+
+// Load 校验转储文件的内容并用它替换内存数据库的全部内容 已经过期的键不会加载
+func (store *Store[K, V]) Load(r io.Reader, codec Codec[K, V]) (*DumpInfo, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("Store.Load 读取转储文件失败：%w", err)
+	}
+	entries, checksum, err := readDump(data, codec)
+	if err != nil {
+		return nil, fmt.Errorf("Store.Load 解析转储文件失败：%w", err)
+	}
+	store.Import(entries)
+	return &DumpInfo{Keys: store.Count(), Size: int64(len(data)), Checksum: fmt.Sprintf("%016x", checksum), Time: time.Now()}, nil
+}
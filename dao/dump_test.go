@@ -0,0 +1,142 @@
+package dao
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"node2/config"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDumpEntries 包含永不过期、绝对过期和滑动过期的键值对
+func testDumpEntries() []StoreEntry[string, string] {
+	expireAt := time.Unix(0, time.Now().Add(time.Hour).UnixNano())
+	return []StoreEntry[string, string]{
+		{Key: "never", Value: "1", Expiry: NoExpiry},
+		{Key: "absolute", Value: "2", ExpireAt: expireAt, Expiry: Expiry{TTL: time.Hour}},
+		{Key: "sliding", Value: "", ExpireAt: expireAt, Expiry: Expiry{TTL: time.Minute, Sliding: true}},
+	}
+}
+
+// encodeTestDump 把键值对编码成转储文件的内容
+func encodeTestDump(t *testing.T, entries []StoreEntry[string, string]) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	size, _, err := writeDump(&buf, entries, testStringCodec{})
+	if err != nil {
+		t.Fatalf("写入转储失败：%v", err)
+	}
+	if size != int64(buf.Len()) {
+		t.Fatalf("writeDump返回的长度：%d和实际写入的：%d不一致", size, buf.Len())
+	}
+	return buf.Bytes()
+}
+
+// resealDump 修改内容之后重新计算末尾的校验和 让解析走到校验和之后的检查
+func resealDump(body []byte) []byte {
+	data := append([]byte(nil), body...)
+	return binary.BigEndian.AppendUint64(data, crc64.Checksum(body, dumpCRCTable))
+}
+
+// TestDumpRoundTrip 写入的转储能原样读回 包括过期时间点、TTL和滑动过期标志
+func TestDumpRoundTrip(t *testing.T) {
+	entries := testDumpEntries()
+	data := encodeTestDump(t, entries)
+	decoded, checksum, err := readDump(data, testStringCodec{})
+	if err != nil {
+		t.Fatalf("读取转储失败：%v", err)
+	}
+	if want := binary.BigEndian.Uint64(data[len(data)-dumpChecksumSize:]); checksum != want {
+		t.Errorf("校验和是：%x 期望：%x", checksum, want)
+	}
+	if len(decoded) != len(entries) {
+		t.Fatalf("读回%d个键值对 期望%d个", len(decoded), len(entries))
+	}
+	for i, entry := range entries {
+		got := decoded[i]
+		if got.Key != entry.Key || got.Value != entry.Value || !got.ExpireAt.Equal(entry.ExpireAt) || got.Expiry != entry.Expiry {
+			t.Errorf("第%d个键值对读回：%+v 期望：%+v", i, got, entry)
+		}
+	}
+}
+
+// TestDumpRejectsCorruption 魔数不对、内容被截断、校验和不一致时都返回ErrDumpCorrupted
+func TestDumpRejectsCorruption(t *testing.T) {
+	data := encodeTestDump(t, testDumpEntries())
+	body := data[:len(data)-dumpChecksumSize]
+
+	badMagic := append([]byte(nil), body...)
+	badMagic[0] = 'X'
+	flippedCRC := append([]byte(nil), data...)
+	flippedCRC[len(flippedCRC)-1] ^= 0xff
+
+	cases := map[string][]byte{
+		"魔数不对":       resealDump(badMagic),
+		"截断后重新计算校验和": resealDump(body[:len(body)-3]),
+		"截断了末尾":      data[:len(data)-5],
+		"太短":         data[:4],
+		"校验和的一个字节翻转": flippedCRC,
+	}
+	for name, corrupted := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := readDump(corrupted, testStringCodec{}); !errors.Is(err, ErrDumpCorrupted) {
+				t.Fatalf("返回的错误：%v 不是ErrDumpCorrupted", err)
+			}
+		})
+	}
+}
+
+// TestConcurrentDumps 并发的转储不会写入同一个临时文件 最后的文件是完整的 也没有留下临时文件
+func TestConcurrentDumps(t *testing.T) {
+	store, err := NewStore[string, string](config.MemoryDBConfig{Capacity: 1000, EvictRatio: 0.1}, nil)
+	if err != nil {
+		t.Fatalf("创建内存数据库失败：%v", err)
+	}
+	for i := 0; i < 200; i++ {
+		store.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i), NoExpiry)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dump.mdb")
+
+	var dumps sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		dumps.Add(1)
+		go func() {
+			defer dumps.Done()
+			if _, err := store.Dump(path, testStringCodec{}); err != nil {
+				t.Errorf("转储失败：%v", err)
+			}
+		}()
+	}
+	dumps.Wait()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("打开转储文件失败：%v", err)
+	}
+	defer file.Close()
+	loaded, err := NewStore[string, string](config.MemoryDBConfig{Capacity: 1000, EvictRatio: 0.1}, nil)
+	if err != nil {
+		t.Fatalf("创建内存数据库失败：%v", err)
+	}
+	info, err := loaded.Load(file, testStringCodec{})
+	if err != nil {
+		t.Fatalf("加载并发转储的文件失败：%v", err)
+	}
+	if info.Keys != 200 {
+		t.Errorf("加载了%d个键值对 期望200个", info.Keys)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("读取目录失败：%v", err)
+	}
+	if len(files) != 1 {
+		t.Errorf("目录中有%d个文件 期望只有转储文件", len(files))
+	}
+}
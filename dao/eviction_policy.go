@@ -0,0 +1,343 @@
+package dao
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// 可选的内存淘汰策略
+const (
+	EvictionLRU         = "lru"          // 淘汰最久没有被访问的键
+	EvictionLFU         = "lfu"          // 淘汰访问频率最低的键 访问次数随时间衰减
+	Eviction2Q          = "2q"           // 新键先进入试用队列 再次访问才进入主队列 一次性的扫描不会挤掉热点键
+	EvictionVolatileTTL = "volatile-ttl" // 优先淘汰最快过期的键 没有设置过期时间的键按LRU淘汰
+	EvictionRandom      = "random"       // 随机淘汰
+)
+
+// evictionSamples 近似策略每次随机采样的键数量
+const evictionSamples = 5
+
+// EvictionPolicy 内存淘汰策略 每个分段有一个独立的实例 所有方法都在持有分段锁时调用 实现不需要加锁
+type EvictionPolicy[K comparable] interface {
+	// OnAdd 添加了新键 expireAt为零值表示永不过期
+	OnAdd(key K, expireAt time.Time)
+	// OnAccess 读取或者修改了已有的键 expireAt是键现在的过期时间
+	OnAccess(key K, expireAt time.Time)
+	// OnRemove 键被删除 evicted表示是不是被淘汰的
+	OnRemove(key K, evicted bool)
+	// Victim 返回这个分段中下一个应该淘汰的键 rank用来在分段之间比较 越小越先淘汰 没有键时ok为false
+	Victim() (key K, rank float64, ok bool)
+}
+
+// NewEvictionPolicyFactory 根据策略名称返回创建淘汰策略的函数 每个分段调用一次
+// lfuHalfLife是LFU访问次数衰减一半的时间
+func NewEvictionPolicyFactory[K comparable](name string, lfuHalfLife time.Duration) (func() EvictionPolicy[K], error) {
+	switch name {
+	case EvictionLRU, "":
+		return func() EvictionPolicy[K] { return newLRUPolicy[K]() }, nil
+	case EvictionLFU:
+		if lfuHalfLife <= 0 {
+			return nil, fmt.Errorf("LFU的衰减半衰期必须大于0：%v", lfuHalfLife)
+		}
+		return func() EvictionPolicy[K] { return newLFUPolicy[K](lfuHalfLife) }, nil
+	case Eviction2Q:
+		return func() EvictionPolicy[K] { return newTwoQueuePolicy[K]() }, nil
+	case EvictionVolatileTTL:
+		return func() EvictionPolicy[K] { return newVolatileTTLPolicy[K]() }, nil
+	case EvictionRandom:
+		return func() EvictionPolicy[K] { return newRandomPolicy[K]() }, nil
+	default:
+		return nil, fmt.Errorf("未知的内存淘汰策略：%s 可选值：lru、lfu、2q、volatile-ttl、random", name)
+	}
+}
+
+// lruItem LRU链表中的一个键
+type lruItem[K comparable] struct {
+	key        K
+	lastAccess int64 // 最后一次访问的时间 纳秒
+}
+
+// lruPolicy 双向链表实现的LRU 链表头是最近访问的键
+type lruPolicy[K comparable] struct {
+	list  *list.List
+	items map[K]*list.Element
+}
+
+func newLRUPolicy[K comparable]() *lruPolicy[K] {
+	return &lruPolicy[K]{list: list.New(), items: make(map[K]*list.Element)}
+}
+
+func (p *lruPolicy[K]) OnAdd(key K, expireAt time.Time) {
+	p.items[key] = p.list.PushFront(&lruItem[K]{key: key, lastAccess: time.Now().UnixNano()})
+}
+
+func (p *lruPolicy[K]) OnAccess(key K, expireAt time.Time) {
+	if element, exists := p.items[key]; exists {
+		element.Value.(*lruItem[K]).lastAccess = time.Now().UnixNano()
+		p.list.MoveToFront(element)
+	}
+}
+
+func (p *lruPolicy[K]) OnRemove(key K, evicted bool) {
+	if element, exists := p.items[key]; exists {
+		p.list.Remove(element)
+		delete(p.items, key)
+	}
+}
+
+func (p *lruPolicy[K]) Victim() (K, float64, bool) {
+	back := p.list.Back()
+	if back == nil {
+		var zero K
+		return zero, 0, false
+	}
+	item := back.Value.(*lruItem[K])
+	return item.key, float64(item.lastAccess), true
+}
+
+// lfuItem LFU中一个键的访问次数
+type lfuItem struct {
+	count float64
+	last  time.Time // 上一次衰减访问次数的时间
+}
+
+// lfuPolicy 访问次数按半衰期指数衰减的近似LFU 淘汰时随机采样几个键 淘汰其中访问次数最低的
+// 很久以前的热点键会逐渐变冷 不会一直占着内存
+type lfuPolicy[K comparable] struct {
+	halfLife time.Duration
+	items    map[K]*lfuItem
+}
+
+func newLFUPolicy[K comparable](halfLife time.Duration) *lfuPolicy[K] {
+	return &lfuPolicy[K]{halfLife: halfLife, items: make(map[K]*lfuItem)}
+}
+
+// decayed 返回衰减到now时的访问次数
+func (p *lfuPolicy[K]) decayed(item *lfuItem, now time.Time) float64 {
+	elapsed := now.Sub(item.last)
+	if elapsed <= 0 {
+		return item.count
+	}
+	return item.count * math.Exp2(-float64(elapsed)/float64(p.halfLife))
+}
+
+func (p *lfuPolicy[K]) OnAdd(key K, expireAt time.Time) {
+	p.items[key] = &lfuItem{count: 1, last: time.Now()}
+}
+
+func (p *lfuPolicy[K]) OnAccess(key K, expireAt time.Time) {
+	if item, exists := p.items[key]; exists {
+		now := time.Now()
+		item.count = p.decayed(item, now) + 1
+		item.last = now
+	}
+}
+
+func (p *lfuPolicy[K]) OnRemove(key K, evicted bool) {
+	delete(p.items, key)
+}
+
+func (p *lfuPolicy[K]) Victim() (K, float64, bool) {
+	now := time.Now()
+	var victim K
+	rank, sampled := 0.0, 0
+	// map的遍历顺序是随机的 前几个键就是随机样本
+	for key, item := range p.items {
+		if count := p.decayed(item, now); sampled == 0 || count < rank {
+			victim, rank = key, count
+		}
+		if sampled++; sampled >= evictionSamples {
+			break
+		}
+	}
+	return victim, rank, sampled > 0
+}
+
+// twoQueuePolicy 简化的2Q 新键进入试用队列a1in 再次被访问时进入主队列am
+// 从试用队列淘汰的键会记在幽灵队列a1out中 在幽灵队列中的键再次添加时直接进入主队列
+// 只访问一次的键(例如一次性的全表扫描)只会在试用队列中停留 不会挤掉主队列中的热点键
+type twoQueuePolicy[K comparable] struct {
+	a1in   *list.List // 试用队列 先进先出
+	am     *list.List // 主队列 LRU
+	a1out  *list.List // 幽灵队列 只记录键
+	items  map[K]*list.Element
+	inA1in map[K]bool
+	ghosts map[K]*list.Element
+}
+
+func newTwoQueuePolicy[K comparable]() *twoQueuePolicy[K] {
+	return &twoQueuePolicy[K]{
+		a1in:   list.New(),
+		am:     list.New(),
+		a1out:  list.New(),
+		items:  make(map[K]*list.Element),
+		inA1in: make(map[K]bool),
+		ghosts: make(map[K]*list.Element),
+	}
+}
+
+// a1inLimit 试用队列最多占四分之一的键 幽灵队列最多记住一半数量的键
+func (p *twoQueuePolicy[K]) a1inLimit() int {
+	return max(1, len(p.items)/4)
+}
+
+func (p *twoQueuePolicy[K]) ghostLimit() int {
+	return max(1, len(p.items)/2)
+}
+
+func (p *twoQueuePolicy[K]) OnAdd(key K, expireAt time.Time) {
+	item := &lruItem[K]{key: key, lastAccess: time.Now().UnixNano()}
+	if ghost, exists := p.ghosts[key]; exists {
+		p.a1out.Remove(ghost)
+		delete(p.ghosts, key)
+		p.items[key] = p.am.PushFront(item)
+		return
+	}
+	p.items[key] = p.a1in.PushFront(item)
+	p.inA1in[key] = true
+}
+
+func (p *twoQueuePolicy[K]) OnAccess(key K, expireAt time.Time) {
+	element, exists := p.items[key]
+	if !exists {
+		return
+	}
+	item := element.Value.(*lruItem[K])
+	item.lastAccess = time.Now().UnixNano()
+	if p.inA1in[key] {
+		p.a1in.Remove(element)
+		delete(p.inA1in, key)
+		p.items[key] = p.am.PushFront(item)
+		return
+	}
+	p.am.MoveToFront(element)
+}
+
+func (p *twoQueuePolicy[K]) OnRemove(key K, evicted bool) {
+	element, exists := p.items[key]
+	if !exists {
+		return
+	}
+	delete(p.items, key)
+	if !p.inA1in[key] {
+		p.am.Remove(element)
+		return
+	}
+	p.a1in.Remove(element)
+	delete(p.inA1in, key)
+	if evicted {
+		p.ghosts[key] = p.a1out.PushFront(key)
+		for p.a1out.Len() > p.ghostLimit() {
+			oldest := p.a1out.Back()
+			p.a1out.Remove(oldest)
+			delete(p.ghosts, oldest.Value.(K))
+		}
+	}
+}
+
+func (p *twoQueuePolicy[K]) Victim() (K, float64, bool) {
+	queue := p.am
+	if p.a1in.Len() > p.a1inLimit() || p.am.Len() == 0 {
+		queue = p.a1in
+	}
+	back := queue.Back()
+	if back == nil {
+		var zero K
+		return zero, 0, false
+	}
+	item := back.Value.(*lruItem[K])
+	return item.key, float64(item.lastAccess), true
+}
+
+// noTTLRank 没有设置过期时间的键的排序基数 比任何过期时间都大 所以总是先淘汰设置了过期时间的键
+const noTTLRank = 1e19
+
+// volatileTTLPolicy 优先淘汰最快过期的键 随机采样几个设置了过期时间的键 淘汰其中最早过期的
+// 没有设置了过期时间的键时按LRU淘汰 保证容量限制仍然有效
+type volatileTTLPolicy[K comparable] struct {
+	volatile map[K]time.Time
+	lru      *lruPolicy[K]
+}
+
+func newVolatileTTLPolicy[K comparable]() *volatileTTLPolicy[K] {
+	return &volatileTTLPolicy[K]{volatile: make(map[K]time.Time), lru: newLRUPolicy[K]()}
+}
+
+func (p *volatileTTLPolicy[K]) OnAdd(key K, expireAt time.Time) {
+	p.lru.OnAdd(key, expireAt)
+	if !expireAt.IsZero() {
+		p.volatile[key] = expireAt
+	}
+}
+
+func (p *volatileTTLPolicy[K]) OnAccess(key K, expireAt time.Time) {
+	p.lru.OnAccess(key, expireAt)
+	if expireAt.IsZero() {
+		delete(p.volatile, key)
+	} else {
+		p.volatile[key] = expireAt
+	}
+}
+
+func (p *volatileTTLPolicy[K]) OnRemove(key K, evicted bool) {
+	p.lru.OnRemove(key, evicted)
+	delete(p.volatile, key)
+}
+
+func (p *volatileTTLPolicy[K]) Victim() (K, float64, bool) {
+	var victim K
+	rank, sampled := 0.0, 0
+	for key, expireAt := range p.volatile {
+		if r := float64(expireAt.UnixNano()); sampled == 0 || r < rank {
+			victim, rank = key, r
+		}
+		if sampled++; sampled >= evictionSamples {
+			break
+		}
+	}
+	if sampled > 0 {
+		return victim, rank, true
+	}
+	key, lruRank, ok := p.lru.Victim()
+	return key, noTTLRank + lruRank, ok
+}
+
+// randomPolicy 随机淘汰 用切片保存所有键 删除时和最后一个键交换 所有操作都是O(1)
+type randomPolicy[K comparable] struct {
+	keys  []K
+	index map[K]int
+}
+
+func newRandomPolicy[K comparable]() *randomPolicy[K] {
+	return &randomPolicy[K]{index: make(map[K]int)}
+}
+
+func (p *randomPolicy[K]) OnAdd(key K, expireAt time.Time) {
+	p.index[key] = len(p.keys)
+	p.keys = append(p.keys, key)
+}
+
+func (p *randomPolicy[K]) OnAccess(key K, expireAt time.Time) {}
+
+func (p *randomPolicy[K]) OnRemove(key K, evicted bool) {
+	i, exists := p.index[key]
+	if !exists {
+		return
+	}
+	last := len(p.keys) - 1
+	p.keys[i] = p.keys[last]
+	p.index[p.keys[i]] = i
+	p.keys = p.keys[:last]
+	delete(p.index, key)
+}
+
+func (p *randomPolicy[K]) Victim() (K, float64, bool) {
+	if len(p.keys) == 0 {
+		var zero K
+		return zero, 0, false
+	}
+	return p.keys[rand.Intn(len(p.keys))], rand.Float64(), true
+}
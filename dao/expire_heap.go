@@ -0,0 +1,35 @@
+package dao
+
+// expireHeap 按过期时间排列的最小堆 堆顶是最早过期的键 只保存设置了过期时间的键
+// 实现container/heap.Interface 键在堆中的位置记录在memoryEntry.heapIndex中 修改过期时间时可以直接调整位置
+type expireHeap[K comparable, V any] []*memoryEntry[K, V]
+
+func (h expireHeap[K, V]) Len() int {
+	return len(h)
+}
+
+func (h expireHeap[K, V]) Less(i, j int) bool {
+	return h[i].expireAt.Before(h[j].expireAt)
+}
+
+func (h expireHeap[K, V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *expireHeap[K, V]) Push(x interface{}) {
+	entry := x.(*memoryEntry[K, V])
+	entry.heapIndex = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expireHeap[K, V]) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.heapIndex = -1
+	*h = old[:n-1]
+	return entry
+}
@@ -1,193 +1,669 @@
 package dao
 
 import (
-	"container/list"
+	"container/heap"
+	"fmt"
+	"hash/fnv"
 	"log"
-	"math/rand"
+	"node2/config"
+	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var Expiration = time.Hour
+// DefaultShardCount 默认的分段数量
+const DefaultShardCount = 16
 
-// MemoryDBDao 定义内存数据库结构体
-type MemoryDBDao struct {
-	dataMap    map[string]interface{}
-	expires    map[string]time.Time
-	rwLock     sync.RWMutex
-	capacity   int                      // 最大内存容量（键值对数量）
-	lruList    *list.List               // 双向链表，用于实现 LRU 内存淘汰
-	lruMap     map[string]*list.Element //键和链表元素的映射map
-	evictRatio float64                  // 淘汰比例
+// 主动过期的参数 每一轮在每个分段检查最早过期的activeExpireSamples个键
+// 一轮中过期的键超过检查数量的activeExpireThreshold时 说明还有很多过期的键 在时间预算内继续下一轮
+const (
+	activeExpireSamples   = 20
+	activeExpireThreshold = 0.25
+)
+
+// Expiry 键的过期设置 TTL小于等于0表示永不过期
+// Sliding为false时键在写入TTL之后过期 访问不会延长 为true时每次访问后重新计时 连续TTL没有访问才过期
+type Expiry struct {
+	TTL     time.Duration
+	Sliding bool
+}
+
+// NoExpiry 永不过期
+var NoExpiry = Expiry{}
+
+// memoryEntry 内存数据库中的一个键值对
+type memoryEntry[K comparable, V any] struct {
+	key       K
+	value     V
+	expireAt  time.Time // 零值表示永不过期
+	expiry    Expiry    // 键自己的过期设置 滑动过期时用它的TTL重新计时
+	seq       uint64    // 最后一次访问的全局序号 导出时按它排列出LRU顺序
+	size      int64     // 估算的内存占用字节数
+	heapIndex int       // 在所属分段过期堆中的位置 没有设置过期时间时为-1
+	scanId    uint64    // 创建键时分配的递增序号 SCAN按它的顺序遍历分段 键存在期间不会改变
+}
+
+// memoryShard 内存数据库的一个分段 每个分段有自己的锁、淘汰策略和过期键集合
+// 读取也会修改淘汰策略和过期时间 所以用互斥锁而不是读写锁
+type memoryShard[K comparable, V any] struct {
+	mu      sync.Mutex
+	entries map[K]*memoryEntry[K, V]
+	expires expireHeap[K, V] // 设置了过期时间的键 按过期时间排列
+	policy  EvictionPolicy[K]
+	index   secondaryIndex[K] // 二级索引 只包含这个分段的键
+	scan    scanOrder[K, V]   // 按scanId排列的键 用于SCAN
+}
+
+// MemoryDBStats 内存数据库的统计数据 用来比较不同淘汰策略的效果
+type MemoryDBStats struct {
+	Policy        string    `json:"policy"`
+	Keys          int       `json:"keys"`
+	Capacity      int       `json:"capacity"`
+	Bytes         int64     `json:"bytes"`         // 所有键值对估算的内存占用字节数
+	MaxMemory     int64     `json:"max_memory"`    // 内存占用上限 0表示按键的数量限制容量
+	HeapInuse     uint64    `json:"heap_inuse"`    // 进程堆实际使用的字节数
+	Fragmentation float64   `json:"fragmentation"` // 堆实际使用的字节数和估算字节数的比值 越大说明额外开销和碎片越多
+	Hits          uint64    `json:"hits"`
+	Misses        uint64    `json:"misses"`
+	HitRate       float64   `json:"hit_rate"`
+	Evictions     uint64    `json:"evictions"` // 因为容量不够被淘汰的键
+	Expired       uint64    `json:"expired"`   // 因为过期被删除的键
+	AOF           *AOFStats `json:"aof"`       // 没有开启AOF时为null
+}
+
+// Store 定义键类型为K、值类型为V的内存数据库结构体 键按哈希分到多个分段 不同分段的读写可以并发执行
+// 容量是所有分段共享的 超过容量时比较所有分段的淘汰策略给出的候选键 淘汰其中最应该淘汰的
+// 保存的是值的副本 调用者之后修改自己的值或者读取到的值都不会影响内存数据库 所以内存数据库中的值不会被原地修改
+type Store[K comparable, V any] struct {
+	shards     []*memoryShard[K, V]
+	count      atomic.Int64  // 所有分段的键值对数量
+	bytes      atomic.Int64  // 所有分段的键值对估算的内存占用字节数
+	accessSeq  atomic.Uint64 // 全局访问序号 每次访问键时递增
+	evictLock  sync.Mutex    // 同一时刻只有一个协程执行淘汰
+	capacity   int           // 最大内存容量（键值对数量）
+	evictRatio float64       // 淘汰比例
+	maxMemory  int64         // 内存占用上限 大于0时按字节数限制容量 不再限制键的数量
+	highBytes  int64         // 超过高水位开始淘汰
+	lowBytes   int64         // 淘汰到低水位为止
+	policyName string
+	newPolicy  func() EvictionPolicy[K]
+	clone      func(V) V // 复制值 为nil时值本身是不可变的 直接保存
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+	evictions  atomic.Uint64
+	expired    atomic.Uint64
+	expireNext atomic.Uint64           // 下一次主动过期从哪个分段开始 时间预算用完时下一次从没有检查的分段继续
+	aof        *aofWriter[K, V]        // 没有开启AOF时为nil 开启后不再修改
+	indexes    map[string]IndexFunc[V] // 二级索引 开始使用之后不再修改
+	lossSeq    atomic.Uint64           // 可能丢失数据的次数 淘汰、过期删除和导入时递增
+	completeAt atomic.Int64            // 确认包含全部数据时lossSeq的值 -1表示没有确认过
+	scanSeq    atomic.Uint64           // 分配scanId的全局序号
+	subsMu     sync.RWMutex            // 保护subs和subSeq
+	subs       map[uint64]*Subscription[K]
+	subSeq     uint64
+	subCount   atomic.Int64 // 订阅者的数量 没有订阅者时发出事件不需要加锁
+	dumpLock   sync.Mutex   // 同一时刻只有一个转储 后开始的转储后替换文件
 }
 
-// NewMemoryDBDao 初始化内存数据库实例
-func NewMemoryDBDao(capacity int, evictRatio float64) *MemoryDBDao {
-	mdb := &MemoryDBDao{
-		dataMap:    make(map[string]interface{}),
-		expires:    make(map[string]time.Time),
-		capacity:   capacity,
-		lruList:    list.New(),
-		lruMap:     make(map[string]*list.Element),
-		evictRatio: evictRatio,
+// NewStore 初始化内存数据库实例 分段数量小于1时使用默认的分段数量
+// clone用来复制值 写入时保存传入的值的副本 读取时返回副本 值本身不可变(例如字符串)时可以为nil
+func NewStore[K comparable, V any](cfg config.MemoryDBConfig, clone func(V) V) (*Store[K, V], error) {
+	newPolicy, err := NewEvictionPolicyFactory[K](cfg.EvictionPolicy, cfg.LFUHalfLife)
+	if err != nil {
+		return nil, err
+	}
+	shardCount := cfg.Shards
+	if shardCount < 1 {
+		shardCount = DefaultShardCount
 	}
-	return mdb
+	policyName := cfg.EvictionPolicy
+	if policyName == "" {
+		policyName = EvictionLRU
+	}
+	store := &Store[K, V]{
+		shards:     make([]*memoryShard[K, V], shardCount),
+		capacity:   cfg.Capacity,
+		evictRatio: cfg.EvictRatio,
+		maxMemory:  cfg.MaxMemory,
+		highBytes:  int64(float64(cfg.MaxMemory) * cfg.HighWatermark),
+		lowBytes:   int64(float64(cfg.MaxMemory) * cfg.LowWatermark),
+		policyName: policyName,
+		newPolicy:  newPolicy,
+		clone:      clone,
+	}
+	for i := range store.shards {
+		store.shards[i] = store.newMemoryShard()
+	}
+	store.completeAt.Store(-1)
+	return store, nil
 }
 
-// Set 设置键值对并设置过期时间
-func (mdb *MemoryDBDao) Set(key string, value interface{}, expiration int64) {
-	nanoseconds := expiration * int64(time.Second)
-	duration := time.Duration(nanoseconds)
-	mdb.rwLock.Lock()
-	defer mdb.rwLock.Unlock()
+// newMemoryShard 创建一个空的分段
+func (store *Store[K, V]) newMemoryShard() *memoryShard[K, V] {
+	shard := &memoryShard[K, V]{
+		entries: make(map[K]*memoryEntry[K, V]),
+		policy:  store.newPolicy(),
+		index:   make(secondaryIndex[K]),
+	}
+	for name := range store.indexes {
+		shard.index[name] = make(map[string]map[K]struct{})
+	}
+	return shard
+}
 
-	//只在添加键时断内存满没满 满了就执行内存淘汰 再添加键 其余操作只把键添加到链表头 然后淘汰从链表尾选取一部分淘汰
-	if len(mdb.dataMap) >= mdb.capacity {
-		mdb.evict()
+// copy 返回值的副本 没有设置clone时返回值本身
+func (store *Store[K, V]) copy(value V) V {
+	if store.clone == nil {
+		return value
 	}
-	element := mdb.lruList.PushFront(key)
-	mdb.lruMap[key] = element
+	return store.clone(value)
+}
 
-	// 如果过期时间大于 0 就设置过期时间，如果过期时间为 0 说明这个键永不过期
-	if expiration > 0 {
-		mdb.expires[key] = time.Now().Add(duration)
-		mdb.dataMap[key] = value
-		log.Printf("已添加键：%s 值：%v 过期时间：%v", key, value, mdb.expires[key])
+// setExpireAt 修改键的过期时间并调整它在过期堆中的位置 expireAt为零值表示永不过期 调用者需要持有分段的锁
+func (shard *memoryShard[K, V]) setExpireAt(entry *memoryEntry[K, V], expireAt time.Time) {
+	entry.expireAt = expireAt
+	switch {
+	case expireAt.IsZero():
+		if entry.heapIndex >= 0 {
+			heap.Remove(&shard.expires, entry.heapIndex)
+		}
+	case entry.heapIndex >= 0:
+		heap.Fix(&shard.expires, entry.heapIndex)
+	default:
+		heap.Push(&shard.expires, entry)
+	}
+}
+
+// shard 返回键所属的分段
+func (store *Store[K, V]) shard(key K) *memoryShard[K, V] {
+	return store.shards[store.shardIndex(key)]
+}
+
+// shardIndex 返回键所属分段的下标 字符串键直接哈希 其他类型的键先格式化成字符串再哈希
+func (store *Store[K, V]) shardIndex(key K) int {
+	h := fnv.New32a()
+	if k, ok := any(key).(string); ok {
+		h.Write([]byte(k))
 	} else {
-		mdb.dataMap[key] = value
-		log.Printf("已添加键：%s 值：%v", key, value)
+		fmt.Fprint(h, key)
 	}
+	return int(h.Sum32() % uint32(len(store.shards)))
 }
 
-// Get 获取键对应的值
-func (mdb *MemoryDBDao) Get(key string) (interface{}, bool) {
-	mdb.rwLock.RLock()
-	defer mdb.rwLock.RUnlock()
-	// 先判断过期时间是否存在 如果存在 那键肯定存在 再判断是否过期就行了
-	expire, exists := mdb.expires[key]
-	if exists {
-		if time.Now().After(expire) {
-			mdb.deleteKey(key)
-			log.Printf("键：%s 在：%v 时已经过期", key, expire)
-			return nil, false
-		}
-		mdb.expires[key] = time.Now().Add(Expiration)
-		log.Printf("已延长键：%s 过期时间至：%v", key, mdb.expires[key])
-		// 将该键移到 LRU 链表头部
-		mdb.lruList.MoveToFront(mdb.lruMap[key])
-		return mdb.dataMap[key], true
-	}
-	//如果过期时间不存在 就判断键是否存在
-	value, exists := mdb.dataMap[key]
+// Set 保存值的副本并按expiry重新设置过期时间
+func (store *Store[K, V]) Set(key K, value V, expiry Expiry) {
+	store.set(key, store.copy(value), expiry, time.Time{})
+}
+
+// SetExpireAt 保存值的副本 按expiry设置过期方式 但是在expireAt过期而不是从现在开始计时 expireAt为零值时和Set相同
+// 用于从其他存储加载时沿用剩余的过期时间
+func (store *Store[K, V]) SetExpireAt(key K, value V, expiry Expiry, expireAt time.Time) {
+	store.set(key, store.copy(value), expiry, expireAt)
+}
+
+// set 设置键值对 value直接保存不再复制 expireAt不是零值时直接使用这个过期时间点 否则从现在开始按expiry计时
+func (store *Store[K, V]) set(key K, value V, expiry Expiry, expireAt time.Time) {
+	if expiry.TTL <= 0 {
+		expiry = NoExpiry
+	}
+	size := estimateSize(key, value)
+	shard := store.shard(key)
+	shard.mu.Lock()
+	entry, exists := shard.entries[key]
+	if !exists {
+		entry = &memoryEntry[K, V]{key: key, heapIndex: -1, scanId: store.scanSeq.Add(1)}
+		shard.scan.add(entry)
+		shard.entries[key] = entry
+		store.count.Add(1)
+	} else {
+		store.indexEntry(shard, key, entry.value, false)
+	}
+	store.indexEntry(shard, key, value, true)
+	store.bytes.Add(size - entry.size)
+	entry.size = size
+	entry.value = value
+	entry.seq = store.accessSeq.Add(1)
+
+	// 如果过期时间大于 0 就设置过期时间，如果过期时间为 0 说明这个键永不过期
+	entry.expiry = expiry
+	if expiry.TTL > 0 {
+		if expireAt.IsZero() {
+			expireAt = time.Now().Add(expiry.TTL)
+		}
+		shard.setExpireAt(entry, expireAt)
+		log.Printf("已添加键：%v 值：%v 过期时间：%v", key, value, entry.expireAt)
+	} else {
+		shard.setExpireAt(entry, time.Time{})
+		log.Printf("已添加键：%v 值：%v", key, value)
+	}
 	if exists {
-		// 将该键移到 LRU 链表头部
-		mdb.lruList.MoveToFront(mdb.lruMap[key])
+		shard.policy.OnAccess(key, entry.expireAt)
+		store.publish(key, EventUpdate, "")
+	} else {
+		shard.policy.OnAdd(key, entry.expireAt)
+		store.publish(key, EventSet, "")
+	}
+	store.logSet(entry)
+	shard.mu.Unlock()
+
+	// 淘汰时不能持有任何分段的锁
+	if store.overLimit() {
+		store.evict()
 	}
-	return value, exists
 }
 
-// Update 更新键对应的值
-func (mdb *MemoryDBDao) Update(key string, value interface{}) bool {
-	mdb.rwLock.Lock()
-	defer mdb.rwLock.Unlock()
-	//先判断过期时间是否存在 如果存在 那键肯定存在 再判断是否过期 不过期就更新
-	expire, exists := mdb.expires[key]
-	if exists {
-		if time.Now().After(expire) {
-			mdb.deleteKey(key)
-			log.Printf("键：%s 在：%v 时已经过期", key, expire)
+// Get 获取键对应的值的副本
+func (store *Store[K, V]) Get(key K) (V, bool) {
+	var zero V
+	shard := store.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry, exists := shard.entries[key]
+	if !exists {
+		store.misses.Add(1)
+		return zero, false
+	}
+	// 先判断过期时间是否存在 如果存在再判断是否过期
+	if !entry.expireAt.IsZero() {
+		if time.Now().After(entry.expireAt) {
+			store.expireEntry(shard, entry)
+			store.misses.Add(1)
+			log.Printf("键：%v 在：%v 时已经过期", key, entry.expireAt)
+			return zero, false
+		}
+		// 只有滑动过期的键访问后重新计时
+		if entry.expiry.Sliding {
+			shard.setExpireAt(entry, time.Now().Add(entry.expiry.TTL))
+			log.Printf("已延长键：%v 过期时间至：%v", key, entry.expireAt)
+		}
+	}
+	// 通知淘汰策略该键被访问了
+	shard.policy.OnAccess(key, entry.expireAt)
+	entry.seq = store.accessSeq.Add(1)
+	store.hits.Add(1)
+	return store.copy(entry.value), true
+}
+
+// Update 用值的副本更新键对应的值
+func (store *Store[K, V]) Update(key K, value V) bool {
+	if !store.update(key, store.copy(value)) {
+		return false
+	}
+	// 新的值可能更大 淘汰时不能持有任何分段的锁
+	if store.overLimit() {
+		store.evict()
+	}
+	return true
+}
+
+// update 在分段锁内更新键对应的值
+func (store *Store[K, V]) update(key K, value V) bool {
+	size := estimateSize(key, value)
+	shard := store.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry, exists := shard.entries[key]
+	if !exists {
+		log.Printf("不存在键：%v", key)
+		return false
+	}
+	//先判断过期时间是否存在 如果存在再判断是否过期 不过期就更新
+	if !entry.expireAt.IsZero() {
+		if time.Now().After(entry.expireAt) {
+			store.expireEntry(shard, entry)
+			log.Printf("键：%v 在：%v 时已经过期", key, entry.expireAt)
 			return false
 		}
-		mdb.expires[key] = time.Now().Add(Expiration)
-		log.Printf("已延长键：%s 过期时间至：%v", key, mdb.expires[key])
-		mdb.dataMap[key] = value
-		log.Printf("修改键：%s 的值为：%v", key, mdb.dataMap[key])
-		// 将该键移到 LRU 链表头部
-		mdb.lruList.MoveToFront(mdb.lruMap[key])
-		return true
+		// 只有滑动过期的键访问后重新计时
+		if entry.expiry.Sliding {
+			shard.setExpireAt(entry, time.Now().Add(entry.expiry.TTL))
+			log.Printf("已延长键：%v 过期时间至：%v", key, entry.expireAt)
+		}
 	}
-	//如果过期时间不存在 就判断键是否存在 再更新
-	if _, exists = mdb.dataMap[key]; exists {
-		mdb.dataMap[key] = value
-		log.Printf("修改键：%s 的值为：%v", key, mdb.dataMap[key])
-		// 将该键移到 LRU 链表头部
-		mdb.lruList.MoveToFront(mdb.lruMap[key])
-		return true
+	store.indexEntry(shard, key, entry.value, false)
+	store.indexEntry(shard, key, value, true)
+	store.bytes.Add(size - entry.size)
+	entry.size = size
+	entry.value = value
+	log.Printf("修改键：%v 的值为：%v", key, value)
+	// 通知淘汰策略该键被访问了
+	shard.policy.OnAccess(key, entry.expireAt)
+	entry.seq = store.accessSeq.Add(1)
+	store.publish(key, EventUpdate, "")
+	store.logSet(entry)
+	return true
+}
+
+// TTL 返回键剩余的过期时间和过期设置 永不过期的键剩余时间为-1 不算一次访问 不会延长滑动过期的时间
+func (store *Store[K, V]) TTL(key K) (time.Duration, Expiry, bool) {
+	shard := store.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry, exists := shard.entries[key]
+	if !exists {
+		return 0, NoExpiry, false
 	}
-	log.Printf("不存在键：%s", key)
-	return false
+	if entry.expireAt.IsZero() {
+		return -1, entry.expiry, true
+	}
+	remaining := time.Until(entry.expireAt)
+	if remaining < 0 {
+		store.expireEntry(shard, entry)
+		log.Printf("键：%v 在：%v 时已经过期", key, entry.expireAt)
+		return 0, NoExpiry, false
+	}
+	return remaining, entry.expiry, true
 }
 
 // Delete 删除指定键
-func (mdb *MemoryDBDao) Delete(key string) {
-	mdb.rwLock.Lock()
-	defer mdb.rwLock.Unlock()
-	mdb.deleteKey(key)
-	log.Printf("删除键: %s", key)
+func (store *Store[K, V]) Delete(key K) {
+	shard := store.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if entry, exists := shard.entries[key]; exists {
+		store.deleteEntry(shard, entry, false)
+		store.publish(key, EventDelete, "")
+	}
+	log.Printf("删除键: %v", key)
 }
 
 // Count 获取数据库中键值对的数量
-func (mdb *MemoryDBDao) Count() int {
-	mdb.rwLock.RLock()
-	defer mdb.rwLock.RUnlock()
-	return len(mdb.dataMap)
-}
-
-// deleteKey 添加一个不加锁的内部的删除方法  删除过期键和内存淘汰有用
-func (mdb *MemoryDBDao) deleteKey(key string) {
-	delete(mdb.dataMap, key)
-	if _, exists := mdb.expires[key]; exists {
-		delete(mdb.expires, key)
-	}
-
-	// 从 LRU 链表和映射中移除
-	if element, exists := mdb.lruMap[key]; exists {
-		mdb.lruList.Remove(element)
-		delete(mdb.lruMap, key)
-	}
-}
-
-// PeriodicDelete 定期删除过期键
-func (mdb *MemoryDBDao) PeriodicDelete(examineSize int) {
-	mdb.rwLock.Lock()
-	defer mdb.rwLock.Unlock()
-	//先把所有有过期时间的键取出来
-	keys := make([]string, 0, len(mdb.expires))
-	for key := range mdb.expires {
-		keys = append(keys, key)
-	}
-	// 随机选择一定数量的键进行检查
-	if len(keys) > 0 {
-		if len(keys) < examineSize {
-			examineSize = len(keys)
-		}
-		//打乱顺序
-		rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
-		for _, key := range keys[:examineSize] {
-			// 检查键是否过期
-			if expire, exists := mdb.expires[key]; exists && time.Now().After(expire) {
-				mdb.deleteKey(key)
-				log.Printf("定期删除过期键：%s", key)
+func (store *Store[K, V]) Count() int {
+	return int(store.count.Load())
+}
+
+// Bytes 获取数据库中键值对估算的内存占用字节数
+func (store *Store[K, V]) Bytes() int64 {
+	return store.bytes.Load()
+}
+
+// Stats 返回内存数据库的统计数据
+// 堆的使用量包括进程中所有的对象 所以碎片率只是一个粗略的参考 数据量越大越接近真实情况
+func (store *Store[K, V]) Stats() MemoryDBStats {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	stats := MemoryDBStats{
+		Policy:    store.policyName,
+		Keys:      store.Count(),
+		Capacity:  store.capacity,
+		Bytes:     store.Bytes(),
+		MaxMemory: store.maxMemory,
+		HeapInuse: memStats.HeapInuse,
+		Hits:      store.hits.Load(),
+		Misses:    store.misses.Load(),
+		Evictions: store.evictions.Load(),
+		Expired:   store.expired.Load(),
+		AOF:       store.AOFStats(),
+	}
+	if stats.Bytes > 0 {
+		stats.Fragmentation = float64(stats.HeapInuse) / float64(stats.Bytes)
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+// deleteEntry 不加锁的内部删除方法 调用者需要持有分段的锁 删除过期键和内存淘汰有用 evicted表示是不是被淘汰的
+func (store *Store[K, V]) deleteEntry(shard *memoryShard[K, V], entry *memoryEntry[K, V], evicted bool) {
+	delete(shard.entries, entry.key)
+	if entry.heapIndex >= 0 {
+		heap.Remove(&shard.expires, entry.heapIndex)
+	}
+	store.indexEntry(shard, entry.key, entry.value, false)
+	shard.scan.remove(entry)
+	if evicted {
+		store.lossSeq.Add(1)
+	}
+	// 从淘汰策略中移除
+	shard.policy.OnRemove(entry.key, evicted)
+	store.count.Add(-1)
+	store.bytes.Add(-entry.size)
+	store.logDel(entry.key)
+}
+
+// expireEntry 删除过期的键 调用者需要持有分段的锁 过期的键在MySQL中仍然存在 所以也算丢失了数据
+func (store *Store[K, V]) expireEntry(shard *memoryShard[K, V], entry *memoryEntry[K, V]) {
+	store.deleteEntry(shard, entry, false)
+	store.expired.Add(1)
+	store.lossSeq.Add(1)
+	store.publish(entry.key, EventExpire, CauseTTL)
+}
+
+// overLimit 判断是否需要淘汰 设置了内存上限时看估算字节数是否超过高水位 否则看键的数量是否超过容量
+func (store *Store[K, V]) overLimit() bool {
+	if store.maxMemory > 0 {
+		return store.bytes.Load() > store.highBytes
+	}
+	return store.count.Load() > int64(store.capacity)
+}
+
+// ActiveExpireCycle 主动删除过期键 每一轮从每个分段的过期堆顶开始检查最多activeExpireSamples个键
+// 堆顶是最早过期的键 遇到没有过期的键时这个分段就不需要继续检查了
+// 一轮中过期的键超过检查数量的activeExpireThreshold时继续下一轮 直到用完budget 返回删除的键的数量
+func (store *Store[K, V]) ActiveExpireCycle(budget time.Duration) int {
+	deadline := time.Now().Add(budget)
+	total := 0
+	for {
+		sampled, expired := 0, 0
+		start := int(store.expireNext.Load())
+		for i := range store.shards {
+			if time.Now().After(deadline) {
+				// 下一次从没有检查的分段开始 避免排在后面的分段一直没有机会
+				store.expireNext.Store(uint64((start + i) % len(store.shards)))
+				return total + expired
 			}
+			s, e := store.expireShard(store.shards[(start+i)%len(store.shards)])
+			sampled += s
+			expired += e
+		}
+		total += expired
+		if sampled == 0 || float64(expired) <= float64(sampled)*activeExpireThreshold || time.Now().After(deadline) {
+			return total
+		}
+	}
+}
+
+// expireShard 检查一个分段过期堆顶的键 删除其中过期的 返回检查和删除的键的数量
+func (store *Store[K, V]) expireShard(shard *memoryShard[K, V]) (sampled int, expired int) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	now := time.Now()
+	for sampled < activeExpireSamples && len(shard.expires) > 0 {
+		entry := shard.expires[0]
+		sampled++
+		if !now.After(entry.expireAt) {
+			break
 		}
+		store.expireEntry(shard, entry)
+		expired++
+		log.Printf("主动删除过期键：%v", entry.key)
 	}
+	return sampled, expired
 }
 
-// evict 执行 LRU 淘汰
-func (mdb *MemoryDBDao) evict() {
-	log.Printf("内存已满(已存储超过：%d个键值对) 通过LRU机制淘汰：%f比例的键", mdb.capacity, mdb.evictRatio)
+// evict 执行内存淘汰 每次比较所有分段的淘汰策略给出的候选键 淘汰其中排序最靠前的
+func (store *Store[K, V]) evict() {
+	store.evictLock.Lock()
+	defer store.evictLock.Unlock()
+	// 其他协程可能已经淘汰过了
+	if !store.overLimit() {
+		return
+	}
+	if store.maxMemory > 0 {
+		log.Printf("内存占用：%d字节超过高水位：%d字节 通过%s策略淘汰到低水位：%d字节", store.bytes.Load(), store.highBytes, store.policyName, store.lowBytes)
+		for store.bytes.Load() > store.lowBytes {
+			if !store.evictOne() {
+				return
+			}
+		}
+		return
+	}
+	log.Printf("内存已满(已存储超过：%d个键值对) 通过%s策略淘汰：%f比例的键", store.capacity, store.policyName, store.evictRatio)
 	// 得到需要淘汰的键的数量
-	evictCount := int(float64(mdb.capacity) * mdb.evictRatio)
+	evictCount := int(float64(store.capacity) * store.evictRatio)
 	if evictCount < 1 {
 		log.Printf("淘汰比例过小 已删除最少一个键")
 		evictCount = 1
 	}
-	for i := 0; i < evictCount && mdb.lruList.Len() > 0; i++ {
-		// 获取链表尾部元素（最久未使用的键）
-		element := mdb.lruList.Back()
-		key := element.Value.(string)
-		// 删除该键 不能调用带锁的删除方法 不然会死锁 因为Set()方法已经加了写锁 故内部不需要再加锁
-		mdb.deleteKey(key)
-		log.Printf("LRU 淘汰键：%s", key)
+	for i := 0; i < evictCount; i++ {
+		if !store.evictOne() {
+			return
+		}
+	}
+}
+
+// evictOne 淘汰一个键 没有键可以淘汰时返回false
+// 先依次询问每个分段的候选键 再锁住候选键最靠前的分段淘汰它此时的候选键 分段之间的比较是近似的
+func (store *Store[K, V]) evictOne() bool {
+	var victim *memoryShard[K, V]
+	var victimRank float64
+	for _, shard := range store.shards {
+		shard.mu.Lock()
+		if _, rank, ok := shard.policy.Victim(); ok && (victim == nil || rank < victimRank) {
+			victim, victimRank = shard, rank
+		}
+		shard.mu.Unlock()
+	}
+	if victim == nil {
+		return false
+	}
+	victim.mu.Lock()
+	defer victim.mu.Unlock()
+	key, _, ok := victim.policy.Victim()
+	if !ok {
+		// 比较之后这个分段的键都被删除了 下一轮重新选择
+		return true
+	}
+	if entry, exists := victim.entries[key]; exists {
+		store.deleteEntry(victim, entry, true)
+		store.evictions.Add(1)
+		store.publish(key, EventEvict, store.policyName)
+		log.Printf("%s 淘汰键：%v", store.policyName, key)
+	}
+	return true
+}
+
+// StoreEntry 内存数据库中的一个键值对 用于导出和导入整个内存数据库
+type StoreEntry[K comparable, V any] struct {
+	Key      K
+	Value    V
+	ExpireAt time.Time // 零值表示永不过期
+	Expiry   Expiry    // 键自己的过期设置
+}
+
+// Export 导出内存数据库某一时刻的全部键值对的副本 按LRU顺序从最近访问到最久未访问排列 已过期的键不导出
+// 同时锁住所有分段 但是只复制键值对的引用 值在修改时整体替换而不会原地修改 所以引用指向的就是这一时刻的值
+// 相当于写时复制 复制值、排序、编码和写文件都在锁外进行 写入者只需要等待复制引用的时间
+func (store *Store[K, V]) Export() []StoreEntry[K, V] {
+	type exported struct {
+		entry StoreEntry[K, V]
+		seq   uint64
+	}
+	for _, shard := range store.shards {
+		shard.mu.Lock()
+	}
+	now := time.Now()
+	all := make([]exported, 0, store.Count())
+	for _, shard := range store.shards {
+		for _, entry := range shard.entries {
+			if !entry.expireAt.IsZero() && now.After(entry.expireAt) {
+				continue
+			}
+			all = append(all, exported{
+				entry: StoreEntry[K, V]{Key: entry.key, Value: entry.value, ExpireAt: entry.expireAt, Expiry: entry.expiry},
+				seq:   entry.seq,
+			})
+		}
+	}
+	for _, shard := range store.shards {
+		shard.mu.Unlock()
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].seq > all[j].seq })
+	entries := make([]StoreEntry[K, V], len(all))
+	for i := range all {
+		entries[i] = all[i].entry
+		entries[i].Value = store.copy(entries[i].Value)
+	}
+	return entries
+}
+
+// Import 用给定的键值对的副本替换内存数据库的全部内容 entries需要按LRU顺序从最近访问到最久未访问排列
+// 新的分段先在锁外构建好 再锁住所有分段一次性替换 读者不会看到恢复到一半的状态
+func (store *Store[K, V]) Import(entries []StoreEntry[K, V]) {
+	now := time.Now()
+	shards := make([]*memoryShard[K, V], len(store.shards))
+	for i := range shards {
+		shards[i] = store.newMemoryShard()
+	}
+	// 按顺序分配访问序号 排在前面的键序号更大
+	seq := store.accessSeq.Add(uint64(len(entries)))
+	count := 0
+	var bytes int64
+	imported := make([]*memoryEntry[K, V], 0, min(len(entries), store.capacity))
+	for _, entry := range entries {
+		// 超过容量的部分是最久未访问的键 直接丢弃
+		if store.maxMemory <= 0 && count >= store.capacity {
+			log.Printf("导入内存数据库时已达到容量：%d 丢弃剩余的键", store.capacity)
+			break
+		}
+		seq--
+		if !entry.ExpireAt.IsZero() && now.After(entry.ExpireAt) {
+			continue
+		}
+		shard := shards[store.shardIndex(entry.Key)]
+		if _, exists := shard.entries[entry.Key]; exists {
+			continue
+		}
+		size := estimateSize(entry.Key, entry.Value)
+		if store.maxMemory > 0 && bytes+size > store.highBytes {
+			log.Printf("导入内存数据库时已达到内存高水位：%d字节 丢弃剩余的键", store.highBytes)
+			break
+		}
+		bytes += size
+		e := &memoryEntry[K, V]{key: entry.Key, value: store.copy(entry.Value), expireAt: entry.ExpireAt, expiry: entry.Expiry, seq: seq, size: size, heapIndex: -1, scanId: store.scanSeq.Add(1)}
+		imported = append(imported, e)
+		shard.entries[entry.Key] = e
+		shard.scan.add(e)
+		store.indexEntry(shard, e.key, e.value, true)
+		if !entry.ExpireAt.IsZero() {
+			e.heapIndex = len(shard.expires)
+			shard.expires = append(shard.expires, e)
+		}
+		count++
+	}
+	for _, shard := range shards {
+		heap.Init(&shard.expires)
+	}
+	// 从最久未访问的键开始通知淘汰策略 恢复之前的访问顺序
+	for i := len(imported) - 1; i >= 0; i-- {
+		e := imported[i]
+		shards[store.shardIndex(e.key)].policy.OnAdd(e.key, e.expireAt)
+	}
+
+	for _, shard := range store.shards {
+		shard.mu.Lock()
+	}
+	for i, shard := range store.shards {
+		shard.entries = shards[i].entries
+		shard.expires = shards[i].expires
+		shard.policy = shards[i].policy
+		shard.index = shards[i].index
+		shard.scan = shards[i].scan
+	}
+	store.count.Store(int64(count))
+	// 导入的内容是否包含全部数据是不知道的 需要重新确认
+	store.lossSeq.Add(1)
+	store.bytes.Store(bytes)
+	// 不为每个键单独发出事件 订阅者收到后需要重新读取需要的键
+	var zero K
+	store.publish(zero, EventImport, "")
+	for _, shard := range store.shards {
+		shard.mu.Unlock()
 	}
+	log.Printf("已导入内存数据库 共%d个键值对 估算占用%d字节", count, bytes)
+	// AOF中的记录已经不是当前的内容了 重写成导入后的内容
+	store.requestAOFRewrite()
 }
@@ -0,0 +1,186 @@
+package dao
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"node2/config"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// 内存数据库每次读写都会打日志 测试时丢弃
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+var allEvictionPolicies = []string{EvictionLRU, EvictionLFU, Eviction2Q, EvictionVolatileTTL, EvictionRandom}
+
+// checkStoreInvariants 检查计数和估算字节数与各个分段中实际的键一致 并且没有超过容量
+func checkStoreInvariants(t *testing.T, store *Store[string, string]) {
+	t.Helper()
+	var count int
+	var bytes int64
+	for _, shard := range store.shards {
+		shard.mu.Lock()
+		count += len(shard.entries)
+		for key, entry := range shard.entries {
+			bytes += entry.size
+			if entry.key != key {
+				t.Errorf("键：%s的记录中保存的键是：%s", key, entry.key)
+			}
+			if entry.expireAt.IsZero() != (entry.heapIndex == -1) {
+				t.Errorf("键：%s的过期时间：%v和过期堆位置：%d不一致", key, entry.expireAt, entry.heapIndex)
+			}
+		}
+		if len(shard.expires) > len(shard.entries) {
+			t.Errorf("过期堆中有%d个键 分段只有%d个键", len(shard.expires), len(shard.entries))
+		}
+		shard.mu.Unlock()
+	}
+	if got := store.Count(); got != count {
+		t.Errorf("Count返回%d 分段中实际有%d个键", got, count)
+	}
+	if got := store.Bytes(); got != bytes {
+		t.Errorf("Bytes返回%d 分段中实际有%d字节", got, bytes)
+	}
+	if count > store.capacity {
+		t.Errorf("键的数量：%d超过了容量：%d", count, store.capacity)
+	}
+}
+
+// TestStoreConcurrentAccess 多个协程同时读写、删除、淘汰和主动过期 用-race运行检查数据竞争 结束后检查计数一致
+func TestStoreConcurrentAccess(t *testing.T) {
+	for _, policy := range allEvictionPolicies {
+		t.Run(policy, func(t *testing.T) {
+			store, err := NewStore[string, string](config.MemoryDBConfig{
+				Capacity:       200,
+				EvictRatio:     0.2,
+				Shards:         8,
+				EvictionPolicy: policy,
+				LFUHalfLife:    time.Second,
+			}, nil)
+			if err != nil {
+				t.Fatalf("创建内存数据库失败：%v", err)
+			}
+
+			const workers = 8
+			const opsPerWorker = 3000
+			const keySpace = 1000
+			stop := make(chan struct{})
+			var expirer sync.WaitGroup
+			expirer.Add(1)
+			go func() {
+				defer expirer.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						store.ActiveExpireCycle(time.Millisecond)
+						time.Sleep(100 * time.Microsecond)
+					}
+				}
+			}()
+
+			var workersDone sync.WaitGroup
+			for w := 0; w < workers; w++ {
+				workersDone.Add(1)
+				go func(seed int64) {
+					defer workersDone.Done()
+					rng := rand.New(rand.NewSource(seed))
+					for i := 0; i < opsPerWorker; i++ {
+						key := fmt.Sprintf("key%d", rng.Intn(keySpace))
+						switch op := rng.Intn(10); {
+						case op < 3:
+							store.Set(key, key, NoExpiry)
+						case op < 5:
+							// 很短的过期时间 让读取和主动过期都会删除过期的键
+							store.Set(key, key, Expiry{TTL: time.Duration(rng.Intn(3)+1) * time.Millisecond, Sliding: op == 4})
+						case op < 8:
+							if value, ok := store.Get(key); ok && value != key {
+								t.Errorf("键：%s读到了错误的值：%s", key, value)
+							}
+						case op < 9:
+							store.Update(key, key)
+							store.TTL(key)
+						default:
+							store.Delete(key)
+						}
+					}
+				}(int64(w))
+			}
+			workersDone.Wait()
+			close(stop)
+			expirer.Wait()
+			// 最后写入的键最多3毫秒后过期 等它们都过期后再主动删除一轮
+			time.Sleep(5 * time.Millisecond)
+			for store.ActiveExpireCycle(10*time.Millisecond) > 0 {
+			}
+
+			checkStoreInvariants(t, store)
+			stats := store.Stats()
+			if stats.Evictions == 0 {
+				t.Errorf("键的数量超过容量时没有淘汰")
+			}
+			if stats.Expired == 0 {
+				t.Errorf("没有删除过期的键")
+			}
+		})
+	}
+}
+
+// benchmarkStore 多个协程并发读写 读和写的比例是4比1 键的数量不超过容量 不会淘汰
+func benchmarkStore(b *testing.B, shards int, policy string) {
+	const keySpace = 10000
+	store, err := NewStore[string, string](config.MemoryDBConfig{
+		Capacity:       keySpace * 2,
+		EvictRatio:     0.1,
+		Shards:         shards,
+		EvictionPolicy: policy,
+		LFUHalfLife:    time.Minute,
+	}, nil)
+	if err != nil {
+		b.Fatalf("创建内存数据库失败：%v", err)
+	}
+	keys := make([]string, keySpace)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+		store.Set(keys[i], keys[i], NoExpiry)
+	}
+	var seed int64
+	var seedLock sync.Mutex
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		seedLock.Lock()
+		seed++
+		rng := rand.New(rand.NewSource(seed))
+		seedLock.Unlock()
+		for pb.Next() {
+			key := keys[rng.Intn(keySpace)]
+			if rng.Intn(5) == 0 {
+				store.Set(key, key, NoExpiry)
+			} else {
+				store.Get(key)
+			}
+		}
+	})
+}
+
+// BenchmarkStoreSingleLock 只有一个分段 所有读写竞争同一把锁
+func BenchmarkStoreSingleLock(b *testing.B) {
+	for _, policy := range allEvictionPolicies {
+		b.Run(policy, func(b *testing.B) { benchmarkStore(b, 1, policy) })
+	}
+}
+
+// BenchmarkStoreSharded 默认的分段数量 不同分段的读写可以并发执行
+func BenchmarkStoreSharded(b *testing.B) {
+	for _, policy := range allEvictionPolicies {
+		b.Run(policy, func(b *testing.B) { benchmarkStore(b, DefaultShardCount, policy) })
+	}
+}
@@ -0,0 +1,34 @@
+package dao
+
+import "unsafe"
+
+// MemorySizer 可以估算自己占用内存字节数的值 存入内存数据库的值实现它时按它的估算值计算内存占用
+type MemorySizer interface {
+	MemorySize() int
+}
+
+// entryOverhead 每个键值对除了键和值以外的固定开销 包括memoryEntry、分段map的桶和淘汰策略的记录
+// 不同类型的键值对结构体大小只差键和值本身的头部 这里按字符串键和接口值估算
+const entryOverhead = int64(unsafe.Sizeof(memoryEntry[string, interface{}]{})) + 96
+
+// defaultValueSize 无法估算大小的值按这个字节数计算
+const defaultValueSize = 64
+
+// estimateSize 估算一个键值对占用的内存字节数 字符串键按长度计算 其他类型的键已经包含在固定开销中
+func estimateSize(key interface{}, value interface{}) int64 {
+	size := entryOverhead
+	if k, ok := key.(string); ok {
+		size += int64(len(k))
+	}
+	switch v := value.(type) {
+	case MemorySizer:
+		size += int64(v.MemorySize())
+	case string:
+		size += int64(len(v))
+	case []byte:
+		size += int64(len(v))
+	default:
+		size += defaultValueSize
+	}
+	return size
+}
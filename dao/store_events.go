@@ -0,0 +1,168 @@
+package dao
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 键空间事件的操作
+const (
+	EventSet    = "set"    // 添加了新键
+	EventUpdate = "update" // 修改了已有的键
+	EventDelete = "delete" // 主动删除
+	EventEvict  = "evict"  // 因为容量不够被淘汰 Cause是淘汰策略
+	EventExpire = "expire" // 因为过期被删除 Cause是ttl
+	EventImport = "import" // 导入替换了全部内容 不会为每个键单独发出事件 Key是零值
+)
+
+// CauseTTL 过期事件的原因
+const CauseTTL = "ttl"
+
+// 订阅者的缓冲区满了时的处理方式
+const (
+	OverflowDropNewest = "drop-newest" // 丢弃新的事件 默认
+	OverflowDropOldest = "drop-oldest" // 丢弃缓冲区中最旧的事件 保留新的事件
+)
+
+// defaultEventBuffer 订阅者默认的缓冲区大小
+const defaultEventBuffer = 256
+
+// Event 键空间事件
+type Event[K comparable] struct {
+	Key   K         `json:"key"`
+	Op    string    `json:"op"`
+	Cause string    `json:"cause,omitempty"` // 淘汰的策略或者过期的原因 其他操作为空
+	Time  time.Time `json:"time"`
+}
+
+// SubscribeOptions 订阅键空间事件的选项
+type SubscribeOptions struct {
+	Buffer   int    // 缓冲区大小 小于1时使用默认值
+	Overflow string // 缓冲区满了时的处理方式 为空时是drop-newest
+}
+
+// ValidOverflow 判断缓冲区满了时的处理方式是否合法 空字符串表示默认的drop-newest
+func ValidOverflow(overflow string) bool {
+	switch overflow {
+	case "", OverflowDropNewest, OverflowDropOldest:
+		return true
+	}
+	return false
+}
+
+// Subscription 键空间事件的订阅 从C中读取事件 不再需要时调用Close
+// 同一个键的事件按修改的顺序发出 不同键之间的顺序不保证
+type Subscription[K comparable] struct {
+	C           <-chan Event[K]
+	ch          chan Event[K]
+	overflow    string
+	dropped     atomic.Uint64
+	mu          sync.RWMutex // 发送事件时持有读锁 关闭时持有写锁 保证不会向已经关闭的通道发送
+	closed      bool
+	unsubscribe func()
+}
+
+// Subscribe 订阅键空间事件 事件在持有分段的锁时发出 订阅者读取得太慢时按opts.Overflow丢弃事件
+// 发送事件从不等待订阅者 慢的订阅者不会拖慢持有分段锁的写入者
+func (store *Store[K, V]) Subscribe(opts SubscribeOptions) (*Subscription[K], error) {
+	if !ValidOverflow(opts.Overflow) {
+		return nil, fmt.Errorf("Store.Subscribe 缓冲区满了时的处理方式：%s只能是drop-newest或者drop-oldest", opts.Overflow)
+	}
+	if opts.Buffer < 1 {
+		opts.Buffer = defaultEventBuffer
+	}
+	if opts.Overflow == "" {
+		opts.Overflow = OverflowDropNewest
+	}
+	ch := make(chan Event[K], opts.Buffer)
+	sub := &Subscription[K]{C: ch, ch: ch, overflow: opts.Overflow}
+
+	store.subsMu.Lock()
+	defer store.subsMu.Unlock()
+	store.subSeq++
+	id := store.subSeq
+	if store.subs == nil {
+		store.subs = make(map[uint64]*Subscription[K])
+	}
+	store.subs[id] = sub
+	store.subCount.Store(int64(len(store.subs)))
+	sub.unsubscribe = func() {
+		store.subsMu.Lock()
+		defer store.subsMu.Unlock()
+		delete(store.subs, id)
+		store.subCount.Store(int64(len(store.subs)))
+	}
+	return sub, nil
+}
+
+// Dropped 返回因为缓冲区满了被丢弃的事件数量
+func (sub *Subscription[K]) Dropped() uint64 {
+	return sub.dropped.Load()
+}
+
+// Close 取消订阅并关闭C 可以重复调用
+func (sub *Subscription[K]) Close() {
+	sub.unsubscribe()
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if !sub.closed {
+		sub.closed = true
+		close(sub.ch)
+	}
+}
+
+// send 按缓冲区满了时的处理方式发送事件 不会阻塞
+func (sub *Subscription[K]) send(event Event[K]) {
+	sub.mu.RLock()
+	defer sub.mu.RUnlock()
+	if sub.closed {
+		return
+	}
+	select {
+	case sub.ch <- event:
+		return
+	default:
+	}
+	if sub.overflow == OverflowDropOldest {
+		// 取出最旧的事件腾出位置 订阅者同时在读取时可能不需要取出
+		select {
+		case <-sub.ch:
+			sub.dropped.Add(1)
+		default:
+		}
+		select {
+		case sub.ch <- event:
+			return
+		default:
+		}
+	}
+	sub.dropped.Add(1)
+}
+
+// publish 向所有订阅者发出事件 调用者需要持有键所属分段的锁 保证同一个键的事件顺序和修改顺序一致
+func (store *Store[K, V]) publish(key K, op string, cause string) {
+	if store.subCount.Load() == 0 {
+		return
+	}
+	event := Event[K]{Key: key, Op: op, Cause: cause, Time: time.Now()}
+	store.subsMu.RLock()
+	defer store.subsMu.RUnlock()
+	for _, sub := range store.subs {
+		sub.send(event)
+	}
+}
+
+// CloseSubscriptions 关闭所有订阅 订阅者的C会被关闭 用于停止服务时结束所有事件流
+func (store *Store[K, V]) CloseSubscriptions() {
+	store.subsMu.RLock()
+	subs := make([]*Subscription[K], 0, len(store.subs))
+	for _, sub := range store.subs {
+		subs = append(subs, sub)
+	}
+	store.subsMu.RUnlock()
+	for _, sub := range subs {
+		sub.Close()
+	}
+}
@@ -0,0 +1,40 @@
+package dao
+
+import (
+	"node2/config"
+	"testing"
+)
+
+// TestSubscribeNeverBlocksWriters 订阅者不读取时写入者不会等待 缓冲区满了按overflow丢弃事件 不再接受block
+func TestSubscribeNeverBlocksWriters(t *testing.T) {
+	store, err := NewStore[string, string](config.MemoryDBConfig{Capacity: 100, EvictRatio: 0.1}, nil)
+	if err != nil {
+		t.Fatalf("创建内存数据库失败：%v", err)
+	}
+	if _, err = store.Subscribe(SubscribeOptions{Overflow: "block"}); err == nil {
+		t.Fatalf("overflow为block时订阅成功")
+	}
+	newest, err := store.Subscribe(SubscribeOptions{Buffer: 1})
+	if err != nil {
+		t.Fatalf("订阅失败：%v", err)
+	}
+	defer newest.Close()
+	oldest, err := store.Subscribe(SubscribeOptions{Buffer: 1, Overflow: OverflowDropOldest})
+	if err != nil {
+		t.Fatalf("订阅失败：%v", err)
+	}
+	defer oldest.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		store.Set(key, key, NoExpiry)
+	}
+	if newest.Dropped() != 2 || oldest.Dropped() != 2 {
+		t.Fatalf("丢弃的事件数量：drop-newest=%d drop-oldest=%d 期望都是2", newest.Dropped(), oldest.Dropped())
+	}
+	if event := <-newest.C; event.Key != "a" {
+		t.Errorf("drop-newest保留了键：%s的事件 期望最早的a", event.Key)
+	}
+	if event := <-oldest.C; event.Key != "c" {
+		t.Errorf("drop-oldest保留了键：%s的事件 期望最新的c", event.Key)
+	}
+}
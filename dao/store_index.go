@@ -0,0 +1,126 @@
+package dao
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// IndexFunc 从值中取出二级索引的索引项 一个值可以有多个索引项(例如多个科目) 空字符串不会加入索引
+type IndexFunc[V any] func(value V) []string
+
+// secondaryIndex 一个分段中的二级索引 索引名称 -> 索引项 -> 键的集合
+type secondaryIndex[K comparable] map[string]map[string]map[K]struct{}
+
+// AddIndex 添加一个二级索引 Set、Update、删除、淘汰和过期时都会维护 需要在内存数据库开始使用之前调用
+func (store *Store[K, V]) AddIndex(name string, fn IndexFunc[V]) {
+	if store.indexes == nil {
+		store.indexes = make(map[string]IndexFunc[V])
+	}
+	store.indexes[name] = fn
+	for _, shard := range store.shards {
+		shard.index[name] = make(map[string]map[K]struct{})
+	}
+}
+
+// indexEntry 把键按值的索引项加入或移出分段的二级索引 调用者需要持有分段的锁
+func (store *Store[K, V]) indexEntry(shard *memoryShard[K, V], key K, value V, add bool) {
+	for name, fn := range store.indexes {
+		terms := shard.index[name]
+		for _, term := range fn(value) {
+			if term == "" {
+				continue
+			}
+			keys := terms[term]
+			if add {
+				if keys == nil {
+					keys = make(map[K]struct{})
+					terms[term] = keys
+				}
+				keys[key] = struct{}{}
+				continue
+			}
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(terms, term)
+			}
+		}
+	}
+}
+
+// Query 通过二级索引查找同时满足所有条件的值的副本 conditions是索引名称 -> 索引项
+// 不算对键的访问 不会改变淘汰顺序和滑动过期的时间 遇到已经过期的键会删除
+// complete表示结果是否完整 内存数据库确认过包含全部数据并且之后没有键被淘汰或者过期时才是完整的
+func (store *Store[K, V]) Query(conditions map[string]string) (values []V, complete bool, err error) {
+	if len(conditions) == 0 {
+		return nil, false, errors.New("Store.Query 至少需要一个查询条件")
+	}
+	for name := range conditions {
+		if _, exists := store.indexes[name]; !exists {
+			return nil, false, fmt.Errorf("Store.Query 不存在索引：%s", name)
+		}
+	}
+	seq := store.lossSeq.Load()
+	for _, shard := range store.shards {
+		values = store.queryShard(shard, conditions, values)
+	}
+	return values, store.completeAt.Load() == int64(seq) && store.lossSeq.Load() == seq, nil
+}
+
+// queryShard 在一个分段中查找满足所有条件的值 追加到values后面
+func (store *Store[K, V]) queryShard(shard *memoryShard[K, V], conditions map[string]string, values []V) []V {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	// 从键最少的条件开始 再检查是否满足其他条件
+	var smallest map[K]struct{}
+	for name, term := range conditions {
+		keys := shard.index[name][term]
+		if len(keys) == 0 {
+			return values
+		}
+		if smallest == nil || len(keys) < len(smallest) {
+			smallest = keys
+		}
+	}
+	now := time.Now()
+	var expired []*memoryEntry[K, V]
+	for key := range smallest {
+		matched := true
+		for name, term := range conditions {
+			if _, ok := shard.index[name][term][key]; !ok {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		entry := shard.entries[key]
+		if !entry.expireAt.IsZero() && now.After(entry.expireAt) {
+			expired = append(expired, entry)
+			continue
+		}
+		values = append(values, store.copy(entry.value))
+	}
+	// 遍历索引时不能删除 遍历完再删除过期的键
+	for _, entry := range expired {
+		store.expireEntry(shard, entry)
+	}
+	return values
+}
+
+// LossSeq 返回内存数据库可能丢失数据的次数 淘汰、过期删除和导入替换全部内容时都会增加
+// 确认内存数据库包含全部数据之前先取得它 确认后传给MarkComplete
+func (store *Store[K, V]) LossSeq() uint64 {
+	return store.lossSeq.Load()
+}
+
+// Complete 判断内存数据库确认包含全部数据之后是否还没有丢失过数据 不完整时需要重新确认
+func (store *Store[K, V]) Complete() bool {
+	return store.completeAt.Load() == int64(store.lossSeq.Load())
+}
+
+// MarkComplete 记录内存数据库在lossSeq时已经确认包含全部数据 之后再有数据丢失时Query的结果就不再完整
+func (store *Store[K, V]) MarkComplete(lossSeq uint64) {
+	store.completeAt.Store(int64(lossSeq))
+}
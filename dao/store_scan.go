@@ -0,0 +1,141 @@
+package dao
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+)
+
+// scanShardShift SCAN游标的高16位是分段的下标 低48位是这个分段中已经返回的最大scanId
+const scanShardShift = 48
+
+// defaultScanCount SCAN每次默认检查的键数量
+const defaultScanCount = 10
+
+// scanOrder 一个分段中按scanId从小到大排列的键 新键的scanId总是最大的 所以添加时追加到末尾
+// 删除时只把位置置为nil 空位超过一半时再整理 保证已经在游标之后的键不会因为删除其他键而移动到游标之前
+type scanOrder[K comparable, V any] struct {
+	entries []*memoryEntry[K, V]
+	holes   int
+}
+
+// add 添加新键 调用者需要持有分段的锁
+func (order *scanOrder[K, V]) add(entry *memoryEntry[K, V]) {
+	order.entries = append(order.entries, entry)
+}
+
+// remove 删除键 调用者需要持有分段的锁
+func (order *scanOrder[K, V]) remove(entry *memoryEntry[K, V]) {
+	i := order.search(entry.scanId)
+	for i < len(order.entries) && order.entries[i] == nil {
+		i++
+	}
+	if i >= len(order.entries) || order.entries[i] != entry {
+		return
+	}
+	order.entries[i] = nil
+	order.holes++
+	if order.holes > len(order.entries)/2 {
+		live := order.entries[:0]
+		for _, e := range order.entries {
+			if e != nil {
+				live = append(live, e)
+			}
+		}
+		clear(order.entries[len(live):])
+		order.entries = live
+		order.holes = 0
+	}
+}
+
+// search 返回一个位置 它之前的键的scanId都小于id 从它开始跳过空位后第一个键的scanId大于等于id
+func (order *scanOrder[K, V]) search(id uint64) int {
+	// 空位不能参与比较 二分时遇到空位向后找到第一个不是空位的键
+	return sort.Search(len(order.entries), func(i int) bool {
+		for j := i; j < len(order.entries); j++ {
+			if e := order.entries[j]; e != nil {
+				return e.scanId >= id
+			}
+		}
+		return true
+	})
+}
+
+// Scan 从游标cursor开始遍历内存数据库 返回这一批中键匹配match的键和下一次的游标 游标为0表示从头开始 返回的游标为0表示遍历完了
+// match是path.Match的通配符模式 为空时匹配所有键 不是字符串的键按fmt.Sprint的结果匹配
+// count是每次最多检查的键数量 不是返回的数量 小于1时使用默认值 返回的键可能少于count甚至为空 但游标不为0时仍然需要继续
+// 遍历期间一直存在的键一定会被返回并且只返回一次 遍历期间添加或删除的键可能返回也可能不返回
+// 导入会重新分配顺序 导入之前的游标可能会重复或者漏掉键 不算对键的访问 已经过期的键不返回
+func (store *Store[K, V]) Scan(cursor uint64, match string, count int) ([]K, uint64, error) {
+	if match != "" {
+		if _, err := path.Match(match, ""); err != nil {
+			return nil, 0, fmt.Errorf("Store.Scan 匹配模式：%s不合法：%w", match, err)
+		}
+	}
+	if count < 1 {
+		count = defaultScanCount
+	}
+	shardIndex := int(cursor >> scanShardShift)
+	lastId := cursor & (1<<scanShardShift - 1)
+	var keys []K
+	for shardIndex < len(store.shards) && count > 0 {
+		var done bool
+		keys, lastId, count, done = store.scanShard(store.shards[shardIndex], lastId, match, count, keys)
+		if !done {
+			return keys, uint64(shardIndex)<<scanShardShift | lastId, nil
+		}
+		shardIndex++
+		lastId = 0
+	}
+	if shardIndex >= len(store.shards) {
+		return keys, 0, nil
+	}
+	return keys, uint64(shardIndex) << scanShardShift, nil
+}
+
+// scanShard 从scanId大于lastId的键开始检查一个分段中最多count个键 返回追加后的键、检查到的最大scanId、剩余的count和这个分段是否检查完了
+func (store *Store[K, V]) scanShard(shard *memoryShard[K, V], lastId uint64, match string, count int, keys []K) ([]K, uint64, int, bool) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	now := time.Now()
+	entries := shard.scan.entries
+	for i := shard.scan.search(lastId + 1); i < len(entries); i++ {
+		entry := entries[i]
+		if entry == nil {
+			continue
+		}
+		if count == 0 {
+			return keys, lastId, 0, false
+		}
+		count--
+		lastId = entry.scanId
+		if !entry.expireAt.IsZero() && now.After(entry.expireAt) {
+			continue
+		}
+		if match != "" && !matchKey(match, entry.key) {
+			continue
+		}
+		keys = append(keys, entry.key)
+	}
+	return keys, lastId, count, true
+}
+
+// matchKey 判断键是否匹配通配符模式 模式已经检查过是合法的
+func matchKey[K comparable](match string, key K) bool {
+	name, ok := any(key).(string)
+	if !ok {
+		name = fmt.Sprint(key)
+	}
+	matched, _ := path.Match(match, name)
+	return matched
+}
+
+// Contains 判断键是否存在并且没有过期 不算对键的访问
+func (store *Store[K, V]) Contains(key K) bool {
+	shard := store.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry, exists := shard.entries[key]
+	return exists && (entry.expireAt.IsZero() || !time.Now().After(entry.expireAt))
+}
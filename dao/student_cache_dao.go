@@ -3,71 +3,176 @@ package dao
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/redis/go-redis/v9"
+	"log"
+	"node2/interfaces"
 	"node2/model"
 	"strconv"
+	"strings"
+	"time"
 )
 
-// 定义缓存键的前缀
+// 定义缓存键的前缀 学生的键是前缀+代数+":"+学生id
 const studentCachePrefix = "student:"
 
+// studentGenerationKey 保存当前代数的指针键 读写学生时都先通过它找到当前代数的键
+const studentGenerationKey = studentCachePrefix + "generation"
+
+// studentGenerationSeqKey 分配新代数的计数器 重新加载时递增
+const studentGenerationSeqKey = studentGenerationKey + ":seq"
+
+// studentCacheBatch SCAN每次返回的键数量的提示值 也是流水线每批执行的命令数量
+const studentCacheBatch = 500
+
+// studentPendingGenerationKey 保存正在重新加载的代数 重新加载期间写入学生时同时写入这一代
+const studentPendingGenerationKey = studentGenerationKey + ":pending"
+
+// studentDirtyKeyPrefix 重新加载期间被写入或删除的学生id集合的键的前缀 后面是正在重新加载的代数
+// 集合中的学生已经是最新的 重新加载时从数据库读到的快照不会覆盖它们
+const studentDirtyKeyPrefix = studentGenerationKey + ":dirty:"
+
+// studentCacheRetries 执行脚本时代数发生了变化的重试次数
+const studentCacheRetries = 5
+
+// checkGenerationLua 检查代数在读取之后没有变化 变化了返回-1由调用者重新读取代数后重试
+// KEYS[1]是指针键 ARGV[1]是读取到的当前代数 有KEYS[3]时它是正在重新加载的代数的键 ARGV[2]是读取到的值
+// 指针键不存在时代数是0 没有正在重新加载的代数时也是0
+const checkGenerationLua = `if (redis.call('GET', KEYS[1]) or '0') ~= ARGV[1] then
+	return -1
+end
+if #KEYS >= 3 and (redis.call('GET', KEYS[3]) or '0') ~= ARGV[2] then
+	return -1
+end
+`
+
+// getStudentScript 获取当前代数中学生的所有字段和剩余的过期时间(毫秒) KEYS[2]是学生在当前代数的键
+// 滑动过期的学生被访问后重新计时 和内存数据库一致
+var getStudentScript = redis.NewScript(checkGenerationLua + `local values = redis.call('HGETALL', KEYS[2])
+if #values > 0 then
+	local expiry = redis.call('HMGET', KEYS[2], 'expiration_mode', 'expiration')
+	local seconds = tonumber(expiry[2])
+	if expiry[1] == 'sliding' and seconds and seconds > 0 then
+		redis.call('PEXPIRE', KEYS[2], seconds * 1000)
+	end
+end
+return {values, redis.call('PTTL', KEYS[2])}`)
+
+// addStudentScript 设置学生的字段和过期时间 KEYS[2]是学生在当前代数的键
+// 有KEYS[4]和KEYS[5]时同时写入正在重新加载的代数中的键KEYS[4] 并把学生id加入集合KEYS[5]
+// ARGV[3]是学生id ARGV[4]是过期时间(毫秒 小于等于0表示永不过期) ARGV[5]为1时总是重新计时
+// ARGV[6]和ARGV[7]是学生的expiration和expiration_mode ARGV[8]之后是字段名和字段值
+// 和内存数据库一样 修改学生时过期设置没有变化就保留剩余的过期时间 否则重新计时
+var addStudentScript = redis.NewScript(checkGenerationLua + `local function write(key)
+	local old = redis.call('HMGET', key, 'expiration', 'expiration_mode')
+	redis.call('HSET', key, unpack(ARGV, 8))
+	local ttl = tonumber(ARGV[4])
+	if ttl <= 0 then
+		redis.call('PERSIST', key)
+	elseif ARGV[5] == '1' or old[1] ~= ARGV[6] or old[2] ~= ARGV[7] or redis.call('PTTL', key) < 0 then
+		redis.call('PEXPIRE', key, ttl)
+	end
+end
+write(KEYS[2])
+if #KEYS >= 5 then
+	write(KEYS[4])
+	redis.call('SADD', KEYS[5], ARGV[3])
+end
+return 1`)
+
+// deleteStudentScript 删除学生 键的含义和addStudentScript一样 ARGV[3]是学生id
+var deleteStudentScript = redis.NewScript(checkGenerationLua + `redis.call('DEL', KEYS[2])
+if #KEYS >= 5 then
+	redis.call('DEL', KEYS[4])
+	redis.call('SADD', KEYS[5], ARGV[3])
+end
+return 1`)
+
+// loadStudentScript 重新加载时把数据库中的学生写入新的一代 KEYS[1]是这一代的已修改集合 KEYS[2]是学生在这一代的键
+// 学生在集合中说明重新加载期间已经写入了更新的值或者被删除了 不再写入 ARGV[1]是学生id ARGV[2]是过期时间(毫秒 0表示永不过期)
+// ARGV[3]之后是字段名和字段值
+var loadStudentScript = redis.NewScript(`if redis.call('SISMEMBER', KEYS[1], ARGV[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[2], unpack(ARGV, 3))
+if tonumber(ARGV[2]) > 0 then
+	redis.call('PEXPIRE', KEYS[2], ARGV[2])
+end
+return 1`)
+
+// beginReloadScript 把KEYS[1]设置为正在重新加载的代数ARGV[1] 只有比已有的大时才设置 返回是否设置了
+var beginReloadScript = redis.NewScript(`if tonumber(ARGV[1]) > tonumber(redis.call('GET', KEYS[1]) or '0') then
+	redis.call('SET', KEYS[1], ARGV[1])
+	return 1
+end
+return 0`)
+
+// flipGenerationScript 把指针键KEYS[1]切换到新的代数ARGV[1] 并清除正在重新加载的代数KEYS[2]和已修改集合KEYS[3]
+// 只有这一代仍然是正在重新加载的代数并且比当前的大时才切换 返回是否切换了 并发的重新加载中先开始的不会覆盖后开始的
+var flipGenerationScript = redis.NewScript(`redis.call('DEL', KEYS[3])
+if redis.call('GET', KEYS[2]) ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[2])
+if tonumber(ARGV[1]) > tonumber(redis.call('GET', KEYS[1]) or '0') then
+	redis.call('SET', KEYS[1], ARGV[1])
+	return 1
+end
+return 0`)
+
+// abortReloadScript 放弃重新加载代数ARGV[1] 清除已修改集合KEYS[2] KEYS[1]仍然是这一代时也清除它
+var abortReloadScript = redis.NewScript(`redis.call('DEL', KEYS[2])
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('DEL', KEYS[1])
+end
+return 1`)
+
 // StudentCacheDao 定义缓存层结构体实例
 type StudentCacheDao struct {
-	client redis.Client
+	client     redis.Client
+	defaultTTL time.Duration // 永不过期的学生在缓存中的过期时间 0表示缓存中也永不过期
 }
 
+// 确保实现 StudentCacheDaoInterface 接口
+var _ interfaces.StudentCacheDaoInterface = (*StudentCacheDao)(nil)
+
 // NewStudentCacheDao 初始化缓存层结构体实例
-func NewStudentCacheDao(client *redis.Client) *StudentCacheDao {
+func NewStudentCacheDao(client *redis.Client, defaultTTL time.Duration) *StudentCacheDao {
 	return &StudentCacheDao{
-		client: *client,
+		client:     *client,
+		defaultTTL: defaultTTL,
 	}
 }
 
-// AddStudent 添加学生
-func (d StudentCacheDao) AddStudent(student *model.Student) error {
-	ctx := context.Background()
-
-	key := studentCachePrefix + student.ID
+// cacheTTL 返回学生在缓存中的过期时间和是否滑动过期 和内存数据库的过期设置对应 永不过期的学生使用defaultTTL
+func (d StudentCacheDao) cacheTTL(student *model.Student) (time.Duration, bool) {
+	if student.Expiration <= 0 || student.ExpirationMode == model.ExpireNever {
+		return d.defaultTTL, false
+	}
+	return time.Duration(student.Expiration) * time.Second, student.ExpirationMode == model.ExpireSliding
+}
 
+// studentFields 构建学生在哈希表中的字段信息
+func studentFields(student *model.Student) ([]interface{}, error) {
 	// 将成绩信息序列化为 JSON 字符串
 	gradeJSON, err := json.Marshal(student.Grades)
 	if err != nil {
-		return fmt.Errorf("StudentRedisDao.AddStudent Marshal err: %v", err)
+		return nil, err
 	}
-
-	// 构建学生的字段信息
-	fields := make(map[string]interface{})
-	fields["id"] = student.ID
-	fields["name"] = student.Name
-	fields["gender"] = student.Gender
-	fields["class"] = student.Class
-	fields["grade"] = gradeJSON
-	fields["expiration"] = student.Expiration
-
-	// 添加键到哈希表里面
-	if err = d.client.HSet(ctx, key, fields).Err(); err != nil {
-		return fmt.Errorf("StudentRedisDao.AddStudent Hset err: %w", err)
-	}
-	return nil
+	return []interface{}{
+		"id", student.ID,
+		"name", student.Name,
+		"gender", student.Gender,
+		"class", student.Class,
+		"grade", gradeJSON,
+		"expiration", student.Expiration,
+		"expiration_mode", student.ExpirationMode,
+	}, nil
 }
 
-// GetStudent 获取学生
-func (d StudentCacheDao) GetStudent(id string) (*model.Student, error) {
-	ctx := context.Background()
-	key := studentCachePrefix + id
-
-	// 从缓存中获取学生的所有字段信息
-	result, err := d.client.HGetAll(ctx, key).Result()
-	if err != nil {
-		return nil, fmt.Errorf("StudentRedisDao.GetStudent HGetAll err: %w", err)
-	}
-
-	// 如果结果为空，说明学生信息不存在
-	if len(result) == 0 {
-		return nil, fmt.Errorf("StudentRedisDao.GetStudent 缓存中不存在学生：%s", id)
-	}
-
+// parseStudent 从哈希表的字段信息中解析出学生
+func parseStudent(result map[string]string) (*model.Student, error) {
 	// 创建一个新的 Student 对象
 	student := &model.Student{}
 
@@ -76,76 +181,393 @@ func (d StudentCacheDao) GetStudent(id string) (*model.Student, error) {
 	student.Name = result["name"]
 	student.Gender = result["gender"]
 	student.Class = result["class"]
+	student.ExpirationMode = result["expiration_mode"]
+	var err error
 	student.Expiration, err = strconv.ParseInt(result["expiration"], 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("StudentRedisDao.GetStudent ParseInt err：%w", err)
+		return nil, fmt.Errorf("ParseInt err：%w", err)
 	}
 
 	// 反序列化成绩信息
-	gradeJSON := []byte(result["grade"])
 	grades := make(map[string]float64)
-	err = json.Unmarshal(gradeJSON, &grades)
-	if err != nil {
-		return nil, fmt.Errorf("StudentRedisDao.GetStudent Unmarshal err：%w", err)
+	if err = json.Unmarshal([]byte(result["grade"]), &grades); err != nil {
+		return nil, fmt.Errorf("Unmarshal err：%w", err)
 	}
 	student.Grades = grades
-
 	return student, nil
 }
 
-// DeleteStudent 删除学生
-func (d StudentCacheDao) DeleteStudent(id string) error {
+// generationPrefix 返回某一代学生的键的前缀
+func generationPrefix(generation int64) string {
+	return studentCachePrefix + strconv.FormatInt(generation, 10) + ":"
+}
+
+// dirtyKey 返回重新加载某一代期间已修改学生的集合的键
+func dirtyKey(generation int64) string {
+	return studentDirtyKeyPrefix + strconv.FormatInt(generation, 10)
+}
+
+// errGenerationChanged 脚本执行时代数已经和读取到的不同
+var errGenerationChanged = errors.New("缓存的代数发生了变化")
+
+// generations 返回当前代数和正在重新加载的代数 不存在时都是0
+func (d StudentCacheDao) generations(ctx context.Context) (int64, int64, error) {
+	values, err := d.client.MGet(ctx, studentGenerationKey, studentPendingGenerationKey).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	var generations [2]int64
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			if generations[i], err = strconv.ParseInt(s, 10, 64); err != nil {
+				return 0, 0, fmt.Errorf("解析代数：%s失败：%w", s, err)
+			}
+		}
+	}
+	return generations[0], generations[1], nil
+}
+
+// runOnGenerations 读取代数后执行脚本 脚本发现代数已经变化时重新读取后重试
+// 所有的键都通过KEYS传入 withPending为true时正在重新加载的代数中的键和已修改集合也会传入
+func (d StudentCacheDao) runOnGenerations(ctx context.Context, script *redis.Script, id string, withPending bool, args ...interface{}) (interface{}, error) {
+	for i := 0; i < studentCacheRetries; i++ {
+		current, pending, err := d.generations(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("获取代数失败：%w", err)
+		}
+		keys := []string{studentGenerationKey, generationPrefix(current) + id}
+		if withPending {
+			keys = append(keys, studentPendingGenerationKey)
+			if pending > current {
+				keys = append(keys, generationPrefix(pending)+id, dirtyKey(pending))
+			}
+		}
+		reply, err := script.Run(ctx, &d.client, keys, append([]interface{}{current, pending}, args...)...).Result()
+		if err != nil {
+			return nil, err
+		}
+		if code, ok := reply.(int64); !ok || code != -1 {
+			return reply, nil
+		}
+	}
+	return nil, errGenerationChanged
+}
+
+// AddStudent 写入学生的最新信息 学生在缓存中的过期时间和内存中一致
+// 正在重新加载时同时写入新的一代 重新加载从数据库读到的旧的学生不会覆盖它
+func (d StudentCacheDao) AddStudent(student *model.Student) error {
+	return d.addStudent(student, false, true)
+}
+
+// FillStudent 把从数据库中读到的学生写入当前代数 只用来填充缓存 正在重新加载的代数由重新加载写入
+func (d StudentCacheDao) FillStudent(student *model.Student) error {
+	return d.addStudent(student, false, false)
+}
+
+// RefreshStudent 向当前代数写入学生并且总是重新计时 用于在缓存过期之前提前刷新
+func (d StudentCacheDao) RefreshStudent(student *model.Student) error {
+	return d.addStudent(student, true, false)
+}
+
+// addStudent 写入学生 resetTTL为true或者学生是滑动过期时总是重新计时 withPending为true时同时写入正在重新加载的代数
+func (d StudentCacheDao) addStudent(student *model.Student, resetTTL bool, withPending bool) error {
+	ctx := context.Background()
+
+	fields, err := studentFields(student)
+	if err != nil {
+		return fmt.Errorf("StudentRedisDao.AddStudent Marshal err: %v", err)
+	}
+
+	// 添加键到哈希表里面 并设置对应的过期时间
+	ttl, sliding := d.cacheTTL(student)
+	reset := 0
+	if resetTTL || sliding {
+		reset = 1
+	}
+	args := append([]interface{}{student.ID, ttl.Milliseconds(), reset, student.Expiration, student.ExpirationMode}, fields...)
+	if _, err = d.runOnGenerations(ctx, addStudentScript, student.ID, withPending, args...); err != nil {
+		return fmt.Errorf("StudentRedisDao.AddStudent Hset err: %w", err)
+	}
+	return nil
+}
+
+// GetStudent 从当前代数获取学生
+func (d StudentCacheDao) GetStudent(id string) (*model.Student, error) {
+	student, _, err := d.GetStudentWithTTL(id)
+	return student, err
+}
+
+// GetStudentWithTTL 从当前代数获取学生和它在缓存中剩余的过期时间 永不过期时剩余时间为-1
+func (d StudentCacheDao) GetStudentWithTTL(id string) (*model.Student, time.Duration, error) {
 	ctx := context.Background()
 
-	key := studentCachePrefix + id
+	// 从缓存中获取学生的所有字段信息 脚本返回的第一项是字段名和字段值交替排列的数组 第二项是剩余的毫秒数
+	result, err := d.runOnGenerations(ctx, getStudentScript, id, false)
+	if err != nil {
+		return nil, 0, fmt.Errorf("StudentRedisDao.GetStudent HGetAll err: %w", err)
+	}
+	reply, _ := result.([]interface{})
+	if len(reply) != 2 {
+		return nil, 0, fmt.Errorf("StudentRedisDao.GetStudent 脚本返回了错误的结果：%v", result)
+	}
+	values, _ := reply[0].([]interface{})
+	pttl, _ := reply[1].(int64)
 
-	// 使用 Del 命令删除缓存数据
-	err := d.client.Del(ctx, key).Err()
+	// 如果结果为空，说明学生信息不存在
+	if len(values) == 0 {
+		return nil, 0, fmt.Errorf("StudentRedisDao.GetStudent 缓存中不存在学生：%s", id)
+	}
+	fieldValues := make(map[string]string, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		field, _ := values[i].(string)
+		value, _ := values[i+1].(string)
+		fieldValues[field] = value
+	}
+
+	student, err := parseStudent(fieldValues)
 	if err != nil {
+		return nil, 0, fmt.Errorf("StudentRedisDao.GetStudent %w", err)
+	}
+	if pttl < 0 {
+		return student, -1, nil
+	}
+	return student, time.Duration(pttl) * time.Millisecond, nil
+}
+
+// DeleteStudent 删除学生 正在重新加载时同时从新的一代删除 重新加载不会再把它写回来
+func (d StudentCacheDao) DeleteStudent(id string) error {
+	ctx := context.Background()
+
+	if _, err := d.runOnGenerations(ctx, deleteStudentScript, id, true, id); err != nil {
 		return fmt.Errorf("StudentRedisDao.DeleteStudent Del err: %w", err)
 	}
 	return nil
 }
 
-func (d StudentCacheDao) ReLoadCacheData(students []*model.Student) error {
+// currentGeneration 返回当前的代数 指针键不存在时是0
+func (d StudentCacheDao) currentGeneration(ctx context.Context) (int64, error) {
+	generation, err := d.client.Get(ctx, studentGenerationKey).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return generation, err
+}
+
+// BeginReload 分配新的一代并把它标记为正在重新加载 之后AddStudent和DeleteStudent会同时写入这一代
+// 调用者应该在标记之后再从数据库读取学生 然后调用FinishReload或者AbortReload
+func (d StudentCacheDao) BeginReload() (int64, error) {
 	ctx := context.Background()
-	// 删除所有 Redis 记录
-	err := d.client.FlushDB(ctx).Err()
+	generation, err := d.client.Incr(ctx, studentGenerationSeqKey).Result()
 	if err != nil {
-		return fmt.Errorf("StudentRedisDao.ReLoadCacheData FlushDB err: %w", err)
+		return 0, fmt.Errorf("StudentRedisDao.BeginReload Incr err: %w", err)
+	}
+	began, err := beginReloadScript.Run(ctx, &d.client, []string{studentPendingGenerationKey}, generation).Bool()
+	if err != nil {
+		return 0, fmt.Errorf("StudentRedisDao.BeginReload 标记第%d代失败：%w", generation, err)
+	}
+	if !began {
+		return 0, fmt.Errorf("StudentRedisDao.BeginReload 已经有比第%d代更新的重新加载", generation)
+	}
+	return generation, nil
+}
+
+// FinishReload 用students替换缓存中的全部学生 不会清空Redis中的其他数据
+// 先把学生写入新的一代 再原子地把指针键切换到新的一代 最后在后台删除旧的代数 读者始终能看到完整的一代
+// 重新加载期间已经写入或删除的学生不会被students覆盖 ctx取消时放弃这一代 不再写入之后的批次
+func (d StudentCacheDao) FinishReload(ctx context.Context, generation int64, students []*model.Student) error {
+	prefix := generationPrefix(generation)
+	dirty := dirtyKey(generation)
+	oldGeneration, err := d.currentGeneration(ctx)
+	if err != nil {
+		d.AbortReload(generation)
+		return fmt.Errorf("StudentRedisDao.FinishReload 获取当前代数失败：%w", err)
+	}
+	oldPrefix := generationPrefix(oldGeneration)
+	if err = loadStudentScript.Load(ctx, &d.client).Err(); err != nil {
+		d.AbortReload(generation)
+		return fmt.Errorf("StudentRedisDao.FinishReload 加载脚本失败：%w", err)
 	}
-	// 重新添加学生数据
-	for _, student := range students {
-		err = d.AddStudent(student)
+
+	// 通过流水线分批写入新的一代
+	for start := 0; start < len(students); start += studentCacheBatch {
+		if err = ctx.Err(); err != nil {
+			d.AbortReload(generation)
+			return fmt.Errorf("StudentRedisDao.FinishReload 写入第%d代时取消：%w", generation, err)
+		}
+		batch := students[start:min(start+studentCacheBatch, len(students))]
+		var ttls []time.Duration
+		if ttls, err = d.remainingTTLs(ctx, oldPrefix, batch); err == nil {
+			_, err = d.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for i, student := range batch {
+					fields, err := studentFields(student)
+					if err != nil {
+						return fmt.Errorf("序列化学生：%s的成绩失败：%w", student.ID, err)
+					}
+					args := append([]interface{}{student.ID, ttls[i].Milliseconds()}, fields...)
+					loadStudentScript.EvalSha(ctx, pipe, []string{dirty, prefix + student.ID}, args...)
+				}
+				return nil
+			})
+		}
 		if err != nil {
-			return fmt.Errorf("StudentRedisDao.ReLoadCacheData 加载学生时出错：%w", err)
+			d.AbortReload(generation)
+			return fmt.Errorf("StudentRedisDao.FinishReload 写入第%d代学生时出错：%w", generation, err)
 		}
 	}
+
+	keys := []string{studentGenerationKey, studentPendingGenerationKey, dirty}
+	flipped, err := flipGenerationScript.Run(ctx, &d.client, keys, generation).Bool()
+	if err != nil {
+		d.AbortReload(generation)
+		return fmt.Errorf("StudentRedisDao.FinishReload 切换到第%d代失败：%w", generation, err)
+	}
+	if !flipped {
+		// 已经有更新的一代了 这一代不再需要
+		log.Printf("缓存已经开始重新加载比第%d代更新的一代 丢弃这一代", generation)
+		go d.deleteGenerations(generation, generation+1)
+		return nil
+	}
+	log.Printf("缓存已切换到第%d代 共%d个学生", generation, len(students))
+	go d.deleteGenerations(0, generation)
 	return nil
 }
 
-// GetAllStudents 获取所有学生
+// AbortReload 放弃重新加载的一代 在后台删除已经写入这一代的学生
+func (d StudentCacheDao) AbortReload(generation int64) {
+	ctx := context.Background()
+	keys := []string{studentPendingGenerationKey, dirtyKey(generation)}
+	if err := abortReloadScript.Run(ctx, &d.client, keys, generation).Err(); err != nil {
+		log.Printf("放弃重新加载第%d代失败：%v", generation, err)
+	}
+	go d.deleteGenerations(generation, generation+1)
+}
+
+// remainingTTLs 返回重新加载时学生在新的一代中的过期时间 不需要过期时为0
+// 学生在当前代数中存在并且过期设置没有变化时沿用剩余的过期时间 重新加载不会延长学生在缓存中的过期时间
+func (d StudentCacheDao) remainingTTLs(ctx context.Context, oldPrefix string, students []*model.Student) ([]time.Duration, error) {
+	expiryCmds := make([]*redis.SliceCmd, len(students))
+	ttlCmds := make([]*redis.DurationCmd, len(students))
+	_, err := d.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, student := range students {
+			expiryCmds[i] = pipe.HMGet(ctx, oldPrefix+student.ID, "expiration", "expiration_mode")
+			ttlCmds[i] = pipe.PTTL(ctx, oldPrefix+student.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("读取当前代数中学生的过期时间失败：%w", err)
+	}
+	ttls := make([]time.Duration, len(students))
+	for i, student := range students {
+		ttl, _ := d.cacheTTL(student)
+		if ttl <= 0 {
+			continue
+		}
+		ttls[i] = ttl
+		old := expiryCmds[i].Val()
+		if len(old) == 2 && old[0] == strconv.FormatInt(student.Expiration, 10) && old[1] == student.ExpirationMode {
+			if remaining := ttlCmds[i].Val(); remaining > 0 {
+				ttls[i] = remaining
+			}
+		}
+	}
+	return ttls, nil
+}
+
+// deleteGenerations 用SCAN找到代数在[from, to)中的学生的键和已修改集合并分批删除 没有代数的旧格式的键也会删除
+// 之前删除失败或者中断时留下的旧代数会在下一次重新加载后删除
+func (d StudentCacheDao) deleteGenerations(from int64, to int64) {
+	ctx := context.Background()
+	deleted := 0
+	iter := d.client.Scan(ctx, 0, studentCachePrefix+"*", studentCacheBatch).Iterator()
+	keys := make([]string, 0, studentCacheBatch)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		if err := d.client.Unlink(ctx, keys...).Err(); err != nil {
+			return err
+		}
+		deleted += len(keys)
+		keys = keys[:0]
+		return nil
+	}
+	for iter.Next(ctx) {
+		key := iter.Val()
+		genPart, rest, found := strings.Cut(strings.TrimPrefix(key, studentCachePrefix), ":")
+		if genPart == "generation" {
+			// 指针键和计数器不删除 中断的重新加载留下的已修改集合和它的代数一起删除
+			if genPart, found = strings.CutPrefix(rest, "dirty:"); !found {
+				continue
+			}
+		}
+		if found {
+			generation, err := strconv.ParseInt(genPart, 10, 64)
+			if err != nil || generation < from || generation >= to {
+				continue
+			}
+		}
+		keys = append(keys, key)
+		if len(keys) >= studentCacheBatch {
+			if err := flush(); err != nil {
+				log.Printf("删除缓存中第%d代到第%d代的学生失败：%v", from, to-1, err)
+				return
+			}
+		}
+	}
+	err := iter.Err()
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		log.Printf("删除缓存中第%d代到第%d代的学生失败：%v", from, to-1, err)
+		return
+	}
+	log.Printf("已删除缓存中第%d代到第%d代的%d个键", from, to-1, deleted)
+}
+
+// GetAllStudents 获取当前代数的所有学生 用SCAN分批遍历 每批通过流水线一次取回
+// 遍历期间缓存切换到了新的一代时 旧的一代可能被删除 已经删除的学生会跳过
 func (d StudentCacheDao) GetAllStudents() ([]*model.Student, error) {
 	ctx := context.Background()
 	var students []*model.Student
 
-	// 使用 KEYS 命令获取所有学生的缓存键
-	keys, err := d.client.Keys(ctx, "student:*").Result()
+	generation, err := d.currentGeneration(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("StudentRedisDao.GetAllStudents Keys student:* err: %w", err)
+		return nil, fmt.Errorf("StudentRedisDao.GetAllStudents 获取当前代数失败：%w", err)
 	}
-
-	// 遍历所有学生的缓存键，先得到id，再通过id获取学生信息
-	for _, key := range keys {
-		studentId, err := d.client.HGet(ctx, key, "id").Result()
+	var cursor uint64
+	for {
+		var keys []string
+		keys, cursor, err = d.client.Scan(ctx, cursor, generationPrefix(generation)+"*", studentCacheBatch).Result()
 		if err != nil {
-			return nil, fmt.Errorf("StudentRedisDao.GetAllStudents HGet err: %w", err)
+			return nil, fmt.Errorf("StudentRedisDao.GetAllStudents Scan err: %w", err)
 		}
-		student, err := d.GetStudent(studentId)
-		if err != nil {
-			return nil, fmt.Errorf("StudentRedisDao.GetAllStudents 通过学生id：%s获得学生时失败：%w", studentId, err)
+		if len(keys) > 0 {
+			cmds := make([]*redis.MapStringStringCmd, len(keys))
+			_, err = d.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for i, key := range keys {
+					cmds[i] = pipe.HGetAll(ctx, key)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("StudentRedisDao.GetAllStudents HGetAll err: %w", err)
+			}
+			for i, cmd := range cmds {
+				result := cmd.Val()
+				if len(result) == 0 {
+					continue
+				}
+				student, err := parseStudent(result)
+				if err != nil {
+					return nil, fmt.Errorf("StudentRedisDao.GetAllStudents 解析学生：%s失败：%w", keys[i], err)
+				}
+				students = append(students, student)
+			}
+		}
+		if cursor == 0 {
+			return students, nil
 		}
-		students = append(students, student)
 	}
-	return students, nil
 }
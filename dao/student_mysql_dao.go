@@ -3,6 +3,7 @@ package dao
 import (
 	"fmt"
 	"gorm.io/gorm"
+	"node2/interfaces"
 	"node2/model"
 )
 
@@ -18,6 +19,9 @@ func NewStudentMysqlDao(db *gorm.DB) *StudentMysqlDao {
 	}
 }
 
+// 确保实现 StudentMysqlDaoInterface 接口
+var _ interfaces.StudentMysqlDaoInterface = (*StudentMysqlDao)(nil)
+
 // GetStudent 查找学生
 func (d *StudentMysqlDao) GetStudent(id string) (*model.StudentDB, error) {
 	var studentDB model.StudentDB
@@ -33,8 +37,8 @@ func (d *StudentMysqlDao) GetStudent(id string) (*model.StudentDB, error) {
 
 // AddStudentToMysql 添加学生（不包含成绩）
 func (d *StudentMysqlDao) AddStudentToMysql(tx *gorm.DB, student *model.Student) error {
-	err := tx.Exec("insert into student (id,name,gender,class,expiration) values (?,?,?,?,?)",
-		student.ID, student.Name, student.Gender, student.Class, student.Expiration).Error
+	err := tx.Exec("insert into student (id,name,gender,class,expiration,expiration_mode) values (?,?,?,?,?,?)",
+		student.ID, student.Name, student.Gender, student.Class, student.Expiration, student.ExpirationMode).Error
 	if err != nil {
 		return fmt.Errorf("StudentMysqlDao.AddStudentToMysql err:%w", err)
 	}
@@ -130,6 +134,50 @@ func (d *StudentMysqlDao) GetAllStudents() ([]model.StudentDB, error) {
 	return studentDBs, nil
 }
 
+// GetAllStudentIds 获取所有学生的id
+func (d *StudentMysqlDao) GetAllStudentIds() ([]string, error) {
+	var ids []string
+	err := d.DB.Raw("select id from student").Scan(&ids).Error
+	if err != nil {
+		return nil, fmt.Errorf("StudentMysqlDao.GetAllStudentIds err:%w", err)
+	}
+	return ids, nil
+}
+
+// ListStudents 按id顺序获取id大于afterId的最多limit个学生
+func (d *StudentMysqlDao) ListStudents(afterId string, limit int) ([]model.StudentDB, error) {
+	var studentDBs []model.StudentDB
+	err := d.DB.Raw("select * from student where id > ? order by id limit ?", afterId, limit).Scan(&studentDBs).Error
+	if err != nil {
+		return nil, fmt.Errorf("StudentMysqlDao.ListStudents err:%w", err)
+	}
+	return studentDBs, nil
+}
+
+// QueryStudents 按班级、性别和科目查找学生 为空的条件不参与查询 按id排序
+func (d *StudentMysqlDao) QueryStudents(class string, gender string, subject string) ([]model.StudentDB, error) {
+	sqlStmt := "select * from student where 1 = 1"
+	var args []interface{}
+	if class != "" {
+		sqlStmt += " and class = ?"
+		args = append(args, class)
+	}
+	if gender != "" {
+		sqlStmt += " and gender = ?"
+		args = append(args, gender)
+	}
+	if subject != "" {
+		sqlStmt += " and exists (select 1 from grade where grade.student_id = student.id and grade.subject = ?)"
+		args = append(args, subject)
+	}
+	var studentDBs []model.StudentDB
+	err := d.DB.Raw(sqlStmt+" order by id", args...).Scan(&studentDBs).Error
+	if err != nil {
+		return nil, fmt.Errorf("StudentMysqlDao.QueryStudents err:%w", err)
+	}
+	return studentDBs, nil
+}
+
 // GetStudentCount 获取学生访问次数
 func (d *StudentMysqlDao) GetStudentCount(id string) (*model.StudentCount, error) {
 	var count model.StudentCount
@@ -179,3 +227,70 @@ func (d *StudentMysqlDao) GetHotStudentCounts() ([]*model.StudentCount, error) {
 	}
 	return counts, nil
 }
+
+// SaveStudent 添加或覆盖学生信息（不包含成绩）
+func (d *StudentMysqlDao) SaveStudent(tx *gorm.DB, student *model.Student) error {
+	err := tx.Exec(`insert into student (id,name,gender,class,expiration,expiration_mode) values (?,?,?,?,?,?)
+        on duplicate key update name=values(name),gender=values(gender),class=values(class),expiration=values(expiration),expiration_mode=values(expiration_mode)`,
+		student.ID, student.Name, student.Gender, student.Class, student.Expiration, student.ExpirationMode).Error
+	if err != nil {
+		return fmt.Errorf("StudentMysqlDao.SaveStudent err:%w", err)
+	}
+	return nil
+}
+
+// InitStudentExpirationModeColumn 给旧的学生表加上过期方式字段 已经有这个字段时什么也不做
+func (d *StudentMysqlDao) InitStudentExpirationModeColumn() error {
+	var count int64
+	err := d.DB.Raw(`select count(*) from information_schema.columns
+        where table_schema = database() and table_name = 'student' and column_name = 'expiration_mode'`).Scan(&count).Error
+	if err != nil {
+		return fmt.Errorf("StudentMysqlDao.InitStudentExpirationModeColumn err:%w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	if err = d.DB.Exec("alter table student add column expiration_mode varchar(16) not null default ''").Error; err != nil {
+		return fmt.Errorf("StudentMysqlDao.InitStudentExpirationModeColumn err:%w", err)
+	}
+	return nil
+}
+
+// Transaction 在一个事务中执行fn fn返回错误或者panic时回滚 否则提交
+func (d *StudentMysqlDao) Transaction(fn func(tx *gorm.DB) error) error {
+	return d.DB.Transaction(fn)
+}
+
+// InitOutboxProgressTable 创建记录发件箱持久化进度的表 并插入进度为0的记录 之后的事务都锁这一行
+func (d *StudentMysqlDao) InitOutboxProgressTable() error {
+	err := d.DB.Exec(`create table if not exists raft_outbox_progress (
+        id tinyint primary key,
+        applied_index bigint unsigned not null
+    )`).Error
+	if err != nil {
+		return fmt.Errorf("StudentMysqlDao.InitOutboxProgressTable err:%w", err)
+	}
+	if err = d.DB.Exec("insert ignore into raft_outbox_progress (id, applied_index) values (1, 0)").Error; err != nil {
+		return fmt.Errorf("StudentMysqlDao.InitOutboxProgressTable err:%w", err)
+	}
+	return nil
+}
+
+// LockOutboxProgress 在事务中锁住持久化进度并返回已经写入数据库的最大日志索引 事务结束前其他事务不能读取或修改进度
+func (d *StudentMysqlDao) LockOutboxProgress(tx *gorm.DB) (uint64, error) {
+	var appliedIndex uint64
+	err := tx.Raw("select applied_index from raft_outbox_progress where id = 1 for update").Scan(&appliedIndex).Error
+	if err != nil {
+		return 0, fmt.Errorf("StudentMysqlDao.LockOutboxProgress err:%w", err)
+	}
+	return appliedIndex, nil
+}
+
+// SetOutboxProgress 在事务中记录已经写入数据库的最大日志索引 进度只会增大
+func (d *StudentMysqlDao) SetOutboxProgress(tx *gorm.DB, index uint64) error {
+	err := tx.Exec("insert into raft_outbox_progress (id, applied_index) values (1, ?) on duplicate key update applied_index = greatest(applied_index, values(applied_index))", index).Error
+	if err != nil {
+		return fmt.Errorf("StudentMysqlDao.SetOutboxProgress err:%w", err)
+	}
+	return nil
+}
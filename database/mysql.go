@@ -16,3 +16,15 @@ func InitDB(dsn string) error {
 	}
 	return nil
 }
+
+// CloseDB 关闭数据库连接池
+func CloseDB() error {
+	if DB == nil {
+		return nil
+	}
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
@@ -0,0 +1,50 @@
+package interfaces
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"node2/model"
+	"time"
+)
+
+// StudentMysqlDaoInterface 定义MySQL数据层接口 服务层通过它访问数据库 测试时可以替换成假的实现
+type StudentMysqlDaoInterface interface {
+	GetStudent(id string) (*model.StudentDB, error)
+	AddStudentToMysql(tx *gorm.DB, student *model.Student) error
+	AddGradeToMysql(tx *gorm.DB, subject string, score float64, id string) error
+	GetGrade(studentId string) ([]model.Grade, error)
+	UpdateStudent(tx *gorm.DB, student *model.Student) error
+	UpdateGrade(tx *gorm.DB, subject string, score float64, studentId string) error
+	DeleteStudent(tx *gorm.DB, id string) error
+	DeleteScore(tx *gorm.DB, id string) error
+	GetGradeBySubject(id string, subject string) (*model.Grade, error)
+	GetAllStudents() ([]model.StudentDB, error)
+	GetAllStudentIds() ([]string, error)
+	ListStudents(afterId string, limit int) ([]model.StudentDB, error)
+	QueryStudents(class string, gender string, subject string) ([]model.StudentDB, error)
+	GetStudentCount(id string) (*model.StudentCount, error)
+	AddStudentCount(id string) error
+	UpdateStudentCount(record *model.StudentCount) error
+	DeleteStudentCount(id string) error
+	GetHotStudentCounts() ([]*model.StudentCount, error)
+	SaveStudent(tx *gorm.DB, student *model.Student) error
+	InitStudentExpirationModeColumn() error
+	Transaction(fn func(tx *gorm.DB) error) error
+	InitOutboxProgressTable() error
+	LockOutboxProgress(tx *gorm.DB) (uint64, error)
+	SetOutboxProgress(tx *gorm.DB, index uint64) error
+}
+
+// StudentCacheDaoInterface 定义Redis缓存数据层接口
+type StudentCacheDaoInterface interface {
+	AddStudent(student *model.Student) error
+	FillStudent(student *model.Student) error
+	RefreshStudent(student *model.Student) error
+	GetStudent(id string) (*model.Student, error)
+	GetStudentWithTTL(id string) (*model.Student, time.Duration, error)
+	DeleteStudent(id string) error
+	BeginReload() (int64, error)
+	FinishReload(ctx context.Context, generation int64, students []*model.Student) error
+	AbortReload(generation int64)
+	GetAllStudents() ([]*model.Student, error)
+}
@@ -7,11 +7,15 @@ import (
 
 // StudentServiceInterface 定义学生服务接口 解决fsm依赖service service依赖fsm导致的循环导入问题。。。
 type StudentServiceInterface interface {
-	AddStudentInternal(student *model.Student) error
-	UpdateStudentInternal(student *model.Student) error
-	DeleteStudentInternal(id string) error
-	ReLoadCacheDataInternal()
-	PeriodicDeleteInternal(examineSize int)
-	GetLeaderPortAddr() (string, error)
+	AddStudentInternal(student *model.Student)
+	UpdateStudentInternal(student *model.Student)
+	DeleteStudentInternal(id string)
+	ExpireStudentInternal(student *model.Student)
+	GetLeaderHttpAddr() (string, error)
 	UpdatePeersInternal(peer *config.Peer)
+	RemovePeerInternal(nodeID string)
+	SnapshotPeers() []*config.Peer
+	RestorePeers(peers []*config.Peer)
+	SnapshotMemoryDB() ([]*model.StudentSnapshotEntry, error)
+	RestoreMemoryDB(snapshot []*model.StudentSnapshotEntry) error
 }
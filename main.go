@@ -1,79 +1,181 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
+	"net/http"
 	"node2/cache"
 	"node2/config"
 	"node2/controller"
 	"node2/dao"
 	"node2/database"
+	"node2/model"
 	"node2/routers"
+	"node2/scheduler"
 	"node2/service"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// leaderLogInterval 启动后还不知道领导者时记录日志的间隔
+const leaderLogInterval = 5 * time.Second
+
+// shutdownTimeout 关闭时等待正在处理的HTTP请求完成的最长时间
+const shutdownTimeout = 15 * time.Second
+
+// 进程退出码 启动失败时log.Fatalf以1退出
+const (
+	exitOK             = 0 // 收到信号后正常关闭
+	exitServeFailed    = 2 // HTTP服务意外停止 之后仍然会尝试关闭其他组件
+	exitShutdownFailed = 3 // 关闭过程中有组件没有正常关闭
+)
+
 func main() {
-	// 初始化数据库和缓存
-	cfg := config.GetConfig()
+	// 加载配置 同一个程序通过不同的配置文件、环境变量或者命令行参数启动不同的节点
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatalf("加载配置失败：%v", err)
+	}
 
-	if err := database.InitDB(cfg.MySQL.DSN); err != nil {
+	// 初始化数据库和缓存
+	if err = database.InitDB(cfg.MySQL.DSN); err != nil {
 		log.Fatalf("节点：%s 初始化数据库失败: %v", cfg.Node.NodeId, err)
 	}
-	cache.InitRedis(cfg.Redis.Addr, cfg.Redis.Password, cfg.Redis.DB)
+	cache.InitRedis(cfg.Redis.Addr, *cfg.Redis.Password, cfg.Redis.DB)
 
 	// 初始化 DAO
-	studentCacheDao := dao.NewStudentCacheDao(cache.RedisClient)
+	studentCacheDao := dao.NewStudentCacheDao(cache.RedisClient, cfg.Redis.DefaultTTL)
 	studentMysqlDao := dao.NewStudentMysqlDao(database.DB)
-	memoryDBDao := dao.NewMemoryDBDao(cfg.MemoryDB.Capacity, cfg.MemoryDB.EvictRatio)
+	memoryDBDao, err := dao.NewStore[string, *model.Student](cfg.MemoryDB, model.CopyStudent)
+	if err != nil {
+		log.Fatalf("节点：%s 初始化内存数据库失败：%v", cfg.Node.NodeId, err)
+	}
 
 	// 初始化服务
-	studentCacheService := service.NewStudentCacheService(studentCacheDao)
+	studentCacheService := service.NewStudentCacheService(studentCacheDao, cfg.Redis.EarlyRefreshBeta)
 	studentMysqlService := service.NewStudentMysqlService(studentMysqlDao)
-	studentMdbService := service.NewStudentMdbService(memoryDBDao)
-	studentService, err := service.NewStudentService(studentMdbService, studentMysqlService, studentCacheService, cfg.Node, cfg.Peers)
+	studentMdbService := service.NewStudentMdbService(memoryDBDao, cfg.DumpPath())
+	// 在启动Raft之前初始化表 启动之后再失败退出会跳过关闭Raft和它的存储
+	if err = studentMysqlService.InitStudentExpirationModeColumn(); err != nil {
+		log.Fatalf("节点：%s 初始化学生表的过期方式字段失败：%v", cfg.Node.NodeId, err)
+	}
+	// 领导者把状态机中的修改写入MySQL时会记录进度 保证每条修改只写入一次
+	if err = studentMysqlService.InitOutboxProgressTable(); err != nil {
+		log.Fatalf("节点：%s 初始化发件箱进度表失败：%v", cfg.Node.NodeId, err)
+	}
+	// 重放AOF和预热内存数据库都在启动Raft之前进行 写入的学生不会和状态机应用的修改交错
+	// 只有节点已经有之前的Raft状态时才重放AOF 有快照时Raft恢复的快照会替换AOF中的内容
+	preload := service.MemoryPreload{
+		AOF:       cfg.MemoryDB.AOF,
+		AOFPath:   cfg.AOFPath(),
+		Capacity:  cfg.MemoryDB.Capacity,
+		LoadRatio: cfg.CachePreheating.LoadRatio,
+	}
+	studentService, err := service.NewStudentService(studentMdbService, studentMysqlService, studentCacheService, cfg.Node, cfg.Raft, cfg.Seeds(), preload)
 	if err != nil {
 		log.Fatalf("节点：%s 初始化学生服务层失败：%v", cfg.Node.NodeId, err)
 	}
 
-	// 初始化控制器
-	studentController := controller.NewStudentController(studentService)
-
-	//启动时加载缓存数据到内存
-	if err = studentService.LoadCacheToMemory(cfg.MemoryDB.Capacity, cfg.CachePreheating.LoadRatio); err != nil {
-		log.Printf("节点：%s 加载缓存到内存时失败：%v", cfg.Node.NodeId, err)
-		if err = studentService.LoadDateBaseToMemory(cfg.MemoryDB.Capacity, cfg.CachePreheating.LoadRatio); err != nil {
-			log.Printf("节点：%s 加载数据库中的数据到内存时失败：%v", cfg.Node.NodeId, err)
-		}
-		log.Printf("节点：%s 加载数据库到内存", cfg.Node.NodeId)
+	// 收到SIGINT或SIGTERM时取消ctx 后台协程都通过ctx退出
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	var background sync.WaitGroup
+	runInBackground := func(fn func()) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			fn()
+		}()
 	}
-	log.Printf("节点：%s 加载缓存到内存", cfg.Node.NodeId)
+	// 每个节点在本地主动删除内存数据库中的过期键
+	runInBackground(func() {
+		studentMdbService.RunActiveExpire(ctx, cfg.Server.ActiveExpireInterval, cfg.Server.ActiveExpireBudget)
+	})
 
-	//启动时等待10秒 第一个节点要等待领导者选举完成再获得地址
-	if cfg.Node.PortAddress == "8080" {
-		time.Sleep(10 * time.Second)
-		log.Printf("节点：%s 等待领导者选举完成", cfg.Node.NodeId)
+	// 内存中有数据库中的全部学生时 按条件查询学生可以直接使用内存中的二级索引
+	if err = studentService.VerifyMemoryComplete(); err != nil {
+		log.Printf("节点：%s 检查内存中的学生是否完整失败：%v", cfg.Node.NodeId, err)
 	}
-	leaderPortAddr, err := studentService.GetLeaderPortAddr()
-	//定期清空缓存 定期清除内存中的过期键 让领导者节点提交命令给所有节点
-	if err != nil {
-		log.Fatalf("节点：%s 获取领导者端口地址失败：%v", cfg.Node.NodeId, err)
+	// 有学生被淘汰或者过期后定期重新确认 否则第一次丢失数据之后就再也不会使用二级索引
+	runInBackground(func() { studentService.RunVerifyComplete(ctx, cfg.Server.VerifyInterval) })
+
+	// 不等待领导者选举完成 调度器由领导权变化驱动 选出领导者之前只记录日志
+	runInBackground(func() { studentService.LogUntilLeader(ctx, leaderLogInterval) })
+
+	// 后台任务只在领导者上执行 领导权变化时调度器会在新的领导者上启动任务 并停止旧领导者上的任务
+	jobScheduler := scheduler.NewScheduler()
+	// 领导者把发件箱中的修改写入MySQL和Redis 同一时刻只有一个节点在写入
+	jobScheduler.RegisterLoop("outboxPersister", studentService.RunOutboxPersister)
+	jobScheduler.Register("reloadCache", cfg.Server.ReloadInterval, studentService.ReLoadCacheJob)
+	runInBackground(func() { jobScheduler.Run(ctx, studentService.LeaderCh(), studentService.IsLeader()) })
+
+	// 初始化控制器
+	studentController := controller.NewStudentController(studentService, jobScheduler)
+
+	//初始化路由
+	studentRouter := routers.SetUpStudentRouter(studentController)
+	server := &http.Server{
+		Addr:    ":" + cfg.Node.PortAddress,
+		Handler: studentRouter,
 	}
+	// Shutdown会等待正在处理的请求完成 事件流不会自己结束 所以关闭订阅让它们结束
+	server.RegisterOnShutdown(studentService.MdbService.CloseSubscriptions)
+	exitCode := exitOK
+	serveErr := make(chan error, 1)
 	go func() {
-		if cfg.Node.PortAddress == leaderPortAddr {
-			studentService.ReLoadCacheData(cfg.Server.ReloadInterval)
-		}
+		serveErr <- server.ListenAndServe()
 	}()
+	select {
+	case <-ctx.Done():
+		log.Printf("节点：%s 收到退出信号 开始关闭", cfg.Node.NodeId)
+	case err = <-serveErr:
+		log.Printf("节点：%s HTTP服务意外停止：%v 开始关闭", cfg.Node.NodeId, err)
+		exitCode = exitServeFailed
+	}
+	stop()
 
-	//定期删除内存数据库过期键
-	go func() {
-		if cfg.Node.PortAddress == leaderPortAddr {
-			studentService.PeriodicDelete(cfg.Server.PeriodicDeleteInterval, cfg.Server.ExamineSize)
-		}
-	}()
-	//初始化路由
-	studentRouter := routers.SetUpStudentRouter(studentController)
-	serverAddress := ":" + cfg.Node.PortAddress
-	if err = studentRouter.Run(serverAddress); err != nil {
-		log.Fatalf("节点：%s 初始化学生路由时出错：%v", cfg.Node.NodeId, err)
+	if code := shutdown(cfg.Node.NodeId, server, &background, studentService); code != exitOK && exitCode == exitOK {
+		exitCode = code
+	}
+	log.Printf("节点：%s 已退出 退出码：%d", cfg.Node.NodeId, exitCode)
+	os.Exit(exitCode)
+}
+
+// shutdown 按顺序关闭各个组件 先停止接收请求并等待正在处理的请求完成 再停止后台协程 然后转移领导权并关闭Raft
+// 最后关闭Redis和MySQL的连接池 因为前面的组件都可能用到它们
+func shutdown(nodeId string, server *http.Server, background *sync.WaitGroup, studentService *service.StudentService) int {
+	exitCode := exitOK
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("节点：%s 关闭HTTP服务失败：%v", nodeId, err)
+		exitCode = exitShutdownFailed
+	}
+	background.Wait()
+	if err := studentService.Shutdown(); err != nil {
+		log.Printf("节点：%s 关闭Raft节点失败：%v", nodeId, err)
+		exitCode = exitShutdownFailed
+	}
+	// Raft关闭后内存数据库不会再被修改
+	if err := studentService.MdbService.CloseAOF(); err != nil {
+		log.Printf("节点：%s 关闭AOF失败：%v", nodeId, err)
+		exitCode = exitShutdownFailed
+	}
+	if err := cache.CloseRedis(); err != nil {
+		log.Printf("节点：%s 关闭Redis连接池失败：%v", nodeId, err)
+		exitCode = exitShutdownFailed
+	}
+	if err := database.CloseDB(); err != nil {
+		log.Printf("节点：%s 关闭MySQL连接池失败：%v", nodeId, err)
+		exitCode = exitShutdownFailed
 	}
+	return exitCode
 }
@@ -0,0 +1,7 @@
+package model
+
+// StudentSnapshotEntry 内存数据库快照中的单个学生 快照中的条目按LRU顺序从最近访问到最久未访问排列
+type StudentSnapshotEntry struct {
+	Student  *Student `json:"student"`
+	ExpireAt int64    `json:"expire_at"` // 过期时间点 unix纳秒 0表示永不过期
+}
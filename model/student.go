@@ -1,22 +1,74 @@
 package model
 
+import "unsafe"
+
+// 学生的过期方式 Expiration小于等于0时永不过期
+const (
+	ExpireAbsolute = "absolute" // 写入后经过Expiration秒过期 访问不会延长过期时间 为空时也是这种方式
+	ExpireSliding  = "sliding"  // 每次访问后重新计时 连续Expiration秒没有访问才过期
+	ExpireNever    = "never"    // 永不过期
+)
+
+// ValidExpirationMode 判断过期方式是否合法 空字符串表示默认的absolute
+func ValidExpirationMode(mode string) bool {
+	switch mode {
+	case "", ExpireAbsolute, ExpireSliding, ExpireNever:
+		return true
+	}
+	return false
+}
+
 // Student 定义学生结构体
 type Student struct {
-	ID         string             `json:"id" validate:"required"`
-	Name       string             `json:"name" validate:"required"`
-	Gender     string             `json:"gender" validate:"required"`
-	Class      string             `json:"class" validate:"required"`
-	Grades     map[string]float64 `json:"grades"`
-	Expiration int64              `json:"expiration"`
+	ID             string             `json:"id" validate:"required"`
+	Name           string             `json:"name" validate:"required"`
+	Gender         string             `json:"gender" validate:"required"`
+	Class          string             `json:"class" validate:"required"`
+	Grades         map[string]float64 `json:"grades"`
+	Expiration     int64              `json:"expiration"`      // 过期时间 单位秒
+	ExpirationMode string             `json:"expiration_mode"` // 过期方式 absolute、sliding或者never
+}
+
+// CopyStudent 深拷贝学生 内存数据库用它保存和返回副本 快照和内存数据库之间不能共享Grades map
+func CopyStudent(student *Student) *Student {
+	if student == nil {
+		return nil
+	}
+	s := *student
+	if student.Grades != nil {
+		s.Grades = make(map[string]float64, len(student.Grades))
+		for k, v := range student.Grades {
+			s.Grades[k] = v
+		}
+	}
+	return &s
+}
+
+// gradeEntrySize Grades中每个成绩除了科目名称以外的开销 包括字符串头、分数和map桶的平均开销
+const gradeEntrySize = int(unsafe.Sizeof("")) + int(unsafe.Sizeof(float64(0))) + 8
+
+// MemorySize 估算学生在内存中占用的字节数 包括结构体本身、字符串内容和Grades map
+// 只是估算值 用于内存数据库按字节数限制容量
+func (s *Student) MemorySize() int {
+	size := int(unsafe.Sizeof(*s)) + len(s.ID) + len(s.Name) + len(s.Gender) + len(s.Class) + len(s.ExpirationMode)
+	if s.Grades != nil {
+		// map头部的开销
+		size += 48
+		for subject := range s.Grades {
+			size += gradeEntrySize + len(subject)
+		}
+	}
+	return size
 }
 
 // StudentDB 关联mysql的学生表
 type StudentDB struct {
-	ID         string `json:"id" validate:"required" gorm:"primaryKey"`
-	Name       string `json:"name" validate:"required"`
-	Gender     string `json:"gender" validate:"required"`
-	Class      string `json:"class" validate:"required"`
-	Expiration int64  `json:"expiration"`
+	ID             string `json:"id" validate:"required" gorm:"primaryKey"`
+	Name           string `json:"name" validate:"required"`
+	Gender         string `json:"gender" validate:"required"`
+	Class          string `json:"class" validate:"required"`
+	Expiration     int64  `json:"expiration"`
+	ExpirationMode string `json:"expiration_mode"`
 }
 
 // Grade 关联mysql的成绩表
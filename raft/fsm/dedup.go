@@ -0,0 +1,105 @@
+package fsm
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// dedupCapacity 去重表最多记住的请求数量 超过后按提交顺序淘汰最早的请求
+const dedupCapacity = 10000
+
+// ErrRequestConflict 请求id已经用于操作或者内容不同的请求 不会执行 也不会返回之前请求的结果
+var ErrRequestConflict = errors.New("请求id已经用于不同的请求")
+
+// DedupEntry 去重表中的一条记录 记录请求id、请求的指纹和它第一次执行时状态机返回的结果
+type DedupEntry struct {
+	RequestId   string `json:"request_id"`
+	Fingerprint string `json:"fingerprint,omitempty"` // 为空表示旧版本记录的请求 不检查指纹
+	Error       string `json:"error,omitempty"`       // 为空表示第一次执行成功
+}
+
+// dedupResult 请求第一次执行的指纹和结果
+type dedupResult struct {
+	fingerprint string
+	message     string
+}
+
+// dedupTable 有界的请求去重表 所有节点按相同的日志顺序写入和淘汰 所以各个节点的去重表完全一致
+type dedupTable struct {
+	mu      sync.RWMutex
+	results map[string]dedupResult
+	order   []string // 按提交顺序排列的请求id 用于淘汰最早的请求
+}
+
+// newDedupTable 创建一个空的去重表
+func newDedupTable() *dedupTable {
+	return &dedupTable{results: make(map[string]dedupResult)}
+}
+
+// lookup 查找请求第一次执行的结果 指纹和第一次的请求不同时返回ErrRequestConflict
+// 任何一方的指纹为空时不检查 兼容旧版本日志中没有指纹的命令
+func (d *dedupTable) lookup(requestId string, fingerprint string) (error, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	result, exists := d.results[requestId]
+	if !exists {
+		return nil, false
+	}
+	if fingerprint != "" && result.fingerprint != "" && fingerprint != result.fingerprint {
+		return fmt.Errorf("%w：%s", ErrRequestConflict, requestId), true
+	}
+	if result.message == "" {
+		return nil, true
+	}
+	return errors.New(result.message), true
+}
+
+// record 记录请求的指纹和执行结果 超过容量时淘汰最早的请求
+func (d *dedupTable) record(requestId string, fingerprint string, result interface{}) {
+	var message string
+	if err, ok := result.(error); ok && err != nil {
+		message = err.Error()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, exists := d.results[requestId]; exists {
+		return
+	}
+	d.results[requestId] = dedupResult{fingerprint: fingerprint, message: message}
+	d.order = append(d.order, requestId)
+	if len(d.order) > dedupCapacity {
+		delete(d.results, d.order[0])
+		d.order[0] = ""
+		d.order = d.order[1:]
+	}
+}
+
+// snapshot 按提交顺序导出去重表
+func (d *dedupTable) snapshot() []DedupEntry {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	entries := make([]DedupEntry, 0, len(d.order))
+	for _, requestId := range d.order {
+		result := d.results[requestId]
+		entries = append(entries, DedupEntry{RequestId: requestId, Fingerprint: result.fingerprint, Error: result.message})
+	}
+	return entries
+}
+
+// restore 用快照中的记录替换去重表
+func (d *dedupTable) restore(entries []DedupEntry) {
+	results := make(map[string]dedupResult, len(entries))
+	order := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if _, exists := results[entry.RequestId]; exists {
+			continue
+		}
+		results[entry.RequestId] = dedupResult{fingerprint: entry.Fingerprint, message: entry.Error}
+		order = append(order, entry.RequestId)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.results = results
+	d.order = order
+}
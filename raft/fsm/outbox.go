@@ -0,0 +1,96 @@
+package fsm
+
+import (
+	"node2/model"
+	"sync"
+)
+
+// OutboxEntry 发件箱中的一条待持久化的修改 状态机只修改内存 对MySQL和Redis的写入由领导者按日志索引顺序执行一次
+type OutboxEntry struct {
+	Index     uint64         `json:"index"` // 产生这条修改的Raft日志索引 持久化进度按这个索引记录
+	Operation string         `json:"operation"`
+	Student   *model.Student `json:"student,omitempty"` // 添加和更新时是修改后的完整学生
+	Id        string         `json:"id"`
+}
+
+// outbox 复制的发件箱 所有节点按相同的日志顺序追加和确认 所以各个节点的发件箱完全一致
+// 领导者持久化完成后提交outboxAck命令 所有节点一起删除已经持久化的修改
+type outbox struct {
+	mu      sync.RWMutex
+	entries []OutboxEntry
+	latest  map[string]OutboxEntry // 每个学生最新的还没有确认的修改 读者查找学生时不需要遍历整个发件箱
+	notify  chan struct{}          // 有新的修改时通知持久化协程
+}
+
+// newOutbox 创建一个空的发件箱
+func newOutbox() *outbox {
+	return &outbox{latest: make(map[string]OutboxEntry), notify: make(chan struct{}, 1)}
+}
+
+// append 追加一条修改 并通知持久化协程
+func (o *outbox) append(entry OutboxEntry) {
+	entry.Student = model.CopyStudent(entry.Student)
+	o.mu.Lock()
+	o.entries = append(o.entries, entry)
+	o.latest[entry.Id] = entry
+	o.mu.Unlock()
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// ack 删除日志索引不超过index的修改
+func (o *outbox) ack(index uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	i := 0
+	for i < len(o.entries) && o.entries[i].Index <= index {
+		// 学生之后还有修改时保留最新的那条
+		if latest := o.latest[o.entries[i].Id]; latest.Index == o.entries[i].Index {
+			delete(o.latest, o.entries[i].Id)
+		}
+		i++
+	}
+	o.entries = append([]OutboxEntry(nil), o.entries[i:]...)
+}
+
+// latestFor 返回学生最新的还没有确认的修改 exists为false表示发件箱中没有这个学生的修改
+func (o *outbox) latestFor(id string) (entry OutboxEntry, exists bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if entry, exists = o.latest[id]; exists {
+		entry.Student = model.CopyStudent(entry.Student)
+	}
+	return entry, exists
+}
+
+// pending 按日志索引顺序返回所有还没有确认的修改
+func (o *outbox) pending() []OutboxEntry {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	entries := make([]OutboxEntry, len(o.entries))
+	for i, entry := range o.entries {
+		entry.Student = model.CopyStudent(entry.Student)
+		entries[i] = entry
+	}
+	return entries
+}
+
+// restore 用快照中的修改替换发件箱
+func (o *outbox) restore(entries []OutboxEntry) {
+	latest := make(map[string]OutboxEntry, len(entries))
+	for _, entry := range entries {
+		latest[entry.Id] = entry
+	}
+	o.mu.Lock()
+	o.entries = append([]OutboxEntry(nil), entries...)
+	o.latest = latest
+	o.mu.Unlock()
+	if len(entries) > 0 {
+		select {
+		case o.notify <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package fsm
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/raft"
@@ -10,24 +12,97 @@ import (
 	"node2/model"
 )
 
+// SnapshotVersion 当前快照格式的版本号 快照格式发生不兼容的变化时需要递增
+const SnapshotVersion = 1
+
+// MaxRequestIdLength 请求id的最大长度
+const MaxRequestIdLength = 128
+
 // StudentCommand 定义 Node 日志条目的结构
 type StudentCommand struct {
 	Operation   string         `json:"operation"`
 	Student     *model.Student `json:"student,omitempty"`
 	Id          string         `json:"id"`
-	ExamineSize int            `json:"examine_size"`
-	Peer        *config.Peer
+	Peer        *config.Peer   `json:"peer,omitempty"`
+	RequestId   string         `json:"request_id,omitempty"`  // 客户端请求id 重试的命令会被状态机去重
+	Fingerprint string         `json:"fingerprint,omitempty"` // 领导者计算的客户端请求的指纹 相同请求id的请求指纹不同时拒绝执行
+	AckIndex    uint64         `json:"ack_index,omitempty"`   // 领导者已经持久化到的日志索引 只用于outboxAck命令
+}
+
+// RequestFingerprint 计算客户端请求的操作和内容的指纹 需要在领导者合并学生信息之前计算
+// encoding/json按键的顺序编码map 所以相同的请求得到相同的指纹
+func (cmd *StudentCommand) RequestFingerprint() (string, error) {
+	payload, err := json.Marshal(struct {
+		Operation string         `json:"operation"`
+		Student   *model.Student `json:"student,omitempty"`
+		Id        string         `json:"id,omitempty"`
+	}{cmd.Operation, cmd.Student, cmd.Id})
+	if err != nil {
+		return "", fmt.Errorf("StudentCommand.RequestFingerprint 编码请求失败：%w", err)
+	}
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Validate 检查命令的结构是否合法 不合法的命令不会提交到Raft
+func (cmd *StudentCommand) Validate() error {
+	switch cmd.Operation {
+	case "add", "update", "expire":
+		if cmd.Student == nil || cmd.Student.ID == "" {
+			return fmt.Errorf("操作：%s缺少学生或学生id", cmd.Operation)
+		}
+		if !model.ValidExpirationMode(cmd.Student.ExpirationMode) {
+			return fmt.Errorf("过期方式：%s只能是absolute、sliding或never", cmd.Student.ExpirationMode)
+		}
+		if cmd.Operation == "expire" && cmd.Student.ExpirationMode != model.ExpireNever && cmd.Student.Expiration <= 0 {
+			return fmt.Errorf("操作：%s的过期时间必须大于0", cmd.Operation)
+		}
+	case "delete", "removePeer":
+		if cmd.Id == "" {
+			return fmt.Errorf("操作：%s缺少id", cmd.Operation)
+		}
+	case "updatePeers":
+		if cmd.Peer == nil || cmd.Peer.NodeId == "" {
+			return fmt.Errorf("操作：%s缺少节点信息", cmd.Operation)
+		}
+	case "outboxAck":
+		if cmd.AckIndex == 0 {
+			return fmt.Errorf("操作：%s缺少日志索引", cmd.Operation)
+		}
+	default:
+		return fmt.Errorf("未知的操作：%s", cmd.Operation)
+	}
+	if len(cmd.RequestId) > MaxRequestIdLength {
+		return fmt.Errorf("请求id长度不能超过%d", MaxRequestIdLength)
+	}
+	return nil
+}
+
+// IsClientOperation 判断操作是不是客户端对学生的增删改 只有这些命令可以由跟随者转发给领导者
+// 节点地址和发件箱进度等内部命令只能由领导者自己提交
+func IsClientOperation(operation string) bool {
+	switch operation {
+	case "add", "update", "delete", "expire":
+		return true
+	default:
+		return false
+	}
 }
 
-// StudentFSM 实现 raft.FSM 接口
+// StudentFSM 实现 raft.FSM 接口 状态机只修改内存中的数据 所有节点执行相同的日志后状态完全一致
+// 对MySQL和Redis的修改写入发件箱 由领导者按日志索引持久化一次
 type StudentFSM struct {
 	service interfaces.StudentServiceInterface
+	dedup   *dedupTable
+	outbox  *outbox
 }
 
 // NewStudentFSM 创建一个新的 StudentFSM 实例
 func NewStudentFSM(service interfaces.StudentServiceInterface) *StudentFSM {
 	return &StudentFSM{
 		service: service,
+		dedup:   newDedupTable(),
+		outbox:  newOutbox(),
 	}
 }
 
@@ -37,34 +112,141 @@ func (fsm *StudentFSM) Apply(log *raft.Log) interface{} {
 	if err := json.Unmarshal(log.Data, &cmd); err != nil {
 		return fmt.Errorf("fsm.Apply unmarshal cmd fail: %s", err)
 	}
+	if cmd.RequestId == "" {
+		return fsm.apply(&cmd, log.Index)
+	}
+	// 重复的请求直接返回第一次执行的结果 不再重复执行 内容不同的请求返回ErrRequestConflict
+	if result, duplicated := fsm.dedup.lookup(cmd.RequestId, cmd.Fingerprint); duplicated {
+		return result
+	}
+	result := fsm.apply(&cmd, log.Index)
+	fsm.dedup.record(cmd.RequestId, cmd.Fingerprint, result)
+	return result
+}
+
+// apply 执行命令 index是命令所在的日志索引
+// 添加、更新、删除在领导者提交之前已经检查过 这里不会访问MySQL和Redis 也不会失败
+func (fsm *StudentFSM) apply(cmd *StudentCommand, index uint64) interface{} {
+	// 先放进发件箱再修改内存 读者在内存中找不到学生时先查发件箱 不会把缓存或数据库中的旧数据写回内存
 	switch cmd.Operation {
 	case "add":
-		return fsm.service.AddStudentInternal(cmd.Student)
+		fsm.outbox.append(OutboxEntry{Index: index, Operation: cmd.Operation, Student: cmd.Student, Id: cmd.Student.ID})
+		fsm.service.AddStudentInternal(cmd.Student)
+		return nil
 	case "update":
-		return fsm.service.UpdateStudentInternal(cmd.Student)
+		fsm.outbox.append(OutboxEntry{Index: index, Operation: cmd.Operation, Student: cmd.Student, Id: cmd.Student.ID})
+		fsm.service.UpdateStudentInternal(cmd.Student)
+		return nil
+	case "expire":
+		// 修改过期设置后学生信息也变了 和更新一样写入MySQL和Redis
+		fsm.outbox.append(OutboxEntry{Index: index, Operation: "update", Student: cmd.Student, Id: cmd.Student.ID})
+		fsm.service.ExpireStudentInternal(cmd.Student)
+		return nil
 	case "delete":
-		return fsm.service.DeleteStudentInternal(cmd.Id)
+		fsm.outbox.append(OutboxEntry{Index: index, Operation: cmd.Operation, Id: cmd.Id})
+		fsm.service.DeleteStudentInternal(cmd.Id)
+		return nil
+	case "outboxAck":
+		fsm.outbox.ack(cmd.AckIndex)
+		return nil
 	case "reloadCacheData":
-		fsm.service.ReLoadCacheDataInternal()
+		// 旧版本会在每个节点上重新加载Redis 现在由领导者直接执行 这里只是为了兼容日志中已有的命令
 		return nil
 	case "periodicDelete":
-		fsm.service.PeriodicDeleteInternal(cmd.ExamineSize)
+		// 旧版本通过Raft在每个节点上删除过期键 现在每个节点在本地主动删除 这里只是为了兼容日志中已有的命令
 		return nil
 	case "updatePeers":
 		fsm.service.UpdatePeersInternal(cmd.Peer)
 		return nil
+	case "removePeer":
+		fsm.service.RemovePeerInternal(cmd.Id)
+		return nil
 	default:
 		return fmt.Errorf("fsm.Apply unknown operation: %s", cmd.Operation)
 	}
 }
 
-// Snapshot 实现快照功能
+// studentSnapshotData 快照的序列化格式 包含内存数据库中的全部学生及其过期时间 学生按LRU顺序排列 节点的地址映射 请求去重表 以及还没有持久化的发件箱
+type studentSnapshotData struct {
+	Version  int                           `json:"version"`
+	Students []*model.StudentSnapshotEntry `json:"students"`
+	Peers    []*config.Peer                `json:"peers,omitempty"`
+	Dedup    []DedupEntry                  `json:"dedup,omitempty"`
+	Outbox   []OutboxEntry                 `json:"outbox,omitempty"`
+}
+
+// studentSnapshot 实现 raft.FSMSnapshot 接口
+type studentSnapshot struct {
+	data []byte
+}
+
+// Snapshot 实现快照功能 Raft保证Snapshot和Apply不会并发调用 所以在这里导出的内存数据库状态是一致的
 func (fsm *StudentFSM) Snapshot() (raft.FSMSnapshot, error) {
-	return nil, nil
+	students, err := fsm.service.SnapshotMemoryDB()
+	if err != nil {
+		return nil, fmt.Errorf("fsm.Snapshot 导出内存数据库失败：%w", err)
+	}
+	data, err := json.Marshal(&studentSnapshotData{
+		Version:  SnapshotVersion,
+		Students: students,
+		Peers:    fsm.service.SnapshotPeers(),
+		Dedup:    fsm.dedup.snapshot(),
+		Outbox:   fsm.outbox.pending(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fsm.Snapshot marshal snapshot fail: %w", err)
+	}
+	return &studentSnapshot{data: data}, nil
 }
 
-// Restore 恢复状态机到快照状态
+// Restore 恢复状态机到快照状态 快照完整解析成功后才会替换内存数据库
 func (fsm *StudentFSM) Restore(snapshot io.ReadCloser) error {
 	defer snapshot.Close()
+	var data studentSnapshotData
+	if err := json.NewDecoder(snapshot).Decode(&data); err != nil {
+		return fmt.Errorf("fsm.Restore unmarshal snapshot fail: %w", err)
+	}
+	if data.Version != SnapshotVersion {
+		return fmt.Errorf("fsm.Restore 不支持的快照版本：%d 当前版本：%d", data.Version, SnapshotVersion)
+	}
+	if err := fsm.service.RestoreMemoryDB(data.Students); err != nil {
+		return err
+	}
+	fsm.service.RestorePeers(data.Peers)
+	fsm.dedup.restore(data.Dedup)
+	fsm.outbox.restore(data.Outbox)
 	return nil
 }
+
+// PendingOutbox 按日志索引顺序返回发件箱中还没有持久化的修改
+func (fsm *StudentFSM) PendingOutbox() []OutboxEntry {
+	return fsm.outbox.pending()
+}
+
+// PendingStudent 返回发件箱中学生最新的还没有持久化的修改 exists为false表示没有
+func (fsm *StudentFSM) PendingStudent(id string) (entry OutboxEntry, exists bool) {
+	return fsm.outbox.latestFor(id)
+}
+
+// OutboxNotify 发件箱有新的修改时会收到通知
+func (fsm *StudentFSM) OutboxNotify() <-chan struct{} {
+	return fsm.outbox.notify
+}
+
+// AppliedResult 返回请求第一次执行的结果 applied为false表示请求还没有执行过
+// fingerprint和第一次的请求不同时返回ErrRequestConflict 为空时不检查
+func (fsm *StudentFSM) AppliedResult(requestId string, fingerprint string) (result error, applied bool) {
+	return fsm.dedup.lookup(requestId, fingerprint)
+}
+
+// Persist 把快照数据写入快照存储
+func (s *studentSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s.data); err != nil {
+		sink.Cancel()
+		return fmt.Errorf("studentSnapshot.Persist 写入快照失败：%w", err)
+	}
+	return sink.Close()
+}
+
+// Release 快照数据只保存在内存中 不需要释放其他资源
+func (s *studentSnapshot) Release() {}
@@ -0,0 +1,500 @@
+package fsm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/raft"
+	"io"
+	"node2/config"
+	"node2/model"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeService 用map模拟内存数据库和节点地址映射的服务层
+type fakeService struct {
+	mu       sync.Mutex
+	students map[string]*model.StudentSnapshotEntry
+	peers    map[string]*config.Peer
+	deletes  int // DeleteStudentInternal被调用的次数
+}
+
+func newFakeService() *fakeService {
+	return &fakeService{
+		students: make(map[string]*model.StudentSnapshotEntry),
+		peers:    make(map[string]*config.Peer),
+	}
+}
+
+func (s *fakeService) AddStudentInternal(student *model.Student) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.students[student.ID] = &model.StudentSnapshotEntry{Student: model.CopyStudent(student)}
+}
+
+func (s *fakeService) UpdateStudentInternal(student *model.Student) {
+	s.AddStudentInternal(student)
+}
+
+func (s *fakeService) DeleteStudentInternal(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deletes++
+	delete(s.students, id)
+}
+
+func (s *fakeService) ExpireStudentInternal(student *model.Student) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := &model.StudentSnapshotEntry{Student: model.CopyStudent(student)}
+	if student.ExpirationMode != model.ExpireNever {
+		entry.ExpireAt = time.Now().Add(time.Duration(student.Expiration) * time.Second).UnixNano()
+	}
+	s.students[student.ID] = entry
+}
+
+func (s *fakeService) GetLeaderHttpAddr() (string, error) {
+	return "", fmt.Errorf("fakeService 没有领导者地址")
+}
+
+func (s *fakeService) UpdatePeersInternal(peer *config.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peerCopy := *peer
+	s.peers[peer.NodeId] = &peerCopy
+}
+
+func (s *fakeService) RemovePeerInternal(nodeID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, nodeID)
+}
+
+func (s *fakeService) SnapshotPeers() []*config.Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make([]*config.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peerCopy := *peer
+		peers = append(peers, &peerCopy)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].NodeId < peers[j].NodeId })
+	return peers
+}
+
+func (s *fakeService) RestorePeers(peers []*config.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers = make(map[string]*config.Peer, len(peers))
+	for _, peer := range peers {
+		peerCopy := *peer
+		s.peers[peer.NodeId] = &peerCopy
+	}
+}
+
+func (s *fakeService) SnapshotMemoryDB() ([]*model.StudentSnapshotEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]*model.StudentSnapshotEntry, 0, len(s.students))
+	for _, entry := range s.students {
+		entries = append(entries, &model.StudentSnapshotEntry{Student: model.CopyStudent(entry.Student), ExpireAt: entry.ExpireAt})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Student.ID < entries[j].Student.ID })
+	return entries, nil
+}
+
+func (s *fakeService) RestoreMemoryDB(snapshot []*model.StudentSnapshotEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.students = make(map[string]*model.StudentSnapshotEntry, len(snapshot))
+	for _, entry := range snapshot {
+		s.students[entry.Student.ID] = &model.StudentSnapshotEntry{Student: model.CopyStudent(entry.Student), ExpireAt: entry.ExpireAt}
+	}
+	return nil
+}
+
+// bufferSink 把快照写到内存中的raft.SnapshotSink
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (s *bufferSink) ID() string    { return "test" }
+func (s *bufferSink) Cancel() error { return nil }
+func (s *bufferSink) Close() error  { return nil }
+
+// applyCommand 把命令当作指定索引的日志应用到状态机
+func applyCommand(t *testing.T, fsm *StudentFSM, index uint64, cmd StudentCommand) interface{} {
+	t.Helper()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatalf("序列化命令失败：%v", err)
+	}
+	return fsm.Apply(&raft.Log{Index: index, Data: data})
+}
+
+// snapshotBytes 对状态机做快照并返回序列化后的数据
+func snapshotBytes(t *testing.T, fsm *StudentFSM) []byte {
+	t.Helper()
+	snapshot, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("快照失败：%v", err)
+	}
+	defer snapshot.Release()
+	var sink bufferSink
+	if err = snapshot.Persist(&sink); err != nil {
+		t.Fatalf("写入快照失败：%v", err)
+	}
+	return sink.Bytes()
+}
+
+func newStudent(id string) *model.Student {
+	return &model.Student{ID: id, Name: "name-" + id, Gender: "男", Class: "1班",
+		Grades: map[string]float64{"math": 90}, ExpirationMode: model.ExpireNever}
+}
+
+// TestSnapshotRoundTrip 快照恢复后学生、过期时间、节点地址、去重表和发件箱都和快照前一致
+func TestSnapshotRoundTrip(t *testing.T) {
+	source := newFakeService()
+	fsm := NewStudentFSM(source)
+	applyCommand(t, fsm, 1, StudentCommand{Operation: "add", Student: newStudent("1"), RequestId: "add-1"})
+	applyCommand(t, fsm, 2, StudentCommand{Operation: "add", Student: newStudent("2"), RequestId: "add-2"})
+	applyCommand(t, fsm, 3, StudentCommand{Operation: "add", Student: newStudent("3")})
+	expiring := newStudent("2")
+	expiring.Expiration = 3600
+	expiring.ExpirationMode = model.ExpireAbsolute
+	applyCommand(t, fsm, 4, StudentCommand{Operation: "expire", Student: expiring, RequestId: "expire-2"})
+	applyCommand(t, fsm, 5, StudentCommand{Operation: "delete", Id: "3", RequestId: "delete-3"})
+	applyCommand(t, fsm, 6, StudentCommand{Operation: "updatePeers", Peer: &config.Peer{NodeId: "node1", Address: "127.0.0.1:7001", PortAddress: "8001", HttpAddress: "127.0.0.1:8001"}})
+	applyCommand(t, fsm, 7, StudentCommand{Operation: "outboxAck", AckIndex: 2})
+
+	restored := newFakeService()
+	restoredFSM := NewStudentFSM(restored)
+	if err := restoredFSM.Restore(io.NopCloser(bytes.NewReader(snapshotBytes(t, fsm)))); err != nil {
+		t.Fatalf("恢复快照失败：%v", err)
+	}
+
+	wantStudents, _ := source.SnapshotMemoryDB()
+	gotStudents, _ := restored.SnapshotMemoryDB()
+	if !reflect.DeepEqual(gotStudents, wantStudents) {
+		t.Errorf("恢复后的学生：%+v 期望：%+v", gotStudents, wantStudents)
+	}
+	if len(gotStudents) != 2 || gotStudents[1].ExpireAt == 0 {
+		t.Errorf("学生2的过期时间没有恢复：%+v", gotStudents)
+	}
+	if got, want := restored.SnapshotPeers(), source.SnapshotPeers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("恢复后的节点地址：%+v 期望：%+v", got, want)
+	}
+	if got, want := restoredFSM.PendingOutbox(), fsm.PendingOutbox(); !reflect.DeepEqual(got, want) {
+		t.Errorf("恢复后的发件箱：%+v 期望：%+v", got, want)
+	}
+	if pending := restoredFSM.PendingOutbox(); len(pending) != 3 || pending[0].Index != 3 {
+		t.Errorf("发件箱应该只剩下索引3、4、5的修改：%+v", pending)
+	}
+	for _, requestId := range []string{"add-1", "add-2", "expire-2", "delete-3"} {
+		if _, applied := restoredFSM.AppliedResult(requestId, ""); !applied {
+			t.Errorf("恢复后的去重表中没有请求：%s", requestId)
+		}
+	}
+	// 重复的删除请求直接返回第一次的结果 不会再执行
+	applyCommand(t, restoredFSM, 8, StudentCommand{Operation: "delete", Id: "3", RequestId: "delete-3"})
+	if restored.deletes != 0 {
+		t.Errorf("重复的删除请求又执行了%d次", restored.deletes)
+	}
+}
+
+// TestPendingStudentTracksLatestEntry 每个学生只返回最新的还没有确认的修改 确认之后学生还有更新的修改时保留 快照恢复后重建
+func TestPendingStudentTracksLatestEntry(t *testing.T) {
+	fsm := NewStudentFSM(newFakeService())
+	updated := newStudent("1")
+	updated.Name = "updated"
+	applyCommand(t, fsm, 1, StudentCommand{Operation: "add", Student: newStudent("1")})
+	applyCommand(t, fsm, 2, StudentCommand{Operation: "add", Student: newStudent("2")})
+	applyCommand(t, fsm, 3, StudentCommand{Operation: "update", Student: updated})
+	applyCommand(t, fsm, 4, StudentCommand{Operation: "delete", Id: "2"})
+
+	check := func(fsm *StudentFSM, id string, wantIndex uint64) {
+		t.Helper()
+		entry, exists := fsm.PendingStudent(id)
+		if wantIndex == 0 {
+			if exists {
+				t.Errorf("学生：%s不应该有还没有确认的修改：%+v", id, entry)
+			}
+			return
+		}
+		if !exists || entry.Index != wantIndex {
+			t.Errorf("学生：%s最新的修改是：%+v %v 期望日志索引：%d", id, entry, exists, wantIndex)
+		}
+	}
+	check(fsm, "1", 3)
+	check(fsm, "2", 4)
+	if entry, _ := fsm.PendingStudent("1"); entry.Student.Name != "updated" {
+		t.Errorf("学生1最新的修改是：%+v", entry.Student)
+	}
+
+	applyCommand(t, fsm, 5, StudentCommand{Operation: "outboxAck", AckIndex: 2})
+	check(fsm, "1", 3)
+	check(fsm, "2", 4)
+	applyCommand(t, fsm, 6, StudentCommand{Operation: "outboxAck", AckIndex: 3})
+	check(fsm, "1", 0)
+	check(fsm, "2", 4)
+
+	restored := NewStudentFSM(newFakeService())
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(snapshotBytes(t, fsm)))); err != nil {
+		t.Fatalf("恢复快照失败：%v", err)
+	}
+	check(restored, "1", 0)
+	check(restored, "2", 4)
+}
+
+// fingerprintedCommand 带上领导者计算的指纹的命令
+func fingerprintedCommand(t *testing.T, cmd StudentCommand) StudentCommand {
+	t.Helper()
+	fingerprint, err := cmd.RequestFingerprint()
+	if err != nil {
+		t.Fatalf("计算请求的指纹失败：%v", err)
+	}
+	cmd.Fingerprint = fingerprint
+	return cmd
+}
+
+// TestRequestFingerprint 操作和内容相同的请求指纹相同 成绩的顺序不影响指纹 内容或者操作不同时指纹不同
+func TestRequestFingerprint(t *testing.T) {
+	first := newStudent("1")
+	first.Grades = map[string]float64{"math": 90, "english": 80, "physics": 70}
+	second := model.CopyStudent(first)
+	second.Grades = map[string]float64{"physics": 70, "english": 80, "math": 90}
+	changed := model.CopyStudent(first)
+	changed.Grades["math"] = 91
+
+	fingerprint := func(cmd StudentCommand) string {
+		return fingerprintedCommand(t, cmd).Fingerprint
+	}
+	add := fingerprint(StudentCommand{Operation: "add", Student: first, RequestId: "r1"})
+	if got := fingerprint(StudentCommand{Operation: "add", Student: second, RequestId: "r2"}); got != add {
+		t.Errorf("相同的请求指纹不同：%s %s", got, add)
+	}
+	if got := fingerprint(StudentCommand{Operation: "add", Student: changed, RequestId: "r1"}); got == add {
+		t.Errorf("内容不同的请求指纹相同")
+	}
+	if got := fingerprint(StudentCommand{Operation: "update", Student: first, RequestId: "r1"}); got == add {
+		t.Errorf("操作不同的请求指纹相同")
+	}
+}
+
+// TestDuplicateRequestFingerprintConflict 请求id相同但是内容不同的请求返回ErrRequestConflict 不会执行 也不会返回之前的结果 快照恢复后同样检查
+func TestDuplicateRequestFingerprintConflict(t *testing.T) {
+	service := newFakeService()
+	fsm := NewStudentFSM(service)
+	first := fingerprintedCommand(t, StudentCommand{Operation: "delete", Id: "1", RequestId: "r1"})
+	other := fingerprintedCommand(t, StudentCommand{Operation: "delete", Id: "2", RequestId: "r1"})
+
+	if result := applyCommand(t, fsm, 1, first); result != nil {
+		t.Fatalf("第一次执行返回：%v", result)
+	}
+	if result := applyCommand(t, fsm, 2, first); result != nil {
+		t.Errorf("重复的请求返回：%v 期望第一次的结果", result)
+	}
+	result := applyCommand(t, fsm, 3, other)
+	if err, ok := result.(error); !ok || !errors.Is(err, ErrRequestConflict) {
+		t.Errorf("内容不同的请求返回：%v 期望ErrRequestConflict", result)
+	}
+	if service.deletes != 1 {
+		t.Errorf("删除执行了%d次 期望只有第一次执行", service.deletes)
+	}
+	if err, applied := fsm.AppliedResult("r1", other.Fingerprint); !applied || !errors.Is(err, ErrRequestConflict) {
+		t.Errorf("用不同的指纹查询结果返回：%v %v 期望ErrRequestConflict", err, applied)
+	}
+	// 没有指纹的旧命令不检查指纹
+	if err, applied := fsm.AppliedResult("r1", ""); !applied || err != nil {
+		t.Errorf("不带指纹查询结果返回：%v %v 期望第一次的结果", err, applied)
+	}
+
+	restored := NewStudentFSM(newFakeService())
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(snapshotBytes(t, fsm)))); err != nil {
+		t.Fatalf("恢复快照失败：%v", err)
+	}
+	if err, applied := restored.AppliedResult("r1", first.Fingerprint); !applied || err != nil {
+		t.Errorf("恢复后用相同的指纹查询结果返回：%v %v", err, applied)
+	}
+	if err, applied := restored.AppliedResult("r1", other.Fingerprint); !applied || !errors.Is(err, ErrRequestConflict) {
+		t.Errorf("恢复后用不同的指纹查询结果返回：%v %v 期望ErrRequestConflict", err, applied)
+	}
+}
+
+// TestRestoreRejectsUnknownVersion 不认识的快照版本不会替换当前状态
+func TestRestoreRejectsUnknownVersion(t *testing.T) {
+	service := newFakeService()
+	fsm := NewStudentFSM(service)
+	applyCommand(t, fsm, 1, StudentCommand{Operation: "add", Student: newStudent("1")})
+	data := fmt.Sprintf(`{"version":%d,"students":[]}`, SnapshotVersion+1)
+	err := fsm.Restore(io.NopCloser(strings.NewReader(data)))
+	if err == nil {
+		t.Fatalf("恢复了不支持的快照版本")
+	}
+	if students, _ := service.SnapshotMemoryDB(); len(students) != 1 {
+		t.Errorf("恢复失败后内存数据库被修改了：%+v", students)
+	}
+}
+
+// testNode 进程内的一个Raft节点 重启时沿用原来的存储
+type testNode struct {
+	id        raft.ServerID
+	service   *fakeService
+	fsm       *StudentFSM
+	raft      *raft.Raft
+	store     *raft.InmemStore
+	snapshots *raft.InmemSnapshotStore
+	transport *raft.InmemTransport
+}
+
+// testConfig 测试用的Raft配置 快照只保留很少的日志 落后的节点只能通过安装快照追上
+func testConfig(id raft.ServerID) *raft.Config {
+	conf := raft.DefaultConfig()
+	conf.LocalID = id
+	conf.HeartbeatTimeout = 100 * time.Millisecond
+	conf.ElectionTimeout = 100 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	conf.TrailingLogs = 2
+	conf.SnapshotThreshold = 1 << 20 // 只在测试中手动快照
+	conf.LogOutput = io.Discard
+	return conf
+}
+
+// start 用节点的存储和新的状态机启动Raft 重启时状态机从本地快照和日志恢复
+func (n *testNode) start(t *testing.T, peers []*testNode) {
+	t.Helper()
+	n.service = newFakeService()
+	n.fsm = NewStudentFSM(n.service)
+	_, n.transport = raft.NewInmemTransport(raft.ServerAddress(n.id))
+	for _, peer := range peers {
+		if peer == n || peer.transport == nil {
+			continue
+		}
+		n.transport.Connect(peer.transport.LocalAddr(), peer.transport)
+		peer.transport.Connect(n.transport.LocalAddr(), n.transport)
+	}
+	r, err := raft.NewRaft(testConfig(n.id), n.fsm, n.store, n.store, n.snapshots, n.transport)
+	if err != nil {
+		t.Fatalf("启动节点：%s失败：%v", n.id, err)
+	}
+	n.raft = r
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待超时：%s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func leaderOf(t *testing.T, nodes []*testNode) *testNode {
+	t.Helper()
+	var leader *testNode
+	waitUntil(t, "选出领导者", func() bool {
+		for _, n := range nodes {
+			if n.raft != nil && n.raft.State() == raft.Leader {
+				leader = n
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+func applyOnLeader(t *testing.T, leader *testNode, cmd StudentCommand) {
+	t.Helper()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatalf("序列化命令失败：%v", err)
+	}
+	if err = leader.raft.Apply(data, 5*time.Second).Error(); err != nil {
+		t.Fatalf("提交命令失败：%v", err)
+	}
+}
+
+// TestFollowerConvergesAfterSnapshot 跟随者停止期间领导者做快照并截断日志 跟随者重启后从自己的快照恢复 再安装领导者的快照追上集群
+func TestFollowerConvergesAfterSnapshot(t *testing.T) {
+	nodes := make([]*testNode, 3)
+	var servers []raft.Server
+	for i := range nodes {
+		id := raft.ServerID(fmt.Sprintf("node%d", i+1))
+		nodes[i] = &testNode{id: id, store: raft.NewInmemStore(), snapshots: raft.NewInmemSnapshotStore()}
+		servers = append(servers, raft.Server{ID: id, Address: raft.ServerAddress(id)})
+	}
+	for _, n := range nodes {
+		n.start(t, nodes)
+		if err := n.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+			t.Fatalf("初始化集群失败：%v", err)
+		}
+	}
+	defer func() {
+		for _, n := range nodes {
+			n.raft.Shutdown()
+		}
+	}()
+
+	leader := leaderOf(t, nodes)
+	for i := 0; i < 10; i++ {
+		applyOnLeader(t, leader, StudentCommand{Operation: "add", Student: newStudent(fmt.Sprintf("a%d", i)), RequestId: fmt.Sprintf("add-a%d", i)})
+	}
+	var follower *testNode
+	for _, n := range nodes {
+		if n != leader {
+			follower = n
+			break
+		}
+	}
+	waitUntil(t, "跟随者应用前10条修改", func() bool { return follower.raft.AppliedIndex() >= leader.raft.AppliedIndex() })
+	if err := follower.raft.Snapshot().Error(); err != nil {
+		t.Fatalf("跟随者快照失败：%v", err)
+	}
+	if err := follower.raft.Shutdown().Error(); err != nil {
+		t.Fatalf("关闭跟随者失败：%v", err)
+	}
+
+	// 跟随者停止期间继续修改 然后领导者快照并截断日志
+	for i := 0; i < 10; i++ {
+		applyOnLeader(t, leader, StudentCommand{Operation: "add", Student: newStudent(fmt.Sprintf("b%d", i))})
+	}
+	applyOnLeader(t, leader, StudentCommand{Operation: "delete", Id: "a0", RequestId: "delete-a0"})
+	applyOnLeader(t, leader, StudentCommand{Operation: "updatePeers", Peer: &config.Peer{NodeId: string(leader.id), Address: string(leader.id)}})
+	applyOnLeader(t, leader, StudentCommand{Operation: "outboxAck", AckIndex: leader.fsm.PendingOutbox()[5].Index})
+	if err := leader.raft.Snapshot().Error(); err != nil {
+		t.Fatalf("领导者快照失败：%v", err)
+	}
+	if first, _ := leader.store.FirstIndex(); first <= follower.raft.LastIndex() {
+		t.Fatalf("领导者的日志没有截断到跟随者之后：第一条日志%d 跟随者最后一条日志%d", first, follower.raft.LastIndex())
+	}
+
+	follower.start(t, nodes)
+	waitUntil(t, "重启的跟随者追上领导者", func() bool { return follower.raft.AppliedIndex() >= leader.raft.AppliedIndex() })
+
+	wantStudents, _ := leader.service.SnapshotMemoryDB()
+	gotStudents, _ := follower.service.SnapshotMemoryDB()
+	if !reflect.DeepEqual(gotStudents, wantStudents) {
+		t.Errorf("跟随者的学生：%d个 领导者：%d个", len(gotStudents), len(wantStudents))
+	}
+	if got, want := follower.service.SnapshotPeers(), leader.service.SnapshotPeers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("跟随者的节点地址：%+v 领导者：%+v", got, want)
+	}
+	if got, want := follower.fsm.PendingOutbox(), leader.fsm.PendingOutbox(); !reflect.DeepEqual(got, want) {
+		t.Errorf("跟随者的发件箱：%d条 领导者：%d条", len(got), len(want))
+	}
+	_, deleteApplied := follower.fsm.AppliedResult("delete-a0", "")
+	_, addApplied := follower.fsm.AppliedResult("add-a9", "")
+	if !deleteApplied || !addApplied {
+		t.Errorf("跟随者的去重表没有追上领导者")
+	}
+}
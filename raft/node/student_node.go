@@ -1,12 +1,18 @@
 package node
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/hashicorp/raft"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"node2/config"
 	"node2/interfaces"
+	"node2/raft/store"
+	"node2/response"
 	"os"
 	"path/filepath"
 	"sync"
@@ -16,8 +22,12 @@ import (
 // 定义全局互斥锁
 var snapshotDirMutex sync.Mutex
 
-// NewRaftNode 创建并启动 Raft 节点
-func NewRaftNode(node config.Node, peers []*config.Peer, fsm raft.FSM, service interfaces.StudentServiceInterface) (*raft.Raft, error) {
+// joinTimeout 加入集群的最长等待时间 集群刚启动时需要等待领导者选举完成
+const joinTimeout = time.Minute
+
+// NewRaftNode 创建并启动 Raft 节点 返回的stores需要在Raft关闭之后关闭
+// beforeStart在启动Raft之前调用 参数是节点是否已经有之前的Raft状态 这时状态机还不会被Raft修改
+func NewRaftNode(node config.Node, raftCfg config.RaftConfig, peers []*config.Peer, fsm raft.FSM, service interfaces.StudentServiceInterface, beforeStart func(hasState bool) error) (r *raft.Raft, stores io.Closer, err error) {
 	log.Printf("开始创建 Raft 节点: NodeID=%s, Address=%s", node.NodeId, node.Address)
 
 	// 配置 Raft
@@ -25,44 +35,66 @@ func NewRaftNode(node config.Node, peers []*config.Peer, fsm raft.FSM, service i
 	raftConfig.LocalID = raft.ServerID(node.NodeId)
 	raftConfig.SnapshotInterval = 120 * time.Second
 	raftConfig.SnapshotThreshold = 1024
+	if raftCfg.LeaseTimeout > 0 {
+		raftConfig.LeaderLeaseTimeout = raftCfg.LeaseTimeout
+	}
 
-	// 初始化存储
-	logStore := raft.NewInmemStore()
-	stableStore := raft.NewInmemStore()
-
-	// 为每个节点创建独立的快照目录
+	// 为每个节点创建独立的快照目录 Raft日志和任期投票也保存在这个目录下
 	snapshotDirMutex.Lock()
 	snapshotDir := filepath.Join("snapshots", node.NodeId)
 	if err := os.MkdirAll(snapshotDir, 0755); err != nil {
 		snapshotDirMutex.Unlock()
-		return nil, fmt.Errorf("创建快照目录失败: NodeID=%s, Directory=%s, Error=%w", node.NodeId, snapshotDir, err)
+		return nil, nil, fmt.Errorf("创建快照目录失败: NodeID=%s, Directory=%s, Error=%w", node.NodeId, snapshotDir, err)
 	}
 	snapshotStore, err := raft.NewFileSnapshotStore(snapshotDir, 3, os.Stderr)
 	snapshotDirMutex.Unlock()
 	if err != nil {
-		return nil, fmt.Errorf("创建快照存储失败: NodeID=%s, Error=%w", node.NodeId, err)
+		return nil, nil, fmt.Errorf("创建快照存储失败: NodeID=%s, Error=%w", node.NodeId, err)
+	}
+
+	// 初始化存储
+	logStore, stableStore, stores, err := newLogAndStableStore(raftCfg, snapshotDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("创建日志存储失败: NodeID=%s, Error=%w", node.NodeId, err)
+	}
+	// 创建失败时Raft已经关闭 不会再使用存储 直接关闭
+	defer func() {
+		if err != nil {
+			stores.Close()
+		}
+	}()
+
+	// 节点重启时已经有之前的任期和日志 不需要再初始化或者加入集群
+	hasState, err := raft.HasExistingState(logStore, stableStore, snapshotStore)
+	if err != nil {
+		return nil, nil, fmt.Errorf("检查节点已有状态失败: NodeID=%s, Error=%w", node.NodeId, err)
+	}
+	if err = beforeStart(hasState); err != nil {
+		return nil, nil, fmt.Errorf("启动 Raft 之前准备状态机失败: NodeID=%s, Error=%w", node.NodeId, err)
 	}
 
 	// 初始化传输层 通过TCP传输
 	transport, err := raft.NewTCPTransport(node.Address, nil, 3, 10*time.Second, os.Stderr)
 	if err != nil {
 		log.Printf("创建 Raft 传输层失败: NodeID=%s Address=%s Error=%v", node.NodeId, node.Address, err)
-		return nil, err
+		return nil, nil, err
 	}
 	if transport == nil {
 		log.Printf("创建 Raft 传输层返回 nil: NodeID=%s Address=%s", node.NodeId, node.Address)
-		return nil, fmt.Errorf("创建 Raft 传输层返回 nil")
+		return nil, nil, fmt.Errorf("创建 Raft 传输层返回 nil")
 	}
 	log.Printf("创建 Raft 传输层成功: NodeID=%s Address=%s transport=%v", node.NodeId, node.Address, transport)
 
 	// 创建 Raft 实例
-	r, err := raft.NewRaft(raftConfig, fsm, logStore, stableStore, snapshotStore, transport)
+	r, err = raft.NewRaft(raftConfig, fsm, logStore, stableStore, snapshotStore, transport)
 	if err != nil {
-		return nil, fmt.Errorf("创建 Raft 实例失败: NodeID：%s, Error：%w", node.NodeId, err)
+		return nil, nil, fmt.Errorf("创建 Raft 实例失败: NodeID：%s, Error：%w", node.NodeId, err)
 	}
 
-	// 如果是第一个节点，初始化集群
-	if len(peers) == 0 {
+	if hasState {
+		log.Printf("节点 %s 已有之前的Raft状态，直接使用之前的任期和日志重新加入集群", node.NodeId)
+	} else if len(peers) == 0 {
+		// 如果是第一个节点，初始化集群
 		log.Printf("节点 %s 是第一个节点，开始初始化集群", node.NodeId)
 		configuration := raft.Configuration{
 			Servers: []raft.Server{
@@ -73,26 +105,88 @@ func NewRaftNode(node config.Node, peers []*config.Peer, fsm raft.FSM, service i
 			},
 		}
 		future := r.BootstrapCluster(configuration)
-		if err := future.Error(); err != nil {
-			return nil, fmt.Errorf("节点 %s 初始化集群失败: %w", node.NodeId, err)
+		if err = future.Error(); err != nil {
+			r.Shutdown()
+			return nil, nil, fmt.Errorf("节点 %s 初始化集群失败: %w", node.NodeId, err)
 		}
 		log.Printf("节点 %s 集群初始化成功", node.NodeId)
 	} else {
-		log.Printf("节点 %s 尝试加入现有集群，等待选举完成...", node.NodeId)
-		time.Sleep(10 * time.Second) // 增加等待时间到 10 秒
+		log.Printf("节点 %s 尝试加入现有集群", node.NodeId)
+		if err = joinCluster(node, service); err != nil {
+			r.Shutdown()
+			return nil, nil, err
+		}
+	}
+	return r, stores, nil
+}
 
-		leaderPortAddr, err := service.GetLeaderPortAddr()
-		if err != nil {
-			log.Printf("节点：%s获取leader地址失败：%v", node.NodeId, err)
-			return nil, fmt.Errorf("节点：%s获取leader地址失败：%w", node.NodeId, err)
+// joinCluster 通过配置中的节点找到领导者并请求加入集群 集群可能还在选举 所以失败后退避重试 直到超时
+func joinCluster(node config.Node, service interfaces.StudentServiceInterface) error {
+	deadline := time.Now().Add(joinTimeout)
+	backoff := 500 * time.Millisecond
+	for {
+		leaderAddr, err := service.GetLeaderHttpAddr()
+		if err == nil {
+			if err = requestJoin(leaderAddr, node); err == nil {
+				log.Printf("节点：%s已通过领导者：%s加入集群", node.NodeId, leaderAddr)
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("节点：%s加入集群失败：%w", node.NodeId, err)
+		}
+		log.Printf("节点：%s加入集群失败：%v %v后重试", node.NodeId, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 5*time.Second {
+			backoff = 5 * time.Second
 		}
+	}
+}
+
+// requestJoin 请求领导者把节点加入集群
+func requestJoin(leaderAddr string, node config.Node) error {
+	query := url.Values{}
+	query.Set("nodeID", node.NodeId)
+	query.Set("nodeAddress", node.Address)
+	query.Set("portAddress", node.PortAddress)
+	query.Set("httpAddress", node.HttpAddr())
+	resp, err := http.Get(fmt.Sprintf("http://%s/JoinRaftCluster?%s", leaderAddr, query.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result response.Result
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("解析 JSON 数据出错：%w", err)
+	}
+	if result.Code != 1 {
+		return errors.New(result.Message)
+	}
+	return nil
+}
 
-		url := fmt.Sprintf("http://localhost:%s/JoinRaftCluster?nodeID=%s&nodeAddress=%s&portAddress=%s", leaderPortAddr, node.Address, node.Address, node.PortAddress)
-		_, err = http.Get(url)
+// nopCloser 内存存储不需要关闭
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// newLogAndStableStore 根据配置创建日志存储和稳定存储 返回的Closer用来在Raft关闭之后关闭存储
+func newLogAndStableStore(raftCfg config.RaftConfig, dir string) (raft.LogStore, raft.StableStore, io.Closer, error) {
+	switch raftCfg.LogStore {
+	case "memory":
+		return raft.NewInmemStore(), raft.NewInmemStore(), nopCloser{}, nil
+	case "file", "":
+		logStore, err := store.NewFileLogStore(dir, raftCfg.SyncPolicy)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		stableStore, err := store.NewFileStableStore(dir, raftCfg.SyncPolicy)
 		if err != nil {
-			log.Printf("节点：%s加入集群失败：%v", node.NodeId, err)
-			return nil, fmt.Errorf("节点：%s加入集群失败：%w", node.NodeId, err)
+			logStore.Close()
+			return nil, nil, nil, err
 		}
+		return logStore, stableStore, logStore, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("未知的日志存储方式：%s 可选值：memory、file", raftCfg.LogStore)
 	}
-	return r, nil
 }
@@ -2,6 +2,7 @@ package raft
 
 import (
 	"github.com/hashicorp/raft"
+	"io"
 	"log"
 	"node2/config"
 	"node2/interfaces"
@@ -12,15 +13,22 @@ import (
 // RaftInitializerImpl 实现 Raft 初始化器接口
 type RaftInitializerImpl struct{}
 
-// InitRaft 初始化 Raft 节点
-func (r *RaftInitializerImpl) InitRaft(node config.Node, peers []*config.Peer, service interfaces.StudentServiceInterface) (*raft.Raft, error) {
+// RaftInstance 初始化完成的 Raft 节点 以及服务层需要用到的状态机和存储
+type RaftInstance struct {
+	Raft   *raft.Raft
+	FSM    *fsm.StudentFSM // 服务层需要从状态机读取发件箱和去重表
+	Stores io.Closer       // 日志存储和稳定存储 Raft关闭之后才能关闭
+}
+
+// InitRaft 初始化 Raft 节点 beforeStart在启动Raft之前调用 参数是节点是否已经有之前的Raft状态
+func (r *RaftInitializerImpl) InitRaft(node config.Node, raftConfig config.RaftConfig, peers []*config.Peer, service interfaces.StudentServiceInterface, beforeStart func(hasState bool) error) (*RaftInstance, error) {
 	log.Printf("开始初始化 Raft 节点: NodeID=%s, Address=%s", node.NodeId, node.Address)
 	fsmInstance := fsm.NewStudentFSM(service)
-	raftNode, err := nodepkg.NewRaftNode(node, peers, fsmInstance, service)
+	raftNode, stores, err := nodepkg.NewRaftNode(node, raftConfig, peers, fsmInstance, service, beforeStart)
 	if err != nil {
 		log.Printf("初始化 Raft 节点失败: NodeID=%s, Error=%v", node.NodeId, err)
 		return nil, err
 	}
 	log.Printf("Raft 节点初始化成功: NodeID=%s", node.NodeId)
-	return raftNode, nil
+	return &RaftInstance{Raft: raftNode, FSM: fsmInstance, Stores: stores}, nil
 }
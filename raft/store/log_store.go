@@ -0,0 +1,440 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// 段文件中记录的类型
+const (
+	recordLog         byte = 1 // 一条Raft日志
+	recordDeleteRange byte = 2 // 删除一段日志的墓碑记录
+)
+
+// recordHeaderSize 每条记录的头部长度：1字节类型 + 4字节负载长度 + 4字节负载的CRC32校验和
+const recordHeaderSize = 9
+
+// maxRecordSize 单条记录负载的最大长度 超过这个长度的记录视为损坏
+const maxRecordSize = 64 << 20
+
+// compactMinGarbage 段文件中被删除的记录至少达到这个大小 并且超过存活记录的大小时才会重写段文件
+const compactMinGarbage = 4 << 20
+
+// logSegmentFile 日志段文件的文件名
+const logSegmentFile = "raft-log.seg"
+
+// 刷盘策略
+const (
+	SyncAlways = "always" // 每次写入后都调用fsync 宕机不丢日志
+	SyncNone   = "none"   // 不主动fsync 交给操作系统刷盘 进程崩溃不丢日志 但机器宕机可能丢失最近的日志
+)
+
+// logPosition 一条日志记录在段文件中的位置
+type logPosition struct {
+	offset int64
+	size   int64
+}
+
+// FileLogStore 基于只追加段文件的 raft.LogStore 实现
+// 所有写入（包括删除）都以记录的形式追加到段文件末尾 内存中维护日志索引到文件偏移量的索引
+// 启动时顺序重放段文件重建索引 被删除的记录过多时会重写段文件回收空间
+type FileLogStore struct {
+	mu         sync.RWMutex
+	path       string
+	file       *os.File
+	sync       bool
+	index      map[uint64]logPosition
+	firstIndex uint64
+	lastIndex  uint64
+	size       int64 // 段文件的有效长度 新记录写在这个位置
+	liveBytes  int64 // 存活日志记录占用的字节数
+}
+
+// 确保实现 raft.LogStore 接口
+var _ raft.LogStore = (*FileLogStore)(nil)
+
+// NewFileLogStore 打开或创建dir目录下的日志段文件 并重放已有的记录重建索引
+func NewFileLogStore(dir string, syncPolicy string) (*FileLogStore, error) {
+	syncWrites, err := parseSyncPolicy(syncPolicy)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, logSegmentFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("NewFileLogStore 打开段文件：%s失败：%w", path, err)
+	}
+	s := &FileLogStore{
+		path:  path,
+		file:  file,
+		sync:  syncWrites,
+		index: make(map[uint64]logPosition),
+	}
+	if err = s.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	log.Printf("已打开Raft日志段文件：%s 日志范围：[%d, %d]", path, s.firstIndex, s.lastIndex)
+	return s, nil
+}
+
+// parseSyncPolicy 解析刷盘策略 返回是否每次写入都需要fsync
+func parseSyncPolicy(syncPolicy string) (bool, error) {
+	switch syncPolicy {
+	case SyncAlways, "":
+		return true, nil
+	case SyncNone:
+		return false, nil
+	default:
+		return false, fmt.Errorf("未知的刷盘策略：%s 可选值：%s、%s", syncPolicy, SyncAlways, SyncNone)
+	}
+}
+
+// replay 顺序读取段文件重建索引 文件尾部不完整或校验失败的记录会被截断
+func (s *FileLogStore) replay() error {
+	var offset int64
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := s.file.ReadAt(header, offset); err != nil {
+			if err != io.EOF {
+				log.Printf("读取段文件：%s偏移量：%d处的记录头失败：%v 截断文件", s.path, offset, err)
+			}
+			break
+		}
+		recordType, payload, err := s.readPayload(header, offset)
+		if err != nil {
+			log.Printf("段文件：%s偏移量：%d处的记录已损坏：%v 截断文件", s.path, offset, err)
+			break
+		}
+		size := int64(recordHeaderSize + len(payload))
+		switch recordType {
+		case recordLog:
+			if len(payload) < 8 {
+				log.Printf("段文件：%s偏移量：%d处的日志记录过短 截断文件", s.path, offset)
+				return s.truncate(offset)
+			}
+			s.indexLog(binary.BigEndian.Uint64(payload[:8]), logPosition{offset: offset, size: size})
+		case recordDeleteRange:
+			if len(payload) != 16 {
+				log.Printf("段文件：%s偏移量：%d处的删除记录长度错误 截断文件", s.path, offset)
+				return s.truncate(offset)
+			}
+			s.deleteIndex(binary.BigEndian.Uint64(payload[:8]), binary.BigEndian.Uint64(payload[8:]))
+		default:
+			log.Printf("段文件：%s偏移量：%d处的记录类型：%d未知 截断文件", s.path, offset, recordType)
+			return s.truncate(offset)
+		}
+		offset += size
+	}
+	return s.truncate(offset)
+}
+
+// readPayload 根据记录头读取并校验记录的负载
+func (s *FileLogStore) readPayload(header []byte, offset int64) (byte, []byte, error) {
+	length := binary.BigEndian.Uint32(header[1:5])
+	if length > maxRecordSize {
+		return 0, nil, fmt.Errorf("记录长度：%d超过上限", length)
+	}
+	payload := make([]byte, length)
+	if _, err := s.file.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return 0, nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[5:9]) {
+		return 0, nil, errors.New("校验和不匹配")
+	}
+	return header[0], payload, nil
+}
+
+// truncate 把段文件截断到size 丢弃之后的不完整记录
+func (s *FileLogStore) truncate(size int64) error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("FileLogStore.truncate 获取段文件信息失败：%w", err)
+	}
+	if info.Size() > size {
+		if err = s.file.Truncate(size); err != nil {
+			return fmt.Errorf("FileLogStore.truncate 截断段文件失败：%w", err)
+		}
+		if err = s.file.Sync(); err != nil {
+			return fmt.Errorf("FileLogStore.truncate 刷盘失败：%w", err)
+		}
+	}
+	s.size = size
+	return nil
+}
+
+// indexLog 把一条日志加入索引 不加锁 调用者需要持有写锁
+func (s *FileLogStore) indexLog(index uint64, position logPosition) {
+	if old, exists := s.index[index]; exists {
+		s.liveBytes -= old.size
+	}
+	s.index[index] = position
+	s.liveBytes += position.size
+	if s.firstIndex == 0 || index < s.firstIndex {
+		s.firstIndex = index
+	}
+	if index > s.lastIndex {
+		s.lastIndex = index
+	}
+}
+
+// deleteIndex 从索引中删除[min, max]范围的日志 不加锁 调用者需要持有写锁
+func (s *FileLogStore) deleteIndex(min, max uint64) {
+	// 只遍历实际存在的日志范围 Raft可能传入比实际日志更大的范围
+	from, to := min, max
+	if from < s.firstIndex {
+		from = s.firstIndex
+	}
+	if to > s.lastIndex {
+		to = s.lastIndex
+	}
+	for i := from; i <= to && i != 0; i++ {
+		if position, exists := s.index[i]; exists {
+			s.liveBytes -= position.size
+			delete(s.index, i)
+		}
+	}
+	if len(s.index) == 0 {
+		s.firstIndex, s.lastIndex = 0, 0
+		return
+	}
+	// Raft只会删除日志的前缀（压缩）或者后缀（冲突截断）
+	if min <= s.firstIndex {
+		s.firstIndex = max + 1
+	}
+	if max >= s.lastIndex {
+		s.lastIndex = min - 1
+	}
+}
+
+// FirstIndex 返回第一条日志的索引 没有日志时返回0
+func (s *FileLogStore) FirstIndex() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.firstIndex, nil
+}
+
+// LastIndex 返回最后一条日志的索引 没有日志时返回0
+func (s *FileLogStore) LastIndex() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastIndex, nil
+}
+
+// GetLog 通过索引从段文件中读取一条日志
+func (s *FileLogStore) GetLog(index uint64, raftLog *raft.Log) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	position, exists := s.index[index]
+	if !exists {
+		return raft.ErrLogNotFound
+	}
+	header := make([]byte, recordHeaderSize)
+	if _, err := s.file.ReadAt(header, position.offset); err != nil {
+		return fmt.Errorf("FileLogStore.GetLog 读取日志：%d的记录头失败：%w", index, err)
+	}
+	_, payload, err := s.readPayload(header, position.offset)
+	if err != nil {
+		return fmt.Errorf("FileLogStore.GetLog 读取日志：%d失败：%w", index, err)
+	}
+	return decodeLog(payload, raftLog)
+}
+
+// StoreLog 存储一条日志
+func (s *FileLogStore) StoreLog(raftLog *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{raftLog})
+}
+
+// StoreLogs 把一批日志追加到段文件末尾 整批日志只写一次文件 按刷盘策略决定是否fsync
+func (s *FileLogStore) StoreLogs(logs []*raft.Log) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var buf []byte
+	positions := make([]logPosition, 0, len(logs))
+	for _, raftLog := range logs {
+		offset := s.size + int64(len(buf))
+		buf = appendRecord(buf, recordLog, encodeLog(raftLog))
+		positions = append(positions, logPosition{offset: offset, size: s.size + int64(len(buf)) - offset})
+	}
+	if err := s.write(buf); err != nil {
+		return fmt.Errorf("FileLogStore.StoreLogs 写入日志失败：%w", err)
+	}
+	for i, raftLog := range logs {
+		s.indexLog(raftLog.Index, positions[i])
+	}
+	return nil
+}
+
+// DeleteRange 删除[min, max]范围内的日志 删除操作以墓碑记录的形式追加到段文件
+func (s *FileLogStore) DeleteRange(min, max uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload := make([]byte, 16)
+	binary.BigEndian.PutUint64(payload[:8], min)
+	binary.BigEndian.PutUint64(payload[8:], max)
+	if err := s.write(appendRecord(nil, recordDeleteRange, payload)); err != nil {
+		return fmt.Errorf("FileLogStore.DeleteRange 写入删除记录失败：%w", err)
+	}
+	s.deleteIndex(min, max)
+
+	// 被删除的记录太多时重写段文件 重写失败不影响数据正确性 下次删除时再试
+	garbage := s.size - s.liveBytes
+	if garbage >= compactMinGarbage && garbage > s.liveBytes {
+		if err := s.compact(); err != nil {
+			log.Printf("重写Raft日志段文件：%s失败：%v", s.path, err)
+		}
+	}
+	return nil
+}
+
+// write 把数据写到段文件末尾 不加锁 调用者需要持有写锁
+func (s *FileLogStore) write(buf []byte) error {
+	if _, err := s.file.WriteAt(buf, s.size); err != nil {
+		// 写入了一半的记录会在下次启动重放时被截断
+		return err
+	}
+	if s.sync {
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+	}
+	s.size += int64(len(buf))
+	return nil
+}
+
+// compact 只保留存活的日志 重写段文件 新文件完整写入并刷盘后才替换旧文件
+func (s *FileLogStore) compact() error {
+	start := time.Now()
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	index := make(map[uint64]logPosition, len(s.index))
+	var size int64
+	for i := s.firstIndex; i <= s.lastIndex && i != 0; i++ {
+		position, exists := s.index[i]
+		if !exists {
+			continue
+		}
+		record := make([]byte, position.size)
+		if _, err = s.file.ReadAt(record, position.offset); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+		if _, err = tmp.WriteAt(record, size); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+		index[i] = logPosition{offset: size, size: position.size}
+		size += position.size
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = os.Rename(tmpPath, s.path); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(s.path))
+	s.file.Close()
+	s.file = tmp
+	s.index = index
+	s.size = size
+	s.liveBytes = size
+	log.Printf("已重写Raft日志段文件：%s 剩余%d字节 耗时：%v", s.path, size, time.Since(start))
+	return nil
+}
+
+// Close 关闭段文件
+func (s *FileLogStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// appendRecord 把一条记录编码后追加到buf
+func appendRecord(buf []byte, recordType byte, payload []byte) []byte {
+	header := make([]byte, recordHeaderSize)
+	header[0] = recordType
+	binary.BigEndian.PutUint32(header[1:5], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[5:9], crc32.ChecksumIEEE(payload))
+	buf = append(buf, header...)
+	return append(buf, payload...)
+}
+
+// encodeLog 编码一条日志 格式：索引 任期 类型 追加时间 数据长度 数据 扩展长度 扩展
+func encodeLog(raftLog *raft.Log) []byte {
+	buf := make([]byte, 0, 33+len(raftLog.Data)+len(raftLog.Extensions))
+	buf = binary.BigEndian.AppendUint64(buf, raftLog.Index)
+	buf = binary.BigEndian.AppendUint64(buf, raftLog.Term)
+	buf = append(buf, byte(raftLog.Type))
+	var appendedAt int64
+	if !raftLog.AppendedAt.IsZero() {
+		appendedAt = raftLog.AppendedAt.UnixNano()
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(appendedAt))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(raftLog.Data)))
+	buf = append(buf, raftLog.Data...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(raftLog.Extensions)))
+	return append(buf, raftLog.Extensions...)
+}
+
+// decodeLog 解码encodeLog编码的日志
+func decodeLog(buf []byte, raftLog *raft.Log) error {
+	if len(buf) < 29 {
+		return errors.New("decodeLog 日志记录过短")
+	}
+	raftLog.Index = binary.BigEndian.Uint64(buf[0:8])
+	raftLog.Term = binary.BigEndian.Uint64(buf[8:16])
+	raftLog.Type = raft.LogType(buf[16])
+	if appendedAt := int64(binary.BigEndian.Uint64(buf[17:25])); appendedAt != 0 {
+		raftLog.AppendedAt = time.Unix(0, appendedAt)
+	} else {
+		raftLog.AppendedAt = time.Time{}
+	}
+	dataLen := int(binary.BigEndian.Uint32(buf[25:29]))
+	buf = buf[29:]
+	if len(buf) < dataLen+4 {
+		return errors.New("decodeLog 日志数据长度错误")
+	}
+	raftLog.Data = nil
+	if dataLen > 0 {
+		raftLog.Data = append([]byte(nil), buf[:dataLen]...)
+	}
+	extLen := int(binary.BigEndian.Uint32(buf[dataLen : dataLen+4]))
+	buf = buf[dataLen+4:]
+	if len(buf) != extLen {
+		return errors.New("decodeLog 日志扩展长度错误")
+	}
+	raftLog.Extensions = nil
+	if extLen > 0 {
+		raftLog.Extensions = append([]byte(nil), buf...)
+	}
+	return nil
+}
+
+// syncDir 对目录调用fsync 保证rename之后的目录项落盘
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	_ = d.Sync()
+}
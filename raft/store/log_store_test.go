@@ -0,0 +1,194 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testLogs 生成索引为[first, last]的日志
+func testLogs(first, last uint64) []*raft.Log {
+	logs := make([]*raft.Log, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		logs = append(logs, &raft.Log{
+			Index:      i,
+			Term:       i/4 + 1,
+			Type:       raft.LogCommand,
+			Data:       []byte(fmt.Sprintf("command%d", i)),
+			Extensions: []byte{byte(i)},
+			AppendedAt: time.Unix(0, int64(i)*int64(time.Second)),
+		})
+	}
+	return logs
+}
+
+// openTestLogStore 打开dir目录下的日志段文件 测试结束时关闭
+func openTestLogStore(t *testing.T, dir string) *FileLogStore {
+	t.Helper()
+	s, err := NewFileLogStore(dir, SyncAlways)
+	if err != nil {
+		t.Fatalf("打开日志段文件失败：%v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// reopenTestLogStore 关闭日志段文件后重新打开 重新打开时会重放段文件重建索引
+func reopenTestLogStore(t *testing.T, s *FileLogStore, dir string) *FileLogStore {
+	t.Helper()
+	if err := s.Close(); err != nil {
+		t.Fatalf("关闭日志段文件失败：%v", err)
+	}
+	return openTestLogStore(t, dir)
+}
+
+// checkLogRange 检查日志的范围 范围内的日志都能读回原来的内容 范围外的日志不存在
+func checkLogRange(t *testing.T, s *FileLogStore, first, last uint64) {
+	t.Helper()
+	if got, _ := s.FirstIndex(); got != first {
+		t.Errorf("FirstIndex是：%d 期望：%d", got, first)
+	}
+	if got, _ := s.LastIndex(); got != last {
+		t.Errorf("LastIndex是：%d 期望：%d", got, last)
+	}
+	if first == 0 {
+		return
+	}
+	for _, want := range testLogs(first, last) {
+		var got raft.Log
+		if err := s.GetLog(want.Index, &got); err != nil {
+			t.Fatalf("读取日志：%d失败：%v", want.Index, err)
+		}
+		if got.Index != want.Index || got.Term != want.Term || got.Type != want.Type || !got.AppendedAt.Equal(want.AppendedAt) ||
+			!bytes.Equal(got.Data, want.Data) || !bytes.Equal(got.Extensions, want.Extensions) {
+			t.Errorf("日志：%d读回：%+v 期望：%+v", want.Index, got, *want)
+		}
+	}
+	for _, index := range []uint64{first - 1, last + 1} {
+		var got raft.Log
+		if err := s.GetLog(index, &got); !errors.Is(err, raft.ErrLogNotFound) {
+			t.Errorf("读取范围外的日志：%d返回：%v 期望ErrLogNotFound", index, err)
+		}
+	}
+}
+
+// TestLogStoreReopen 写入的日志在关闭并重新打开后仍然能读回 之后还能继续追加
+func TestLogStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLogStore(t, dir)
+	checkLogRange(t, s, 0, 0)
+	if err := s.StoreLogs(testLogs(1, 10)); err != nil {
+		t.Fatalf("写入日志失败：%v", err)
+	}
+	if err := s.StoreLog(testLogs(11, 11)[0]); err != nil {
+		t.Fatalf("写入日志失败：%v", err)
+	}
+
+	s = reopenTestLogStore(t, s, dir)
+	checkLogRange(t, s, 1, 11)
+	if err := s.StoreLogs(testLogs(12, 15)); err != nil {
+		t.Fatalf("重新打开后写入日志失败：%v", err)
+	}
+	s = reopenTestLogStore(t, s, dir)
+	checkLogRange(t, s, 1, 15)
+}
+
+// TestLogStoreDeleteRange 安装快照后删除前缀、冲突时删除后缀 重新打开后重放删除记录得到相同的范围
+func TestLogStoreDeleteRange(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLogStore(t, dir)
+	if err := s.StoreLogs(testLogs(1, 20)); err != nil {
+		t.Fatalf("写入日志失败：%v", err)
+	}
+
+	// 快照之后压缩日志 删除前缀
+	if err := s.DeleteRange(1, 8); err != nil {
+		t.Fatalf("删除前缀失败：%v", err)
+	}
+	checkLogRange(t, s, 9, 20)
+	s = reopenTestLogStore(t, s, dir)
+	checkLogRange(t, s, 9, 20)
+
+	// 和新的Leader冲突 删除后缀后写入新任期的日志 Raft传入的范围可能超过实际的日志
+	if err := s.DeleteRange(16, 100); err != nil {
+		t.Fatalf("删除后缀失败：%v", err)
+	}
+	checkLogRange(t, s, 9, 15)
+	s = reopenTestLogStore(t, s, dir)
+	checkLogRange(t, s, 9, 15)
+
+	replaced := testLogs(16, 18)
+	for _, raftLog := range replaced {
+		raftLog.Term += 10
+	}
+	if err := s.StoreLogs(replaced); err != nil {
+		t.Fatalf("写入新任期的日志失败：%v", err)
+	}
+	s = reopenTestLogStore(t, s, dir)
+	if last, _ := s.LastIndex(); last != 18 {
+		t.Fatalf("LastIndex是：%d 期望18", last)
+	}
+	var got raft.Log
+	if err := s.GetLog(17, &got); err != nil || got.Term != replaced[1].Term {
+		t.Errorf("日志17读回任期：%d 错误：%v 期望新任期：%d", got.Term, err, replaced[1].Term)
+	}
+
+	// 删除全部日志后范围为空
+	if err := s.DeleteRange(9, 18); err != nil {
+		t.Fatalf("删除全部日志失败：%v", err)
+	}
+	s = reopenTestLogStore(t, s, dir)
+	checkLogRange(t, s, 0, 0)
+}
+
+// TestLogStoreTruncatesTornRecord 最后一条记录只写了一部分时 重新打开会截断它 之前的日志不受影响 之后的写入从截断的位置开始
+func TestLogStoreTruncatesTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLogStore(t, dir)
+	if err := s.StoreLogs(testLogs(1, 5)); err != nil {
+		t.Fatalf("写入日志失败：%v", err)
+	}
+	validSize := s.size
+	if err := s.StoreLog(testLogs(6, 6)[0]); err != nil {
+		t.Fatalf("写入日志失败：%v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("关闭日志段文件失败：%v", err)
+	}
+	path := filepath.Join(dir, logSegmentFile)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("获取段文件信息失败：%v", err)
+	}
+	// 模拟写入最后一条记录时宕机
+	if err = os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatalf("截断段文件失败：%v", err)
+	}
+
+	s = openTestLogStore(t, dir)
+	checkLogRange(t, s, 1, 5)
+	if info, err = os.Stat(path); err != nil {
+		t.Fatalf("获取段文件信息失败：%v", err)
+	}
+	if info.Size() != validSize {
+		t.Fatalf("重新打开后段文件长度是：%d 期望截断到：%d", info.Size(), validSize)
+	}
+	if err = s.StoreLog(testLogs(6, 6)[0]); err != nil {
+		t.Fatalf("截断后写入日志失败：%v", err)
+	}
+	s = reopenTestLogStore(t, s, dir)
+	checkLogRange(t, s, 1, 6)
+}
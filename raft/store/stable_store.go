@@ -0,0 +1,137 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+// stableStoreFile 保存任期、投票等信息的文件名
+const stableStoreFile = "raft-stable.json"
+
+// errKeyNotFound Raft通过错误信息是否为"not found"判断键不存在 不能修改这个错误信息
+var errKeyNotFound = errors.New("not found")
+
+// FileStableStore 基于文件的 raft.StableStore 实现
+// 任期和投票只在选举时才会修改 所以每次Set都把全部内容写到临时文件 刷盘后再原子地重命名替换旧文件
+type FileStableStore struct {
+	mu   sync.RWMutex
+	path string
+	sync bool
+	data map[string][]byte
+}
+
+// 确保实现 raft.StableStore 接口
+var _ raft.StableStore = (*FileStableStore)(nil)
+
+// NewFileStableStore 打开或创建dir目录下的稳定存储文件
+func NewFileStableStore(dir string, syncPolicy string) (*FileStableStore, error) {
+	syncWrites, err := parseSyncPolicy(syncPolicy)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStableStore{
+		path: filepath.Join(dir, stableStoreFile),
+		sync: syncWrites,
+		data: make(map[string][]byte),
+	}
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("NewFileStableStore 读取文件：%s失败：%w", s.path, err)
+	}
+	if err = json.Unmarshal(content, &s.data); err != nil {
+		return nil, fmt.Errorf("NewFileStableStore 解析文件：%s失败：%w", s.path, err)
+	}
+	return s, nil
+}
+
+// Set 设置键值对并持久化
+func (s *FileStableStore) Set(key []byte, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, existed := s.data[string(key)]
+	s.data[string(key)] = append([]byte(nil), val...)
+	if err := s.persist(); err != nil {
+		// 持久化失败时恢复内存中的旧值 保证内存和文件一致
+		if existed {
+			s.data[string(key)] = old
+		} else {
+			delete(s.data, string(key))
+		}
+		return fmt.Errorf("FileStableStore.Set 持久化失败：%w", err)
+	}
+	return nil
+}
+
+// Get 获取键对应的值 键不存在时返回"not found"错误
+func (s *FileStableStore) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, exists := s.data[string(key)]
+	if !exists {
+		return nil, errKeyNotFound
+	}
+	return append([]byte(nil), val...), nil
+}
+
+// SetUint64 设置一个uint64类型的值
+func (s *FileStableStore) SetUint64(key []byte, val uint64) error {
+	return s.Set(key, binary.BigEndian.AppendUint64(nil, val))
+}
+
+// GetUint64 获取一个uint64类型的值 键不存在时返回0
+func (s *FileStableStore) GetUint64(key []byte) (uint64, error) {
+	val, err := s.Get(key)
+	if err != nil {
+		if errors.Is(err, errKeyNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if len(val) != 8 {
+		return 0, fmt.Errorf("FileStableStore.GetUint64 键：%s的值长度错误：%d", key, len(val))
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+// persist 把全部内容写入临时文件后重命名 不加锁 调用者需要持有写锁
+func (s *FileStableStore) persist() error {
+	content, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if s.sync {
+		if err = file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+	if s.sync {
+		syncDir(filepath.Dir(s.path))
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestStableStoreReopen Set和SetUint64写入的值重新打开后仍然存在 不存在的键返回"not found"错误
+func TestStableStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStableStore(dir, SyncAlways)
+	if err != nil {
+		t.Fatalf("打开稳定存储失败：%v", err)
+	}
+	if _, err = s.Get([]byte("LastVoteCand")); err == nil || err.Error() != "not found" {
+		t.Fatalf("读取不存在的键返回：%v 期望\"not found\"", err)
+	}
+	if term, err := s.GetUint64([]byte("CurrentTerm")); err != nil || term != 0 {
+		t.Fatalf("读取不存在的uint64返回：%d 错误：%v 期望0", term, err)
+	}
+	if err = s.Set([]byte("LastVoteCand"), []byte("节点2")); err != nil {
+		t.Fatalf("Set失败：%v", err)
+	}
+	if err = s.SetUint64([]byte("CurrentTerm"), 7); err != nil {
+		t.Fatalf("SetUint64失败：%v", err)
+	}
+	if err = s.SetUint64([]byte("CurrentTerm"), 8); err != nil {
+		t.Fatalf("SetUint64失败：%v", err)
+	}
+
+	reopened, err := NewFileStableStore(dir, SyncAlways)
+	if err != nil {
+		t.Fatalf("重新打开稳定存储失败：%v", err)
+	}
+	if val, err := reopened.Get([]byte("LastVoteCand")); err != nil || !bytes.Equal(val, []byte("节点2")) {
+		t.Errorf("重新打开后LastVoteCand是：%q 错误：%v", val, err)
+	}
+	if term, err := reopened.GetUint64([]byte("CurrentTerm")); err != nil || term != 8 {
+		t.Errorf("重新打开后CurrentTerm是：%d 错误：%v 期望8", term, err)
+	}
+	if _, err = reopened.Get([]byte("LastVoteTerm")); err == nil || err.Error() != "not found" {
+		t.Errorf("重新打开后读取不存在的键返回：%v 期望\"not found\"", err)
+	}
+}
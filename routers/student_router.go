@@ -11,15 +11,42 @@ func SetUpStudentRouter(studentController *controller.StudentController) *gin.En
 	studentGroup := r.Group("/student")
 
 	studentGroup.POST("", studentController.AddStudent)
+	studentGroup.GET("", studentController.ListStudents)
 	studentGroup.GET("/:id", studentController.GetStudent)
 	studentGroup.PUT("", studentController.UpdateStudent)
 	studentGroup.DELETE("/:id", studentController.DeleteStudent)
+	studentGroup.GET("/:id/ttl", studentController.GetStudentTTL)
+	studentGroup.POST("/:id/expire", studentController.ExpireStudent)
+	studentGroup.POST("/:id/persist", studentController.PersistStudent)
 
 	r.GET("/JoinRaftCluster", studentController.JoinRaftCluster)
 
-	r.GET("/LeaderHandleCommand", studentController.LeaderHandleCommand)
+	// 创建一个集群管理组
+	clusterGroup := r.Group("/cluster")
 
-	r.GET("/GetLeaderAddress", studentController.GetLeaderPortAddress)
+	clusterGroup.GET("/members", studentController.GetClusterMembers)
+	clusterGroup.POST("/remove", studentController.RemoveRaftClusterMember)
+	clusterGroup.POST("/demote", studentController.DemoteRaftClusterMember)
+	clusterGroup.POST("/replace", studentController.ReplaceRaftClusterMember)
+	clusterGroup.POST("/leave", studentController.LeaveRaftCluster)
+
+	r.POST("/internal/command", studentController.LeaderHandleCommand)
+
+	r.GET("/internal/readIndex", studentController.LeaderReadIndex)
+
+	r.GET("/GetLeaderAddress", studentController.GetLeaderAddress)
+
+	r.GET("/events", studentController.StreamEvents)
+
+	// 创建一个管理组
+	adminGroup := r.Group("/admin")
+
+	adminGroup.GET("/jobs", studentController.GetJobStatus)
+	adminGroup.GET("/memory/stats", studentController.GetMemoryStats)
+	adminGroup.GET("/memory/scan", studentController.ScanMemoryDB)
+	adminGroup.POST("/aof/rewrite", studentController.RewriteAOF)
+	adminGroup.POST("/dump", studentController.DumpMemoryDB)
+	adminGroup.POST("/load", studentController.LoadMemoryDB)
 
 	return r
 
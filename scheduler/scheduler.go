@@ -0,0 +1,208 @@
+package scheduler
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// JobFunc 后台任务执行一次的函数 ctx在失去领导权或者节点关闭时取消
+type JobFunc func(ctx context.Context) error
+
+// JobStatus 后台任务的执行状态
+type JobStatus struct {
+	Name      string     `json:"name"`
+	Interval  string     `json:"interval"`   // 一直执行的任务为空
+	Running   bool       `json:"running"`    // 本节点是不是正在定期执行这个任务 只有领导者会执行
+	RunCount  int64      `json:"run_count"`  // 本节点执行的次数
+	LastRun   *time.Time `json:"last_run"`   // 本节点最后一次开始执行的时间
+	LastError string     `json:"last_error"` // 本节点最后一次执行的错误 成功时为空
+	NextRun   *time.Time `json:"next_run"`   // 下一次执行的时间 没有在执行时为空
+}
+
+// job 注册的后台任务和它的执行状态
+type job struct {
+	name     string
+	interval time.Duration
+	run      JobFunc
+
+	mu        sync.Mutex
+	running   bool
+	runCount  int64
+	lastRun   time.Time
+	lastError string
+	nextRun   time.Time
+}
+
+// Scheduler 只在领导者上执行的后台任务调度器
+// 通过Raft的领导权变化通知启动和停止任务 成为领导者时启动所有任务 失去领导权时取消所有任务并等待它们退出
+// 所以同一时刻集群中最多只有一个节点在执行任务
+type Scheduler struct {
+	mu      sync.Mutex
+	jobs    []*job
+	cancel  context.CancelFunc // 正在执行任务时用来取消任务 没有执行时为nil
+	running sync.WaitGroup
+}
+
+// NewScheduler 创建一个后台任务调度器
+func NewScheduler() *Scheduler {
+	return &Scheduler{}
+}
+
+// Register 注册一个每隔interval执行一次的任务 需要在Run之前注册
+func (s *Scheduler) Register(name string, interval time.Duration, run JobFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, &job{name: name, interval: interval, run: run})
+}
+
+// RegisterLoop 注册一个在领导期间一直执行的任务 run应该一直运行到ctx取消 需要在Run之前注册
+func (s *Scheduler) RegisterLoop(name string, run JobFunc) {
+	s.Register(name, 0, run)
+}
+
+// Run 根据领导权变化启动和停止任务 直到ctx取消 isLeader是调用时本节点是否已经是领导者
+// leaderCh是Raft的LeaderCh 成为领导者时收到true 失去领导权时收到false
+func (s *Scheduler) Run(ctx context.Context, leaderCh <-chan bool, isLeader bool) {
+	if isLeader {
+		s.start(ctx)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			s.stop()
+			return
+		case leader := <-leaderCh:
+			if leader {
+				log.Printf("成为领导者 启动后台任务")
+				s.start(ctx)
+			} else {
+				log.Printf("失去领导权 停止后台任务")
+				s.stop()
+			}
+		}
+	}
+}
+
+// start 启动所有任务 已经在执行时什么也不做
+func (s *Scheduler) start(parent context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(parent)
+	s.cancel = cancel
+	for _, j := range s.jobs {
+		s.running.Add(1)
+		go func(j *job) {
+			defer s.running.Done()
+			j.loop(ctx)
+		}(j)
+	}
+}
+
+// stop 取消所有任务并等待它们退出
+func (s *Scheduler) stop() {
+	s.mu.Lock()
+	cancel := s.cancel
+	s.cancel = nil
+	s.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	s.running.Wait()
+}
+
+// Status 返回所有任务的执行状态
+func (s *Scheduler) Status() []JobStatus {
+	s.mu.Lock()
+	jobs := append([]*job(nil), s.jobs...)
+	s.mu.Unlock()
+	statuses := make([]JobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		statuses = append(statuses, j.status())
+	}
+	return statuses
+}
+
+// loop 每次执行完成后等待interval再执行下一次 直到ctx取消 interval为0的任务只执行一次 由任务自己运行到ctx取消
+func (j *job) loop(ctx context.Context) {
+	if j.interval <= 0 {
+		j.mu.Lock()
+		j.running = true
+		j.mu.Unlock()
+		j.execute(ctx)
+		j.mu.Lock()
+		j.running = false
+		j.nextRun = time.Time{}
+		j.mu.Unlock()
+		return
+	}
+	timer := time.NewTimer(j.interval)
+	defer timer.Stop()
+	j.mu.Lock()
+	j.running = true
+	j.nextRun = time.Now().Add(j.interval)
+	j.mu.Unlock()
+	defer func() {
+		j.mu.Lock()
+		j.running = false
+		j.nextRun = time.Time{}
+		j.mu.Unlock()
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			j.execute(ctx)
+			timer.Reset(j.interval)
+		}
+	}
+}
+
+// execute 执行一次任务并记录结果
+func (j *job) execute(ctx context.Context) {
+	started := time.Now()
+	err := j.run(ctx)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.runCount++
+	j.lastRun = started
+	if j.interval > 0 {
+		j.nextRun = time.Now().Add(j.interval)
+	}
+	if err != nil {
+		j.lastError = err.Error()
+		log.Printf("后台任务：%s执行失败：%v", j.name, err)
+	} else {
+		j.lastError = ""
+	}
+}
+
+// status 返回任务的执行状态
+func (j *job) status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := JobStatus{
+		Name:      j.name,
+		Running:   j.running,
+		RunCount:  j.runCount,
+		LastError: j.lastError,
+	}
+	if j.interval > 0 {
+		status.Interval = j.interval.String()
+	}
+	if !j.lastRun.IsZero() {
+		lastRun := j.lastRun
+		status.LastRun = &lastRun
+	}
+	if !j.nextRun.IsZero() {
+		nextRun := j.nextRun
+		status.NextRun = &nextRun
+	}
+	return status
+}
@@ -0,0 +1,148 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// waitFor 等待cond返回true 超时后测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("5秒内没有等到：%s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// statusOf 返回名为name的任务的执行状态
+func statusOf(t *testing.T, s *Scheduler, name string) JobStatus {
+	t.Helper()
+	for _, status := range s.Status() {
+		if status.Name == name {
+			return status
+		}
+	}
+	t.Fatalf("没有注册任务：%s", name)
+	return JobStatus{}
+}
+
+// TestSchedulerFollowsLeadership 成为领导者时启动任务 失去领导权时取消任务并等待它们退出 再次成为领导者时重新启动一直执行的任务
+func TestSchedulerFollowsLeadership(t *testing.T) {
+	s := NewScheduler()
+	var loopStarts, loopRunning atomic.Int64
+	s.RegisterLoop("loop", func(ctx context.Context) error {
+		loopStarts.Add(1)
+		loopRunning.Add(1)
+		defer loopRunning.Add(-1)
+		<-ctx.Done()
+		return nil
+	})
+	var ticks atomic.Int64
+	s.Register("ticker", 5*time.Millisecond, func(ctx context.Context) error {
+		ticks.Add(1)
+		return nil
+	})
+
+	leaderCh := make(chan bool)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx, leaderCh, false)
+	}()
+
+	if status := statusOf(t, s, "loop"); status.Running || loopStarts.Load() != 0 {
+		t.Fatalf("不是领导者时任务在执行：%+v", status)
+	}
+	leaderCh <- true
+	waitFor(t, "一直执行的任务启动", func() bool { return loopRunning.Load() == 1 })
+	waitFor(t, "定期执行的任务执行", func() bool { return ticks.Load() > 0 })
+	if status := statusOf(t, s, "ticker"); !status.Running || status.NextRun == nil || status.Interval != "5ms" {
+		t.Errorf("领导者上定期执行的任务的状态：%+v", status)
+	}
+	if status := statusOf(t, s, "loop"); !status.Running || status.Interval != "" || status.NextRun != nil {
+		t.Errorf("领导者上一直执行的任务的状态：%+v", status)
+	}
+
+	leaderCh <- false
+	waitFor(t, "一直执行的任务退出", func() bool { return loopRunning.Load() == 0 })
+	waitFor(t, "任务停止", func() bool { return !statusOf(t, s, "ticker").Running && !statusOf(t, s, "loop").Running })
+	stopped := ticks.Load()
+	time.Sleep(30 * time.Millisecond)
+	if ticks.Load() != stopped {
+		t.Errorf("失去领导权后定期执行的任务仍然在执行")
+	}
+	if status := statusOf(t, s, "ticker"); status.NextRun != nil || status.RunCount != stopped || status.LastRun == nil {
+		t.Errorf("失去领导权后定期执行的任务的状态：%+v", status)
+	}
+
+	leaderCh <- true
+	waitFor(t, "一直执行的任务重新启动", func() bool { return loopStarts.Load() == 2 && loopRunning.Load() == 1 })
+	// 重复的成为领导者通知不会再启动一份任务
+	leaderCh <- true
+	time.Sleep(10 * time.Millisecond)
+	if loopStarts.Load() != 2 {
+		t.Errorf("一直执行的任务启动了%d次 期望2次", loopStarts.Load())
+	}
+
+	cancel()
+	<-done
+	if loopRunning.Load() != 0 || statusOf(t, s, "loop").Running {
+		t.Errorf("调度器退出后任务仍然在执行")
+	}
+	if status := statusOf(t, s, "loop"); status.RunCount != 2 {
+		t.Errorf("一直执行的任务执行了%d次 期望2次", status.RunCount)
+	}
+}
+
+// TestSchedulerStartsWhenAlreadyLeader 调用Run时已经是领导者就立即启动任务 记录任务最后一次执行的错误 成功后清除
+func TestSchedulerStartsWhenAlreadyLeader(t *testing.T) {
+	s := NewScheduler()
+	var runs atomic.Int64
+	proceed := make(chan struct{})
+	s.Register("flaky", 5*time.Millisecond, func(ctx context.Context) error {
+		if runs.Add(1) == 1 {
+			return errors.New("第一次失败")
+		}
+		// 检查完第一次的错误之后才完成第二次执行
+		select {
+		case <-proceed:
+		case <-ctx.Done():
+		}
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx, make(chan bool), true)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor(t, "第一次执行失败", func() bool { return statusOf(t, s, "flaky").RunCount == 1 })
+	if status := statusOf(t, s, "flaky"); status.LastError != "第一次失败" || !status.Running {
+		t.Errorf("第一次执行后的状态：%+v", status)
+	}
+	close(proceed)
+	waitFor(t, "执行成功后清除错误", func() bool {
+		status := statusOf(t, s, "flaky")
+		return status.RunCount >= 2 && status.LastError == ""
+	})
+}
@@ -0,0 +1,286 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	raftfpk "github.com/hashicorp/raft"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"node2/config"
+	"node2/response"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClusterMember 集群中的一个成员 由Raft当前的配置和复制的地址映射组成
+type ClusterMember struct {
+	NodeId      string     `json:"node_id"`
+	Address     string     `json:"address"`
+	PortAddress string     `json:"port_address"`
+	HttpAddress string     `json:"http_address"`
+	Suffrage    string     `json:"suffrage"`
+	Leader      bool       `json:"leader"`
+	LastContact *time.Time `json:"last_contact"` // 观察到的最后联系时间 不知道时为null 领导者自己也为null
+}
+
+// heartbeatTracker 通过Raft的观察者记录领导者观察到的和各个跟随者的联系时间
+// hashicorp/raft 不直接提供跟随者的最后联系时间 只会在心跳失败和恢复时发出通知 所以只记录这两种通知中的时间
+type heartbeatTracker struct {
+	mu           sync.RWMutex
+	contacts     map[raftfpk.ServerID]time.Time // 节点 -> 观察到的最后一次成功联系的时间
+	raftNode     *raftfpk.Raft
+	observer     *raftfpk.Observer
+	observations chan raftfpk.Observation
+	stopped      chan struct{} // 处理通知的协程退出后关闭
+}
+
+// newHeartbeatTracker 创建心跳记录器并注册到Raft节点 不再使用时调用close
+func newHeartbeatTracker(raftNode *raftfpk.Raft) *heartbeatTracker {
+	tracker := &heartbeatTracker{
+		contacts:     make(map[raftfpk.ServerID]time.Time),
+		raftNode:     raftNode,
+		observations: make(chan raftfpk.Observation, 16),
+		stopped:      make(chan struct{}),
+	}
+	tracker.observer = raftfpk.NewObserver(tracker.observations, false, func(o *raftfpk.Observation) bool {
+		switch o.Data.(type) {
+		case raftfpk.FailedHeartbeatObservation, raftfpk.ResumedHeartbeatObservation, raftfpk.PeerObservation:
+			return true
+		}
+		return false
+	})
+	raftNode.RegisterObserver(tracker.observer)
+	go tracker.run()
+	return tracker
+}
+
+// run 处理Raft发出的通知 直到close关闭通知通道
+func (t *heartbeatTracker) run() {
+	defer close(t.stopped)
+	for o := range t.observations {
+		t.mu.Lock()
+		switch data := o.Data.(type) {
+		case raftfpk.FailedHeartbeatObservation:
+			t.contacts[data.PeerID] = data.LastContact
+		case raftfpk.ResumedHeartbeatObservation:
+			// 恢复的通知中没有时间 收到通知时刚刚联系上
+			t.contacts[data.PeerID] = time.Now()
+		case raftfpk.PeerObservation:
+			if data.Removed {
+				delete(t.contacts, data.Peer.ID)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// lastContact 返回观察到的领导者和节点最后一次联系的时间 没有观察到时返回零值
+func (t *heartbeatTracker) lastContact(id raftfpk.ServerID) time.Time {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.contacts[id]
+}
+
+// close 从Raft节点注销观察者并等待处理通知的协程退出
+func (t *heartbeatTracker) close() {
+	// 注销之后Raft不会再向通道发送通知 可以安全地关闭
+	t.raftNode.DeregisterObserver(t.observer)
+	close(t.observations)
+	<-t.stopped
+}
+
+// Peers 根据Raft当前的配置重建集群中其他节点的列表 端口号和HTTP地址来自通过Raft复制的地址映射
+func (ss *StudentService) Peers() ([]*config.Peer, error) {
+	future := ss.raftNode.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, fmt.Errorf("StudentService.Peers 获取集群配置失败：%w", err)
+	}
+	ss.peersLock.RLock()
+	defer ss.peersLock.RUnlock()
+	var peers []*config.Peer
+	for _, server := range future.Configuration().Servers {
+		if string(server.ID) == ss.node.NodeId {
+			continue
+		}
+		peer := &config.Peer{
+			NodeId:  string(server.ID),
+			Address: string(server.Address),
+		}
+		if registered, exists := ss.peerAddrs[peer.NodeId]; exists {
+			peer.PortAddress = registered.PortAddress
+			peer.HttpAddress = registered.HttpAddress
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// GetClusterMembers 返回Raft当前配置中的所有成员
+func (ss *StudentService) GetClusterMembers() ([]*ClusterMember, error) {
+	future := ss.raftNode.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, fmt.Errorf("StudentService.GetClusterMembers 获取集群配置失败：%w", err)
+	}
+	isLeader := ss.raftNode.State() == raftfpk.Leader
+	_, leaderId := ss.raftNode.LeaderWithID()
+
+	ss.peersLock.RLock()
+	defer ss.peersLock.RUnlock()
+	members := make([]*ClusterMember, 0, len(future.Configuration().Servers))
+	for _, server := range future.Configuration().Servers {
+		member := &ClusterMember{
+			NodeId:   string(server.ID),
+			Address:  string(server.Address),
+			Suffrage: server.Suffrage.String(),
+			Leader:   server.ID == leaderId,
+		}
+		if registered, exists := ss.peerAddrs[member.NodeId]; exists {
+			member.PortAddress = registered.PortAddress
+			member.HttpAddress = registered.HttpAddr()
+		}
+		var lastContact time.Time
+		switch {
+		case string(server.ID) == ss.node.NodeId:
+			member.PortAddress = ss.node.PortAddress
+			member.HttpAddress = ss.node.HttpAddr()
+		case isLeader:
+			lastContact = ss.heartbeats.lastContact(server.ID)
+		case server.ID == leaderId:
+			lastContact = ss.raftNode.LastContact()
+		}
+		if !lastContact.IsZero() {
+			member.LastContact = &lastContact
+		}
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].NodeId < members[j].NodeId })
+	return members, nil
+}
+
+// RemoveRaftClusterMember 领导者把节点从集群中移除 并从所有节点的地址映射中删除
+func (ss *StudentService) RemoveRaftClusterMember(nodeID string) error {
+	if ss.raftNode.State() != raftfpk.Leader {
+		return fmt.Errorf("StudentService.RemoveRaftClusterMember 节点：%s不是领导者节点", ss.node.NodeId)
+	}
+	future := ss.raftNode.RemoveServer(raftfpk.ServerID(nodeID), 0, 0)
+	if err := future.Error(); err != nil {
+		return fmt.Errorf("StudentService.RemoveRaftClusterMember 移除节点：%s失败：%w", nodeID, err)
+	}
+	log.Printf("领导者节点已将节点：%s移出集群", nodeID)
+	// 领导者移除自己之后就不再是领导者了 地址映射由新的领导者在下一次成员变更时清理
+	if nodeID == ss.node.NodeId {
+		return nil
+	}
+	if err := ss.applyInternalCommand("removePeer", nodeID, nil); err != nil {
+		return fmt.Errorf("StudentService.RemoveRaftClusterMember 更新所有节点的地址映射失败：%w", err)
+	}
+	return nil
+}
+
+// DemoteRaftClusterMember 领导者把投票节点降级为不参与投票的节点 节点仍然会接收日志
+func (ss *StudentService) DemoteRaftClusterMember(nodeID string) error {
+	if ss.raftNode.State() != raftfpk.Leader {
+		return fmt.Errorf("StudentService.DemoteRaftClusterMember 节点：%s不是领导者节点", ss.node.NodeId)
+	}
+	future := ss.raftNode.DemoteVoter(raftfpk.ServerID(nodeID), 0, 0)
+	if err := future.Error(); err != nil {
+		return fmt.Errorf("StudentService.DemoteRaftClusterMember 降级节点：%s失败：%w", nodeID, err)
+	}
+	log.Printf("领导者节点已将节点：%s降级为不参与投票的节点", nodeID)
+	return nil
+}
+
+// ReplaceRaftClusterMember 领导者用新节点替换集群中的旧节点 新旧节点id相同时直接修改节点的地址
+// 先加入新节点 成功后才移除旧节点 加入失败时旧节点仍然在集群中 不会让集群少一个投票节点
+func (ss *StudentService) ReplaceRaftClusterMember(oldNodeID string, nodeID string, nodeAddress string, nodePortAddress string, nodeHttpAddress string) error {
+	if ss.raftNode.State() != raftfpk.Leader {
+		return fmt.Errorf("StudentService.ReplaceRaftClusterMember 节点：%s不是领导者节点", ss.node.NodeId)
+	}
+	if oldNodeID == ss.node.NodeId {
+		return fmt.Errorf("StudentService.ReplaceRaftClusterMember 不能替换领导者节点自己：%s", oldNodeID)
+	}
+	// id相同时AddVoter会用新地址替换配置中的旧地址 不需要先移除
+	if err := ss.JoinRaftCluster(nodeID, nodeAddress, nodePortAddress, nodeHttpAddress); err != nil {
+		return fmt.Errorf("StudentService.ReplaceRaftClusterMember 加入新节点：%s失败 旧节点：%s仍然在集群中：%w", nodeID, oldNodeID, err)
+	}
+	if oldNodeID == nodeID {
+		return nil
+	}
+	if err := ss.RemoveRaftClusterMember(oldNodeID); err != nil {
+		return fmt.Errorf("StudentService.ReplaceRaftClusterMember 新节点：%s已经加入集群 %w", nodeID, err)
+	}
+	return nil
+}
+
+// LeaveRaftCluster 本节点主动离开集群 领导者直接移除自己 跟随者请求领导者移除自己
+func (ss *StudentService) LeaveRaftCluster() error {
+	if ss.raftNode.State() == raftfpk.Leader {
+		return ss.RemoveRaftClusterMember(ss.node.NodeId)
+	}
+	leaderAddr, err := ss.GetLeaderHttpAddr()
+	if err != nil {
+		return fmt.Errorf("StudentService.LeaveRaftCluster 获取领导者地址失败：%w", err)
+	}
+	return postClusterRequest(leaderAddr, "/cluster/remove", map[string]string{"nodeID": ss.node.NodeId})
+}
+
+// RemovePeerInternal 从地址映射中删除节点 由状态机在所有节点上执行
+func (ss *StudentService) RemovePeerInternal(nodeID string) {
+	ss.peersLock.Lock()
+	defer ss.peersLock.Unlock()
+	delete(ss.peerAddrs, nodeID)
+}
+
+// SnapshotPeers 导出地址映射 供状态机生成快照
+func (ss *StudentService) SnapshotPeers() []*config.Peer {
+	ss.peersLock.RLock()
+	defer ss.peersLock.RUnlock()
+	peers := make([]*config.Peer, 0, len(ss.peerAddrs))
+	for _, peer := range ss.peerAddrs {
+		peerCopy := *peer
+		peers = append(peers, &peerCopy)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].NodeId < peers[j].NodeId })
+	return peers
+}
+
+// RestorePeers 用快照中的地址映射替换当前的地址映射
+func (ss *StudentService) RestorePeers(peers []*config.Peer) {
+	peerAddrs := make(map[string]*config.Peer, len(peers))
+	for _, peer := range peers {
+		peerCopy := *peer
+		peerAddrs[peer.NodeId] = &peerCopy
+	}
+	ss.peersLock.Lock()
+	defer ss.peersLock.Unlock()
+	ss.peerAddrs = peerAddrs
+}
+
+// postClusterRequest 向指定HTTP地址的节点发送集群管理请求 并解析统一结果
+func postClusterRequest(httpAddr string, path string, params map[string]string) error {
+	query := url.Values{}
+	for k, v := range params {
+		query.Set(k, v)
+	}
+	requestUrl := fmt.Sprintf("http://%s%s?%s", httpAddr, path, query.Encode())
+	resp, err := http.Post(requestUrl, "application/json", nil)
+	if err != nil {
+		return fmt.Errorf("postClusterRequest 请求：%s失败：%w", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("postClusterRequest 读取响应体出错：%w", err)
+	}
+	var result response.Result
+	if err = json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("postClusterRequest 解析 JSON 数据出错：%w", err)
+	}
+	if result.Code != 1 {
+		return fmt.Errorf("领导者节点处理请求：%s失败：%s", path, result.Message)
+	}
+	return nil
+}
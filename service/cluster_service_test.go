@@ -0,0 +1,63 @@
+package service
+
+import (
+	"testing"
+)
+
+// configuredAddresses 返回领导者的Raft配置中每个节点的地址
+func configuredAddresses(t *testing.T, leader *StudentService) map[string]string {
+	t.Helper()
+	future := leader.raftNode.GetConfiguration()
+	if err := future.Error(); err != nil {
+		t.Fatalf("获取集群配置失败：%v", err)
+	}
+	addresses := make(map[string]string)
+	for _, server := range future.Configuration().Servers {
+		addresses[string(server.ID)] = string(server.Address)
+	}
+	return addresses
+}
+
+// TestReplaceRaftClusterMember 加入新节点失败时旧节点仍然在集群中 成功时新节点替换旧节点 id相同时只修改地址
+func TestReplaceRaftClusterMember(t *testing.T) {
+	nodes := newTestCluster(t, 3, newFakeMysqlDao(), newFakeCacheDao())
+	leader := waitForLeader(t, nodes)
+	var oldNodeID string
+	for _, ss := range nodes {
+		if ss != leader {
+			oldNodeID = ss.node.NodeId
+		}
+	}
+
+	// 新节点的地址和领导者重复 Raft拒绝加入
+	if err := leader.ReplaceRaftClusterMember(oldNodeID, "node4", leader.node.Address, "8084", ""); err == nil {
+		t.Fatalf("新节点的地址重复时替换成功")
+	}
+	addresses := configuredAddresses(t, leader)
+	if _, exists := addresses[oldNodeID]; !exists || len(addresses) != 3 {
+		t.Fatalf("加入新节点失败后集群配置是：%v 期望旧节点：%s仍然在集群中", addresses, oldNodeID)
+	}
+
+	// 新节点还没有启动 其他两个节点仍然能组成多数派
+	if err := leader.ReplaceRaftClusterMember(oldNodeID, "node4", "node4", "8084", ""); err != nil {
+		t.Fatalf("替换节点：%s失败：%v", oldNodeID, err)
+	}
+	addresses = configuredAddresses(t, leader)
+	if _, exists := addresses[oldNodeID]; exists || addresses["node4"] != "node4" || len(addresses) != 3 {
+		t.Fatalf("替换后集群配置是：%v 期望node4替换了%s", addresses, oldNodeID)
+	}
+	leader.peersLock.RLock()
+	peer, exists := leader.peerAddrs["node4"]
+	leader.peersLock.RUnlock()
+	if !exists || peer.PortAddress != "8084" {
+		t.Errorf("替换后的地址映射中node4是：%+v", peer)
+	}
+
+	if err := leader.ReplaceRaftClusterMember("node4", "node4", "node4-moved", "8085", ""); err != nil {
+		t.Fatalf("修改节点node4的地址失败：%v", err)
+	}
+	addresses = configuredAddresses(t, leader)
+	if addresses["node4"] != "node4-moved" || len(addresses) != 3 {
+		t.Fatalf("修改地址后集群配置是：%v 期望node4的地址是node4-moved", addresses)
+	}
+}
@@ -0,0 +1,398 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	raftfpk "github.com/hashicorp/raft"
+	"gorm.io/gorm"
+	"io"
+	"log"
+	"node2/config"
+	"node2/dao"
+	"node2/interfaces"
+	"node2/model"
+	"node2/raft/fsm"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// 服务层每一步都会打日志 测试时丢弃
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeMysqlDao 用map模拟MySQL 事务之间互斥 和锁住持久化进度的事务一样串行执行 事务失败时回滚
+// 只实现了测试用到的方法 其他方法调用时会因为嵌入的接口为nil而panic
+type fakeMysqlDao struct {
+	interfaces.StudentMysqlDaoInterface
+
+	txLock    sync.Mutex // 同一时刻只有一个事务
+	mu        sync.Mutex
+	students  map[string]*model.Student
+	progress  uint64
+	written   map[uint64]int // 每个日志索引提交的次数
+	txWritten []uint64       // 正在执行的事务记录的日志索引 提交后计入written
+
+	getStudentCalls map[string]int // 每个学生从数据库加载的次数
+	getStudentGate  chan struct{}  // 不为nil时GetStudent等它关闭后才返回
+	getStudentDelay time.Duration  // 模拟每次查询数据库的耗时
+	progressErr     error          // 不为nil时更新持久化进度失败 整个事务回滚
+}
+
+func newFakeMysqlDao() *fakeMysqlDao {
+	return &fakeMysqlDao{
+		students:        make(map[string]*model.Student),
+		written:         make(map[uint64]int),
+		getStudentCalls: make(map[string]int),
+	}
+}
+
+func (d *fakeMysqlDao) Transaction(fn func(tx *gorm.DB) error) error {
+	d.txLock.Lock()
+	defer d.txLock.Unlock()
+	d.mu.Lock()
+	backup := make(map[string]*model.Student, len(d.students))
+	for id, student := range d.students {
+		backup[id] = model.CopyStudent(student)
+	}
+	backupProgress := d.progress
+	d.txWritten = nil
+	d.mu.Unlock()
+
+	err := fn(nil)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		d.students = backup
+		d.progress = backupProgress
+		return err
+	}
+	for _, index := range d.txWritten {
+		d.written[index]++
+	}
+	return nil
+}
+
+func (d *fakeMysqlDao) LockOutboxProgress(tx *gorm.DB) (uint64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.progress, nil
+}
+
+func (d *fakeMysqlDao) SetOutboxProgress(tx *gorm.DB, index uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.progressErr != nil {
+		return d.progressErr
+	}
+	if index > d.progress {
+		d.progress = index
+	}
+	d.txWritten = append(d.txWritten, index)
+	return nil
+}
+
+func (d *fakeMysqlDao) SaveStudent(tx *gorm.DB, student *model.Student) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	saved := model.CopyStudent(student)
+	saved.Grades = make(map[string]float64)
+	d.students[student.ID] = saved
+	return nil
+}
+
+func (d *fakeMysqlDao) DeleteScore(tx *gorm.DB, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if student, exists := d.students[id]; exists {
+		student.Grades = make(map[string]float64)
+	}
+	return nil
+}
+
+func (d *fakeMysqlDao) AddGradeToMysql(tx *gorm.DB, subject string, score float64, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if student, exists := d.students[id]; exists {
+		student.Grades[subject] = score
+	}
+	return nil
+}
+
+func (d *fakeMysqlDao) DeleteStudent(tx *gorm.DB, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.students, id)
+	return nil
+}
+
+func (d *fakeMysqlDao) GetStudent(id string) (*model.StudentDB, error) {
+	d.mu.Lock()
+	d.getStudentCalls[id]++
+	gate := d.getStudentGate
+	d.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	time.Sleep(d.getStudentDelay)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	student, exists := d.students[id]
+	if !exists {
+		return nil, fmt.Errorf("数据库不存在学生：%s", id)
+	}
+	return &model.StudentDB{ID: student.ID, Name: student.Name, Gender: student.Gender, Class: student.Class,
+		Expiration: student.Expiration, ExpirationMode: student.ExpirationMode}, nil
+}
+
+func (d *fakeMysqlDao) GetAllStudentIds() ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ids := make([]string, 0, len(d.students))
+	for id := range d.students {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (d *fakeMysqlDao) GetGrade(studentId string) ([]model.Grade, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var grades []model.Grade
+	if student, exists := d.students[studentId]; exists {
+		for subject, score := range student.Grades {
+			grades = append(grades, model.Grade{Subject: subject, Score: score, StudentId: studentId})
+		}
+	}
+	return grades, nil
+}
+
+func (d *fakeMysqlDao) GetStudentCount(id string) (*model.StudentCount, error) {
+	return nil, fmt.Errorf("数据库不存在学生记录：%s", id)
+}
+
+// GetHotStudentCounts 所有学生按id顺序作为访问最多的学生
+func (d *fakeMysqlDao) GetHotStudentCounts() ([]*model.StudentCount, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	counts := make([]*model.StudentCount, 0, len(d.students))
+	for id := range d.students {
+		counts = append(counts, &model.StudentCount{ID: id, StudentId: id, Count: 1})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].StudentId < counts[j].StudentId })
+	return counts, nil
+}
+
+func (d *fakeMysqlDao) AddStudentCount(id string) error { return nil }
+
+func (d *fakeMysqlDao) DeleteStudentCount(id string) error { return nil }
+
+// fakeCacheDao 用map模拟Redis 学生永不过期
+type fakeCacheDao struct {
+	interfaces.StudentCacheDaoInterface
+
+	mu       sync.Mutex
+	students map[string]*model.Student
+	addErr   error // 不为nil时AddStudent失败
+
+	generation int64   // 最近一次重新加载的代数
+	finished   []int64 // 完成重新加载的代数
+	aborted    []int64 // 放弃重新加载的代数
+}
+
+func newFakeCacheDao() *fakeCacheDao {
+	return &fakeCacheDao{students: make(map[string]*model.Student)}
+}
+
+func (d *fakeCacheDao) AddStudent(student *model.Student) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.addErr != nil {
+		return d.addErr
+	}
+	d.students[student.ID] = model.CopyStudent(student)
+	return nil
+}
+
+func (d *fakeCacheDao) FillStudent(student *model.Student) error {
+	return d.AddStudent(student)
+}
+
+func (d *fakeCacheDao) GetStudent(id string) (*model.Student, error) {
+	student, _, err := d.GetStudentWithTTL(id)
+	return student, err
+}
+
+func (d *fakeCacheDao) GetStudentWithTTL(id string) (*model.Student, time.Duration, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	student, exists := d.students[id]
+	if !exists {
+		return nil, 0, fmt.Errorf("StudentRedisDao.GetStudent 缓存中不存在学生：%s", id)
+	}
+	return model.CopyStudent(student), -1, nil
+}
+
+func (d *fakeCacheDao) BeginReload() (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.generation++
+	return d.generation, nil
+}
+
+func (d *fakeCacheDao) FinishReload(ctx context.Context, generation int64, students []*model.Student) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.students = make(map[string]*model.Student, len(students))
+	for _, student := range students {
+		d.students[student.ID] = model.CopyStudent(student)
+	}
+	d.finished = append(d.finished, generation)
+	return nil
+}
+
+func (d *fakeCacheDao) AbortReload(generation int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.aborted = append(d.aborted, generation)
+}
+
+func (d *fakeCacheDao) DeleteStudent(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.students, id)
+	return nil
+}
+
+// writeCounts 返回每个日志索引提交的次数的副本
+func (d *fakeMysqlDao) writeCounts() map[uint64]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	counts := make(map[uint64]int, len(d.written))
+	for index, count := range d.written {
+		counts[index] = count
+	}
+	return counts
+}
+
+// studentIds 返回数据库中所有学生的id
+func (d *fakeMysqlDao) studentIds() map[string]bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ids := make(map[string]bool, len(d.students))
+	for id := range d.students {
+		ids[id] = true
+	}
+	return ids
+}
+
+// nopStores 内存中的Raft存储不需要关闭
+type nopStores struct{}
+
+func (nopStores) Close() error { return nil }
+
+// newTestService 创建一个使用内存数据库和假的MySQL、Redis的学生服务 还没有Raft节点
+func newTestService(t testing.TB, nodeId string, mysqlDao interfaces.StudentMysqlDaoInterface, cacheDao interfaces.StudentCacheDaoInterface) *StudentService {
+	t.Helper()
+	store, err := dao.NewStore[string, *model.Student](config.MemoryDBConfig{Capacity: 1000, EvictRatio: 0.1}, model.CopyStudent)
+	if err != nil {
+		t.Fatalf("创建内存数据库失败：%v", err)
+	}
+	ss := &StudentService{
+		MdbService:   NewStudentMdbService(store, ""),
+		MysqlService: NewStudentMysqlService(mysqlDao),
+		CacheService: NewStudentCacheService(cacheDao, 0),
+		node:         config.Node{NodeId: nodeId, Address: nodeId},
+		peerAddrs:    make(map[string]*config.Peer),
+		raftStores:   nopStores{},
+	}
+	ss.fsm = fsm.NewStudentFSM(ss)
+	return ss
+}
+
+// testRaftConfig 测试用的Raft配置 缩短超时时间让选举更快
+func testRaftConfig(nodeId string) *raftfpk.Config {
+	conf := raftfpk.DefaultConfig()
+	conf.LocalID = raftfpk.ServerID(nodeId)
+	conf.HeartbeatTimeout = 100 * time.Millisecond
+	conf.ElectionTimeout = 100 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	conf.LogOutput = io.Discard
+	return conf
+}
+
+// newTestCluster 在进程内用内存传输层启动n个节点的集群 所有节点共用同一个假的MySQL和Redis
+func newTestCluster(t testing.TB, n int, mysqlDao interfaces.StudentMysqlDaoInterface, cacheDao interfaces.StudentCacheDaoInterface) []*StudentService {
+	t.Helper()
+	nodes := make([]*StudentService, n)
+	transports := make([]*raftfpk.InmemTransport, n)
+	var servers []raftfpk.Server
+	for i := range nodes {
+		nodeId := fmt.Sprintf("node%d", i+1)
+		nodes[i] = newTestService(t, nodeId, mysqlDao, cacheDao)
+		addr, transport := raftfpk.NewInmemTransport(raftfpk.ServerAddress(nodeId))
+		transports[i] = transport
+		servers = append(servers, raftfpk.Server{ID: raftfpk.ServerID(nodeId), Address: addr})
+	}
+	for i := range transports {
+		for j := range transports {
+			if i != j {
+				transports[i].Connect(transports[j].LocalAddr(), transports[j])
+			}
+		}
+	}
+	for i, ss := range nodes {
+		store := raftfpk.NewInmemStore()
+		r, err := raftfpk.NewRaft(testRaftConfig(ss.node.NodeId), ss.fsm, store, store, raftfpk.NewInmemSnapshotStore(), transports[i])
+		if err != nil {
+			t.Fatalf("创建Raft节点：%s失败：%v", ss.node.NodeId, err)
+		}
+		if err = r.BootstrapCluster(raftfpk.Configuration{Servers: servers}).Error(); err != nil {
+			t.Fatalf("初始化集群失败：%v", err)
+		}
+		ss.raftNode = r
+		ss.leaseTimeout = testRaftConfig(ss.node.NodeId).LeaderLeaseTimeout
+		ss.heartbeats = newHeartbeatTracker(r)
+	}
+	t.Cleanup(func() {
+		for _, ss := range nodes {
+			ss.raftNode.Shutdown()
+			ss.heartbeats.close()
+		}
+	})
+	return nodes
+}
+
+// waitForLeader 等待集群选出领导者并返回它
+func waitForLeader(t testing.TB, nodes []*StudentService) *StudentService {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, ss := range nodes {
+			if ss.IsLeader() {
+				return ss
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("5秒内没有选出领导者")
+	return nil
+}
+
+// waitFor 等待cond返回true 超时后测试失败
+func waitFor(t testing.TB, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v内没有等到：%s", timeout, what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
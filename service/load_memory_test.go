@@ -0,0 +1,45 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"node2/model"
+	"path/filepath"
+	"testing"
+)
+
+// TestLoadMemoryDBOnlyOnSingleNode 集群中有其他节点时拒绝加载转储 只有本节点时加载前已经提交的修改会被转储的内容替换
+func TestLoadMemoryDBOnlyOnSingleNode(t *testing.T) {
+	cluster := newTestCluster(t, 3, newFakeMysqlDao(), newFakeCacheDao())
+	leader := waitForLeader(t, cluster)
+	if _, err := leader.LoadMemoryDB(bytes.NewReader(nil)); !errors.Is(err, ErrLoadRequiresSingleNode) {
+		t.Fatalf("三个节点的集群中加载转储返回：%v 期望ErrLoadRequiresSingleNode", err)
+	}
+
+	single := newTestCluster(t, 1, newFakeMysqlDao(), newFakeCacheDao())
+	ss := waitForLeader(t, single)
+	ss.MdbService.dumpPath = filepath.Join(t.TempDir(), "dump.mdb")
+	dumped := &model.Student{ID: "dumped", Name: "name", Gender: "男", Class: "1班",
+		Grades: map[string]float64{"math": 90}, ExpirationMode: model.ExpireNever}
+	addStudentOnLeader(t, single, dumped)
+	if _, err := ss.MdbService.Dump(); err != nil {
+		t.Fatalf("转储失败：%v", err)
+	}
+	later := model.CopyStudent(dumped)
+	later.ID = "later"
+	addStudentOnLeader(t, single, later)
+
+	info, err := ss.LoadMemoryDB(nil)
+	if err != nil {
+		t.Fatalf("只有本节点时加载转储失败：%v", err)
+	}
+	if info.Path != ss.MdbService.dumpPath {
+		t.Errorf("加载的文件是：%s 期望：%s", info.Path, ss.MdbService.dumpPath)
+	}
+	if !ss.MdbService.Resident(dumped.ID) {
+		t.Errorf("加载后内存中没有转储的学生")
+	}
+	if ss.MdbService.Resident(later.ID) {
+		t.Errorf("加载后内存中仍然有转储之后添加的学生")
+	}
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"log"
+	"node2/raft/fsm"
+	"time"
+)
+
+// outboxPersistInterval 没有收到发件箱通知时也会定期检查 重试上一次写入失败的修改
+const outboxPersistInterval = time.Second
+
+// RunOutboxPersister 按日志索引顺序把发件箱中的修改写入MySQL和Redis 直到ctx取消
+// 由只在领导者上执行任务的调度器启动 成为领导者时启动 失去领导权时取消 不需要自己判断是不是领导者
+func (ss *StudentService) RunOutboxPersister(ctx context.Context) error {
+	ticker := time.NewTicker(outboxPersistInterval)
+	defer ticker.Stop()
+	for {
+		// 刚成为领导者时发件箱中可能已经有之前的领导者没有写入的修改 先写一次
+		if err := ss.persistOutbox(); err != nil {
+			log.Printf("StudentService.RunOutboxPersister 持久化发件箱失败：%v 稍后重试", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ss.fsm.OutboxNotify():
+		case <-ticker.C:
+		}
+	}
+}
+
+// persistOutbox 写入发件箱中所有还没有持久化的修改 然后通过Raft通知所有节点从发件箱中删除它们
+// MySQL中记录了已经写入的最大日志索引 每条修改的事务都会先锁住它 所以即使新旧领导者同时写入 每条修改也只会写入一次
+func (ss *StudentService) persistOutbox() error {
+	pending := ss.fsm.PendingOutbox()
+	if len(pending) == 0 {
+		return nil
+	}
+	var ackIndex uint64
+	var err error
+	for _, entry := range pending {
+		if err = ss.persistOutboxEntry(entry); err != nil {
+			break
+		}
+		ackIndex = entry.Index
+	}
+	if ackIndex > 0 {
+		ackErr := ss.applyLocally(&fsm.StudentCommand{Operation: "outboxAck", AckIndex: ackIndex})
+		if ackErr != nil {
+			log.Printf("StudentService.persistOutbox 确认发件箱索引：%d失败：%v", ackIndex, ackErr)
+		}
+	}
+	return err
+}
+
+// errOutboxEntryPersisted 日志索引不大于数据库中的进度 说明之前的领导者已经写入了 只是还没来得及从发件箱删除
+var errOutboxEntryPersisted = errors.New("修改已经写入数据库")
+
+// persistOutboxEntry 在一个MySQL事务中写入一条修改并更新持久化进度 事务提交之后再写入Redis
+// 事务先锁住持久化进度 已经写入过的修改直接跳过 写入的都是完整的学生信息
+func (ss *StudentService) persistOutboxEntry(entry fsm.OutboxEntry) error {
+	err := ss.MysqlService.Transaction(func(tx *gorm.DB) error {
+		progress, err := ss.MysqlService.LockOutboxProgress(tx)
+		if err != nil {
+			return err
+		}
+		if entry.Index <= progress {
+			return errOutboxEntryPersisted
+		}
+		switch entry.Operation {
+		case "add", "update":
+			err = ss.MysqlService.SaveStudent(tx, entry.Student)
+		case "delete":
+			err = ss.MysqlService.RemoveStudent(tx, entry.Id)
+		default:
+			err = fmt.Errorf("未知的操作：%s", entry.Operation)
+		}
+		if err != nil {
+			return err
+		}
+		return ss.MysqlService.SetOutboxProgress(tx, entry.Index)
+	})
+	if errors.Is(err, errOutboxEntryPersisted) {
+		log.Printf("日志索引：%d的修改已经写入数据库 跳过", entry.Index)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("StudentService.persistOutboxEntry 写入日志索引：%d的修改失败：%w", entry.Index, err)
+	}
+	log.Printf("已将日志索引：%d的修改：%s 学生：%s写入数据库", entry.Index, entry.Operation, entry.Id)
+	ss.writeOutboxEntryToCache(entry)
+
+	// 访问次数只是统计数据 不需要和学生信息在同一个事务中
+	if entry.Operation == "delete" {
+		ss.MysqlService.DeleteStudentCount(entry.Id)
+	} else {
+		ss.MysqlService.AddStudentCount(entry.Id)
+	}
+	return nil
+}
+
+// writeOutboxEntryToCache 把已经提交到MySQL的修改写入Redis 缓存不会出现MySQL中没有提交的学生
+// 写入失败时删除缓存中的学生 之后读取时从MySQL重新加载 删除也失败时只能等缓存过期或者下一次重新加载缓存
+func (ss *StudentService) writeOutboxEntryToCache(entry fsm.OutboxEntry) {
+	var err error
+	if entry.Operation == "delete" {
+		err = ss.CacheService.DeleteStudent(entry.Id)
+	} else {
+		err = ss.CacheService.AddStudent(entry.Student)
+	}
+	if err == nil {
+		return
+	}
+	log.Printf("StudentService.writeOutboxEntryToCache 把学生：%s写入缓存失败：%v 删除缓存中的学生", entry.Id, err)
+	if err = ss.CacheService.DeleteStudent(entry.Id); err != nil {
+		log.Printf("StudentService.writeOutboxEntryToCache 删除缓存中的学生：%s失败：%v", entry.Id, err)
+	}
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"node2/model"
+	"node2/scheduler"
+	"sync"
+	"testing"
+	"time"
+)
+
+// addStudentOnLeader 通过当前的领导者添加学生 领导权变化时换一个领导者重试
+func addStudentOnLeader(t *testing.T, nodes []*StudentService, student *model.Student) {
+	t.Helper()
+	requestId := "add-" + student.ID
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		leader := waitForLeader(t, nodes)
+		err := leader.AddStudent(model.CopyStudent(student), requestId)
+		if err == nil {
+			return
+		}
+		if !errors.Is(err, ErrNotLeader) || time.Now().After(deadline) {
+			t.Fatalf("添加学生：%s失败：%v", student.ID, err)
+		}
+	}
+}
+
+// TestOutboxPersistedOnceAcrossLeaderChange 三个节点共用一个数据库 领导者切换前后 以及旧领导者还在写入时 每条修改都只写入一次
+func TestOutboxPersistedOnceAcrossLeaderChange(t *testing.T) {
+	mysqlDao := newFakeMysqlDao()
+	nodes := newTestCluster(t, 3, mysqlDao, newFakeCacheDao())
+	waitForLeader(t, nodes)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var running sync.WaitGroup
+	defer func() {
+		cancel()
+		running.Wait()
+	}()
+	for _, ss := range nodes {
+		jobScheduler := scheduler.NewScheduler()
+		jobScheduler.RegisterLoop("outboxPersister", ss.RunOutboxPersister)
+		running.Add(1)
+		go func(ss *StudentService) {
+			defer running.Done()
+			jobScheduler.Run(ctx, ss.LeaderCh(), ss.IsLeader())
+		}(ss)
+	}
+
+	const total = 40
+	students := make([]*model.Student, total)
+	for i := range students {
+		students[i] = &model.Student{ID: fmt.Sprintf("s%03d", i), Name: "name", Gender: "男", Class: "1班",
+			Grades: map[string]float64{"math": float64(i)}, ExpirationMode: model.ExpireNever}
+	}
+	for _, student := range students[:total/2] {
+		addStudentOnLeader(t, nodes, student)
+	}
+
+	// 切换领导者 同时让所有节点(包括已经不是领导者的节点)不停地写入发件箱 模拟旧领导者还没有发现自己失去领导权
+	oldLeader := waitForLeader(t, nodes)
+	stale := make(chan struct{})
+	var stalePersisters sync.WaitGroup
+	for _, ss := range nodes {
+		stalePersisters.Add(1)
+		go func(ss *StudentService) {
+			defer stalePersisters.Done()
+			for {
+				select {
+				case <-stale:
+					return
+				default:
+				}
+				ss.persistOutbox()
+				time.Sleep(time.Millisecond)
+			}
+		}(ss)
+	}
+	if err := oldLeader.raftNode.LeadershipTransfer().Error(); err != nil {
+		t.Fatalf("转移领导权失败：%v", err)
+	}
+	waitFor(t, 5*time.Second, "新的领导者", func() bool {
+		leader := waitForLeader(t, nodes)
+		return leader != oldLeader
+	})
+	for _, student := range students[total/2:] {
+		addStudentOnLeader(t, nodes, student)
+	}
+	close(stale)
+	stalePersisters.Wait()
+
+	waitFor(t, 10*time.Second, "所有节点的发件箱清空", func() bool {
+		for _, ss := range nodes {
+			if len(ss.fsm.PendingOutbox()) > 0 {
+				return false
+			}
+		}
+		return true
+	})
+
+	counts := mysqlDao.writeCounts()
+	if len(counts) != total {
+		t.Fatalf("写入了%d条修改 期望%d条", len(counts), total)
+	}
+	for index, count := range counts {
+		if count != 1 {
+			t.Errorf("日志索引：%d写入了%d次", index, count)
+		}
+	}
+	ids := mysqlDao.studentIds()
+	for _, student := range students {
+		if !ids[student.ID] {
+			t.Errorf("数据库中没有学生：%s", student.ID)
+		}
+	}
+}
+
+// TestOutboxWritesCacheAfterCommit 事务回滚时缓存中不会出现没有提交的学生 事务提交后写入缓存失败时删除缓存中的旧值
+func TestOutboxWritesCacheAfterCommit(t *testing.T) {
+	mysqlDao := newFakeMysqlDao()
+	cacheDao := newFakeCacheDao()
+	nodes := newTestCluster(t, 1, mysqlDao, cacheDao)
+	ss := waitForLeader(t, nodes)
+	student := &model.Student{ID: "s1", Name: "name", Gender: "男", Class: "1班",
+		Grades: map[string]float64{"math": 90}, ExpirationMode: model.ExpireNever}
+
+	mysqlDao.progressErr = errors.New("更新持久化进度失败")
+	addStudentOnLeader(t, nodes, student)
+	if err := ss.persistOutbox(); err == nil {
+		t.Fatalf("事务失败时持久化发件箱成功")
+	}
+	if _, err := cacheDao.GetStudent(student.ID); err == nil {
+		t.Fatalf("事务回滚后缓存中有没有提交的学生")
+	}
+	if mysqlDao.studentIds()[student.ID] {
+		t.Fatalf("事务回滚后数据库中有学生")
+	}
+
+	mysqlDao.mu.Lock()
+	mysqlDao.progressErr = nil
+	mysqlDao.mu.Unlock()
+	stale := model.CopyStudent(student)
+	stale.Name = "stale"
+	cacheDao.AddStudent(stale)
+	cacheDao.mu.Lock()
+	cacheDao.addErr = errors.New("写入缓存失败")
+	cacheDao.mu.Unlock()
+	if err := ss.persistOutbox(); err != nil {
+		t.Fatalf("写入缓存失败时持久化发件箱返回：%v", err)
+	}
+	if !mysqlDao.studentIds()[student.ID] {
+		t.Errorf("数据库中没有学生")
+	}
+	if cached, err := cacheDao.GetStudent(student.ID); err == nil {
+		t.Errorf("写入缓存失败后缓存中仍然是旧的学生：%+v", cached)
+	}
+	if len(ss.fsm.PendingOutbox()) != 0 {
+		t.Errorf("写入数据库后发件箱中仍然有修改：%+v", ss.fsm.PendingOutbox())
+	}
+}
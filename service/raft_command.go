@@ -0,0 +1,300 @@
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	raftfpk "github.com/hashicorp/raft"
+	"log"
+	"net/http"
+	"node2/config"
+	"node2/model"
+	"node2/raft/fsm"
+	"node2/response"
+	"time"
+)
+
+const (
+	raftApplyTimeout       = 5 * time.Second        // 领导者提交一条命令到状态机的最长等待时间
+	forwardRequestTimeout  = 10 * time.Second       // 跟随者转发一次命令给领导者的最长等待时间
+	forwardMaxAttempts     = 5                      // 提交命令的最大尝试次数 领导权变化时会重新寻找领导者后重试
+	forwardInitialBackoff  = 100 * time.Millisecond // 第一次重试前的等待时间 之后每次翻倍
+	forwardMaxBackoff      = 2 * time.Second        // 重试等待时间的上限
+	forwardCommandEndpoint = "/internal/command"    // 领导者接收转发命令的接口
+)
+
+// ErrNotLeader 本节点不是领导者 或者处理命令的过程中失去了领导权 调用者可以重新寻找领导者后重试
+var ErrNotLeader = errors.New("当前节点不是领导者节点")
+
+// forwardClient 转发命令使用的HTTP客户端 每次请求都有超时时间
+var forwardClient = &http.Client{Timeout: forwardRequestTimeout}
+
+// applyInternalCommand 领导者提交集群内部的命令 比如节点地址的变更
+// 内部命令不会转发 也不能通过转发接口提交 只有领导者自己可以提交
+func (ss *StudentService) applyInternalCommand(operation string, id string, peer *config.Peer) error {
+	cmd := &fsm.StudentCommand{
+		Operation: operation,
+		Id:        id,
+		Peer:      peer,
+	}
+	if err := cmd.Validate(); err != nil {
+		return fmt.Errorf("StudentService.applyInternalCommand 命令不合法：%w", err)
+	}
+	if !ss.IsLeader() {
+		return fmt.Errorf("StudentService.applyInternalCommand 节点：%s不能提交内部命令：%w", ss.node.NodeId, ErrNotLeader)
+	}
+	return ss.applyLocally(cmd)
+}
+
+// submitCommand 检查命令并提交 没有请求id的命令会生成一个 保证转发重试时状态机只执行一次
+func (ss *StudentService) submitCommand(cmd *fsm.StudentCommand) error {
+	if cmd.RequestId == "" {
+		cmd.RequestId = newRequestId()
+	}
+	if err := cmd.Validate(); err != nil {
+		return fmt.Errorf("StudentService.submitCommand 命令不合法：%w", err)
+	}
+	return ss.applyCommand(cmd)
+}
+
+// newRequestId 生成一个随机的请求id
+func newRequestId() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		// 随机数生成失败时退化为时间戳 仍然可以区分绝大多数请求
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// applyCommand 自己是领导者就直接提交命令 否则转发给领导者 领导权变化导致失败时退避后重新寻找领导者重试
+// 状态机返回的错误会原样返回 不会重试
+func (ss *StudentService) applyCommand(cmd *fsm.StudentCommand) error {
+	return retryOnLeaderChange("提交命令："+cmd.Operation, func() error {
+		if ss.IsLeader() {
+			return ss.applyLocally(cmd)
+		}
+		return ss.forwardToLeader(cmd)
+	})
+}
+
+// retryOnLeaderChange 执行需要领导者参与的操作 返回ErrNotLeader时退避后重试 其他错误直接返回
+func retryOnLeaderChange(operation string, fn func() error) error {
+	backoff := forwardInitialBackoff
+	var err error
+	for attempt := 1; attempt <= forwardMaxAttempts; attempt++ {
+		if err = fn(); err == nil || !errors.Is(err, ErrNotLeader) {
+			return err
+		}
+		log.Printf("%s第%d次失败：%v %v后重试", operation, attempt, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > forwardMaxBackoff {
+			backoff = forwardMaxBackoff
+		}
+	}
+	return fmt.Errorf("%s重试%d次后仍然失败：%w", operation, forwardMaxAttempts, err)
+}
+
+// applyLocally 领导者把命令提交到Raft 并返回状态机的处理结果
+func (ss *StudentService) applyLocally(cmd *fsm.StudentCommand) error {
+	// 学生的增删改由领导者检查并确定完整的学生信息后再提交 状态机只修改内存 不会失败
+	if fsm.IsClientOperation(cmd.Operation) {
+		ss.proposeLock.Lock()
+		defer ss.proposeLock.Unlock()
+		// 确保之前任期的修改都已经应用到状态机 否则去重表和学生的状态都可能是旧的
+		if err := ss.termBarrier(); err != nil {
+			return err
+		}
+		// 已经执行过的请求不再提交 直接返回第一次执行的结果 指纹用客户端的请求计算 不能用合并之后的学生
+		var fingerprint string
+		if cmd.RequestId != "" {
+			var err error
+			if fingerprint, err = cmd.RequestFingerprint(); err != nil {
+				return err
+			}
+			if result, applied := ss.fsm.AppliedResult(cmd.RequestId, fingerprint); applied {
+				log.Printf("请求：%s已经执行过 返回第一次执行的结果", cmd.RequestId)
+				return result
+			}
+		}
+		prepared, err := ss.prepareStudentCommand(cmd)
+		if err != nil {
+			return err
+		}
+		prepared.Fingerprint = fingerprint
+		cmd = prepared
+	}
+	// 序列化命令
+	cmdData, err := json.Marshal(cmd)
+	if err != nil {
+		return fmt.Errorf("StudentService.applyLocally Marshal err: %w", err)
+	}
+	future := ss.raftNode.Apply(cmdData, raftApplyTimeout)
+	if err = future.Error(); err != nil {
+		if isLeadershipErr(err) {
+			return fmt.Errorf("%w：%v", ErrNotLeader, err)
+		}
+		return fmt.Errorf("StudentService.applyLocally 处理命令失败：%w", err)
+	}
+	// 处理响应
+	if resultErr, ok := future.Response().(error); ok {
+		return resultErr
+	}
+	log.Printf("领导者节点已接收并提交命令到状态机")
+	return nil
+}
+
+// prepareStudentCommand 领导者在提交之前检查学生是否存在 更新命令会和当前的学生信息合并成完整的学生
+// 返回的命令是副本 不会修改调用者的命令
+// 调用之前需要执行过本任期的屏障
+func (ss *StudentService) prepareStudentCommand(cmd *fsm.StudentCommand) (*fsm.StudentCommand, error) {
+	id := cmd.Id
+	if cmd.Student != nil {
+		id = cmd.Student.ID
+	}
+	current, err := ss.currentStudent(id)
+	if err != nil {
+		return nil, fmt.Errorf("StudentService.prepareStudentCommand 查找学生：%s失败：%w", id, err)
+	}
+	prepared := *cmd
+	switch cmd.Operation {
+	case "add":
+		if current != nil {
+			return nil, fmt.Errorf("StudentService.prepareStudentCommand 学生：%s已存在", id)
+		}
+		prepared.Student = model.CopyStudent(cmd.Student)
+	case "update":
+		if current == nil {
+			return nil, fmt.Errorf("StudentService.prepareStudentCommand 不存在学生：%s", id)
+		}
+		prepared.Student = mergeStudent(current, cmd.Student)
+	case "expire":
+		if current == nil {
+			return nil, fmt.Errorf("StudentService.prepareStudentCommand 不存在学生：%s", id)
+		}
+		prepared.Student = model.CopyStudent(current)
+		prepared.Student.Expiration = cmd.Student.Expiration
+		prepared.Student.ExpirationMode = cmd.Student.ExpirationMode
+	case "delete":
+		if current == nil {
+			return nil, fmt.Errorf("StudentService.prepareStudentCommand 不存在学生：%s", id)
+		}
+	}
+	return &prepared, nil
+}
+
+// currentStudent 返回学生当前的状态 学生不存在时返回nil
+// 发件箱中还没有写入MySQL的修改最新 其次是内存 最后是MySQL
+func (ss *StudentService) currentStudent(id string) (*model.Student, error) {
+	if student, pending := ss.pendingStudent(id); pending {
+		return student, nil
+	}
+	// 内存数据库返回的已经是副本
+	if student, err := ss.MdbService.GetStudent(id); err == nil {
+		return student, nil
+	}
+	student, err := ss.MysqlService.GetStudentFromMysql(id)
+	if err != nil {
+		if ss.StudentNotFoundErr(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return student, nil
+}
+
+// pendingStudent 返回发件箱中学生最新的还没有持久化的修改 pending为false表示没有 学生被删除时返回nil
+func (ss *StudentService) pendingStudent(id string) (student *model.Student, pending bool) {
+	entry, exists := ss.fsm.PendingStudent(id)
+	if !exists {
+		return nil, false
+	}
+	if entry.Operation == "delete" {
+		return nil, true
+	}
+	return entry.Student, true
+}
+
+// mergeStudent 用更新请求中的字段覆盖当前的学生信息 没有提供的字段保留原来的值 成绩按学科合并
+func mergeStudent(current *model.Student, update *model.Student) *model.Student {
+	merged := model.CopyStudent(current)
+	if merged.Grades == nil {
+		merged.Grades = make(map[string]float64, len(update.Grades))
+	}
+	for subject, score := range update.Grades {
+		merged.Grades[subject] = score
+	}
+	if update.Name != "" {
+		merged.Name = update.Name
+	}
+	if update.Class != "" {
+		merged.Class = update.Class
+	}
+	if update.Gender != "" {
+		merged.Gender = update.Gender
+	}
+	if update.Expiration != 0 {
+		merged.Expiration = update.Expiration
+	}
+	if update.ExpirationMode != "" {
+		merged.ExpirationMode = update.ExpirationMode
+	}
+	return merged
+}
+
+// isLeadershipErr 判断Raft返回的错误是不是因为领导权变化 这类错误换一个领导者重试就可能成功
+func isLeadershipErr(err error) bool {
+	return errors.Is(err, raftfpk.ErrNotLeader) ||
+		errors.Is(err, raftfpk.ErrLeadershipLost) ||
+		errors.Is(err, raftfpk.ErrLeadershipTransferInProgress) ||
+		errors.Is(err, raftfpk.ErrEnqueueTimeout)
+}
+
+// forwardToLeader 把命令放在POST请求体中转发给领导者 领导者返回503说明它已经不是领导者了
+func (ss *StudentService) forwardToLeader(cmd *fsm.StudentCommand) error {
+	leaderAddr, err := ss.GetLeaderHttpAddr()
+	if err != nil {
+		return fmt.Errorf("%w：获取领导者地址失败：%v", ErrNotLeader, err)
+	}
+	cmdData, err := json.Marshal(cmd)
+	if err != nil {
+		return fmt.Errorf("StudentService.forwardToLeader Marshal err: %w", err)
+	}
+	resp, err := forwardClient.Post(fmt.Sprintf("http://%s%s", leaderAddr, forwardCommandEndpoint), "application/json", bytes.NewReader(cmdData))
+	if err != nil {
+		// 请求没有送达或者超时 领导者可能已经宕机
+		return fmt.Errorf("%w：将命令发送给领导者：%s失败：%v", ErrNotLeader, leaderAddr, err)
+	}
+	defer resp.Body.Close()
+
+	// 解析 JSON 响应
+	var result response.Result
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("StudentService.forwardToLeader 解析领导者：%s的响应出错：%w", leaderAddr, err)
+	}
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return fmt.Errorf("%w：%s", ErrNotLeader, result.Message)
+	}
+	if resp.StatusCode == http.StatusConflict {
+		return fmt.Errorf("%w：%s", fsm.ErrRequestConflict, result.Message)
+	}
+	//把状态机返回的错误信息原样返回给前端
+	if result.Code != 1 {
+		return errors.New(result.Message)
+	}
+	return nil
+}
+
+// LeaderHandleCommand 领导者节点会处理跟随者转发的命令 并发送到状态机 只接受学生的增删改
+func (ss *StudentService) LeaderHandleCommand(cmd *fsm.StudentCommand) error {
+	if !fsm.IsClientOperation(cmd.Operation) {
+		return fmt.Errorf("StudentService.LeaderHandleCommand 不能转发内部命令：%s", cmd.Operation)
+	}
+	if !ss.IsLeader() {
+		return ErrNotLeader
+	}
+	return ss.applyLocally(cmd)
+}
@@ -0,0 +1,227 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"node2/model"
+	"node2/response"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 读一致性级别
+const (
+	ConsistencyLinearizable = "linearizable" // 线性一致读 读之前确认领导权并等待本节点应用到领导者的提交位置
+	ConsistencyLease        = "lease"        // 租约读 只能在领导者上执行 领导者和多数节点确认领导权后的租约内不再确认 直接读已经应用的状态
+	ConsistencyStale        = "stale"        // 直接读本节点的数据 可能读到已经删除或者修改前的学生
+)
+
+// readIndexEndpoint 领导者返回读索引的接口
+const readIndexEndpoint = "/internal/readIndex"
+
+// StudentReadResult 查询学生的结果 包含实际使用的读一致性级别
+type StudentReadResult struct {
+	Student     *model.Student `json:"student"`
+	Consistency string         `json:"consistency"`
+}
+
+// ValidConsistency 判断读一致性级别是否合法
+func ValidConsistency(consistency string) bool {
+	switch consistency {
+	case ConsistencyLinearizable, ConsistencyLease, ConsistencyStale:
+		return true
+	}
+	return false
+}
+
+// ReadStudent 按指定的读一致性级别查询学生
+// 线性一致读和租约读只读状态机已经应用的状态 不经过缓存 也不会把读到的学生写回内存
+func (ss *StudentService) ReadStudent(id string, consistency string) (*StudentReadResult, error) {
+	if consistency == "" {
+		consistency = ConsistencyStale
+	}
+	var student *model.Student
+	var err error
+	switch consistency {
+	case ConsistencyLinearizable:
+		if err = ss.linearizableBarrier(); err != nil {
+			return nil, fmt.Errorf("StudentService.ReadStudent 线性一致读失败：%w", err)
+		}
+		student, err = ss.readApplied(id)
+	case ConsistencyLease:
+		// 跟随者不知道领导者的租约是否还有效 只有领导者可以租约读
+		if err = ss.leaseBarrier(); err != nil {
+			return nil, fmt.Errorf("StudentService.ReadStudent 节点：%s不能租约读：%w", ss.node.NodeId, err)
+		}
+		student, err = ss.readApplied(id)
+	case ConsistencyStale:
+		student, err = ss.GetStudent(id)
+	default:
+		return nil, fmt.Errorf("StudentService.ReadStudent 未知的读一致性级别：%s", consistency)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &StudentReadResult{Student: student, Consistency: consistency}, nil
+}
+
+// readApplied 从状态机已经应用的状态读学生 先读内存 再读发件箱中还没有持久化的修改
+// 发件箱中没有这个学生的修改时 它的所有修改都已经写入MySQL 所以最后直接读MySQL 不读可能落后的缓存
+func (ss *StudentService) readApplied(id string) (*model.Student, error) {
+	if student, err := ss.MdbService.GetStudent(id); err == nil {
+		ss.MysqlService.AddStudentCount(id)
+		return student, nil
+	}
+	if student, pending := ss.pendingStudent(id); pending {
+		if student == nil {
+			return nil, fmt.Errorf("StudentService.readApplied 不存在学生：%s 删除还没有写入数据库", id)
+		}
+		ss.MysqlService.AddStudentCount(id)
+		return model.CopyStudent(student), nil
+	}
+	student, err := ss.MysqlService.GetStudentFromMysql(id)
+	if err != nil {
+		return nil, fmt.Errorf("StudentService.readApplied 查找学生：%s失败：%w", id, err)
+	}
+	ss.MysqlService.AddStudentCount(id)
+	return student, nil
+}
+
+// linearizableBarrier 获取读索引并等待本节点的状态机应用到读索引 之后读本地数据就不会读到旧数据
+func (ss *StudentService) linearizableBarrier() error {
+	var readIndex uint64
+	err := retryOnLeaderChange("获取读索引", func() error {
+		var err error
+		if ss.IsLeader() {
+			readIndex, err = ss.LeaderReadIndex()
+		} else {
+			readIndex, err = ss.requestReadIndex()
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return ss.waitForApplied(readIndex, raftApplyTimeout)
+}
+
+// LeaderReadIndex 领导者确认自己仍然是领导者后返回当前的提交索引作为读索引
+func (ss *StudentService) LeaderReadIndex() (uint64, error) {
+	if !ss.IsLeader() {
+		return 0, ErrNotLeader
+	}
+	if err := ss.termBarrier(); err != nil {
+		return 0, err
+	}
+	readIndex := ss.raftNode.CommitIndex()
+	// 和多数节点确认领导权 防止网络分区中的旧领导者返回旧的提交索引
+	if err := ss.raftNode.VerifyLeader().Error(); err != nil {
+		return 0, fmt.Errorf("%w：%v", ErrNotLeader, err)
+	}
+	return readIndex, nil
+}
+
+// leaderLease 领导者和多数节点确认领导权后得到的租约 只在确认时的任期内有效
+type leaderLease struct {
+	mu     sync.Mutex
+	term   uint64
+	expiry time.Time
+}
+
+// valid 判断任期term的租约在now时是否还有效
+func (l *leaderLease) valid(term uint64, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.term == term && now.Before(l.expiry)
+}
+
+// extend 把任期term的租约延长到expiry 不会缩短已有的租约
+func (l *leaderLease) extend(term uint64, expiry time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.term != term || expiry.After(l.expiry) {
+		l.term = term
+		l.expiry = expiry
+	}
+}
+
+// leaseBarrier 确认领导者的租约还有效并等待状态机应用到当前的提交索引 之后读本地数据就不会读到旧数据
+// 租约从开始和多数节点确认领导权的时间算起 持续raft.lease_timeout 跟随者在心跳超时之内不会投票给其他节点
+// 而租约不超过心跳超时 所以租约内不会有新的领导者提交修改 租约过期后再和多数节点确认一次并续约
+// 联系不上多数节点时确认失败 返回ErrNotLeader 不会在网络分区中读到旧数据
+func (ss *StudentService) leaseBarrier() error {
+	if !ss.IsLeader() {
+		return ErrNotLeader
+	}
+	if err := ss.termBarrier(); err != nil {
+		return err
+	}
+	term := ss.raftNode.CurrentTerm()
+	readIndex := ss.raftNode.CommitIndex()
+	if start := time.Now(); !ss.lease.valid(term, start) {
+		if err := ss.raftNode.VerifyLeader().Error(); err != nil {
+			return fmt.Errorf("%w：%v", ErrNotLeader, err)
+		}
+		ss.lease.extend(term, start.Add(ss.leaseTimeout))
+	}
+	return ss.waitForApplied(readIndex, raftApplyTimeout)
+}
+
+// termBarrier 新领导者在本任期提交第一条日志之前 提交索引可能落后 先用屏障确保之前任期的日志都已提交并应用到状态机
+// 每个任期只需要执行一次
+func (ss *StudentService) termBarrier() error {
+	term := ss.raftNode.CurrentTerm()
+	if atomic.LoadUint64(&ss.barrierTerm) == term {
+		return nil
+	}
+	if err := ss.raftNode.Barrier(raftApplyTimeout).Error(); err != nil {
+		if isLeadershipErr(err) {
+			return fmt.Errorf("%w：%v", ErrNotLeader, err)
+		}
+		return fmt.Errorf("StudentService.termBarrier 等待屏障失败：%w", err)
+	}
+	atomic.StoreUint64(&ss.barrierTerm, term)
+	return nil
+}
+
+// requestReadIndex 跟随者向领导者请求读索引
+func (ss *StudentService) requestReadIndex() (uint64, error) {
+	leaderAddr, err := ss.GetLeaderHttpAddr()
+	if err != nil {
+		return 0, fmt.Errorf("%w：获取领导者地址失败：%v", ErrNotLeader, err)
+	}
+	resp, err := forwardClient.Get(fmt.Sprintf("http://%s%s", leaderAddr, readIndexEndpoint))
+	if err != nil {
+		return 0, fmt.Errorf("%w：向领导者：%s请求读索引失败：%v", ErrNotLeader, leaderAddr, err)
+	}
+	defer resp.Body.Close()
+	var result response.Result
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("StudentService.requestReadIndex 解析领导者：%s的响应出错：%w", leaderAddr, err)
+	}
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return 0, fmt.Errorf("%w：%s", ErrNotLeader, result.Message)
+	}
+	if result.Code != 1 {
+		return 0, fmt.Errorf("StudentService.requestReadIndex 领导者返回错误：%s", result.Message)
+	}
+	readIndex, ok := result.Data.(float64)
+	if !ok {
+		return 0, fmt.Errorf("StudentService.requestReadIndex 读索引 类型断言失败")
+	}
+	return uint64(readIndex), nil
+}
+
+// waitForApplied 等待本节点的状态机应用到指定的日志索引
+func (ss *StudentService) waitForApplied(index uint64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for ss.raftNode.AppliedIndex() < index {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("StudentService.waitForApplied 等待%v后仍未应用到日志：%d 当前应用到：%d", timeout, index, ss.raftNode.AppliedIndex())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil
+}
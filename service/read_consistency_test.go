@@ -0,0 +1,45 @@
+package service
+
+import (
+	"errors"
+	"node2/model"
+	"testing"
+	"time"
+)
+
+// TestLeaseReadRequiresQuorum 领导者租约读时和多数节点确认领导权并续约 跟随者不能租约读
+// 联系不上多数节点后租约过期 租约读返回ErrNotLeader 不会读到网络分区之后的旧数据
+func TestLeaseReadRequiresQuorum(t *testing.T) {
+	mysqlDao := newFakeMysqlDao()
+	mysqlDao.students["s1"] = &model.Student{ID: "s1", Name: "name", Gender: "男", Class: "1班",
+		Grades: map[string]float64{"math": 90}, ExpirationMode: model.ExpireNever}
+	nodes := newTestCluster(t, 3, mysqlDao, newFakeCacheDao())
+	leader := waitForLeader(t, nodes)
+
+	readAt := time.Now()
+	result, err := leader.ReadStudent("s1", ConsistencyLease)
+	if err != nil {
+		t.Fatalf("领导者租约读失败：%v", err)
+	}
+	if result.Student.ID != "s1" || result.Consistency != ConsistencyLease {
+		t.Errorf("租约读的结果：%+v 期望读到学生s1", result)
+	}
+	if now := time.Now(); now.Sub(readAt) < leader.leaseTimeout && !leader.lease.valid(leader.raftNode.CurrentTerm(), now) {
+		t.Errorf("租约读之后领导者没有续约")
+	}
+	for _, ss := range nodes {
+		if ss == leader {
+			continue
+		}
+		if _, err = ss.ReadStudent("s1", ConsistencyLease); !errors.Is(err, ErrNotLeader) {
+			t.Errorf("跟随者：%s租约读返回：%v 期望ErrNotLeader", ss.node.NodeId, err)
+		}
+		ss.raftNode.Shutdown()
+	}
+
+	// 跟随者都关闭后领导者联系不上多数节点 租约过期后不能再租约读
+	time.Sleep(leader.leaseTimeout + 10*time.Millisecond)
+	if _, err = leader.ReadStudent("s1", ConsistencyLease); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("联系不上多数节点时租约读返回：%v 期望ErrNotLeader", err)
+	}
+}
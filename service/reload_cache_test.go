@@ -0,0 +1,59 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"node2/model"
+	"testing"
+	"time"
+)
+
+// TestReloadCacheJobStopsOnCancel 重新加载缓存时ctx取消 正在进行的查询完成后不再读取之后的学生 放弃这一代并返回
+// 没有取消时读取全部学生并切换到新的一代
+func TestReloadCacheJobStopsOnCancel(t *testing.T) {
+	mysqlDao := newFakeMysqlDao()
+	cacheDao := newFakeCacheDao()
+	ss := newTestService(t, "node1", mysqlDao, cacheDao)
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("s%d", i)
+		mysqlDao.students[id] = &model.Student{ID: id, Name: "name-" + id, Gender: "男", Class: "1班",
+			Grades: map[string]float64{"math": 90}, ExpirationMode: model.ExpireNever}
+	}
+	gate := make(chan struct{})
+	mysqlDao.getStudentGate = gate
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- ss.ReLoadCacheJob(ctx) }()
+	waitFor(t, 5*time.Second, "开始读取学生", func() bool {
+		mysqlDao.mu.Lock()
+		defer mysqlDao.mu.Unlock()
+		return len(mysqlDao.getStudentCalls) == 1
+	})
+	cancel()
+	close(gate)
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Fatalf("取消后重新加载返回：%v 期望context.Canceled", err)
+	}
+	mysqlDao.mu.Lock()
+	calls := len(mysqlDao.getStudentCalls)
+	mysqlDao.mu.Unlock()
+	if calls != 1 {
+		t.Errorf("取消后又读取了%d个学生", calls-1)
+	}
+	cacheDao.mu.Lock()
+	if len(cacheDao.aborted) != 1 || len(cacheDao.finished) != 0 {
+		t.Errorf("取消后放弃的代数：%v 完成的代数：%v 期望放弃第一代", cacheDao.aborted, cacheDao.finished)
+	}
+	cacheDao.mu.Unlock()
+
+	if err := ss.ReLoadCacheJob(context.Background()); err != nil {
+		t.Fatalf("重新加载缓存失败：%v", err)
+	}
+	cacheDao.mu.Lock()
+	defer cacheDao.mu.Unlock()
+	if len(cacheDao.finished) != 1 || len(cacheDao.students) != 5 {
+		t.Errorf("重新加载后完成的代数：%v 缓存中有%d个学生 期望5个", cacheDao.finished, len(cacheDao.students))
+	}
+}
@@ -0,0 +1,35 @@
+package service
+
+import (
+	"errors"
+	"node2/model"
+	"node2/raft/fsm"
+	"testing"
+)
+
+// TestReusedRequestIdConflicts 重试相同的请求返回第一次的结果 用同一个请求id提交不同的请求返回ErrRequestConflict 并且不会执行
+func TestReusedRequestIdConflicts(t *testing.T) {
+	nodes := newTestCluster(t, 1, newFakeMysqlDao(), newFakeCacheDao())
+	ss := waitForLeader(t, nodes)
+	student := &model.Student{ID: "s1", Name: "name", Gender: "男", Class: "1班",
+		Grades: map[string]float64{"math": 90}, ExpirationMode: model.ExpireNever}
+	if err := ss.AddStudent(model.CopyStudent(student), "request-1"); err != nil {
+		t.Fatalf("添加学生失败：%v", err)
+	}
+	if err := ss.AddStudent(model.CopyStudent(student), "request-1"); err != nil {
+		t.Fatalf("重试添加学生返回：%v 期望第一次的结果", err)
+	}
+
+	changed := model.CopyStudent(student)
+	changed.Name = "changed"
+	if err := ss.UpdateStudent(changed, "request-1"); !errors.Is(err, fsm.ErrRequestConflict) {
+		t.Fatalf("用同一个请求id修改学生返回：%v 期望ErrRequestConflict", err)
+	}
+	got, err := ss.MdbService.GetStudent(student.ID)
+	if err != nil {
+		t.Fatalf("读取内存中的学生失败：%v", err)
+	}
+	if got.Name != student.Name {
+		t.Errorf("冲突的请求修改了学生的名字：%s", got.Name)
+	}
+}
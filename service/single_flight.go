@@ -0,0 +1,50 @@
+package service
+
+import (
+	"errors"
+	"sync"
+)
+
+// errFlightPanicked 执行加载的调用者发生了panic 等待它的调用者收到这个错误
+var errFlightPanicked = errors.New("合并的加载发生了panic")
+
+// flightCall 一次正在执行或者已经完成的加载
+type flightCall[V any] struct {
+	done  chan struct{} // 加载完成后关闭
+	value V
+	err   error
+}
+
+// flightGroup 合并相同键的并发加载 同一时刻每个键只执行一次fn 其他调用者等待并共享它的结果
+type flightGroup[V any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[V]
+}
+
+// Do 执行并返回fn的结果 相同的键已经在加载时不再执行fn 等待那次加载的结果 shared表示结果是否和其他调用者共享
+// 加载完成后结果不会保留 之后的调用会重新执行fn
+func (g *flightGroup[V]) Do(key string, fn func() (V, error)) (value V, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall[V])
+	}
+	if call, exists := g.calls[key]; exists {
+		g.mu.Unlock()
+		<-call.done
+		return call.value, call.err, true
+	}
+	call := &flightCall[V]{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	// fn发生panic时也要让等待的调用者返回
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.err = errFlightPanicked
+	call.value, call.err = fn()
+	return call.value, call.err, false
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"fmt"
+	"node2/model"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConcurrentMissesLoadOnce 内存和缓存中都没有的学生被并发查询时 每个学生只从数据库加载一次
+func TestConcurrentMissesLoadOnce(t *testing.T) {
+	mysqlDao := newFakeMysqlDao()
+	cacheDao := newFakeCacheDao()
+	ss := newTestService(t, "node1", mysqlDao, cacheDao)
+
+	const students = 5
+	const readersPerStudent = 20
+	ids := make([]string, students)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("s%d", i)
+		mysqlDao.students[ids[i]] = &model.Student{ID: ids[i], Name: "name-" + ids[i], Gender: "男", Class: "1班",
+			Grades: map[string]float64{"math": 90}, ExpirationMode: model.ExpireNever}
+	}
+	// 第一次加载会一直等到所有请求都到达之后才返回
+	gate := make(chan struct{})
+	mysqlDao.getStudentGate = gate
+
+	var readers sync.WaitGroup
+	errs := make(chan error, students*readersPerStudent)
+	for _, id := range ids {
+		for r := 0; r < readersPerStudent; r++ {
+			readers.Add(1)
+			go func(id string) {
+				defer readers.Done()
+				student, err := ss.GetStudent(id)
+				if err != nil {
+					errs <- fmt.Errorf("查询学生：%s失败：%w", id, err)
+					return
+				}
+				if student.ID != id || student.Grades["math"] != 90 {
+					errs <- fmt.Errorf("查询学生：%s得到了错误的学生：%+v", id, student)
+				}
+			}(id)
+		}
+	}
+	waitFor(t, 5*time.Second, "每个学生都开始从数据库加载", func() bool {
+		mysqlDao.mu.Lock()
+		defer mysqlDao.mu.Unlock()
+		return len(mysqlDao.getStudentCalls) == students
+	})
+	// 给其他请求留出时间进入合并加载
+	time.Sleep(50 * time.Millisecond)
+	close(gate)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	mysqlDao.mu.Lock()
+	defer mysqlDao.mu.Unlock()
+	for _, id := range ids {
+		if calls := mysqlDao.getStudentCalls[id]; calls != 1 {
+			t.Errorf("学生：%s从数据库加载了%d次 期望1次", id, calls)
+		}
+		if !ss.MdbService.Resident(id) {
+			t.Errorf("学生：%s加载后没有写回内存", id)
+		}
+	}
+}
+
+// BenchmarkGetStudentConcurrentMiss 并发查询刚刚从内存和缓存中缺失的学生 每个学生依次被benchReadersPerStudent个请求查询
+// queries/op是平均每次查询访问数据库的次数 合并加载时接近1/benchReadersPerStudent
+func BenchmarkGetStudentConcurrentMiss(b *testing.B) {
+	const benchReadersPerStudent = 8
+	mysqlDao := newFakeMysqlDao()
+	mysqlDao.getStudentDelay = 100 * time.Microsecond
+	ss := newTestService(b, "node1", mysqlDao, newFakeCacheDao())
+	for i := 0; i <= b.N/benchReadersPerStudent; i++ {
+		id := fmt.Sprintf("s%d", i)
+		mysqlDao.students[id] = &model.Student{ID: id, Name: "name-" + id, Gender: "男", Class: "1班",
+			Grades: map[string]float64{"math": 90}, ExpirationMode: model.ExpireNever}
+	}
+
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			id := fmt.Sprintf("s%d", (next.Add(1)-1)/benchReadersPerStudent)
+			if _, err := ss.GetStudent(id); err != nil {
+				b.Errorf("查询学生：%s失败：%v", id, err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+
+	mysqlDao.mu.Lock()
+	defer mysqlDao.mu.Unlock()
+	var queries int
+	for _, calls := range mysqlDao.getStudentCalls {
+		queries += calls
+	}
+	b.ReportMetric(float64(queries)/float64(b.N), "queries/op")
+}
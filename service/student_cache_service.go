@@ -1,23 +1,71 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"node2/dao"
+	"math"
+	"math/rand"
+	"node2/interfaces"
 	"node2/model"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// loadCostWeight 估算从数据库加载学生耗时的指数移动平均中最新一次的权重
+const loadCostWeight = 0.2
+
 // StudentCacheService 定义缓存服务层结构体
 type StudentCacheService struct {
-	cacheDao *dao.StudentCacheDao
+	cacheDao         interfaces.StudentCacheDaoInterface
+	earlyRefreshBeta float64      // 概率提前刷新的系数 0表示不提前刷新
+	loadCost         atomic.Int64 // 从数据库加载学生耗时的指数移动平均 单位纳秒
 }
 
-// NewStudentCacheService 创建一个新的 StudentCacheService 实例
-func NewStudentCacheService(cacheDao *dao.StudentCacheDao) *StudentCacheService {
+// NewStudentCacheService 创建一个新的 StudentCacheService 实例 earlyRefreshBeta为0时不提前刷新
+func NewStudentCacheService(cacheDao interfaces.StudentCacheDaoInterface, earlyRefreshBeta float64) *StudentCacheService {
 	return &StudentCacheService{
-		cacheDao: cacheDao,
+		cacheDao:         cacheDao,
+		earlyRefreshBeta: earlyRefreshBeta,
+	}
+}
+
+// RecordLoadCost 记录一次从数据库加载学生的耗时 用于决定提前多久刷新
+func (scs *StudentCacheService) RecordLoadCost(cost time.Duration) {
+	for {
+		old := scs.loadCost.Load()
+		next := int64(cost)
+		if old > 0 {
+			next = int64(float64(old)*(1-loadCostWeight) + float64(cost)*loadCostWeight)
+		}
+		if scs.loadCost.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// ShouldRefreshEarly 判断是否需要在缓存过期之前提前刷新学生 remaining是学生在缓存中剩余的过期时间
+// 按XFetch算法 加载耗时 * beta * -ln(随机数) 超过剩余时间时刷新 越接近过期越可能刷新 并发的读取者不会同时在过期时回源
+// 只刷新永不过期的学生 它们在缓存中的过期时间只是缓存的期限 设置了过期时间的学生到期后就应该从缓存中消失
+func (scs *StudentCacheService) ShouldRefreshEarly(student *model.Student, remaining time.Duration) bool {
+	if scs.earlyRefreshBeta <= 0 || remaining <= 0 {
+		return false
+	}
+	if student.Expiration > 0 && student.ExpirationMode != model.ExpireNever {
+		return false
+	}
+	cost := float64(scs.loadCost.Load())
+	return cost*scs.earlyRefreshBeta*-math.Log(1-rand.Float64()) >= float64(remaining)
+}
+
+// RefreshStudent 用数据库中的学生刷新缓存 并重新计算缓存的过期时间
+func (scs *StudentCacheService) RefreshStudent(student *model.Student) error {
+	if err := scs.cacheDao.RefreshStudent(student); err != nil {
+		return fmt.Errorf("StudentCacheService.RefreshStudent 刷新缓存中的学生：%s失败：%w", student.ID, err)
 	}
+	log.Printf("提前刷新缓存中的学生：%s", student.ID)
+	return nil
 }
 
 // StudentExists 判断学生是否存在
@@ -34,7 +82,7 @@ func (scs *StudentCacheService) StudentExists(id string) error {
 	return nil
 }
 
-// AddStudent 向缓存添加学生
+// AddStudent 向缓存写入学生的最新信息 正在重新加载时同时写入新的一代
 func (scs *StudentCacheService) AddStudent(student *model.Student) error {
 	//调用数据层代码
 	if err := scs.cacheDao.AddStudent(student); err != nil {
@@ -44,15 +92,24 @@ func (scs *StudentCacheService) AddStudent(student *model.Student) error {
 	return nil
 }
 
-// GetStudentFromCache 从缓存中获取学生
-func (scs *StudentCacheService) GetStudentFromCache(id string) (*model.Student, error) {
+// FillStudent 把从数据库中读到的学生填充到缓存中
+func (scs *StudentCacheService) FillStudent(student *model.Student) error {
+	if err := scs.cacheDao.FillStudent(student); err != nil {
+		return fmt.Errorf("StudentCacheService.FillStudent 向缓存填充学生：%s失败：%w", student.ID, err)
+	}
+	log.Printf("向缓存填充学生：%s", student.ID)
+	return nil
+}
+
+// GetStudentFromCache 从缓存中获取学生和它在缓存中剩余的过期时间 永不过期时剩余时间为-1
+func (scs *StudentCacheService) GetStudentFromCache(id string) (*model.Student, time.Duration, error) {
 	//调用数据层代码
-	student, err := scs.cacheDao.GetStudent(id)
+	student, ttl, err := scs.cacheDao.GetStudentWithTTL(id)
 	if err != nil {
-		return nil, fmt.Errorf("StudentCacheService.GetStudentFromCache 从缓存中查找学生：%s失败：%w", id, err)
+		return nil, 0, fmt.Errorf("StudentCacheService.GetStudentFromCache 从缓存中查找学生：%s失败：%w", id, err)
 	}
 	log.Printf("从缓存查找学生：%s", id)
-	return student, nil
+	return student, ttl, nil
 }
 
 // UpdateStudent 更新学生信息
@@ -85,24 +142,29 @@ func (scs *StudentCacheService) UpdateStudent(student *model.Student) error {
 	return nil
 }
 
-// DeleteStudent 删除学生
+// DeleteStudent 删除学生 不存在时也会执行 正在重新加载时同时从新的一代删除
 func (scs *StudentCacheService) DeleteStudent(id string) error {
-	// 先判断是否存在
-	err := scs.StudentExists(id)
-	if err != nil {
-		return err
-	}
 	// 调用数据层代码
-	if err = scs.cacheDao.DeleteStudent(id); err != nil {
+	if err := scs.cacheDao.DeleteStudent(id); err != nil {
 		return fmt.Errorf("StudentCacheService.DeleteStudent 从缓存删除学生：%s失败：%w", id, err)
 	}
 	log.Printf("从缓存删除学生：%s", id)
 	return nil
 }
 
-// ReLoadCacheData 重新加载缓存数据
-func (scs *StudentCacheService) ReLoadCacheData(students []*model.Student) error {
-	return scs.cacheDao.ReLoadCacheData(students)
+// BeginReload 开始重新加载缓存 返回新的一代
+func (scs *StudentCacheService) BeginReload() (int64, error) {
+	return scs.cacheDao.BeginReload()
+}
+
+// FinishReload 把学生写入新的一代并切换过去
+func (scs *StudentCacheService) FinishReload(ctx context.Context, generation int64, students []*model.Student) error {
+	return scs.cacheDao.FinishReload(ctx, generation, students)
+}
+
+// AbortReload 放弃重新加载的一代
+func (scs *StudentCacheService) AbortReload(generation int64) {
+	scs.cacheDao.AbortReload(generation)
 }
 
 // GetAllStudentsFromCache 从缓存中获取所有学生
@@ -1,24 +1,121 @@
 package service
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"node2/config"
 	"node2/dao"
 	"node2/model"
+	"os"
+	"sort"
 	"strings"
+	"time"
 )
 
 // StudentMdbService 定义内存数据库服务层结构体
 type StudentMdbService struct {
-	memoryDBDao *dao.MemoryDBDao
+	memoryDBDao *dao.Store[string, *model.Student]
+	dumpPath    string // 转储文件的路径
 }
 
-// NewStudentMdbService 创建一个新的 StudentMdbService 实例
-func NewStudentMdbService(db *dao.MemoryDBDao) *StudentMdbService {
+// 内存中学生的二级索引
+const (
+	IndexClass   = "class"
+	IndexGender  = "gender"
+	IndexSubject = "subject" // Grades中的科目名称
+)
+
+// NewStudentMdbService 创建一个新的 StudentMdbService 实例 并在内存数据库上建立班级、性别和科目的二级索引
+func NewStudentMdbService(db *dao.Store[string, *model.Student], dumpPath string) *StudentMdbService {
+	db.AddIndex(IndexClass, func(student *model.Student) []string { return []string{student.Class} })
+	db.AddIndex(IndexGender, func(student *model.Student) []string { return []string{student.Gender} })
+	db.AddIndex(IndexSubject, func(student *model.Student) []string {
+		subjects := make([]string, 0, len(student.Grades))
+		for subject := range student.Grades {
+			subjects = append(subjects, subject)
+		}
+		return subjects
+	})
 	return &StudentMdbService{
 		memoryDBDao: db,
+		dumpPath:    dumpPath,
+	}
+}
+
+// studentCodec 把内存数据库中的学生编码成JSON 用于AOF和转储文件
+type studentCodec struct {
+	dao.StringKeys
+}
+
+func (studentCodec) Encode(student *model.Student) ([]byte, error) {
+	return json.Marshal(student)
+}
+
+func (studentCodec) Decode(data []byte) (*model.Student, error) {
+	var student model.Student
+	if err := json.Unmarshal(data, &student); err != nil {
+		return nil, fmt.Errorf("studentCodec.Decode 解析学生失败：%w", err)
+	}
+	return &student, nil
+}
+
+// OpenAOF replay为true时重放AOF文件恢复内存中的学生 否则丢弃已有的AOF文件 然后开始记录之后的每次修改
+func (smdbs *StudentMdbService) OpenAOF(cfg config.AOFConfig, path string, replay bool) error {
+	return smdbs.memoryDBDao.OpenAOF(cfg, path, studentCodec{}, replay)
+}
+
+// RewriteAOF 用内存中当前的学生重写AOF
+func (smdbs *StudentMdbService) RewriteAOF() error {
+	return smdbs.memoryDBDao.RewriteAOF()
+}
+
+// CloseAOF 把AOF刷到磁盘并关闭
+func (smdbs *StudentMdbService) CloseAOF() error {
+	return smdbs.memoryDBDao.CloseAOF()
+}
+
+// Dump 把内存中当前的学生转储到配置的转储文件
+func (smdbs *StudentMdbService) Dump() (*dao.DumpInfo, error) {
+	return smdbs.memoryDBDao.Dump(smdbs.dumpPath, studentCodec{})
+}
+
+// Load 校验r中的转储内容并用它替换内存中的全部学生
+func (smdbs *StudentMdbService) Load(r io.Reader) (*dao.DumpInfo, error) {
+	return smdbs.memoryDBDao.Load(r, studentCodec{})
+}
+
+// LoadFile 从配置的转储文件加载内存中的全部学生
+func (smdbs *StudentMdbService) LoadFile() (*dao.DumpInfo, error) {
+	file, err := os.Open(smdbs.dumpPath)
+	if err != nil {
+		return nil, fmt.Errorf("StudentMdbService.LoadFile 打开转储文件失败：%w", err)
+	}
+	defer file.Close()
+	info, err := smdbs.Load(file)
+	if err != nil {
+		return nil, err
 	}
+	info.Path = smdbs.dumpPath
+	return info, nil
+}
+
+// Stats 返回内存数据库的命中率、淘汰次数等统计数据
+func (smdbs *StudentMdbService) Stats() dao.MemoryDBStats {
+	return smdbs.memoryDBDao.Stats()
+}
+
+// Subscribe 订阅内存中学生的变化事件 事件的键是学生id 不再需要时调用返回的订阅的Close
+func (smdbs *StudentMdbService) Subscribe(opts dao.SubscribeOptions) (*dao.Subscription[string], error) {
+	return smdbs.memoryDBDao.Subscribe(opts)
+}
+
+// CloseSubscriptions 关闭所有订阅 正在推送的事件流会结束
+func (smdbs *StudentMdbService) CloseSubscriptions() {
+	smdbs.memoryDBDao.CloseSubscriptions()
 }
 
 // StudentExists 判断学生是否存在
@@ -34,20 +131,48 @@ func (smdbs *StudentMdbService) StudentExists(studentId string) error {
 	return nil
 }
 
-// AddStudent 向内存添加学生
+// studentExpiry 根据学生的过期时间和过期方式得到内存数据库的过期设置
+func studentExpiry(student *model.Student) dao.Expiry {
+	if student.Expiration <= 0 || student.ExpirationMode == model.ExpireNever {
+		return dao.NoExpiry
+	}
+	return dao.Expiry{
+		TTL:     time.Duration(student.Expiration) * time.Second,
+		Sliding: student.ExpirationMode == model.ExpireSliding,
+	}
+}
+
+// AddStudent 向内存添加学生 按学生的过期设置重新开始计时
 func (smdbs *StudentMdbService) AddStudent(student *model.Student) {
 	log.Printf("向内存添加学生：%s", student.ID)
-	smdbs.memoryDBDao.Set(student.ID, student, student.Expiration)
+	smdbs.memoryDBDao.Set(student.ID, student, studentExpiry(student))
 }
 
-// GetStudent 从内存中获取学生
+// AddStudentWithTTL 向内存添加学生 学生按绝对时间过期并且remaining比它的过期时间短时 沿用剩余的过期时间
+// 从缓存加载学生时使用 让学生在内存中和缓存中同时过期
+func (smdbs *StudentMdbService) AddStudentWithTTL(student *model.Student, remaining time.Duration) {
+	expiry := studentExpiry(student)
+	if expiry.TTL <= 0 || expiry.Sliding || remaining <= 0 || remaining >= expiry.TTL {
+		smdbs.AddStudent(student)
+		return
+	}
+	log.Printf("向内存添加学生：%s 剩余过期时间：%v", student.ID, remaining)
+	smdbs.memoryDBDao.SetExpireAt(student.ID, student, expiry, time.Now().Add(remaining))
+}
+
+// StudentTTL 返回内存中学生剩余的过期时间和过期设置 永不过期时剩余时间为-1
+func (smdbs *StudentMdbService) StudentTTL(studentId string) (time.Duration, dao.Expiry, error) {
+	remaining, expiry, exists := smdbs.memoryDBDao.TTL(studentId)
+	if !exists {
+		return 0, expiry, fmt.Errorf("StudentMdbService.StudentTTL 内存中不存在学生：%s", studentId)
+	}
+	return remaining, expiry, nil
+}
+
+// GetStudent 从内存中获取学生的副本 修改返回的学生不会影响内存中的学生
 func (smdbs *StudentMdbService) GetStudent(studentId string) (*model.Student, error) {
-	value, exists := smdbs.memoryDBDao.Get(studentId)
+	student, exists := smdbs.memoryDBDao.Get(studentId)
 	if exists {
-		student, ok := value.(*model.Student)
-		if !ok {
-			return nil, errors.New("StudentMdbService.GetStudent 类型断言失败")
-		}
 		log.Printf("从内存中查找学生：%s", studentId)
 		log.Printf("%v", student)
 		return student, nil
@@ -55,34 +180,62 @@ func (smdbs *StudentMdbService) GetStudent(studentId string) (*model.Student, er
 	return nil, fmt.Errorf("StudentMdbService.GetStudent 内存中不存在学生：%s", studentId)
 }
 
-// UpdateStudent 更新学生信息
-func (smdbs *StudentMdbService) UpdateStudent(student *model.Student) error {
-	// 先判断是否存在
-	err := smdbs.StudentExists(student.ID)
+// QueryStudents 通过二级索引在内存中查找满足所有条件的学生 conditions是索引名称 -> 索引项 结果按id排序
+// complete为false时内存中的学生不完整 可能漏掉被淘汰或者过期的学生
+func (smdbs *StudentMdbService) QueryStudents(conditions map[string]string) ([]*model.Student, bool, error) {
+	students, complete, err := smdbs.memoryDBDao.Query(conditions)
 	if err != nil {
-		return fmt.Errorf("StudentMdbService.UpdateStudent 在内存更新学生：%s失败：%w", student.ID, err)
+		return nil, false, fmt.Errorf("StudentMdbService.QueryStudents 在内存中查找学生失败：%w", err)
 	}
-	// 用新的学生信息更新原来的学生信息
-	s, _ := smdbs.GetStudent(student.ID)
-	for k, v := range student.Grades {
-		s.Grades[k] = v
+	if students == nil {
+		students = []*model.Student{}
 	}
-	student.Grades = s.Grades
+	sort.Slice(students, func(i, j int) bool { return students[i].ID < students[j].ID })
+	return students, complete, nil
+}
 
-	if student.Name == "" {
-		student.Name = s.Name
-	}
-	if student.Class == "" {
-		student.Class = s.Class
-	}
-	if student.Gender == "" {
-		student.Gender = s.Gender
+// ScanStudents 从游标cursor开始遍历内存中的学生id 返回这一批中匹配match的id和下一次的游标 返回的游标为0表示遍历完了
+func (smdbs *StudentMdbService) ScanStudents(cursor uint64, match string, count int) ([]string, uint64, error) {
+	return smdbs.memoryDBDao.Scan(cursor, match, count)
+}
+
+// Resident 判断学生现在是否在内存中 不算对学生的访问
+func (smdbs *StudentMdbService) Resident(studentId string) bool {
+	return smdbs.memoryDBDao.Contains(studentId)
+}
+
+// VerifyComplete 确认内存中是否包含ids中的全部学生 全部包含时之后的查询结果是完整的 直到有学生被淘汰或者过期
+// 检查不算对学生的访问
+func (smdbs *StudentMdbService) VerifyComplete(ids []string) bool {
+	lossSeq := smdbs.memoryDBDao.LossSeq()
+	for _, id := range ids {
+		if _, _, exists := smdbs.memoryDBDao.TTL(id); !exists {
+			log.Printf("内存中没有学生：%s 二级索引不完整", id)
+			return false
+		}
 	}
+	smdbs.memoryDBDao.MarkComplete(lossSeq)
+	return true
+}
 
+// Complete 判断之前确认的完整性是否仍然有效 有学生被淘汰或者过期之后需要重新确认
+func (smdbs *StudentMdbService) Complete() bool {
+	return smdbs.memoryDBDao.Complete()
+}
+
+// UpdateStudent 用完整的学生信息替换内存中的学生 内存中没有这个学生或者过期设置变了时重新添加
+func (smdbs *StudentMdbService) UpdateStudent(student *model.Student) {
+	if _, expiry, exists := smdbs.memoryDBDao.TTL(student.ID); exists && expiry != studentExpiry(student) {
+		log.Printf("学生：%s的过期设置改变 重新计时", student.ID)
+		smdbs.AddStudent(student)
+		return
+	}
 	// 调用数据层代码
-	smdbs.memoryDBDao.Update(student.ID, student)
+	if !smdbs.memoryDBDao.Update(student.ID, student) {
+		smdbs.AddStudent(student)
+		return
+	}
 	log.Printf("在内存中更新学生：%s", student.ID)
-	return nil
 }
 
 // DeleteStudent 删除学生
@@ -97,7 +250,55 @@ func (smdbs *StudentMdbService) DeleteStudent(studentId string) error {
 	return nil
 }
 
-// PeriodicDelete 定期删除内存中的过期键
-func (smdbs *StudentMdbService) PeriodicDelete(examineSize int) {
-	smdbs.memoryDBDao.PeriodicDelete(examineSize)
+// RunActiveExpire 每隔interval主动删除一次内存中的过期键 每次最多花费budget 直到ctx取消
+// 过期时间由本节点的时钟决定 所以每个节点在本地执行 不需要经过Raft
+func (smdbs *StudentMdbService) RunActiveExpire(ctx context.Context, interval time.Duration, budget time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if expired := smdbs.memoryDBDao.ActiveExpireCycle(budget); expired > 0 {
+				log.Printf("主动删除内存中的过期键：%d个", expired)
+			}
+		}
+	}
+}
+
+// Snapshot 导出内存中的所有学生 用于生成Raft快照 导出的学生是深拷贝 不会和内存数据库共享数据
+func (smdbs *StudentMdbService) Snapshot() ([]*model.StudentSnapshotEntry, error) {
+	entries := smdbs.memoryDBDao.Export()
+	snapshot := make([]*model.StudentSnapshotEntry, 0, len(entries))
+	for _, entry := range entries {
+		snapshotEntry := &model.StudentSnapshotEntry{Student: entry.Value}
+		if !entry.ExpireAt.IsZero() {
+			snapshotEntry.ExpireAt = entry.ExpireAt.UnixNano()
+		}
+		snapshot = append(snapshot, snapshotEntry)
+	}
+	return snapshot, nil
+}
+
+// Restore 用快照中的学生替换内存中的所有学生
+func (smdbs *StudentMdbService) Restore(snapshot []*model.StudentSnapshotEntry) error {
+	entries := make([]dao.StoreEntry[string, *model.Student], 0, len(snapshot))
+	for _, snapshotEntry := range snapshot {
+		if snapshotEntry == nil || snapshotEntry.Student == nil || snapshotEntry.Student.ID == "" {
+			return errors.New("StudentMdbService.Restore 快照中存在无效的学生")
+		}
+		entry := dao.StoreEntry[string, *model.Student]{
+			Key:    snapshotEntry.Student.ID,
+			Value:  snapshotEntry.Student,
+			Expiry: studentExpiry(snapshotEntry.Student),
+		}
+		if snapshotEntry.ExpireAt > 0 {
+			entry.ExpireAt = time.Unix(0, snapshotEntry.ExpireAt)
+		}
+		entries = append(entries, entry)
+	}
+	smdbs.memoryDBDao.Import(entries)
+	log.Printf("已从快照恢复内存中的学生 共%d个", len(entries))
+	return nil
 }
@@ -1,21 +1,22 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"gorm.io/gorm"
 	"log"
-	"node2/dao"
+	"node2/interfaces"
 	"node2/model"
 	"strings"
 )
 
 // StudentMysqlService 定义mysql数据库服务层结构体
 type StudentMysqlService struct {
-	mysqlDao *dao.StudentMysqlDao
+	mysqlDao interfaces.StudentMysqlDaoInterface
 }
 
 // NewStudentMysqlService 创建一个新的 StudentMysqlService 实例
-func NewStudentMysqlService(mysqlDao *dao.StudentMysqlDao) *StudentMysqlService {
+func NewStudentMysqlService(mysqlDao interfaces.StudentMysqlDaoInterface) *StudentMysqlService {
 	return &StudentMysqlService{
 		mysqlDao: mysqlDao,
 	}
@@ -34,12 +35,13 @@ func (sms *StudentMysqlService) ConvertToStudent(studentDB *model.StudentDB) (*m
 		grades[v.Subject] = v.Score
 	}
 	return &model.Student{
-		ID:         studentDB.ID,
-		Name:       studentDB.Name,
-		Gender:     studentDB.Gender,
-		Class:      studentDB.Class,
-		Grades:     grades,
-		Expiration: studentDB.Expiration,
+		ID:             studentDB.ID,
+		Name:           studentDB.Name,
+		Gender:         studentDB.Gender,
+		Class:          studentDB.Class,
+		Grades:         grades,
+		Expiration:     studentDB.Expiration,
+		ExpirationMode: studentDB.ExpirationMode,
 	}, nil
 }
 
@@ -107,6 +109,42 @@ func (sms *StudentMysqlService) GetStudentFromMysql(studentId string) (*model.St
 	return student, nil
 }
 
+// QueryStudentsFromMysql 按班级、性别和科目从数据库查找学生 为空的条件不参与查询
+func (sms *StudentMysqlService) QueryStudentsFromMysql(class string, gender string, subject string) ([]*model.Student, error) {
+	studentDBs, err := sms.mysqlDao.QueryStudents(class, gender, subject)
+	if err != nil {
+		return nil, fmt.Errorf("StudentMysqlService.QueryStudentsFromMysql 从数据库查找学生失败：%w", err)
+	}
+	return sms.convertStudents(studentDBs)
+}
+
+// ListStudentsFromMysql 按id顺序从数据库获取id大于afterId的最多limit个学生
+func (sms *StudentMysqlService) ListStudentsFromMysql(afterId string, limit int) ([]*model.Student, error) {
+	studentDBs, err := sms.mysqlDao.ListStudents(afterId, limit)
+	if err != nil {
+		return nil, fmt.Errorf("StudentMysqlService.ListStudentsFromMysql 从数据库获取学生失败：%w", err)
+	}
+	return sms.convertStudents(studentDBs)
+}
+
+// convertStudents 把数据库中的多个学生转化为model中的学生
+func (sms *StudentMysqlService) convertStudents(studentDBs []model.StudentDB) ([]*model.Student, error) {
+	students := make([]*model.Student, 0, len(studentDBs))
+	for i := range studentDBs {
+		student, err := sms.ConvertToStudent(&studentDBs[i])
+		if err != nil {
+			return nil, fmt.Errorf("数据库中学生：%s转化出错：%w", studentDBs[i].ID, err)
+		}
+		students = append(students, student)
+	}
+	return students, nil
+}
+
+// GetAllStudentIds 获取数据库中所有学生的id
+func (sms *StudentMysqlService) GetAllStudentIds() ([]string, error) {
+	return sms.mysqlDao.GetAllStudentIds()
+}
+
 // UpdateStudent 从数据库中获取所有学生
 func (sms *StudentMysqlService) UpdateStudent(tx *gorm.DB, student *model.Student) error {
 	// 先判断是否存在
@@ -173,8 +211,8 @@ func (sms *StudentMysqlService) DeleteStudent(tx *gorm.DB, id string) error {
 	return nil
 }
 
-// GetHotStudentsFromMysql 获取访问次数最高的学生
-func (sms *StudentMysqlService) GetHotStudentsFromMysql() ([]*model.Student, error) {
+// GetHotStudentsFromMysql 获取访问次数最高的学生 每读取一个学生之前检查ctx 取消时返回ctx的错误
+func (sms *StudentMysqlService) GetHotStudentsFromMysql(ctx context.Context) ([]*model.Student, error) {
 	var hotStudents []*model.StudentCount
 	var students []*model.Student
 	// 调用数据层代码 获取访问次数最高的学生
@@ -184,6 +222,9 @@ func (sms *StudentMysqlService) GetHotStudentsFromMysql() ([]*model.Student, err
 	}
 	// 将数据库中的学生记录转化为model中的学生
 	for _, studentRecord := range hotStudents {
+		if err = ctx.Err(); err != nil {
+			return nil, fmt.Errorf("StudentMysqlService.GetHotStudentFromMysql 已取消：%w", err)
+		}
 		student, err := sms.GetStudentFromMysql(studentRecord.StudentId)
 		if err != nil {
 			return nil, fmt.Errorf("StudentMysqlService.GetHotStudentFromMysql 从数据库转化学生：%s失败：%w", studentRecord.StudentId, err)
@@ -243,3 +284,58 @@ func (sms *StudentMysqlService) DeleteStudentCount(id string) {
 		}
 	}
 }
+
+// SaveStudent 在事务中用完整的学生信息覆盖数据库中的学生和成绩 学生不存在时添加 重复执行结果相同
+func (sms *StudentMysqlService) SaveStudent(tx *gorm.DB, student *model.Student) error {
+	if err := sms.mysqlDao.SaveStudent(tx, student); err != nil {
+		return fmt.Errorf("StudentMysqlService.SaveStudent 保存学生：%s失败：%w", student.ID, err)
+	}
+	// 先删除原来的成绩再全部重新添加 这样被删除的学科也会同步
+	if err := sms.mysqlDao.DeleteScore(tx, student.ID); err != nil {
+		return fmt.Errorf("StudentMysqlService.SaveStudent 删除学生：%s原来的成绩失败：%w", student.ID, err)
+	}
+	for subject, score := range student.Grades {
+		if err := sms.mysqlDao.AddGradeToMysql(tx, subject, score, student.ID); err != nil {
+			return fmt.Errorf("StudentMysqlService.SaveStudent 向成绩表添加学生：%s的成绩：%s失败：%w", student.ID, subject, err)
+		}
+	}
+	log.Printf("向数据库保存学生：%s", student.ID)
+	return nil
+}
+
+// RemoveStudent 在事务中删除学生和成绩 学生不存在时什么也不做 重复执行结果相同
+func (sms *StudentMysqlService) RemoveStudent(tx *gorm.DB, id string) error {
+	if err := sms.mysqlDao.DeleteStudent(tx, id); err != nil {
+		return fmt.Errorf("StudentMysqlService.RemoveStudent 删除学生：%s失败：%w", id, err)
+	}
+	if err := sms.mysqlDao.DeleteScore(tx, id); err != nil {
+		return fmt.Errorf("StudentMysqlService.RemoveStudent 删除学生：%s的成绩时失败：%w", id, err)
+	}
+	log.Printf("从数据库删除学生：%s", id)
+	return nil
+}
+
+// InitStudentExpirationModeColumn 给旧的学生表加上过期方式字段
+func (sms *StudentMysqlService) InitStudentExpirationModeColumn() error {
+	return sms.mysqlDao.InitStudentExpirationModeColumn()
+}
+
+// InitOutboxProgressTable 创建记录发件箱持久化进度的表
+func (sms *StudentMysqlService) InitOutboxProgressTable() error {
+	return sms.mysqlDao.InitOutboxProgressTable()
+}
+
+// Transaction 在一个MySQL事务中执行fn fn返回错误时回滚
+func (sms *StudentMysqlService) Transaction(fn func(tx *gorm.DB) error) error {
+	return sms.mysqlDao.Transaction(fn)
+}
+
+// LockOutboxProgress 在事务中锁住并获取已经写入数据库的最大日志索引
+func (sms *StudentMysqlService) LockOutboxProgress(tx *gorm.DB) (uint64, error) {
+	return sms.mysqlDao.LockOutboxProgress(tx)
+}
+
+// SetOutboxProgress 在事务中记录已经写入数据库的最大日志索引
+func (sms *StudentMysqlService) SetOutboxProgress(tx *gorm.DB, index uint64) error {
+	return sms.mysqlDao.SetOutboxProgress(tx, index)
+}
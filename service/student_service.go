@@ -1,51 +1,91 @@
 package service
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	raftfpk "github.com/hashicorp/raft"
+	"gorm.io/gorm"
 	"io"
 	"log"
 	"net/http"
 	"node2/config"
+	"node2/dao"
 	"node2/interfaces"
 	"node2/model"
 	"node2/raft"
 	"node2/raft/fsm"
 	"node2/response"
 	"strings"
+	"sync"
 	"time"
 )
 
 // StudentService 定义学生服务层结构体
 type StudentService struct {
-	MdbService   *StudentMdbService
-	MysqlService *StudentMysqlService
-	CacheService *StudentCacheService
-	raftNode     *raftfpk.Raft
-	node         config.Node
-	peers        []*config.Peer
+	MdbService    *StudentMdbService
+	MysqlService  *StudentMysqlService
+	CacheService  *StudentCacheService
+	raftNode      *raftfpk.Raft
+	fsm           *fsm.StudentFSM
+	raftStores    io.Closer // Raft的日志存储和稳定存储 关闭Raft之后关闭
+	node          config.Node
+	seeds         []*config.Peer          // 配置文件中的节点 只在加入集群之前用来寻找领导者 之后以Raft的配置为准
+	peerAddrs     map[string]*config.Peer // 通过Raft复制的节点id到端口号和HTTP地址的映射
+	peersLock     sync.RWMutex
+	heartbeats    *heartbeatTracker
+	barrierTerm   uint64                      // 领导者已经执行过屏障的任期 线性一致读在每个任期只需要执行一次屏障
+	lease         leaderLease                 // 租约读使用的领导者租约
+	leaseTimeout  time.Duration               // 每次和多数节点确认领导权后租约持续的时间
+	proposeLock   sync.Mutex                  // 领导者逐条检查并提交学生的修改 保证检查时看到的是前一条修改之后的状态
+	writeBackLock sync.Mutex                  // 状态机修改内存和把缓存或数据库中的学生写回内存互斥
+	loadFlight    flightGroup[*model.Student] // 合并内存中没有的同一个学生的并发加载
+	refreshFlight flightGroup[*model.Student] // 合并同一个学生的并发提前刷新
 }
 
-// NewStudentService 创建并初始化 StudentService 实例
-func NewStudentService(mdbService *StudentMdbService, mysqlService *StudentMysqlService, cacheService *StudentCacheService, node config.Node, peers []*config.Peer) (*StudentService, error) {
+// MemoryPreload 启动Raft之前恢复和预热内存数据库的设置
+type MemoryPreload struct {
+	AOF       config.AOFConfig // AOF的设置 开启时在预热之前打开AOF
+	AOFPath   string           // AOF文件的路径
+	Capacity  int              // 内存数据库的容量
+	LoadRatio float64          // 预热的学生最多占容量的比例
+}
+
+// NewStudentService 创建并初始化 StudentService 实例 在启动Raft之前按preload预热内存数据库
+func NewStudentService(mdbService *StudentMdbService, mysqlService *StudentMysqlService, cacheService *StudentCacheService, node config.Node, raftConfig config.RaftConfig, peers []*config.Peer, preload MemoryPreload) (*StudentService, error) {
 
 	ss := &StudentService{
 		MdbService:   mdbService,
 		MysqlService: mysqlService,
 		CacheService: cacheService,
-		raftNode:     new(raftfpk.Raft),
 		node:         node,
-		peers:        peers,
+		seeds:        peers,
+		peerAddrs:    make(map[string]*config.Peer),
+		leaseTimeout: raftConfig.LeaseTimeout,
 	}
 
 	initializer := &raft.RaftInitializerImpl{}
 
-	raftNode, err := initializer.InitRaft(node, peers, ss)
+	instance, err := initializer.InitRaft(node, raftConfig, peers, ss, func(hasState bool) error {
+		// AOF记录的是本节点之前应用到状态机的修改 只有节点已经有之前的Raft状态时才属于当前集群的历史
+		// 新节点或者Raft状态被清空的节点不重放AOF 由初始化集群、领导者发送的快照和日志得到状态
+		if preload.AOF.Enabled {
+			if err := ss.MdbService.OpenAOF(preload.AOF, preload.AOFPath, hasState); err != nil {
+				return fmt.Errorf("打开AOF失败：%w", err)
+			}
+		}
+		ss.preloadMemory(preload)
+		return nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("初始化 Raft 节点 %s 时出错: %w", node.NodeId, err)
 	}
-	ss.raftNode = raftNode
+	ss.raftNode = instance.Raft
+	ss.fsm = instance.FSM
+	ss.raftStores = instance.Stores
+	ss.heartbeats = newHeartbeatTracker(instance.Raft)
 	return ss, nil
 }
 
@@ -58,210 +98,266 @@ func (ss *StudentService) StudentNotFoundErr(err error) bool {
 	return strings.Contains(err.Error(), studentNotFoundErrMsg)
 }
 
-func (ss *StudentService) StudentExists(id string) bool {
-	student, err := ss.MysqlService.GetStudentFromMysql(id)
+// JoinRaftCluster 将节点加入 Raft 集群 节点id已经存在时会更新它的地址
+func (ss *StudentService) JoinRaftCluster(nodeID string, nodeAddress string, nodePortAddress string, nodeHttpAddress string) error {
+	//再次确保是领导者节点才会处理加入集群的请求
+	if ss.raftNode.State() != raftfpk.Leader {
+		return fmt.Errorf("StudentService.JoinRaftCluster 节点：%s不是领导者节点", ss.node.NodeId)
+	}
+	// 和加载转储互斥 加载时集群中只有本节点
+	ss.proposeLock.Lock()
+	future := ss.raftNode.AddVoter(raftfpk.ServerID(nodeID), raftfpk.ServerAddress(nodeAddress), 0, 0)
+	err := future.Error()
+	ss.proposeLock.Unlock()
 	if err != nil {
-		log.Printf("查找学生：%s失败：%v", id, err)
-		return false
-	}
-	if student != nil {
-		return true
+		return err
 	}
-	return false
-}
+	log.Printf("领导者节点已将节点：%s加入集群", nodeID)
 
-// JoinRaftCluster 将节点加入 Raft 集群
-func (ss *StudentService) JoinRaftCluster(nodeID string, nodeAddress string, nodePortAddress string) error {
-	//再次确保是领导者节点才会处理加入集群的请求
-	if ss.raftNode.State() == raftfpk.Leader {
-		future := ss.raftNode.AddVoter(raftfpk.ServerID(nodeID), raftfpk.ServerAddress(nodeAddress), 0, 0)
-		if err := future.Error(); err != nil {
-			return err
-		}
-		log.Printf("领导者节点已将节点：%s加入集群", nodeID)
-
-		var newPeer *config.Peer
-		newPeer.NodeId = nodeID
-		newPeer.Address = nodeAddress
-		newPeer.PortAddress = nodePortAddress
-
-		err := ss.ApplyRaftCommandToLeader("updatePeers", nil, "", 0, newPeer)
-		if err != nil {
-			log.Printf("领导者节点更新所有节点的Peers失败：%v", err)
+	// 第一个节点初始化集群时没有登记过自己的地址 在第一次成员变更时补上
+	ss.peersLock.RLock()
+	_, registered := ss.peerAddrs[ss.node.NodeId]
+	ss.peersLock.RUnlock()
+	if !registered {
+		self := &config.Peer{NodeId: ss.node.NodeId, Address: ss.node.Address, PortAddress: ss.node.PortAddress, HttpAddress: ss.node.HttpAddr()}
+		if err := ss.applyInternalCommand("updatePeers", "", self); err != nil {
+			log.Printf("领导者节点登记自己的地址失败：%v", err)
 			return err
 		}
+	}
 
-		return nil
+	newPeer := &config.Peer{
+		NodeId:      nodeID,
+		Address:     nodeAddress,
+		PortAddress: nodePortAddress,
+		HttpAddress: nodeHttpAddress,
+	}
+	newPeer.HttpAddress = newPeer.HttpAddr()
+	if err := ss.applyInternalCommand("updatePeers", "", newPeer); err != nil {
+		log.Printf("领导者节点更新所有节点的Peers失败：%v", err)
+		return err
 	}
 	return nil
 }
 
+// UpdatePeersInternal 登记节点的端口和HTTP地址 由状态机在所有节点上执行
 func (ss *StudentService) UpdatePeersInternal(peer *config.Peer) {
-	ss.peers = append(ss.peers, peer)
-	return
+	if peer == nil {
+		return
+	}
+	peerCopy := *peer
+	ss.peersLock.Lock()
+	defer ss.peersLock.Unlock()
+	ss.peerAddrs[peer.NodeId] = &peerCopy
 }
 
-// HandleGetLeaderPortAddressRequest 处理获取领导者地址的请求 返回领导者的端口号
-func (ss *StudentService) HandleGetLeaderPortAddressRequest() string {
-	if ss.raftNode.State() == raftfpk.Leader {
-		log.Printf("节点：%s是领导者节点", ss.node.NodeId)
-		return ss.node.PortAddress
-	}
-	return ""
+// IsLeader 判断本节点是不是领导者节点
+func (ss *StudentService) IsLeader() bool {
+	return ss.raftNode.State() == raftfpk.Leader
 }
 
-// GetLeaderPortAddr 获取领导者端口地址 向集群的各个节点都发送一个http请求 如果他是领导者节点 他就会把自己的端口号返回过来
-func (ss *StudentService) GetLeaderPortAddr() (string, error) {
-	if ss.raftNode.State() == raftfpk.Leader {
-		return ss.node.PortAddress, nil
-	}
-	for _, node := range ss.peers {
-		url := fmt.Sprintf("http://localhost:%s/GetLeaderAddress", node.PortAddress)
-		resp, err := http.Get(url)
-		if err != nil {
-			log.Printf("请求出错：%v", err)
-			return "", err
-		}
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("读取响应体出错：%v", err)
-			return "", err
+// LogUntilLeader 在知道领导者之前每隔interval记录一次日志 知道领导者或者ctx取消后返回
+// 整个集群重启时节点可能要等其他节点启动后才能选出领导者 这期间节点照常提供服务 需要领导者的请求返回错误
+func (ss *StudentService) LogUntilLeader(ctx context.Context, interval time.Duration) {
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if leaderAddr, leaderId := ss.raftNode.LeaderWithID(); leaderId != "" {
+			log.Printf("节点：%s 集群的领导者是：%s(%s)", ss.node.NodeId, leaderId, leaderAddr)
+			return
 		}
-		// 解析 JSON 响应
-		var result response.Result
-		err = json.Unmarshal(body, &result)
-		if err != nil {
-			fmt.Printf("解析 JSON 数据出错: %v\n", err)
-			return "", err
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			log.Printf("节点：%s 已经%v还不知道集群的领导者", ss.node.NodeId, time.Since(start).Round(time.Second))
 		}
+	}
+}
 
-		// 提取 leaderAddr
-		leaderPortAddr, ok := result.Data.(string)
-		if ok {
-			return leaderPortAddr, nil
+// Shutdown 关闭Raft节点和它的存储 领导者会先把领导权转移给其他节点 减少集群没有领导者的时间
+func (ss *StudentService) Shutdown() error {
+	if ss.IsLeader() {
+		if err := ss.raftNode.LeadershipTransfer().Error(); err != nil {
+			// 集群只有一个节点时没有可以转移的节点 直接关闭
+			log.Printf("节点：%s转移领导权失败：%v", ss.node.NodeId, err)
+		} else {
+			log.Printf("节点：%s已转移领导权", ss.node.NodeId)
 		}
-		return "", fmt.Errorf("领导者地址 类型断言失败")
 	}
-	return "", fmt.Errorf("获取领导者地址失败")
+	var errs []error
+	if err := ss.raftNode.Shutdown().Error(); err != nil {
+		errs = append(errs, fmt.Errorf("StudentService.Shutdown 关闭Raft节点失败：%w", err))
+	}
+	ss.heartbeats.close()
+	if err := ss.raftStores.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("StudentService.Shutdown 关闭Raft存储失败：%w", err))
+	}
+	return errors.Join(errs...)
 }
 
-// ApplyRaftCommandToLeader 将命令提交给领导者处理
-func (ss *StudentService) ApplyRaftCommandToLeader(operation string, student *model.Student, id string, examineSize int, peer *config.Peer) error {
-	// 创建 Node 命令
-	cmd := fsm.StudentCommand{
-		Operation:   operation,
-		Student:     student,
-		Id:          id,
-		ExamineSize: examineSize,
-		Peer:        peer,
+// HandleGetLeaderAddressRequest 处理获取领导者地址的请求 任何节点都会通过Raft返回领导者的HTTP地址
+func (ss *StudentService) HandleGetLeaderAddressRequest() (string, error) {
+	if ss.raftNode == nil {
+		return "", fmt.Errorf("StudentService.HandleGetLeaderAddressRequest 节点：%s还没有加入集群", ss.node.NodeId)
 	}
-	// 序列化命令
-	cmdData, err := json.Marshal(cmd)
-	if err != nil {
-		return fmt.Errorf("ApplyRaftCommandToLeader Marshal err: %w", err)
-	}
-	//如果自己是领导者节点 那就处理这个命令
-	if ss.raftNode.State() == raftfpk.Leader {
-		// 提交命令到领导者 Node 节点
-		future := ss.raftNode.Apply(cmdData, 500)
-		if err = future.Error(); err != nil {
-			return fmt.Errorf("ApplyRaftCommandToLeader 处理命令失败：%w", err)
-		}
-		// 处理响应
-		result := future.Response()
-		if resultErr, ok := result.(error); ok {
-			return resultErr
-		}
-		log.Printf("领导者节点已接收并提交命令到状态机")
-		return nil
-	} else {
-		//如果不是 那就找到领导者节点的端口 把命令交给领导者节点处理
-		leaderPortAddr, err := ss.GetLeaderPortAddr()
-		if err != nil {
-			return fmt.Errorf("StudentService.ApplyRaftCommandToLeader 获取领导者地址失败：%w", err)
-		}
-		url := fmt.Sprintf("http://localhost:%s/LeaderHandleCommand?cmd=%s", leaderPortAddr, cmdData)
-		resp, err := http.Get(url)
-		if err != nil {
-			log.Printf("将cmd命令：%s发送给领导者失败：%v", cmdData, err)
-			return fmt.Errorf("将cmd命令：%s发送给领导者失败：%v", cmdData, err)
-		}
-		defer resp.Body.Close()
+	return ss.GetLeaderHttpAddr()
+}
 
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("读取响应体出错：%v", err)
-			return err
-		}
-		// 解析 JSON 响应
-		var result response.Result
-		err = json.Unmarshal(body, &result)
-		if err != nil {
-			fmt.Printf("解析 JSON 数据出错: %v\n", err)
-		}
-		//把错误信息返回给前端发送的对应端口
-		if result.Code != 1 {
-			return fmt.Errorf("领导者节点处理命令失败：%v", result.Message)
-		}
-		return nil
+// GetLeaderHttpAddr 获取领导者的HTTP地址 通过Raft得到领导者的id 再从复制的地址映射中找到它的HTTP地址
+func (ss *StudentService) GetLeaderHttpAddr() (string, error) {
+	// 加入集群之前Raft节点还没有创建 只能通过配置文件中的节点寻找领导者
+	if ss.raftNode == nil {
+		return ss.discoverLeaderFromSeeds()
 	}
+	_, leaderId := ss.raftNode.LeaderWithID()
+	if leaderId == "" {
+		return "", fmt.Errorf("StudentService.GetLeaderHttpAddr 集群当前没有领导者")
+	}
+	if string(leaderId) == ss.node.NodeId {
+		return ss.node.HttpAddr(), nil
+	}
+	ss.peersLock.RLock()
+	leader, exists := ss.peerAddrs[string(leaderId)]
+	ss.peersLock.RUnlock()
+	if !exists {
+		return "", fmt.Errorf("StudentService.GetLeaderHttpAddr 领导者：%s的HTTP地址未知", leaderId)
+	}
+	return leader.HttpAddr(), nil
 }
 
-// LeaderHandleCommand 领导者节点会处理命令 并发送到状态机
-func (ss *StudentService) LeaderHandleCommand(data string) error {
-	future := ss.raftNode.Apply([]byte(data), 500)
-	if err := future.Error(); err != nil {
-		return fmt.Errorf("ApplyRaftCommandToLeader 处理命令失败：%w", err)
-	}
-	// 处理响应
-	result := future.Response()
-	if resultErr, ok := result.(error); ok {
-		return resultErr
+// discoverLeaderFromSeeds 依次询问配置文件中的节点 返回第一个知道领导者的节点给出的领导者HTTP地址
+func (ss *StudentService) discoverLeaderFromSeeds() (string, error) {
+	for _, seed := range ss.seeds {
+		leaderAddr, err := requestLeaderAddr(seed.HttpAddr())
+		if err != nil {
+			log.Printf("向节点：%s询问领导者地址失败：%v", seed.NodeId, err)
+			continue
+		}
+		return leaderAddr, nil
 	}
-	log.Printf("领导者节点已接收并提交命令到状态机")
-	return nil
+	return "", fmt.Errorf("StudentService.discoverLeaderFromSeeds 所有配置的节点都不知道领导者地址")
 }
 
-// RestoreCacheData 恢复缓存机制 mysql有事务可以很方便地回滚 此函数专门用于恢复缓存的数据
-func (ss *StudentService) RestoreCacheData(id string) error {
-	//如果要恢复数据 mysql的事务会回滚 所以这个时候找到的学生还是一开始的学生
-	studentBackUp, err := ss.MysqlService.GetStudentFromMysql(id)
+// requestLeaderAddr 向指定HTTP地址的节点询问领导者的HTTP地址
+func requestLeaderAddr(httpAddr string) (string, error) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/GetLeaderAddress", httpAddr))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("StudentService.RestoreCacheData 尝试通过学生id：%s获取学生时失败：%w", id, err)
+		return "", fmt.Errorf("读取响应体出错：%w", err)
 	}
-	if err = ss.CacheService.AddStudent(studentBackUp); err != nil {
-		return fmt.Errorf("StudentService.RestoreCacheData 尝试恢复缓存数据时失败: %w", err)
+	// 解析 JSON 响应
+	var result response.Result
+	if err = json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("解析 JSON 数据出错：%w", err)
 	}
-	return nil
+	if result.Code != 1 {
+		return "", errors.New(result.Message)
+	}
+	// 提取 leaderAddr
+	leaderAddr, ok := result.Data.(string)
+	if !ok || leaderAddr == "" {
+		return "", fmt.Errorf("领导者地址 类型断言失败")
+	}
+	return leaderAddr, nil
 }
 
-// ReLoadCacheDataInternal 重新加载缓存数据
-func (ss *StudentService) ReLoadCacheDataInternal() {
+// ReLoadCacheDataInternal 重新加载缓存数据 Redis是所有节点共享的 只需要领导者执行一次
+// 读取学生和分批写入缓存时都会检查ctx 失去领导权时放弃这一代并尽快返回
+func (ss *StudentService) ReLoadCacheDataInternal(ctx context.Context) error {
+	// 锁住发件箱的持久化进度后再标记新的一代 已经写入缓存但还没提交的修改先提交 之后的修改会同时写入新的一代
+	var generation int64
+	err := ss.MysqlService.Transaction(func(tx *gorm.DB) error {
+		if _, err := ss.MysqlService.LockOutboxProgress(tx); err != nil {
+			return err
+		}
+		var err error
+		generation, err = ss.CacheService.BeginReload()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("StudentService.ReLoadCacheDataInternal 开始重新加载缓存失败：%w", err)
+	}
 	// 从 MySQL 中获取访问最多的学生
-	students, err := ss.MysqlService.GetHotStudentsFromMysql()
+	students, err := ss.MysqlService.GetHotStudentsFromMysql(ctx)
 	if err != nil {
-		log.Printf("StudentService.ReLoadCacheDataInternal 获得访问最多的学生时出错：%v", err)
+		ss.CacheService.AbortReload(generation)
+		return fmt.Errorf("StudentService.ReLoadCacheDataInternal 获得访问最多的学生时出错：%w", err)
 	}
 	// 将学生添加到缓存
-	err = ss.CacheService.ReLoadCacheData(students)
-	if err != nil {
-		log.Printf("StudentService.ReLoadCacheDataInternal 重新加载缓存失败：%v", err)
+	if err = ss.CacheService.FinishReload(ctx, generation, students); err != nil {
+		return fmt.Errorf("StudentService.ReLoadCacheDataInternal 重新加载缓存失败：%w", err)
 	}
 	log.Printf("已重新加载缓存: %v", time.Now())
+	return nil
+}
+
+// ErrLoadRequiresSingleNode 集群中还有其他节点时不能加载转储
+var ErrLoadRequiresSingleNode = errors.New("只有集群中只有本节点时才能加载转储")
+
+// LoadMemoryDB 用转储内容替换内存数据库的全部内容 r为nil时加载配置的转储文件
+// 内存数据库是状态机的一部分 加载的内容不经过Raft 有其他节点时会和它们不一致 所以只允许在只有本节点的集群中加载
+// 加载前等待已经提交的修改都应用到状态机 加载期间不提交新的修改也不加入新的节点 之后加入的节点从快照中得到加载的内容
+func (ss *StudentService) LoadMemoryDB(r io.Reader) (*dao.DumpInfo, error) {
+	ss.proposeLock.Lock()
+	defer ss.proposeLock.Unlock()
+	future := ss.raftNode.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, fmt.Errorf("StudentService.LoadMemoryDB 获取集群配置失败：%w", err)
+	}
+	servers := future.Configuration().Servers
+	if len(servers) != 1 || servers[0].ID != raftfpk.ServerID(ss.node.NodeId) {
+		return nil, fmt.Errorf("%w：集群中有%d个节点", ErrLoadRequiresSingleNode, len(servers))
+	}
+	if err := ss.raftNode.Barrier(raftApplyTimeout).Error(); err != nil {
+		if isLeadershipErr(err) {
+			return nil, fmt.Errorf("%w：%v", ErrNotLeader, err)
+		}
+		return nil, fmt.Errorf("StudentService.LoadMemoryDB 等待屏障失败：%w", err)
+	}
+	if r == nil {
+		return ss.MdbService.LoadFile()
+	}
+	return ss.MdbService.Load(r)
 }
 
-// PeriodicDeleteInternal 定期删除内存中的过期键 接收一个淘汰键的数量
-func (ss *StudentService) PeriodicDeleteInternal(examineSize int) {
-	log.Printf("定期删除内存中的过期键：%v", time.Now())
-	ss.MdbService.PeriodicDelete(examineSize)
+// SnapshotMemoryDB 导出内存数据库中的学生 供状态机生成快照
+func (ss *StudentService) SnapshotMemoryDB() ([]*model.StudentSnapshotEntry, error) {
+	return ss.MdbService.Snapshot()
 }
 
-// LoadCacheToMemory 加载缓存到内存
-func (ss *StudentService) LoadCacheToMemory(capacity int, addRadio float64) error {
+// RestoreMemoryDB 用快照替换内存数据库中的学生 供状态机从快照恢复
+func (ss *StudentService) RestoreMemoryDB(snapshot []*model.StudentSnapshotEntry) error {
+	return ss.MdbService.Restore(snapshot)
+}
+
+// preloadMemory 启动时加载缓存数据到内存 缓存加载失败时从数据库加载 失败时只记录日志 之后读取时仍然会回源
+// 只在启动Raft之前调用 预热写入的学生不经过Raft 这时状态机还没有应用任何日志 不会覆盖更新的修改
+// 之后Raft恢复的快照会替换预热的内容 重放的日志会覆盖预热的旧值
+func (ss *StudentService) preloadMemory(preload MemoryPreload) {
+	if err := ss.loadCacheToMemory(preload.Capacity, preload.LoadRatio); err != nil {
+		log.Printf("节点：%s 加载缓存到内存时失败：%v", ss.node.NodeId, err)
+		if err = ss.loadDateBaseToMemory(preload.Capacity, preload.LoadRatio); err != nil {
+			log.Printf("节点：%s 加载数据库中的数据到内存时失败：%v", ss.node.NodeId, err)
+			return
+		}
+		log.Printf("节点：%s 加载数据库到内存", ss.node.NodeId)
+		return
+	}
+	log.Printf("节点：%s 加载缓存到内存", ss.node.NodeId)
+}
+
+// loadCacheToMemory 加载缓存到内存
+func (ss *StudentService) loadCacheToMemory(capacity int, addRadio float64) error {
 	// 从缓存中获取所有学生
 	students, err := ss.CacheService.GetAllStudentsFromCache()
 	if err != nil {
-		return fmt.Errorf("StudentService.LoadCacheToMemory 从缓存中获取所有学生时失败：%w", err)
+		return fmt.Errorf("StudentService.loadCacheToMemory 从缓存中获取所有学生时失败：%w", err)
 	}
 	// 定义一个已加载学生数量的计数器 如果超过了容量*加载学生占内存总容量的比例 就停止添加
 	addCount := 0
@@ -277,12 +373,12 @@ func (ss *StudentService) LoadCacheToMemory(capacity int, addRadio float64) erro
 	return nil
 }
 
-// LoadDateBaseToMemory 加载数据库的学生到内存
-func (ss *StudentService) LoadDateBaseToMemory(capacity int, addRadio float64) error {
+// loadDateBaseToMemory 加载数据库的学生到内存
+func (ss *StudentService) loadDateBaseToMemory(capacity int, addRadio float64) error {
 	// 从数据库中获取热门学生
-	students, err := ss.MysqlService.GetHotStudentsFromMysql()
+	students, err := ss.MysqlService.GetHotStudentsFromMysql(context.Background())
 	if err != nil {
-		return fmt.Errorf("StudentService.LoadDateBaseToMemory 从数据库中获取热门学生失败：%w", err)
+		return fmt.Errorf("StudentService.loadDateBaseToMemory 从数据库中获取热门学生失败：%w", err)
 	}
 	// 定义一个已加载学生数量的计数器 如果超过了容量*加载学生占内存总容量的比例 就停止添加
 	addCount := 0
@@ -298,47 +394,11 @@ func (ss *StudentService) LoadDateBaseToMemory(capacity int, addRadio float64) e
 	return nil
 }
 
-// AddStudentInternal 向数据库和缓存和内存添加学生
-func (ss *StudentService) AddStudentInternal(student *model.Student) error {
-	// 开始 MySQL 事务
-	tx := ss.MysqlService.mysqlDao.DB.Begin()
-	if tx.Error != nil {
-		return fmt.Errorf("StudentService.AddStudentInternal 开启 MySQL 事务失败：%w", tx.Error)
-	}
-	defer func() {
-		if r := recover(); r != nil {
-			// 发生 panic 时回滚事务
-			tx.Rollback()
-			log.Printf("事务已回滚：%v", r)
-		}
-	}()
-
-	//如果学生已经有其他节点添加到数据库和缓存了 那本节点只更新内存即可
-	if ss.StudentExists(student.ID) {
-		ss.MdbService.AddStudent(student)
-		return nil
-	}
-
-	// 在 MySQL 数据库事务中添加学生信息
-	if err := ss.MysqlService.AddStudentToMysql(tx, student); err != nil {
-		return err
-	}
-
-	// MySQL 数据库事务提交成功后，尝试添加到缓存
-	if err := ss.CacheService.AddStudent(student); err != nil {
-		tx.Rollback()
-		//缓存中添加失败 就回滚 确保数据一致性 （添加其实好像不影响 更新和删除如果有错误肯定要回滚保持数据一致性的）
-		log.Printf("添加缓存失败 回滚事务")
-		return err
-	}
-	// 最后添加到内存数据库
+// AddStudentInternal 向内存添加学生 由状态机在所有节点上执行 MySQL和Redis由领导者通过发件箱写入
+func (ss *StudentService) AddStudentInternal(student *model.Student) {
+	ss.writeBackLock.Lock()
+	defer ss.writeBackLock.Unlock()
 	ss.MdbService.AddStudent(student)
-	if err := tx.Commit().Error; err != nil {
-		return fmt.Errorf("StudentService.AddStudentInternal 提交事务失败：%w", err)
-	}
-	// 添加学生访问次数
-	ss.MysqlService.AddStudentCount(student.ID)
-	return nil
 }
 
 // GetStudent 获取学生
@@ -353,25 +413,54 @@ func (ss *StudentService) GetStudent(id string) (*model.Student, error) {
 		log.Printf("从内存中查找到了学生：%s", id)
 		return student, nil
 	}
+	// 发件箱中的修改还没有写入缓存和数据库 比它们新 删除了的学生不能再从缓存或数据库读到
+	if student, pending := ss.pendingStudent(id); pending {
+		if student == nil {
+			return nil, fmt.Errorf("StudentService.GetStudent 不存在学生：%s 删除还没有写入数据库", id)
+		}
+		ss.MysqlService.AddStudentCount(id)
+		log.Printf("从发件箱中查找到了学生：%s", id)
+		return student, nil
+	}
 
+	// 内存中没有时 同一个学生的并发请求只有一个去缓存和数据库加载 其他请求等待它的结果
+	student, err, shared := ss.loadFlight.Do(id, func() (*model.Student, error) {
+		return ss.loadStudent(id, memoryErr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		ss.MysqlService.AddStudentCount(id)
+		log.Printf("合并了加载学生：%s的请求", id)
+	}
+	// 加载的结果由所有等待的请求共享 每个请求返回自己的副本
+	return model.CopyStudent(student), nil
+}
+
+// loadStudent 依次从缓存和数据库加载内存中没有的学生 并写回内存和缓存
+// 加载期间学生可能被修改或删除 写回之前会再检查发件箱 不会把旧数据写回
+func (ss *StudentService) loadStudent(id string, memoryErr error) (*model.Student, error) {
 	//再从缓存中查找学生
-	student, cacheErr := ss.CacheService.GetStudentFromCache(id)
+	student, cacheTTL, cacheErr := ss.CacheService.GetStudentFromCache(id)
 	if cacheErr != nil {
 		log.Printf(cacheErr.Error())
 	}
 	if student != nil {
 		ss.MysqlService.AddStudentCount(id)
 		log.Printf("从缓存中查找到了学生：%s", id)
-		//如果确定内存里没有这个学生 就向内存中添加学生
-		if ss.StudentNotFoundErr(memoryErr) {
-			ss.MdbService.AddStudent(student)
+		//如果确定内存里没有这个学生 就向内存中添加学生 沿用缓存中剩余的过期时间
+		if ss.StudentNotFoundErr(memoryErr) && ss.writeBackToMemory(id, func() { ss.MdbService.AddStudentWithTTL(student, cacheTTL) }) {
 			log.Printf("从缓存向内存中添加学生：%s", id)
 		}
+		if ss.CacheService.ShouldRefreshEarly(student, cacheTTL) {
+			go ss.refreshCache(id)
+		}
 		return student, nil
 	}
 
 	// 最后从数据库中查找学生
-	student, mysqlErr := ss.MysqlService.GetStudentFromMysql(id)
+	student, mysqlErr := ss.getStudentFromMysql(id)
 	if mysqlErr != nil {
 		log.Printf(mysqlErr.Error())
 		return nil, mysqlErr
@@ -380,12 +469,11 @@ func (ss *StudentService) GetStudent(id string) (*model.Student, error) {
 		ss.MysqlService.AddStudentCount(id)
 		log.Printf("在数据库中查找到了学生：%s", id)
 		//如果确定内存和缓存没有学生 就向内存和缓存中添加学生
-		if ss.StudentNotFoundErr(memoryErr) {
-			ss.MdbService.AddStudent(student)
+		if ss.StudentNotFoundErr(memoryErr) && ss.writeBackToMemory(id, func() { ss.MdbService.AddStudent(student) }) {
 			log.Printf("从数据库向内存中添加学生：%s", id)
 		}
-		if ss.StudentNotFoundErr(cacheErr) {
-			err := ss.CacheService.AddStudent(student)
+		if _, pending := ss.pendingStudent(id); ss.StudentNotFoundErr(cacheErr) && !pending {
+			err := ss.CacheService.FillStudent(student)
 			if err != nil {
 				log.Printf("从数据库向缓存中添加学生：%s失败：%v", id, err)
 			} else {
@@ -398,142 +486,252 @@ func (ss *StudentService) GetStudent(id string) (*model.Student, error) {
 	return nil, fmt.Errorf("StudentService.GetStudent 错误到达的代码")
 }
 
-// UpdateStudentInternal 更新学生
-func (ss *StudentService) UpdateStudentInternal(student *model.Student) error {
-	// 开始 MySQL 事务
-	tx := ss.MysqlService.mysqlDao.DB.Begin()
-	if tx.Error != nil {
-		return fmt.Errorf("StudentService.UpdateStudentInternal 开启 MySQL 事务失败：%w", tx.Error)
+// writeBackToMemory 把从缓存或数据库读到的学生写回内存 返回是否写回了
+// 学生在发件箱中还有没有持久化的修改 或者已经在内存中时 读到的可能是旧数据 不写回
+// 状态机先把修改放进发件箱再在这个锁内修改内存 所以检查之后状态机的修改一定会覆盖写回的学生
+func (ss *StudentService) writeBackToMemory(id string, write func()) bool {
+	ss.writeBackLock.Lock()
+	defer ss.writeBackLock.Unlock()
+	if _, pending := ss.pendingStudent(id); pending {
+		log.Printf("学生：%s在发件箱中还有没有持久化的修改 不写回内存", id)
+		return false
 	}
-	defer func() {
-		if r := recover(); r != nil {
-			// 发生 panic 时回滚事务
-			tx.Rollback()
-			log.Printf("事务已回滚：%v", r)
-		}
-	}()
-
-	// 在 MySQL 数据库事务中更新学生信息
-	if err := ss.MysqlService.UpdateStudent(tx, student); err != nil {
-		return fmt.Errorf("StudentService.UpdateStudentInternal 更新学生：%s时失败：%w", student.ID, err)
-	}
-	// MySQL 数据库事务提交成功后，尝试更新缓存和内存 还要确保数据一致性
-	if err := ss.CacheService.UpdateStudent(student); err != nil {
-		if !ss.StudentNotFoundErr(err) {
-			tx.Rollback()
-			log.Printf("更新缓存失败 回滚事务")
-			return fmt.Errorf("StudentService.UpdateStudentInternal 更新缓存中的学生：%s时失败：%w", student.ID, err)
-		}
+	if ss.MdbService.Resident(id) {
+		return false
 	}
-	if err := ss.MdbService.UpdateStudent(student); err != nil {
-		if !ss.StudentNotFoundErr(err) && !strings.Contains(err.Error(), "过期") {
-			tx.Rollback()
-			if err = ss.RestoreCacheData(student.ID); err != nil {
-				return fmt.Errorf("StudentService.UpdateStudentInternal 更新内存中的学生失败后 尝试恢复缓存数据时失败：%w", err)
-			}
-			log.Printf("回滚数据库事务并恢复缓存")
-			return fmt.Errorf("StudentService.UpdateStudentInternal 更新内存中的学生：%s失败：%w", student.ID, err)
+	write()
+	return true
+}
 
-		}
+// getStudentFromMysql 从数据库中查找学生 并记录耗时用于决定缓存提前多久刷新
+func (ss *StudentService) getStudentFromMysql(id string) (*model.Student, error) {
+	start := time.Now()
+	student, err := ss.MysqlService.GetStudentFromMysql(id)
+	if err == nil {
+		ss.CacheService.RecordLoadCost(time.Since(start))
 	}
-	if err := tx.Commit().Error; err != nil {
-		return fmt.Errorf("StudentService.UpdateStudentInternal 回滚事务失败：%w", err)
+	return student, err
+}
+
+// refreshCache 在缓存过期之前从数据库重新加载学生并刷新缓存 同一个学生同一时刻只刷新一次
+func (ss *StudentService) refreshCache(id string) {
+	_, err, _ := ss.refreshFlight.Do(id, func() (*model.Student, error) {
+		student, err := ss.getStudentFromMysql(id)
+		if err != nil {
+			return nil, err
+		}
+		return student, ss.CacheService.RefreshStudent(student)
+	})
+	if err != nil {
+		log.Printf("提前刷新缓存中的学生：%s失败：%v", id, err)
 	}
-	// 添加学生访问次数
-	ss.MysqlService.AddStudentCount(student.ID)
-	return nil
 }
 
-// DeleteStudentInternal 删除学生 分别删除三个数据库的数据 然后再提交事务 保证数据一致性
-func (ss *StudentService) DeleteStudentInternal(id string) error {
-	// 开始 MySQL 事务
-	tx := ss.MysqlService.mysqlDao.DB.Begin()
-	if tx.Error != nil {
-		return fmt.Errorf("StudentService.DeleteStudentInternal 开启 MySQL 事务失败：%w", tx.Error)
+// UpdateStudentInternal 用领导者合并后的完整学生信息替换内存中的学生 由状态机在所有节点上执行
+func (ss *StudentService) UpdateStudentInternal(student *model.Student) {
+	ss.writeBackLock.Lock()
+	defer ss.writeBackLock.Unlock()
+	ss.MdbService.UpdateStudent(student)
+}
+
+// DeleteStudentInternal 从内存删除学生 由状态机在所有节点上执行 内存中没有这个学生时什么也不做
+func (ss *StudentService) DeleteStudentInternal(id string) {
+	ss.writeBackLock.Lock()
+	defer ss.writeBackLock.Unlock()
+	if err := ss.MdbService.DeleteStudent(id); err != nil && !ss.StudentNotFoundErr(err) {
+		log.Printf("从内存中删除学生：%s失败：%v", id, err)
 	}
-	defer func() {
-		if r := recover(); r != nil {
-			// 发生 panic 时回滚事务
-			tx.Rollback()
-			log.Printf("事务已回滚：%v", r)
-		}
-	}()
+}
+
+// ReLoadCacheJob 重新加载缓存的后台任务 由调度器在领导者上定期执行 失去领导权时ctx取消 调度器不会一直等待重新加载完成
+func (ss *StudentService) ReLoadCacheJob(ctx context.Context) error {
+	return ss.ReLoadCacheDataInternal(ctx)
+}
+
+// LeaderCh 返回Raft的领导权变化通知 成为领导者时收到true 失去领导权时收到false 只能有一个接收者
+func (ss *StudentService) LeaderCh() <-chan bool {
+	return ss.raftNode.LeaderCh()
+}
+
+// AddStudent 接收添加学生命令 提交给Raft节点 相同请求id的重复请求只会执行一次
+func (ss *StudentService) AddStudent(student *model.Student, requestId string) error {
+	return ss.submitCommand(&fsm.StudentCommand{Operation: "add", Student: student, RequestId: requestId})
+}
+
+// UpdateStudent 接收更新学生命令 提交给Raft节点 相同请求id的重复请求只会执行一次
+func (ss *StudentService) UpdateStudent(student *model.Student, requestId string) error {
+	return ss.submitCommand(&fsm.StudentCommand{Operation: "update", Student: student, RequestId: requestId})
+}
+
+// DeleteStudent 接收删除学生命令 提交给Raft节点 相同请求id的重复请求只会执行一次
+func (ss *StudentService) DeleteStudent(id string, requestId string) error {
+	return ss.submitCommand(&fsm.StudentCommand{Operation: "delete", Id: id, RequestId: requestId})
+}
+
+// StudentTTL 学生剩余的过期时间和过期设置
+type StudentTTL struct {
+	ID             string `json:"id"`
+	TTL            int64  `json:"ttl"`             // 剩余的秒数 永不过期时为-1
+	Expiration     int64  `json:"expiration"`      // 过期时间 单位秒
+	ExpirationMode string `json:"expiration_mode"` // 过期方式 absolute、sliding或者never
+}
 
-	if err := ss.CacheService.DeleteStudent(id); err != nil {
-		if !ss.StudentNotFoundErr(err) {
-			tx.Rollback()
-			log.Printf("删除缓存数据失败 回滚事务")
-			return fmt.Errorf("StudentService.DeleteStudentInternal 从缓存中删除学生：%s失败：%w", id, err)
+// GetStudentTTL 返回本节点内存中学生剩余的过期时间 不算一次访问 不会延长滑动过期的时间
+// 学生不在内存中时先按查询学生的流程从缓存或数据库加载到内存 加载后重新开始计时
+func (ss *StudentService) GetStudentTTL(id string) (*StudentTTL, error) {
+	remaining, expiry, err := ss.MdbService.StudentTTL(id)
+	if err != nil {
+		if _, err = ss.GetStudent(id); err != nil {
+			return nil, fmt.Errorf("StudentService.GetStudentTTL 查找学生：%s失败：%w", id, err)
+		}
+		if remaining, expiry, err = ss.MdbService.StudentTTL(id); err != nil {
+			return nil, fmt.Errorf("StudentService.GetStudentTTL 获取学生：%s的过期时间失败：%w", id, err)
 		}
 	}
-
-	if err := ss.MdbService.DeleteStudent(id); err != nil {
-		if !ss.StudentNotFoundErr(err) {
-			tx.Rollback()
-			log.Printf("从内存中删除学生：%s失败：%v", id, err)
-			if err = ss.RestoreCacheData(id); err != nil {
-				return fmt.Errorf("StudentService.DeleteStudentInternal 从内存中删除学生失败后 尝试恢复缓存数据失败：%w", err)
-			}
-			log.Printf("回滚数据库事务并恢复缓存")
+	ttl := &StudentTTL{ID: id, TTL: -1, ExpirationMode: model.ExpireNever}
+	if expiry != dao.NoExpiry {
+		ttl.TTL = int64(remaining / time.Second)
+		ttl.Expiration = int64(expiry.TTL / time.Second)
+		ttl.ExpirationMode = model.ExpireAbsolute
+		if expiry.Sliding {
+			ttl.ExpirationMode = model.ExpireSliding
 		}
 	}
+	return ttl, nil
+}
+
+// ExpireStudent 修改学生的过期时间和过期方式 过期时间从修改时重新开始计算 相同请求id的重复请求只会执行一次
+func (ss *StudentService) ExpireStudent(id string, expiration int64, mode string, requestId string) error {
+	student := &model.Student{ID: id, Expiration: expiration, ExpirationMode: mode}
+	return ss.submitCommand(&fsm.StudentCommand{Operation: "expire", Student: student, RequestId: requestId})
+}
+
+// PersistStudent 清除学生的过期时间 学生永不过期 相同请求id的重复请求只会执行一次
+func (ss *StudentService) PersistStudent(id string, requestId string) error {
+	return ss.ExpireStudent(id, 0, model.ExpireNever, requestId)
+}
+
+// ExpireStudentInternal 用领导者确定的过期设置替换内存中的学生并重新计时 由状态机在所有节点上执行
+func (ss *StudentService) ExpireStudentInternal(student *model.Student) {
+	ss.writeBackLock.Lock()
+	defer ss.writeBackLock.Unlock()
+	ss.MdbService.AddStudent(student)
+}
+
+// 查询学生结果的来源
+const (
+	SourceMemory = "memory"
+	SourceMysql  = "mysql"
+)
 
-	if err := ss.MysqlService.DeleteStudent(tx, id); err != nil {
-		return fmt.Errorf("StudentService.DeleteStudentInternal err: %w", err)
+// StudentQueryResult 按条件查询学生的结果 Source表示是内存的二级索引还是MySQL回答的
+type StudentQueryResult struct {
+	Source   string           `json:"source"`
+	Students []*model.Student `json:"students"`
+}
+
+// QueryStudents 按班级、性别和科目查找学生 为空的条件不参与查询 至少需要一个条件 结果按id排序
+// 先查本节点内存中的二级索引 内存中的学生不完整(有学生被淘汰或者过期)时改为查询MySQL
+// MySQL由领导者通过发件箱异步写入 刚刚修改的学生可能还没有写入
+func (ss *StudentService) QueryStudents(class string, gender string, subject string) (*StudentQueryResult, error) {
+	conditions := make(map[string]string)
+	for name, term := range map[string]string{IndexClass: class, IndexGender: gender, IndexSubject: subject} {
+		if term != "" {
+			conditions[name] = term
+		}
 	}
-	if err := tx.Commit().Error; err != nil {
-		return fmt.Errorf("StudentService.DeleteStudentInternal 提交事务失败: %w", err)
+	if len(conditions) == 0 {
+		return nil, errors.New("StudentService.QueryStudents 至少需要class、gender、subject中的一个条件")
 	}
-	// 删除学生访问次数
-	ss.MysqlService.DeleteStudentCount(id)
-	return nil
+	students, complete, err := ss.MdbService.QueryStudents(conditions)
+	if err != nil {
+		return nil, fmt.Errorf("StudentService.QueryStudents %w", err)
+	}
+	if complete {
+		return &StudentQueryResult{Source: SourceMemory, Students: students}, nil
+	}
+	log.Printf("内存中的学生不完整 从数据库查找学生 class：%s gender：%s subject：%s", class, gender, subject)
+	if students, err = ss.MysqlService.QueryStudentsFromMysql(class, gender, subject); err != nil {
+		return nil, fmt.Errorf("StudentService.QueryStudents %w", err)
+	}
+	return &StudentQueryResult{Source: SourceMysql, Students: students}, nil
 }
 
-// ReLoadCacheData 重新加载缓存 并提交给Raft节点
-func (ss *StudentService) ReLoadCacheData(interval time.Duration) {
-	// 每隔一段时间重新加载缓存
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			err := ss.ApplyRaftCommandToLeader("reloadCacheData", nil, "", 0, nil)
-			if err != nil {
-				log.Printf("StudentService.ReLoadCacheData 分布式加载缓存数据失败: %v，跳过这次操作", err)
-				continue
-			}
-		}
+// VerifyMemoryComplete 检查本节点内存中是否有数据库中的全部学生 有的话之后按条件查询学生可以直接使用内存中的二级索引
+func (ss *StudentService) VerifyMemoryComplete() error {
+	ids, err := ss.MysqlService.GetAllStudentIds()
+	if err != nil {
+		return fmt.Errorf("StudentService.VerifyMemoryComplete 获取数据库中所有学生的id失败：%w", err)
 	}
+	if ss.MdbService.VerifyComplete(ids) {
+		log.Printf("内存中有数据库中的全部%d个学生 按条件查询学生时使用内存中的二级索引", len(ids))
+	}
+	return nil
 }
 
-// PeriodicDelete 定期删除内存中的过期键 并提交给Raft节点
-func (ss *StudentService) PeriodicDelete(interval time.Duration, examineSize int) {
-	// 每隔一段时间删除内存中的过期键
+// RunVerifyComplete 每隔interval检查内存中的学生是否仍然完整 有学生被淘汰或者过期之后重新和数据库确认
+// 淘汰或者过期的学生重新加载到内存、或者也从数据库中删除之后 按条件查询学生又可以使用内存中的二级索引 直到ctx取消
+func (ss *StudentService) RunVerifyComplete(ctx context.Context, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-ticker.C:
-			err := ss.ApplyRaftCommandToLeader("periodicDelete", nil, "", examineSize, nil)
-			if err != nil {
-				log.Printf("StudentService.PeriodicDelete 分布式删除内存数据库过期键失败：: %v，跳过这次操作", err)
+			if ss.MdbService.Complete() {
 				continue
 			}
+			if err := ss.VerifyMemoryComplete(); err != nil {
+				log.Printf("重新检查内存中的学生是否完整失败：%v", err)
+			}
 		}
 	}
 }
 
-// AddStudent 接收添加学生命令 提交给Raft节点
-func (ss *StudentService) AddStudent(student *model.Student) error {
-	return ss.ApplyRaftCommandToLeader("add", student, "", 0, nil)
+// ErrInvalidPageToken 分页获取学生时的页令牌不合法
+var ErrInvalidPageToken = errors.New("页令牌不合法")
+
+// 分页获取学生时每页的学生数量
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// StudentListItem 列表中的一个学生 Resident表示学生现在是否在本节点的内存中
+type StudentListItem struct {
+	*model.Student
+	Resident bool `json:"resident"`
 }
 
-// UpdateStudent 接收更新学生命令 提交给Raft节点
-func (ss *StudentService) UpdateStudent(student *model.Student) error {
-	return ss.ApplyRaftCommandToLeader("update", student, "", 0, nil)
+// StudentPage 一页学生
+type StudentPage struct {
+	Students      []*StudentListItem `json:"students"`
+	NextPageToken string             `json:"next_page_token"` // 下一页的令牌 为空表示没有下一页了
 }
 
-// DeleteStudent 接收删除学生命令 提交给Raft节点
-func (ss *StudentService) DeleteStudent(id string) error {
-	return ss.ApplyRaftCommandToLeader("delete", nil, id, 0, nil)
+// ListStudents 以MySQL为准按id顺序分页获取学生 并标出每个学生现在是否在本节点的内存中
+// pageToken是上一页返回的令牌 为空时从第一页开始 pageSize不在[1,MaxPageSize]之间时使用DefaultPageSize
+func (ss *StudentService) ListStudents(pageToken string, pageSize int) (*StudentPage, error) {
+	if pageSize < 1 || pageSize > MaxPageSize {
+		pageSize = DefaultPageSize
+	}
+	afterId, err := base64.RawURLEncoding.DecodeString(pageToken)
+	if err != nil {
+		return nil, fmt.Errorf("StudentService.ListStudents %w：%s", ErrInvalidPageToken, pageToken)
+	}
+	// 多取一个学生判断是否还有下一页
+	students, err := ss.MysqlService.ListStudentsFromMysql(string(afterId), pageSize+1)
+	if err != nil {
+		return nil, fmt.Errorf("StudentService.ListStudents %w", err)
+	}
+	page := &StudentPage{Students: make([]*StudentListItem, 0, min(len(students), pageSize))}
+	if len(students) > pageSize {
+		students = students[:pageSize]
+		page.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(students[pageSize-1].ID))
+	}
+	for _, student := range students {
+		page.Students = append(page.Students, &StudentListItem{Student: student, Resident: ss.MdbService.Resident(student.ID)})
+	}
+	return page, nil
 }
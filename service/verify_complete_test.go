@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"node2/dao"
+	"node2/model"
+	"testing"
+	"time"
+)
+
+// TestRunVerifyCompleteAfterLoss 有学生丢失后二级索引不完整 丢失的学生重新加载到内存后 定期检查重新确认索引是完整的
+func TestRunVerifyCompleteAfterLoss(t *testing.T) {
+	mysqlDao := newFakeMysqlDao()
+	nodes := newTestCluster(t, 1, mysqlDao, newFakeCacheDao())
+	ss := waitForLeader(t, nodes)
+	for _, id := range []string{"s1", "s2"} {
+		student := &model.Student{ID: id, Name: "name", Gender: "男", Class: "1班",
+			Grades: map[string]float64{"math": 90}, ExpirationMode: model.ExpireNever}
+		addStudentOnLeader(t, nodes, student)
+		mysqlDao.mu.Lock()
+		mysqlDao.students[id] = model.CopyStudent(student)
+		mysqlDao.mu.Unlock()
+	}
+	conditions := map[string]string{IndexClass: "1班"}
+	queryComplete := func() bool {
+		_, complete, err := ss.MdbService.QueryStudents(conditions)
+		if err != nil {
+			t.Fatalf("查询学生失败：%v", err)
+		}
+		return complete
+	}
+	if queryComplete() {
+		t.Fatalf("没有确认过时查询结果是完整的")
+	}
+	if err := ss.VerifyMemoryComplete(); err != nil {
+		t.Fatalf("检查内存是否完整失败：%v", err)
+	}
+	if !queryComplete() {
+		t.Fatalf("内存中有全部学生时查询结果不完整")
+	}
+
+	// 模拟学生s2被淘汰
+	store := ss.MdbService.memoryDBDao
+	lost, _ := store.Get("s2")
+	var kept []dao.StoreEntry[string, *model.Student]
+	for _, entry := range store.Export() {
+		if entry.Key != "s2" {
+			kept = append(kept, entry)
+		}
+	}
+	store.Import(kept)
+	if queryComplete() {
+		t.Fatalf("丢失学生后查询结果仍然是完整的")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ss.RunVerifyComplete(ctx, 10*time.Millisecond)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if queryComplete() {
+		t.Fatalf("内存中仍然缺少学生时重新确认为完整")
+	}
+	ss.MdbService.AddStudent(lost)
+	waitFor(t, 5*time.Second, "重新确认内存中的学生是完整的", queryComplete)
+}